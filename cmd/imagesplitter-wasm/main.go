@@ -0,0 +1,101 @@
+//go:build js && wasm
+
+// Command imagesplitter-wasm exposes the split of the splitcore package to
+// JavaScript as imagesplitter.split(bytes, options), which returns a Promise
+// of the chunks named like the server names them.
+package main
+
+import (
+	"bytes"
+	"context"
+	"syscall/js"
+
+	"github.com/jempe/imagesplitter/imageprocessor/splitcore"
+)
+
+// defaultMaxHeight is the --max-height default of the server
+const defaultMaxHeight = 5000
+
+func main() {
+	js.Global().Set("imagesplitter", js.ValueOf(map[string]any{
+		"split": js.FuncOf(split),
+	}))
+
+	// The functions are served for the lifetime of the page
+	select {}
+}
+
+// split resolves to an array of {name, data} objects, data being the
+// Uint8Array of the chunk, or rejects with the error of the split
+func split(this js.Value, args []js.Value) any {
+	if len(args) == 0 || args[0].Type() != js.TypeObject {
+		return rejected("split expects the bytes of an image")
+	}
+
+	source := make([]byte, args[0].Get("length").Int())
+	js.CopyBytesToGo(source, args[0])
+
+	opts := splitcore.Options{
+		Layout:       splitcore.Layout{MaxHeight: defaultMaxHeight},
+		ImagesPrefix: "image",
+	}
+	if len(args) > 1 && args[1].Type() == js.TypeObject {
+		options := args[1]
+		if v := options.Get("maxHeight"); v.Type() == js.TypeNumber {
+			opts.MaxHeight = v.Int()
+		}
+		if v := options.Get("maxPixels"); v.Type() == js.TypeNumber {
+			opts.MaxPixels = v.Int()
+		}
+		if v := options.Get("width"); v.Type() == js.TypeNumber {
+			opts.Width = v.Int()
+		}
+		if v := options.Get("maxImages"); v.Type() == js.TypeNumber {
+			opts.MaxImages = v.Int()
+		}
+		if v := options.Get("anchor"); v.Type() == js.TypeString {
+			opts.Anchor = v.String()
+		}
+		if v := options.Get("quality"); v.Type() == js.TypeNumber {
+			opts.Quality = v.Int()
+		}
+		if v := options.Get("format"); v.Type() == js.TypeString {
+			opts.Format = v.String()
+		}
+		if v := options.Get("prefix"); v.Type() == js.TypeString {
+			opts.ImagesPrefix = v.String()
+		}
+	}
+
+	executor := js.FuncOf(func(this js.Value, promise []js.Value) any {
+		resolve, reject := promise[0], promise[1]
+
+		// A goroutine keeps the event loop running while the image is split
+		go func() {
+			var chunks splitcore.MemFS
+			names, err := splitcore.SplitReader(context.Background(), bytes.NewReader(source), &chunks, opts)
+			if err != nil {
+				reject.Invoke(js.Global().Get("Error").New(err.Error()))
+				return
+			}
+
+			result := js.Global().Get("Array").New(len(names))
+			for i, name := range names {
+				data, _ := chunks.File(name)
+				array := js.Global().Get("Uint8Array").New(len(data))
+				js.CopyBytesToJS(array, data)
+				result.SetIndex(i, js.ValueOf(map[string]any{"name": name, "data": array}))
+			}
+			resolve.Invoke(result)
+		}()
+		return nil
+	})
+	defer executor.Release()
+
+	return js.Global().Get("Promise").New(executor)
+}
+
+// rejected returns a Promise rejected with message
+func rejected(message string) any {
+	return js.Global().Get("Promise").Call("reject", js.Global().Get("Error").New(message))
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/jempe/imagesplitter/internal/jsonlog"
+)
+
+// adminToken protects the /admin routes, they are disabled when it is empty
+var adminToken string
+
+// loadAdminToken reads the admin bearer token from path
+func loadAdminToken(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read admin token file: %v", err)
+	}
+
+	token := strings.TrimSpace(string(data))
+	if len(token) < 16 {
+		return "", errors.New("admin token must be at least 16 characters long")
+	}
+
+	return token, nil
+}
+
+// requireAdmin is a middleware accepting only requests carrying the admin token
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		scheme, token, found := strings.Cut(r.Header.Get("Authorization"), " ")
+		if !found || !strings.EqualFold(scheme, "Bearer") ||
+			subtle.ConstantTimeCompare([]byte(strings.TrimSpace(token)), []byte(adminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="Admin"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// adminSettingsResponse is the runtime settings plus the current log level
+type adminSettingsResponse struct {
+	runtimeSettings
+	LogLevel string `json:"log_level"`
+}
+
+func currentAdminSettings() adminSettingsResponse {
+	return adminSettingsResponse{
+		runtimeSettings: *settings.Load(),
+		LogLevel:        logger.MinLevel().String(),
+	}
+}
+
+// handleAdminConfig returns the effective configuration, without secrets, and
+// the current runtime state
+func handleAdminConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		errMessage := map[string]string{
+			"error": "Method not allowed",
+		}
+		apiResponse(w, http.StatusMethodNotAllowed, errMessage)
+		return
+	}
+
+	authModes := []string{}
+	if tenants.Load() != nil {
+		authModes = append(authModes, "api_key")
+	}
+	if credentials.Load() != nil {
+		authModes = append(authModes, "basic")
+	}
+	if oidcVerifier != nil {
+		authModes = append(authModes, "oidc")
+	}
+	if signingKeys.Load() != nil {
+		authModes = append(authModes, "hmac")
+	}
+
+	htpasswdFile := ""
+	if users := credentials.Load(); users != nil {
+		htpasswdFile = users.path
+	}
+
+	hmacKeysFile := ""
+	if keys := signingKeys.Load(); keys != nil {
+		hmacKeysFile = keys.path
+	}
+
+	tenantsFile, tenantCount := "", 0
+	if reg := tenants.Load(); reg != nil {
+		tenantsFile, tenantCount = reg.path, len(reg.tenants)
+	}
+
+	totalBytes, _ := usage.get(defaultTenant.ID)
+
+	config := map[string]any{
+		"version":                  version,
+		"port":                     cfg.port,
+		"url_host":                 cfg.urlHost,
+		"file_path":                cfg.filePath,
+		"max_height":               cfg.maxHeight,
+		"use_cli":                  cfg.useCLI,
+		"backend":                  cfg.backend,
+		"config_file":              cfg.configFile,
+		"auth_modes":               authModes,
+		"htpasswd_file":            htpasswdFile,
+		"hmac_keys_file":           hmacKeysFile,
+		"oidc_issuer":              cfg.oidcIssuer,
+		"oidc_audience":            cfg.oidcAudience,
+		"tenants_file":             tenantsFile,
+		"tenants":                  tenantCount,
+		"disk_quota":               cfg.diskQuota,
+		"min_free_disk":            cfg.minFreeDisk,
+		"disk_precheck":            cfg.diskPrecheck,
+		"disk_high_water":          cfg.diskHighWater,
+		"disk_low_water":           cfg.diskLowWater,
+		"output_ttl":               expiry.Load().ttl.String(),
+		"s3_bucket":                cfg.s3.bucket,
+		"trusted_proxies":          trustedProxies.Load().list,
+		"max_concurrent_downloads": cfg.maxConcurrentDownloads,
+		"max_concurrent_encodes":   cfg.maxConcurrentEncodes,
+		"download_bandwidth":       cfg.downloadBandwidth,
+		"download_bandwidth_total": cfg.downloadBandwidthTotal,
+		"default_width":            cfg.defaults.width,
+		"default_max_images":       cfg.defaults.maxImages,
+		"default_quality":          cfg.defaults.quality,
+		"hook_source":              cfg.hooks.source,
+		"hook_chunk":               cfg.hooks.chunk,
+		"hook_job":                 cfg.hooks.job,
+		"prefix_min_length":        cfg.prefixMinLength,
+		"prefix_max_length":        cfg.prefixMaxLength,
+		"prefix_chars":             cfg.prefixChars,
+		"normalize_prefix":         cfg.normalizePrefix,
+		"output_name_collision":    cfg.outputNameCollision,
+		"content_addressed_output": cfg.contentAddressed,
+		"recover_jobs":             cfg.recoverJobs,
+		"statsd_addr":              cfg.statsd.addr,
+		"max_queued_jobs":          cfg.maxQueuedJobs,
+		"queue_timeout":            cfg.queueTimeout.String(),
+		"circuit_failures":         cfg.circuit.failures,
+		"circuit_cooldown":         cfg.circuit.cooldown.String(),
+	}
+
+	status := map[string]any{
+		"running_jobs":     jobs.running(),
+		"queued_jobs":      jobs.queued(),
+		"active_downloads": downloadSlots.InUse(),
+		"active_encodes":   encodeSlots.InUse(),
+		"stored_bytes":     totalBytes,
+		"open_circuits":    sourceCircuits.OpenHosts(),
+	}
+
+	apiResponse(w, http.StatusOK, map[string]any{
+		"config":   config,
+		"settings": currentAdminSettings(),
+		"status":   status,
+	})
+}
+
+// handleAdminSettings returns (GET) or partially updates (PATCH) the runtime
+// settings. Only the fields present in the JSON body are changed.
+func handleAdminSettings(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		apiResponse(w, http.StatusOK, currentAdminSettings())
+		return
+	case http.MethodPatch:
+	default:
+		errMessage := map[string]string{
+			"error": "Method not allowed",
+		}
+		apiResponse(w, http.StatusMethodNotAllowed, errMessage)
+		return
+	}
+
+	var input struct {
+		MaxConcurrentJobs *int     `json:"max_concurrent_jobs"`
+		RateLimitEnabled  *bool    `json:"rate_limit_enabled"`
+		RateLimitRPS      *float64 `json:"rate_limit_rps"`
+		RateLimitBurst    *int     `json:"rate_limit_burst"`
+		LogLevel          *string  `json:"log_level"`
+		Maintenance       *bool    `json:"maintenance"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&input); err != nil {
+		errMessage := map[string]string{
+			"error": "Invalid JSON",
+		}
+		apiResponse(w, http.StatusBadRequest, errMessage)
+		return
+	}
+
+	var validationError string
+	var level jsonlog.Level
+
+	switch {
+	case input.MaxConcurrentJobs != nil && *input.MaxConcurrentJobs < 0:
+		validationError = "max_concurrent_jobs must be a positive integer"
+	case input.RateLimitRPS != nil && *input.RateLimitRPS <= 0:
+		validationError = "rate_limit_rps must be greater than zero"
+	case input.RateLimitBurst != nil && *input.RateLimitBurst <= 0:
+		validationError = "rate_limit_burst must be greater than zero"
+	case input.LogLevel != nil:
+		var err error
+		if level, err = jsonlog.ParseLevel(*input.LogLevel); err != nil || level == jsonlog.LevelFatal {
+			validationError = "log_level must be INFO, ERROR or OFF"
+		}
+	}
+
+	if validationError != "" {
+		errMessage := map[string]string{
+			"error": validationError,
+		}
+		apiResponse(w, http.StatusBadRequest, errMessage)
+		return
+	}
+
+	previous, next := updateSettings(func(s *runtimeSettings) {
+		if input.MaxConcurrentJobs != nil {
+			s.MaxConcurrentJobs = *input.MaxConcurrentJobs
+		}
+		if input.RateLimitEnabled != nil {
+			s.RateLimitEnabled = *input.RateLimitEnabled
+		}
+		if input.RateLimitRPS != nil {
+			s.RateLimitRPS = *input.RateLimitRPS
+		}
+		if input.RateLimitBurst != nil {
+			s.RateLimitBurst = *input.RateLimitBurst
+		}
+		if input.Maintenance != nil {
+			s.Maintenance = *input.Maintenance
+		}
+	})
+
+	changes := settingsDiff(previous, next)
+
+	levelChanged := input.LogLevel != nil && logger.MinLevel() != level
+	if levelChanged {
+		changes["log_level"] = fmt.Sprintf("%s to %s", logger.MinLevel(), level)
+	}
+
+	if len(changes) > 0 {
+		changes["source"] = "admin api"
+		changes["client_ip"] = contextGetClient(r).IP
+		logger.PrintInfo("updated runtime settings", changes)
+	}
+
+	// Applied after logging so the change is recorded even when the new level hides INFO
+	if levelChanged {
+		logger.SetMinLevel(level)
+	}
+
+	apiResponse(w, http.StatusOK, currentAdminSettings())
+}
+
+// settingsDiff describes the fields that differ between two settings snapshots
+func settingsDiff(previous, next runtimeSettings) map[string]string {
+	changes := make(map[string]string)
+
+	if previous.MaxConcurrentJobs != next.MaxConcurrentJobs {
+		changes["max_concurrent_jobs"] = fmt.Sprintf("%d to %d", previous.MaxConcurrentJobs, next.MaxConcurrentJobs)
+	}
+	if previous.RateLimitEnabled != next.RateLimitEnabled {
+		changes["rate_limit_enabled"] = fmt.Sprintf("%t to %t", previous.RateLimitEnabled, next.RateLimitEnabled)
+	}
+	if previous.RateLimitRPS != next.RateLimitRPS {
+		changes["rate_limit_rps"] = fmt.Sprintf("%g to %g", previous.RateLimitRPS, next.RateLimitRPS)
+	}
+	if previous.RateLimitBurst != next.RateLimitBurst {
+		changes["rate_limit_burst"] = fmt.Sprintf("%d to %d", previous.RateLimitBurst, next.RateLimitBurst)
+	}
+	if previous.Maintenance != next.Maintenance {
+		changes["maintenance"] = fmt.Sprintf("%t to %t", previous.Maintenance, next.Maintenance)
+	}
+
+	return changes
+}
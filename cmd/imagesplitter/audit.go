@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/jempe/imagesplitter/imageprocessor"
+)
+
+// Outcomes of the audited jobs
+const (
+	auditOutcomeCompleted = "completed"
+	auditOutcomeFailed    = "failed"
+	auditOutcomeTimedOut  = "timed_out"
+)
+
+// auditEntry is a line of the audit log
+type auditEntry struct {
+	Time     time.Time `json:"time"`
+	Tenant   string    `json:"tenant"`
+	User     string    `json:"user,omitempty"`
+	APIKey   string    `json:"api_key,omitempty"`
+	ClientIP string    `json:"client_ip"`
+	JobID    string    `json:"job_id,omitempty"`
+	URL      string    `json:"url"`
+	// SourceSHA256 is the digest of the downloaded source
+	SourceSHA256 string `json:"source_sha256,omitempty"`
+	Outcome      string `json:"outcome"`
+	Error        string `json:"error,omitempty"`
+	// OutputDir is relative to file-path
+	OutputDir string `json:"output_dir,omitempty"`
+	ZipURL    string `json:"zip_url,omitempty"`
+}
+
+// auditLog appends an entry per split job to a file that is only ever
+// appended to, separate from the operational logs
+type auditLog struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// audit is nil unless --audit-log is set
+var audit *auditLog
+
+// openAuditLog opens the audit log at path for appending, creating it if needed
+func openAuditLog(path string) (*auditLog, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0640)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %v", err)
+	}
+	return &auditLog{file: file}, nil
+}
+
+// write appends entry and syncs it to disk, an audit entry must not be lost
+// in a crash
+func (a *auditLog) write(entry auditEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to encode audit entry: %v", err)
+	}
+	data = append(data, '\n')
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if _, err := a.file.Write(data); err != nil {
+		return fmt.Errorf("failed to write audit entry: %v", err)
+	}
+	if err := a.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync audit log: %v", err)
+	}
+	return nil
+}
+
+// auditJob records the outcome of a split job of r for imageURL, result is
+// ignored when jobErr is set
+func auditJob(r *http.Request, imageURL string, record *jobRecord, outcome string, result *imageprocessor.ImageResponse, jobErr error) {
+	if audit == nil {
+		return
+	}
+
+	entry := auditEntry{
+		Time:     time.Now().UTC(),
+		Tenant:   contextGetTenant(r).ID,
+		User:     contextGetUser(r),
+		APIKey:   apiKeyID(r),
+		ClientIP: contextGetClient(r).IP,
+		URL:      imageURL,
+		Outcome:  outcome,
+	}
+
+	if record != nil {
+		entry.JobID = record.ID
+	}
+
+	if jobErr != nil {
+		entry.Error = jobErr.Error()
+	} else {
+		if rel, err := filepath.Rel(cfg.filePath, result.OutputDir); err == nil {
+			entry.OutputDir = rel
+		}
+		entry.ZipURL = result.ZipURL
+		entry.SourceSHA256 = result.SourceSHA256
+		// The mirror that served the source, when the first URL failed
+		if result.SourceURL != "" {
+			entry.URL = result.SourceURL
+		}
+	}
+
+	if err := audit.write(entry); err != nil {
+		// The job already ran, losing its entry is reported loudly
+		logger.PrintError(err, map[string]string{
+			"url":     imageURL,
+			"outcome": outcome,
+		})
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/jempe/imagesplitter/internal/oidc"
+)
+
+// oidcVerifier is nil unless an OIDC issuer is configured
+var oidcVerifier *oidc.Verifier
+
+// requireAuth authenticates the request and stores its tenant in the context.
+// With a tenants file the tenant is resolved from the API key. Otherwise the
+// default tenant is used, behind basic authentication (htpasswd file), OIDC
+// bearer tokens and/or HMAC signed requests when they are configured.
+func requireAuth(next http.HandlerFunc) http.HandlerFunc {
+	if tenants.Load() != nil {
+		return apiKeyAuth(next)
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, ok := authenticate(r)
+		if !ok {
+			unauthorized(w)
+			return
+		}
+
+		// Credentials are valid, call the next handler
+		r = contextSetUser(r, user)
+		next(w, contextSetTenant(r, defaultTenant))
+	}
+}
+
+// authenticate reports whether the request carries valid credentials for one
+// of the configured schemes, and returns the basic auth username or the
+// token subject or the signing client. Requests are accepted when no scheme
+// is configured.
+func authenticate(r *http.Request) (string, bool) {
+	users := credentials.Load()
+	keys := signingKeys.Load()
+	if users == nil && oidcVerifier == nil && keys == nil {
+		return "", true
+	}
+
+	if users != nil {
+		if username, password, ok := r.BasicAuth(); ok {
+			// Check the credentials against the bcrypt hashes of the htpasswd file
+			return username, users.authenticate(username, password)
+		}
+	}
+
+	if oidcVerifier != nil {
+		scheme, token, found := strings.Cut(r.Header.Get("Authorization"), " ")
+		if found && strings.EqualFold(scheme, "Bearer") {
+			claims, err := oidcVerifier.Verify(strings.TrimSpace(token))
+			if err != nil {
+				logger.PrintInfo("rejected bearer token", map[string]string{
+					"error":     err.Error(),
+					"client_ip": contextGetClient(r).IP,
+				})
+				return "", false
+			}
+			return claims.Subject, true
+		}
+	}
+
+	if keys != nil {
+		scheme, signed, found := strings.Cut(r.Header.Get("Authorization"), " ")
+		if found && strings.EqualFold(scheme, hmacScheme) {
+			client, err := keys.verify(r, signed)
+			if err != nil {
+				logger.PrintInfo("rejected signed request", map[string]string{
+					"error":     err.Error(),
+					"client_ip": contextGetClient(r).IP,
+				})
+				return "", false
+			}
+			return client, true
+		}
+	}
+
+	return "", false
+}
+
+// unauthorized sends a 401 response advertising the configured schemes
+func unauthorized(w http.ResponseWriter) {
+	if credentials.Load() != nil {
+		w.Header().Add("WWW-Authenticate", `Basic realm="Restricted"`)
+	}
+	if oidcVerifier != nil {
+		w.Header().Add("WWW-Authenticate", `Bearer realm="Restricted"`)
+	}
+	if signingKeys.Load() != nil {
+		w.Header().Add("WWW-Authenticate", hmacScheme+` realm="Restricted"`)
+	}
+	http.Error(w, "Unauthorized", http.StatusUnauthorized)
+}
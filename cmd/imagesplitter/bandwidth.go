@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"golang.org/x/time/rate"
+)
+
+// maxBandwidthBurst bounds the bytes a throttled download writes at once
+const maxBandwidthBurst = 64 << 10
+
+// downloadBandwidth caps the bytes per second of all the output downloads
+// together, nil without --download-bandwidth-total
+var downloadBandwidth *rate.Limiter
+
+// newBandwidthLimiter returns a limiter of bytesPerSecond, nil when zero
+func newBandwidthLimiter(bytesPerSecond int64) *rate.Limiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	return rate.NewLimiter(rate.Limit(bytesPerSecond), int(min(bytesPerSecond, maxBandwidthBurst)))
+}
+
+// throttledWriter writes the body of an output download at most at the rate
+// of its own limiter and of the global one. It does not implement
+// io.ReaderFrom, so every copy goes through Write.
+type throttledWriter struct {
+	http.ResponseWriter
+	ctx      context.Context
+	limiters []*rate.Limiter
+}
+
+// throttleDownload returns w limited to --download-bandwidth and
+// --download-bandwidth-total, w itself without a limit
+func throttleDownload(w http.ResponseWriter, r *http.Request) http.ResponseWriter {
+	var limiters []*rate.Limiter
+	if limiter := newBandwidthLimiter(cfg.downloadBandwidth); limiter != nil {
+		limiters = append(limiters, limiter)
+	}
+	if downloadBandwidth != nil {
+		limiters = append(limiters, downloadBandwidth)
+	}
+	if len(limiters) == 0 {
+		return w
+	}
+
+	return &throttledWriter{ResponseWriter: w, ctx: r.Context(), limiters: limiters}
+}
+
+func (tw *throttledWriter) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		n := len(p)
+		for _, limiter := range tw.limiters {
+			n = min(n, limiter.Burst())
+		}
+
+		// A client that goes away stops the wait
+		for _, limiter := range tw.limiters {
+			if err := limiter.WaitN(tw.ctx, n); err != nil {
+				return written, err
+			}
+		}
+
+		n, err := tw.ResponseWriter.Write(p[:n])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jempe/imagesplitter/imageprocessor"
+)
+
+// batchSupportedExts lists the source extensions picked up by the batch walker
+var batchSupportedExts = map[string]bool{
+	".jpg":  true,
+	".jpeg": true,
+	".png":  true,
+}
+
+type batchConfig struct {
+	inDir      string
+	outDir     string
+	reportPath string
+	maxHeight  int
+	width      int
+	maxImages  int
+	workers    int
+	createZip  bool
+	useCLI     bool
+	dryRun     bool
+}
+
+type batchJob struct {
+	source    string
+	outputDir string
+	prefix    string
+}
+
+type batchResult struct {
+	Source     string                    `json:"source"`
+	OutputDir  string                    `json:"output_dir"`
+	Status     string                    `json:"status"`
+	Error      string                    `json:"error,omitempty"`
+	Images     []string                  `json:"images,omitempty"`
+	ZipURL     string                    `json:"zip_url,omitempty"`
+	Plan       *imageprocessor.SplitPlan `json:"plan,omitempty"`
+	DurationMS int64                     `json:"duration_ms"`
+}
+
+type batchReport struct {
+	Input      string        `json:"input"`
+	Output     string        `json:"output"`
+	StartedAt  string        `json:"started_at"`
+	DurationMS int64         `json:"duration_ms"`
+	Total      int           `json:"total"`
+	Succeeded  int           `json:"succeeded"`
+	Failed     int           `json:"failed"`
+	Results    []batchResult `json:"results"`
+}
+
+// runBatch implements the "batch" subcommand: it splits every supported image
+// below the input directory concurrently and returns the process exit code
+func runBatch(args []string) int {
+	var bcfg batchConfig
+
+	fset := flag.NewFlagSet("batch", flag.ExitOnError)
+	fset.StringVar(&bcfg.inDir, "in", "", "Directory tree containing the source images")
+	fset.StringVar(&bcfg.outDir, "out", "", "Directory where the chunks are written")
+	fset.StringVar(&bcfg.reportPath, "report", "", "Path of the JSON summary report (default <out>/report.json)")
+	fset.IntVar(&bcfg.maxHeight, "max-height", 5000, "Maximum height for image processing")
+	fset.IntVar(&bcfg.width, "width", 0, "Crop chunks to this width (0 keeps the original width)")
+	fset.IntVar(&bcfg.maxImages, "max-images", 0, "Maximum number of chunks per image (0 means unlimited)")
+	fset.IntVar(&bcfg.workers, "workers", 4, "Number of images processed concurrently")
+	fset.BoolVar(&bcfg.createZip, "zip", false, "Create a zip file for every image")
+	fset.BoolVar(&bcfg.useCLI, "use-cli", false, "Use command line tools (vips and zip) instead of Go implementation")
+	fset.BoolVar(&bcfg.dryRun, "dry-run", false, "Only compute the split plan of every image without writing chunks")
+	fset.Parse(args)
+
+	if bcfg.inDir == "" || bcfg.outDir == "" {
+		logger.PrintError(errors.New("in and out directories cannot be empty"), nil)
+		return 2
+	}
+
+	if bcfg.maxHeight <= 0 {
+		logger.PrintError(errors.New("max-height must be a positive integer"), nil)
+		return 2
+	}
+
+	if bcfg.workers <= 0 {
+		logger.PrintError(errors.New("workers must be a positive integer"), nil)
+		return 2
+	}
+
+	if !checkIfIsDirectory(bcfg.inDir) {
+		logger.PrintError(errors.New("input path is not a directory"), nil)
+		return 2
+	}
+
+	if err := os.MkdirAll(bcfg.outDir, 0755); err != nil {
+		logger.PrintError(fmt.Errorf("failed to create output directory: %v", err), nil)
+		return 2
+	}
+
+	// The chunks would be written next to their sources
+	if sameDir(bcfg.inDir, bcfg.outDir) {
+		logger.PrintError(errors.New("out directory cannot be the in directory"), nil)
+		return 2
+	}
+
+	if bcfg.reportPath == "" {
+		bcfg.reportPath = filepath.Join(bcfg.outDir, "report.json")
+	}
+
+	jobs, err := collectBatchJobs(bcfg.inDir, bcfg.outDir)
+	if err != nil {
+		logger.PrintError(err, nil)
+		return 2
+	}
+
+	logger.PrintInfo("starting batch", map[string]string{
+		"in":      bcfg.inDir,
+		"out":     bcfg.outDir,
+		"images":  fmt.Sprintf("%d", len(jobs)),
+		"workers": fmt.Sprintf("%d", bcfg.workers),
+	})
+
+	processor := imageprocessor.Processor{
+		OutputBaseDir: bcfg.outDir,
+		MaxHeight:     bcfg.maxHeight,
+		UseCLI:        bcfg.useCLI,
+	}
+
+	start := time.Now()
+	results := make([]batchResult, len(jobs))
+
+	queue := make(chan int)
+	var workers sync.WaitGroup
+
+	for w := 0; w < bcfg.workers; w++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for i := range queue {
+				results[i] = runBatchJob(&processor, jobs[i], bcfg)
+			}
+		}()
+	}
+
+	for i := range jobs {
+		queue <- i
+	}
+	close(queue)
+	workers.Wait()
+
+	report := batchReport{
+		Input:      bcfg.inDir,
+		Output:     bcfg.outDir,
+		StartedAt:  start.UTC().Format(time.RFC3339),
+		DurationMS: time.Since(start).Milliseconds(),
+		Total:      len(results),
+		Results:    results,
+	}
+
+	for _, result := range results {
+		if result.Status == "success" {
+			report.Succeeded++
+		} else {
+			report.Failed++
+		}
+	}
+
+	if err := writeBatchReport(bcfg.reportPath, report); err != nil {
+		logger.PrintError(err, nil)
+		return 1
+	}
+
+	logger.PrintInfo("finished batch", map[string]string{
+		"total":     fmt.Sprintf("%d", report.Total),
+		"succeeded": fmt.Sprintf("%d", report.Succeeded),
+		"failed":    fmt.Sprintf("%d", report.Failed),
+		"report":    bcfg.reportPath,
+	})
+
+	if report.Failed > 0 {
+		return 1
+	}
+
+	return 0
+}
+
+func runBatchJob(processor *imageprocessor.Processor, job batchJob, bcfg batchConfig) batchResult {
+	start := time.Now()
+
+	result := batchResult{
+		Source:    job.source,
+		OutputDir: job.outputDir,
+	}
+
+	if bcfg.dryRun {
+		plan, err := processor.PlanFile(job.source, job.prefix, bcfg.width, bcfg.maxImages)
+		result.DurationMS = time.Since(start).Milliseconds()
+
+		if err != nil {
+			result.Status = "failed"
+			result.Error = err.Error()
+			return result
+		}
+
+		result.Status = "success"
+		result.Plan = &plan
+		return result
+	}
+
+	response, err := processor.ProcessFile(job.source, job.outputDir, job.prefix, bcfg.width, bcfg.maxImages, bcfg.createZip)
+	result.DurationMS = time.Since(start).Milliseconds()
+
+	if err != nil {
+		result.Status = "failed"
+		result.Error = err.Error()
+
+		logger.PrintError(err, map[string]string{
+			"source": job.source,
+		})
+		return result
+	}
+
+	result.Status = "success"
+	result.Images = response.Images
+	if bcfg.createZip {
+		result.ZipURL = response.ZipURL
+	}
+
+	return result
+}
+
+// collectBatchJobs walks inDir and returns one job per supported image. Every
+// image gets its own output directory mirroring its relative path below inDir.
+// An outDir below inDir is skipped, so a rerun does not split the chunks of
+// the previous run.
+func collectBatchJobs(inDir string, outDir string) ([]batchJob, error) {
+	var jobs []batchJob
+	usedDirs := make(map[string]bool)
+
+	err := filepath.WalkDir(inDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if d.IsDir() {
+			if sameDir(path, outDir) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		ext := strings.ToLower(filepath.Ext(path))
+		if !batchSupportedExts[ext] {
+			return nil
+		}
+
+		relPath, err := filepath.Rel(inDir, path)
+		if err != nil {
+			return err
+		}
+
+		// Keep the extension in the directory name when two sources only differ by it
+		relDir := strings.TrimSuffix(relPath, filepath.Ext(relPath))
+		if usedDirs[relDir] {
+			relDir = relDir + "_" + strings.TrimPrefix(ext, ".")
+		}
+		usedDirs[relDir] = true
+
+		jobs = append(jobs, batchJob{
+			source:    path,
+			outputDir: filepath.Join(outDir, relDir),
+			prefix:    sanitizePrefix(filepath.Base(relDir)),
+		})
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan input directory: %v", err)
+	}
+
+	return jobs, nil
+}
+
+// sameDir reports whether the paths a and b are the same directory
+func sameDir(a string, b string) bool {
+	aInfo, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	bInfo, err := os.Stat(b)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(aInfo, bInfo)
+}
+
+// sanitizePrefix replaces every character that is not allowed in an images
+// prefix with an underscore
+func sanitizePrefix(name string) string {
+	var b strings.Builder
+	for _, char := range name {
+		if strings.ContainsRune(allowedPrefixChars, char) {
+			b.WriteRune(char)
+		} else {
+			b.WriteRune('_')
+		}
+	}
+	return b.String()
+}
+
+func writeBatchReport(path string, report batchReport) error {
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode batch report: %v", err)
+	}
+
+	if err := os.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write batch report: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type benchConfig struct {
+	target      string
+	image       string
+	concurrency int
+	requests    int
+	duration    time.Duration
+	timeout     time.Duration
+	width       int
+	maxImages   int
+	createZip   bool
+	dryRun      bool
+	headers     http.Header
+}
+
+// benchLatency are the latency percentiles of the bench requests, in
+// milliseconds
+type benchLatency struct {
+	Min  float64 `json:"min"`
+	Mean float64 `json:"mean"`
+	P50  float64 `json:"p50"`
+	P90  float64 `json:"p90"`
+	P95  float64 `json:"p95"`
+	P99  float64 `json:"p99"`
+	Max  float64 `json:"max"`
+}
+
+type benchReport struct {
+	Target            string         `json:"target"`
+	Image             string         `json:"image"`
+	Concurrency       int            `json:"concurrency"`
+	StartedAt         string         `json:"started_at"`
+	DurationMS        int64          `json:"duration_ms"`
+	Requests          int            `json:"requests"`
+	Succeeded         int            `json:"succeeded"`
+	Failed            int            `json:"failed"`
+	ErrorRate         float64        `json:"error_rate"`
+	RequestsPerSecond float64        `json:"requests_per_second"`
+	Latency           benchLatency   `json:"latency_ms"`
+	StatusCodes       map[string]int `json:"status_codes"`
+	// Errors counts the requests that got no response, by error
+	Errors map[string]int `json:"errors,omitempty"`
+}
+
+// benchResult is the outcome of a bench request, status is zero without a
+// response
+type benchResult struct {
+	latency time.Duration
+	status  int
+	err     error
+}
+
+// runBench implements the "bench" subcommand: it sends split requests for
+// -image to -target from -concurrency workers until -requests were sent or
+// -duration elapsed, prints the latency and error report as JSON and returns
+// the process exit code
+func runBench(args []string) int {
+	bcfg := benchConfig{headers: make(http.Header)}
+
+	fset := flag.NewFlagSet("bench", flag.ExitOnError)
+	fset.StringVar(&bcfg.target, "target", "", "Base URL of the server, e.g. http://localhost:4000")
+	fset.StringVar(&bcfg.image, "image", "", "Source of the split requests, relative to the url-host of the server")
+	fset.IntVar(&bcfg.concurrency, "concurrency", 8, "Number of requests in flight at once")
+	fset.IntVar(&bcfg.requests, "requests", 100, "Number of requests sent (0 means until -duration elapsed)")
+	fset.DurationVar(&bcfg.duration, "duration", 0, "Longest time requests are sent for (0 means until -requests were sent)")
+	fset.DurationVar(&bcfg.timeout, "timeout", 15*time.Minute, "Timeout of every request")
+	fset.IntVar(&bcfg.width, "width", 0, "Width of the split requests (0 uses the default of the server)")
+	fset.IntVar(&bcfg.maxImages, "max-images", 0, "Maximum number of chunks of the split requests (0 uses the default of the server)")
+	fset.BoolVar(&bcfg.createZip, "zip", false, "Create a zip in every split request")
+	fset.BoolVar(&bcfg.dryRun, "dry-run", false, "Only request the split plans, the server writes no chunks")
+	fset.Func("header", "Header sent with every request, e.g. \"Authorization: Bearer ...\" (repeatable)", func(value string) error {
+		name, headerValue, ok := strings.Cut(value, ":")
+		if !ok || strings.TrimSpace(name) == "" {
+			return errors.New("header must be \"Name: value\"")
+		}
+		bcfg.headers.Add(strings.TrimSpace(name), strings.TrimSpace(headerValue))
+		return nil
+	})
+	fset.Parse(args)
+
+	if !strings.HasPrefix(bcfg.target, "http://") && !strings.HasPrefix(bcfg.target, "https://") {
+		logger.PrintError(errors.New("target must start with http:// or https://"), nil)
+		return 2
+	}
+
+	if bcfg.image == "" {
+		logger.PrintError(errors.New("image cannot be empty"), nil)
+		return 2
+	}
+
+	if bcfg.concurrency <= 0 {
+		logger.PrintError(errors.New("concurrency must be a positive integer"), nil)
+		return 2
+	}
+
+	if bcfg.requests < 0 || bcfg.duration < 0 || (bcfg.requests == 0 && bcfg.duration == 0) {
+		logger.PrintError(errors.New("requests or duration must be positive"), nil)
+		return 2
+	}
+
+	if bcfg.timeout <= 0 {
+		logger.PrintError(errors.New("timeout must be positive"), nil)
+		return 2
+	}
+
+	logger.PrintInfo("starting bench", map[string]string{
+		"target":      bcfg.target,
+		"image":       bcfg.image,
+		"concurrency": fmt.Sprintf("%d", bcfg.concurrency),
+		"requests":    fmt.Sprintf("%d", bcfg.requests),
+		"duration":    bcfg.duration.String(),
+	})
+
+	report := runBenchRequests(&bcfg)
+
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		logger.PrintError(err, nil)
+		return 1
+	}
+	fmt.Println(string(data))
+	return 0
+}
+
+// runBenchRequests sends the requests of bcfg and returns their report
+func runBenchRequests(bcfg *benchConfig) benchReport {
+	ctx := context.Background()
+	if bcfg.duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, bcfg.duration)
+		defer cancel()
+	}
+
+	client := &http.Client{Timeout: bcfg.timeout}
+	endpoint := strings.TrimSuffix(bcfg.target, "/") + "/v1/split-image"
+
+	start := time.Now()
+	var sent atomic.Int64
+	var mu sync.Mutex
+	var results []benchResult
+
+	var workers sync.WaitGroup
+	for i := 0; i < bcfg.concurrency; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+
+			for ctx.Err() == nil {
+				n := sent.Add(1)
+				if bcfg.requests > 0 && n > int64(bcfg.requests) {
+					return
+				}
+
+				// Every request gets its own prefix
+				prefix := fmt.Sprintf("bench_%d_%d", start.Unix(), n)
+				result := sendBenchRequest(ctx, client, endpoint, bcfg, prefix)
+
+				// The requests cut off by -duration are not counted
+				if errors.Is(result.err, context.DeadlineExceeded) && ctx.Err() != nil {
+					return
+				}
+
+				mu.Lock()
+				results = append(results, result)
+				mu.Unlock()
+			}
+		}()
+	}
+	workers.Wait()
+
+	return newBenchReport(bcfg, start, time.Since(start), results)
+}
+
+// sendBenchRequest sends a split request of bcfg for prefix
+func sendBenchRequest(ctx context.Context, client *http.Client, endpoint string, bcfg *benchConfig, prefix string) benchResult {
+	// The fields left out get the defaults of the server
+	fields := map[string]any{
+		"url":           bcfg.image,
+		"images_prefix": prefix,
+		"create_zip":    bcfg.createZip,
+		"dry_run":       bcfg.dryRun,
+	}
+	if bcfg.width > 0 {
+		fields["width"] = bcfg.width
+	}
+	if bcfg.maxImages > 0 {
+		fields["max_images"] = bcfg.maxImages
+	}
+
+	body, err := json.Marshal(fields)
+	if err != nil {
+		return benchResult{err: err}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return benchResult{err: err}
+	}
+	for name, values := range bcfg.headers {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return benchResult{latency: time.Since(start), err: err}
+	}
+	defer resp.Body.Close()
+
+	// The latency includes the whole response
+	_, err = io.Copy(io.Discard, resp.Body)
+	return benchResult{latency: time.Since(start), status: resp.StatusCode, err: err}
+}
+
+// newBenchReport summarizes the results of a bench run
+func newBenchReport(bcfg *benchConfig, start time.Time, elapsed time.Duration, results []benchResult) benchReport {
+	report := benchReport{
+		Target:      bcfg.target,
+		Image:       bcfg.image,
+		Concurrency: bcfg.concurrency,
+		StartedAt:   start.UTC().Format(time.RFC3339),
+		DurationMS:  elapsed.Milliseconds(),
+		Requests:    len(results),
+		StatusCodes: make(map[string]int),
+	}
+
+	latencies := make([]float64, 0, len(results))
+	var total float64
+	for _, result := range results {
+		if result.status != 0 {
+			report.StatusCodes[fmt.Sprintf("%d", result.status)]++
+		}
+
+		if result.err == nil && result.status >= 200 && result.status < 300 {
+			report.Succeeded++
+		} else {
+			report.Failed++
+		}
+
+		if result.status == 0 && result.err != nil {
+			if report.Errors == nil {
+				report.Errors = make(map[string]int)
+			}
+			report.Errors[result.err.Error()]++
+		}
+
+		ms := float64(result.latency) / float64(time.Millisecond)
+		latencies = append(latencies, ms)
+		total += ms
+	}
+
+	if len(results) == 0 {
+		return report
+	}
+
+	report.ErrorRate = float64(report.Failed) / float64(len(results))
+	report.RequestsPerSecond = float64(len(results)) / elapsed.Seconds()
+
+	sort.Float64s(latencies)
+	report.Latency = benchLatency{
+		Min:  latencies[0],
+		Mean: total / float64(len(latencies)),
+		P50:  percentile(latencies, 0.50),
+		P90:  percentile(latencies, 0.90),
+		P95:  percentile(latencies, 0.95),
+		P99:  percentile(latencies, 0.99),
+		Max:  latencies[len(latencies)-1],
+	}
+	return report
+}
+
+// percentile returns the nearest-rank percentile p of the sorted values
+func percentile(sorted []float64, p float64) float64 {
+	rank := int(math.Ceil(p * float64(len(sorted))))
+	return sorted[max(rank, 1)-1]
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jempe/imagesplitter/internal/jsonlog"
+)
+
+// loadedConfig is the configuration resolved by the last successful load. It
+// is only accessed from main and the SIGHUP handler.
+var loadedConfig config
+
+// parseConfig resolves the server configuration from the command line
+// arguments and, when -config is set, from the config file. Flags given on
+// the command line take precedence over the file.
+func parseConfig(args []string) (config, error) {
+	var c config
+
+	fs := flag.NewFlagSet("imagesplitter", flag.ContinueOnError)
+	defineFlags(fs, &c)
+
+	if err := fs.Parse(args); err != nil {
+		return config{}, err
+	}
+
+	if c.configFile == "" {
+		return c, nil
+	}
+
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	values, err := readConfigFile(c.configFile)
+	if err != nil {
+		return config{}, err
+	}
+
+	for name, value := range values {
+		if name == "config" || fs.Lookup(name) == nil {
+			return config{}, fmt.Errorf("config file: unknown setting %q", name)
+		}
+
+		if explicit[name] {
+			continue
+		}
+
+		if err := fs.Set(name, value); err != nil {
+			return config{}, fmt.Errorf("config file: invalid value for %q: %v", name, err)
+		}
+	}
+
+	return c, nil
+}
+
+// readConfigFile reads a JSON object whose keys are flag names and whose
+// values are strings, numbers or booleans
+func readConfigFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %v", err)
+	}
+
+	var raw map[string]any
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&raw); err != nil {
+		return nil, fmt.Errorf("failed to parse config file: %v", err)
+	}
+
+	values := make(map[string]string, len(raw))
+	for name, value := range raw {
+		switch v := value.(type) {
+		case string:
+			values[name] = v
+		case json.Number:
+			values[name] = v.String()
+		case bool:
+			values[name] = strconv.FormatBool(v)
+		default:
+			return nil, fmt.Errorf("config file: %q must be a string, number or boolean", name)
+		}
+	}
+
+	return values, nil
+}
+
+// reloadableFlags are the settings applied again on SIGHUP
+var reloadableFlags = map[string]bool{
+	"htpasswd-file":       true,
+	"hmac-keys-file":      true,
+	"tenants-file":        true,
+	"oidc-keys-ttl":       true,
+	"max-concurrent-jobs": true,
+	"limiter-enabled":     true,
+	"limiter-rps":         true,
+	"limiter-burst":       true,
+	"output-ttl":          true,
+	"cleanup-interval":    true,
+	"source-headers":      true,
+	"trusted-proxies":     true,
+	"log-level":           true,
+}
+
+// flagValues returns the value of every flag, as printed by the flag package, for c
+func flagValues(c config) map[string]string {
+	var bound config
+
+	fs := flag.NewFlagSet("imagesplitter", flag.ContinueOnError)
+	defineFlags(fs, &bound)
+
+	// The flag values point into bound, so copying c makes them report its fields
+	bound = c
+
+	values := make(map[string]string)
+	fs.VisitAll(func(f *flag.Flag) {
+		values[f.Name] = f.Value.String()
+	})
+
+	return values
+}
+
+// withReloaded returns previous with the reloadable settings of next, the
+// configuration running once next is applied
+func withReloaded(previous, next config) config {
+	var applied config
+
+	fs := flag.NewFlagSet("imagesplitter", flag.ContinueOnError)
+	defineFlags(fs, &applied)
+
+	// Like flagValues, the flags set the fields of the copy of previous
+	applied = previous
+
+	after := flagValues(next)
+	for name := range reloadableFlags {
+		// The values were printed by the same flags, so they parse
+		if err := fs.Set(name, after[name]); err != nil {
+			logger.PrintError(fmt.Errorf("failed to record the reloaded %s: %v", name, err), nil)
+		}
+	}
+
+	return applied
+}
+
+// restartRequired returns the names of the changed settings that are not reloadable
+func restartRequired(previous, next config) []string {
+	before := flagValues(previous)
+	after := flagValues(next)
+
+	var names []string
+	for name, value := range after {
+		if !reloadableFlags[name] && before[name] != value {
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// reloadConfig resolves the configuration again and applies the reloadable
+// settings: the htpasswd credentials, the HMAC keys, the tenants and their
+// API keys, the OIDC key cache, concurrency and rate limits, the output
+// expiry, the allowed source headers, the trusted proxies and log level.
+// All of them are validated before any is applied, so an invalid file leaves
+// the running configuration untouched. Runtime settings are only changed
+// when their configured value changed, so adjustments made through the admin
+// API survive a reload of an unrelated setting.
+func reloadConfig() {
+	previous := loadedConfig
+
+	next, err := parseConfig(os.Args[1:])
+	if err == nil {
+		err = validateReloadable(previous, next)
+	}
+
+	var users *htpasswd
+	if err == nil && next.htpasswdFile != "" {
+		users, err = loadHtpasswd(next.htpasswdFile)
+	}
+
+	var keys *hmacKeys
+	if err == nil && next.hmacKeysFile != "" {
+		keys, err = loadHMACKeys(next.hmacKeysFile)
+	}
+
+	var registry *tenantRegistry
+	if err == nil && next.tenantsFile != "" {
+		registry, err = loadTenants(next.tenantsFile)
+	}
+
+	var networks []*net.IPNet
+	if err == nil {
+		networks, err = parseTrustedProxies(next.trustedProxies)
+	}
+
+	var level jsonlog.Level
+	if err == nil {
+		level, err = jsonlog.ParseLevel(next.logLevel)
+	}
+
+	if err != nil {
+		logger.PrintError(err, map[string]string{
+			"action": "reload configuration",
+		})
+		return
+	}
+
+	if names := restartRequired(previous, next); len(names) > 0 {
+		logger.PrintInfo("ignored configuration changes that require a restart", map[string]string{
+			"settings": strings.Join(names, ", "),
+		})
+	}
+
+	changes := make(map[string]string)
+
+	if users != nil {
+		credentials.Store(users)
+		changes["htpasswd_users"] = fmt.Sprintf("%d", len(users.users))
+		if previous.htpasswdFile != next.htpasswdFile {
+			changes["htpasswd_file"] = fmt.Sprintf("%q to %q", previous.htpasswdFile, next.htpasswdFile)
+		}
+	}
+
+	if keys != nil {
+		signingKeys.Store(keys)
+		changes["hmac_clients"] = fmt.Sprintf("%d", len(keys.secrets))
+		if previous.hmacKeysFile != next.hmacKeysFile {
+			changes["hmac_keys_file"] = fmt.Sprintf("%q to %q", previous.hmacKeysFile, next.hmacKeysFile)
+		}
+	}
+
+	if registry != nil {
+		registry.adopt(tenants.Load())
+		tenants.Store(registry)
+		changes["tenants"] = fmt.Sprintf("%d", len(registry.tenants))
+		if previous.tenantsFile != next.tenantsFile {
+			changes["tenants_file"] = fmt.Sprintf("%q to %q", previous.tenantsFile, next.tenantsFile)
+		}
+	}
+
+	if oidcVerifier != nil && previous.oidcKeysTTL != next.oidcKeysTTL {
+		oidcVerifier.SetCacheTTL(next.oidcKeysTTL)
+		changes["oidc_keys_ttl"] = fmt.Sprintf("%s to %s", previous.oidcKeysTTL, next.oidcKeysTTL)
+	}
+
+	if previous.outputTTL != next.outputTTL || previous.cleanupInterval != next.cleanupInterval {
+		setExpiry(next.outputTTL, next.cleanupInterval)
+		if previous.outputTTL != next.outputTTL {
+			changes["output_ttl"] = fmt.Sprintf("%s to %s", previous.outputTTL, next.outputTTL)
+		}
+		if previous.cleanupInterval != next.cleanupInterval {
+			changes["cleanup_interval"] = fmt.Sprintf("%s to %s", previous.cleanupInterval, next.cleanupInterval)
+		}
+	}
+
+	if previous.sourceHeaders != next.sourceHeaders {
+		names := splitList(next.sourceHeaders)
+		sourceHeaderNames.Store(&names)
+		changes["source_headers"] = fmt.Sprintf("%q to %q", previous.sourceHeaders, next.sourceHeaders)
+	}
+
+	if previous.trustedProxies != next.trustedProxies {
+		trustedProxies.Store(&proxyList{list: next.trustedProxies, networks: networks})
+		changes["trusted_proxies"] = fmt.Sprintf("%q to %q", previous.trustedProxies, next.trustedProxies)
+	}
+
+	before, after := updateSettings(func(s *runtimeSettings) {
+		if previous.maxConcurrentJobs != next.maxConcurrentJobs {
+			s.MaxConcurrentJobs = next.maxConcurrentJobs
+		}
+		if previous.limiter.enabled != next.limiter.enabled {
+			s.RateLimitEnabled = next.limiter.enabled
+		}
+		if previous.limiter.rps != next.limiter.rps {
+			s.RateLimitRPS = next.limiter.rps
+		}
+		if previous.limiter.burst != next.limiter.burst {
+			s.RateLimitBurst = next.limiter.burst
+		}
+	})
+
+	for name, change := range settingsDiff(before, after) {
+		changes[name] = change
+	}
+
+	levelChanged := previous.logLevel != next.logLevel && logger.MinLevel() != level
+	if levelChanged {
+		changes["log_level"] = fmt.Sprintf("%s to %s", logger.MinLevel(), level)
+	}
+
+	// The ignored changes are still reported by the next reload
+	loadedConfig = withReloaded(previous, next)
+
+	changes["source"] = "sighup"
+	logger.PrintInfo("reloaded configuration", changes)
+
+	// Applied after logging so the change is recorded even when the new level hides INFO
+	if levelChanged {
+		logger.SetMinLevel(level)
+	}
+}
+
+// validateReloadable checks the reloadable settings of next
+func validateReloadable(previous, next config) error {
+	if next.maxConcurrentJobs < 0 {
+		return errors.New("max concurrent jobs must be a positive integer")
+	}
+
+	if next.limiter.rps <= 0 || next.limiter.burst <= 0 {
+		return errors.New("limiter rps and burst must be greater than zero")
+	}
+
+	if previous.htpasswdFile != "" && next.htpasswdFile == "" {
+		return errors.New("htpasswd file cannot be removed without a restart")
+	}
+
+	if previous.hmacKeysFile != "" && next.hmacKeysFile == "" {
+		return errors.New("hmac keys file cannot be removed without a restart")
+	}
+
+	if (previous.tenantsFile == "") != (next.tenantsFile == "") {
+		return errors.New("tenants file cannot be added or removed without a restart")
+	}
+
+	if next.tenantsFile != "" && (next.htpasswdFile != "" || next.hmacKeysFile != "") {
+		return errors.New("basic, OIDC and HMAC authentication cannot be combined with a tenants file")
+	}
+
+	if next.cleanupInterval <= 0 {
+		return errors.New("disk monitor and cleanup intervals must be greater than zero")
+	}
+
+	// Outputs of the running jobs must not expire
+	if next.outputTTL < 0 || (next.outputTTL > 0 && next.outputTTL <= previous.jobTimeout) {
+		return errors.New("output TTL must exceed the job timeout")
+	}
+
+	return nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"net/http"
+)
+
+type contextKey string
+
+const (
+	tenantContextKey = contextKey("tenant")
+	clientContextKey = contextKey("client")
+	userContextKey   = contextKey("user")
+)
+
+// contextSetTenant returns a copy of r carrying the tenant the request belongs to
+func contextSetTenant(r *http.Request, t *tenant) *http.Request {
+	ctx := context.WithValue(r.Context(), tenantContextKey, t)
+	return r.WithContext(ctx)
+}
+
+// contextGetTenant returns the tenant stored by the authentication middleware.
+// It panics when called on a route that was not wrapped by requireAuth.
+func contextGetTenant(r *http.Request) *tenant {
+	t, ok := r.Context().Value(tenantContextKey).(*tenant)
+	if !ok {
+		panic("missing tenant value in request context")
+	}
+	return t
+}
+
+// contextSetClient returns a copy of r carrying the resolved client of the request
+func contextSetClient(r *http.Request, client clientInfo) *http.Request {
+	ctx := context.WithValue(r.Context(), clientContextKey, client)
+	return r.WithContext(ctx)
+}
+
+// contextGetClient returns the client stored by the realClient middleware, or
+// the peer of the connection when the middleware did not run
+func contextGetClient(r *http.Request) clientInfo {
+	client, ok := r.Context().Value(clientContextKey).(clientInfo)
+	if !ok {
+		return resolveClient(r)
+	}
+	return client
+}
+
+// contextSetUser returns a copy of r carrying the authenticated user, the basic
+// auth username or the token subject
+func contextSetUser(r *http.Request, user string) *http.Request {
+	ctx := context.WithValue(r.Context(), userContextKey, user)
+	return r.WithContext(ctx)
+}
+
+// contextGetUser returns the user stored by requireAuth, empty for anonymous
+// and API key requests
+func contextGetUser(r *http.Request) string {
+	user, _ := r.Context().Value(userContextKey).(string)
+	return user
+}
@@ -0,0 +1,15 @@
+//go:build !unix
+
+package main
+
+import "errors"
+
+// freeDiskSpace is not implemented on this platform
+func freeDiskSpace(path string) (uint64, error) {
+	return 0, errors.New("free disk space check is not supported on this platform")
+}
+
+// diskSpace is not implemented on this platform
+func diskSpace(path string) (uint64, uint64, error) {
+	return 0, 0, errors.New("free disk space check is not supported on this platform")
+}
@@ -0,0 +1,29 @@
+//go:build unix
+
+package main
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// freeDiskSpace returns the bytes available to unprivileged users on the
+// volume holding path
+func freeDiskSpace(path string) (uint64, error) {
+	free, _, err := diskSpace(path)
+	return free, err
+}
+
+// diskSpace returns the bytes available to unprivileged users and the size
+// of the volume holding path usable by them, which leaves out the blocks
+// reserved for root like df does
+func diskSpace(path string) (uint64, uint64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, 0, fmt.Errorf("failed to read free disk space: %v", err)
+	}
+
+	used := uint64(stat.Blocks-stat.Bfree) * uint64(stat.Bsize)
+	free := uint64(stat.Bavail) * uint64(stat.Bsize)
+	return free, used + free, nil
+}
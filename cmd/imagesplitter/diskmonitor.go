@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/jempe/imagesplitter/imageprocessor"
+)
+
+// diskPressure is set while the used share of the file-path volume is above
+// --disk-high-water, until it drops below --disk-low-water
+var diskPressure atomic.Bool
+
+// outputExpiry is the --output-ttl and the --cleanup-interval in effect
+type outputExpiry struct {
+	ttl      time.Duration
+	interval time.Duration
+}
+
+// expiry is swapped atomically when the configuration is reloaded
+var expiry atomic.Pointer[outputExpiry]
+
+// expiryReloaded wakes the disk monitor up to apply a new expiry
+var expiryReloaded = make(chan struct{}, 1)
+
+// setExpiry stores the expiry of the outputs and wakes the disk monitor up
+func setExpiry(ttl time.Duration, interval time.Duration) {
+	expiry.Store(&outputExpiry{ttl: ttl, interval: interval})
+
+	select {
+	case expiryReloaded <- struct{}{}:
+	default:
+	}
+}
+
+// diskUsedPercent returns the used share of the file-path volume
+func diskUsedPercent() (float64, error) {
+	free, total, err := diskSpace(cfg.filePath)
+	if err != nil {
+		return 0, err
+	}
+	if total == 0 {
+		return 0, nil
+	}
+	return 100 * float64(total-free) / float64(total), nil
+}
+
+// checkDiskPressure updates diskPressure from the volume usage and runs the
+// output cleanup early when the high-water mark is crossed
+func checkDiskPressure() {
+	used, err := diskUsedPercent()
+	if err != nil {
+		logger.PrintError(err, nil)
+		return
+	}
+
+	properties := map[string]string{
+		"used_percent": strconv.FormatFloat(used, 'f', 1, 64),
+	}
+
+	switch {
+	case !diskPressure.Load() && used >= cfg.diskHighWater:
+		diskPressure.Store(true)
+		logger.PrintWarning("disk usage above the high-water mark, refusing new jobs", properties)
+
+		if expiry.Load().ttl > 0 {
+			removeExpiredOutputs()
+			if used, err = diskUsedPercent(); err == nil && used < cfg.diskLowWater {
+				diskPressure.Store(false)
+				properties["used_percent"] = strconv.FormatFloat(used, 'f', 1, 64)
+				logger.PrintInfo("disk usage below the low-water mark after the cleanup, accepting new jobs", properties)
+			}
+		}
+	case diskPressure.Load() && used < cfg.diskLowWater:
+		diskPressure.Store(false)
+		logger.PrintInfo("disk usage below the low-water mark, accepting new jobs", properties)
+	}
+}
+
+// removeExpiredOutputs deletes the job output directories of every tenant
+// last modified more than --output-ttl ago. With a tenants file the default
+// tenant serves no job, and file-path holds the tenant directories, whose
+// names may look like job directories, e.g. a tenant 2024.
+func removeExpiredOutputs() {
+	outputs := map[string]string{defaultTenant.ID: defaultTenant.outputPath}
+	if reg := tenants.Load(); reg != nil {
+		outputs = make(map[string]string)
+		for _, t := range reg.tenants {
+			outputs[t.ID] = t.outputPath
+		}
+	}
+
+	cutoff := time.Now().Add(-expiry.Load().ttl)
+	var removed, freed int64
+
+	for tenantID, outputPath := range outputs {
+		entries, err := os.ReadDir(outputPath)
+		if err != nil {
+			logger.PrintError(fmt.Errorf("failed to list outputs: %v", err), nil)
+			continue
+		}
+
+		for _, entry := range entries {
+			// Job directories are named after their Unix timestamp or
+			// their content key, the other entries are tenant directories
+			name := entry.Name()
+			jobDir := strings.Trim(name, "0123456789") == "" || imageprocessor.IsContentDirName(name)
+			if !entry.IsDir() || !jobDir {
+				continue
+			}
+
+			info, err := entry.Info()
+			if err != nil || !info.ModTime().Before(cutoff) {
+				continue
+			}
+
+			dir := filepath.Join(outputPath, entry.Name())
+			size, err := dirSize(dir)
+			if err != nil {
+				logger.PrintError(err, nil)
+				continue
+			}
+			if err := os.RemoveAll(dir); err != nil {
+				logger.PrintError(fmt.Errorf("failed to remove expired output: %v", err), nil)
+				continue
+			}
+
+			usage.add(tenantID, -size)
+			removed++
+			freed += size
+
+			event := serverEvent{Type: eventCleaned, Tenant: tenantID, Bytes: size}
+			if rel, err := filepath.Rel(cfg.filePath, dir); err == nil {
+				event.OutputDir = rel
+			}
+			serverEvents.publish(event)
+		}
+	}
+
+	if removed > 0 {
+		logger.PrintInfo("removed expired outputs", map[string]string{
+			"directories": strconv.FormatInt(removed, 10),
+			"bytes":       strconv.FormatInt(freed, 10),
+		})
+	}
+}
+
+// runDiskMonitor checks the volume usage every --disk-monitor-interval and
+// removes the expired outputs every --cleanup-interval until stop is closed.
+// It runs without a TTL too, which a reload may set.
+func runDiskMonitor(stop <-chan struct{}) {
+	monitor := time.NewTicker(cfg.diskMonitorInterval)
+	defer monitor.Stop()
+
+	cleanup := time.NewTicker(expiry.Load().interval)
+	defer cleanup.Stop()
+
+	if cfg.diskHighWater > 0 {
+		checkDiskPressure()
+	}
+
+	for {
+		select {
+		case <-monitor.C:
+			if cfg.diskHighWater > 0 {
+				checkDiskPressure()
+			}
+		case <-cleanup.C:
+			if expiry.Load().ttl > 0 {
+				removeExpiredOutputs()
+			}
+		case <-expiryReloaded:
+			cleanup.Reset(expiry.Load().interval)
+		case <-stop:
+			return
+		}
+	}
+}
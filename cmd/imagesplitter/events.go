@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jempe/imagesplitter/imageprocessor"
+)
+
+// Types of the server events
+const (
+	eventAccepted  = "accepted"
+	eventStarted   = "started"
+	eventChunk     = "chunk"
+	eventCompleted = "completed"
+	eventFailed    = "failed"
+	eventCleaned   = "cleaned"
+)
+
+// eventBuffer is the number of events a stream may fall behind, it is
+// closed past it
+const eventBuffer = 256
+
+// serverEvent is one line of the /events stream
+type serverEvent struct {
+	Type   string    `json:"type"`
+	Time   time.Time `json:"time"`
+	Tenant string    `json:"tenant"`
+	// Job is the id of the job record, or an id of the stream only when the
+	// job store is disabled
+	Job        string `json:"job,omitempty"`
+	URL        string `json:"url,omitempty"`
+	Chunk      int    `json:"chunk,omitempty"`
+	Bytes      int64  `json:"bytes,omitempty"`
+	ChunkCount int    `json:"chunk_count,omitempty"`
+	OutputDir  string `json:"output_dir,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// eventBus fans the server events out to the streams of their tenant
+type eventBus struct {
+	mu      sync.Mutex
+	streams map[chan serverEvent]string
+	closed  bool
+}
+
+var serverEvents = eventBus{streams: make(map[chan serverEvent]string)}
+
+// subscribe returns a stream of the events of tenant, nil once the bus is closed
+func (b *eventBus) subscribe(tenant string) chan serverEvent {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return nil
+	}
+
+	stream := make(chan serverEvent, eventBuffer)
+	b.streams[stream] = tenant
+	return stream
+}
+
+// unsubscribe stops and closes stream, unless it is already closed
+func (b *eventBus) unsubscribe(stream chan serverEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.streams[stream]; ok {
+		delete(b.streams, stream)
+		close(stream)
+	}
+}
+
+// publish sends event to the streams of its tenant. A stream that fell
+// behind is closed rather than blocking the jobs.
+func (b *eventBus) publish(event serverEvent) {
+	event.Time = time.Now().UTC()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for stream, tenant := range b.streams {
+		if tenant != event.Tenant {
+			continue
+		}
+		select {
+		case stream <- event:
+		default:
+			delete(b.streams, stream)
+			close(stream)
+		}
+	}
+}
+
+// close ends the streams on shutdown, srv.Shutdown does not wait for them
+func (b *eventBus) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.closed = true
+	for stream := range b.streams {
+		delete(b.streams, stream)
+		close(stream)
+	}
+}
+
+// jobEvents publishes the events of a split job
+type jobEvents struct {
+	tenant string
+	job    string
+	url    string
+	chunks atomic.Int64
+}
+
+// newJobEvents publishes that the job of tenant t splitting imageURL is
+// accepted. The job is named by its record when the job store is enabled.
+func newJobEvents(t *tenant, imageURL string, record *jobRecord) *jobEvents {
+	e := &jobEvents{
+		tenant: t.ID,
+		url:    imageURL,
+	}
+
+	if record != nil {
+		e.job = record.ID
+	} else if id, err := newJobID(); err == nil {
+		e.job = id
+	}
+
+	e.publish(serverEvent{Type: eventAccepted, URL: imageURL})
+	return e
+}
+
+func (e *jobEvents) publish(event serverEvent) {
+	event.Tenant = e.tenant
+	event.Job = e.job
+	serverEvents.publish(event)
+}
+
+// observe makes processor publish its chunks, after the ChunkWritten
+// already set
+func (e *jobEvents) observe(processor *imageprocessor.Processor) {
+	chunkWritten := processor.ChunkWritten
+	processor.ChunkWritten = func(encodeTime time.Duration, size int64) {
+		if chunkWritten != nil {
+			chunkWritten(encodeTime, size)
+		}
+		e.publish(serverEvent{Type: eventChunk, Chunk: int(e.chunks.Add(1)), Bytes: size})
+	}
+}
+
+func (e *jobEvents) started() {
+	e.publish(serverEvent{Type: eventStarted, URL: e.url})
+}
+
+func (e *jobEvents) completed(result *imageprocessor.ImageResponse) {
+	event := serverEvent{
+		Type:       eventCompleted,
+		URL:        e.url,
+		ChunkCount: result.ChunkCount,
+		Bytes:      result.OutputBytes,
+	}
+	if rel, err := filepath.Rel(cfg.filePath, result.OutputDir); err == nil {
+		event.OutputDir = rel
+	}
+	e.publish(event)
+}
+
+func (e *jobEvents) failed(err error) {
+	e.publish(serverEvent{Type: eventFailed, URL: e.url, Error: err.Error()})
+}
+
+// handleEvents streams the events of the tenant of the request as
+// newline-delimited JSON until the client disconnects
+func handleEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		errMessage := map[string]string{
+			"error": "Method not allowed",
+		}
+		apiResponse(w, http.StatusMethodNotAllowed, errMessage)
+		return
+	}
+
+	stream := serverEvents.subscribe(contextGetTenant(r).ID)
+	if stream == nil {
+		errMessage := map[string]string{
+			"error": "server is shutting down",
+		}
+		apiResponse(w, http.StatusServiceUnavailable, errMessage)
+		return
+	}
+	defer serverEvents.unsubscribe(stream)
+
+	// The stream outlives --write-timeout
+	rc := http.NewResponseController(w)
+	rc.SetWriteDeadline(time.Time{})
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	rc.Flush()
+
+	encoder := json.NewEncoder(w)
+	for {
+		select {
+		case event, ok := <-stream:
+			if !ok {
+				return
+			}
+			if err := encoder.Encode(event); err != nil {
+				return
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
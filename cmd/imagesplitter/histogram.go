@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// histogram counts observations in cumulative buckets, like the Prometheus
+// histograms, and is served on /debug/vars as
+// {"buckets": {"<upper bound>": n, ..., "+Inf": n}, "count": n, "sum": s}
+type histogram struct {
+	mu     sync.Mutex
+	bounds []float64
+	counts []int64
+	count  int64
+	sum    float64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]int64, len(bounds))}
+}
+
+// observe records a value
+func (h *histogram) observe(value float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	// The counts are cumulative, every bucket at or above value gets it
+	for i := sort.SearchFloat64s(h.bounds, value); i < len(h.bounds); i++ {
+		h.counts[i]++
+	}
+	h.count++
+	h.sum += value
+}
+
+// MarshalJSON returns the buckets, count and sum of h
+func (h *histogram) MarshalJSON() ([]byte, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	buckets := make(map[string]int64, len(h.bounds)+1)
+	for i, bound := range h.bounds {
+		buckets[strconv.FormatFloat(bound, 'f', -1, 64)] = h.counts[i]
+	}
+	buckets["+Inf"] = h.count
+
+	return json.Marshal(map[string]any{
+		"buckets": buckets,
+		"count":   h.count,
+		"sum":     h.sum,
+	})
+}
+
+// histogramVec is a set of histograms with the same buckets, one per label
+type histogramVec struct {
+	mu      sync.Mutex
+	bounds  []float64
+	byLabel map[string]*histogram
+}
+
+func newHistogramVec(bounds []float64) *histogramVec {
+	return &histogramVec{bounds: bounds, byLabel: make(map[string]*histogram)}
+}
+
+// observe records a value in the histogram of label
+func (v *histogramVec) observe(label string, value float64) {
+	v.mu.Lock()
+	h, ok := v.byLabel[label]
+	if !ok {
+		h = newHistogram(v.bounds)
+		v.byLabel[label] = h
+	}
+	v.mu.Unlock()
+
+	h.observe(value)
+}
+
+// String implements expvar.Var
+func (v *histogramVec) String() string {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	data, err := json.Marshal(v.byLabel)
+	if err != nil {
+		return "{}"
+	}
+	return string(data)
+}
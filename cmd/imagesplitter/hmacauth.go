@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// hmacScheme is the Authorization scheme of the signed requests
+const hmacScheme = "HMAC-SHA256"
+
+// maxSignedBodyBytes bounds the body read to verify a signature
+const maxSignedBodyBytes = 1 << 20
+
+// minHMACSecretLength is the shortest shared secret accepted
+const minHMACSecretLength = 32
+
+// hmacKeys holds the shared secrets of the clients signing their requests
+type hmacKeys struct {
+	path    string
+	secrets map[string][]byte
+}
+
+// signingKeys is swapped atomically when the HMAC keys file is reloaded
+var signingKeys atomic.Pointer[hmacKeys]
+
+// loadHMACKeys parses a keys file with one "client:secret" entry per line.
+// Blank lines and lines starting with # are ignored.
+func loadHMACKeys(path string) (*hmacKeys, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open hmac keys file: %v", err)
+	}
+	defer file.Close()
+
+	k := &hmacKeys{
+		path:    path,
+		secrets: make(map[string][]byte),
+	}
+
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		client, secret, found := strings.Cut(line, ":")
+		if !found || client == "" {
+			return nil, fmt.Errorf("hmac keys line %d: expected client:secret", lineNumber)
+		}
+
+		if len(secret) < minHMACSecretLength {
+			return nil, fmt.Errorf("hmac keys line %d: the secret of client %q must be at least %d characters", lineNumber, client, minHMACSecretLength)
+		}
+
+		if _, exists := k.secrets[client]; exists {
+			return nil, fmt.Errorf("hmac keys line %d: duplicate client %q", lineNumber, client)
+		}
+
+		k.secrets[client] = []byte(secret)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read hmac keys file: %v", err)
+	}
+
+	if len(k.secrets) == 0 {
+		return nil, errors.New("hmac keys file does not define any client")
+	}
+
+	return k, nil
+}
+
+// hmacSignature returns the hex HMAC-SHA256 of a request with secret. The
+// method and the URI are signed with the timestamp and the body digest, so a
+// signature is only valid for one request. The nonce, when sent, follows the
+// timestamp.
+func hmacSignature(secret []byte, timestamp string, nonce string, method string, requestURI string, body []byte) string {
+	bodyHash := sha256.Sum256(body)
+
+	signed := timestamp + "\n"
+	if nonce != "" {
+		signed += nonce + "\n"
+	}
+	signed += method + "\n" + requestURI + "\n" + hex.EncodeToString(bodyHash[:])
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(signed))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// nonceCache remembers the signatures accepted within the --hmac-max-skew
+// window, so a captured request is not accepted twice
+type nonceCache struct {
+	mu        sync.Mutex
+	seen      map[string]time.Time
+	lastPrune time.Time
+}
+
+var signedRequests = nonceCache{seen: make(map[string]time.Time)}
+
+// add records key until expires and reports whether it was not seen yet
+func (c *nonceCache) add(key string, expires time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(c.lastPrune) > time.Minute {
+		for seenKey, seenExpires := range c.seen {
+			if now.After(seenExpires) {
+				delete(c.seen, seenKey)
+			}
+		}
+		c.lastPrune = now
+	}
+
+	if seenExpires, ok := c.seen[key]; ok && !now.After(seenExpires) {
+		return false
+	}
+	c.seen[key] = expires
+	return true
+}
+
+// verify checks the credentials of an HMAC-SHA256 Authorization header,
+// "client=<id>,timestamp=<unix seconds>[,nonce=<nonce>],signature=<hex>",
+// and returns the client. The timestamp must be within --hmac-max-skew of
+// the server clock and the signature not seen before. The body of r is read
+// and replaced by a copy.
+func (k *hmacKeys) verify(r *http.Request, credentials string) (string, error) {
+	params := make(map[string]string)
+	for _, param := range strings.Split(credentials, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+		params[strings.ToLower(name)] = strings.Trim(value, `"`)
+	}
+
+	client, timestamp, nonce, signature := params["client"], params["timestamp"], params["nonce"], params["signature"]
+	if client == "" || timestamp == "" || signature == "" {
+		return "", errors.New("client, timestamp and signature are required")
+	}
+
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return "", errors.New("timestamp must be a Unix time in seconds")
+	}
+
+	signedAt := time.Unix(seconds, 0)
+	if skew := time.Since(signedAt); skew > cfg.hmacMaxSkew || skew < -cfg.hmacMaxSkew {
+		return "", fmt.Errorf("timestamp of client %q is %s away from the server clock", client, skew.Round(time.Second))
+	}
+
+	secret, ok := k.secrets[client]
+	if !ok {
+		return "", fmt.Errorf("unknown client %q", client)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxSignedBodyBytes+1))
+	if err != nil {
+		return "", fmt.Errorf("failed to read the body: %v", err)
+	}
+	if len(body) > maxSignedBodyBytes {
+		return "", fmt.Errorf("signed bodies are limited to %d bytes", maxSignedBodyBytes)
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	expected := hmacSignature(secret, timestamp, nonce, r.Method, r.URL.RequestURI(), body)
+	if !hmac.Equal([]byte(strings.ToLower(signature)), []byte(expected)) {
+		return "", fmt.Errorf("invalid signature of client %q", client)
+	}
+
+	// Recorded once verified, so forged requests cannot fill the cache. Past
+	// the window the timestamp is refused anyway.
+	if !signedRequests.add(client+":"+expected, signedAt.Add(cfg.hmacMaxSkew)) {
+		return "", fmt.Errorf("replayed request of client %q", client)
+	}
+
+	return client, nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/jempe/imagesplitter/imageprocessor"
+)
+
+// errHookFailed fails the jobs whose hook command exits with an error
+var errHookFailed = errors.New("hook failed")
+
+// Hooks of a split job, the IMAGESPLITTER_HOOK of their commands
+const (
+	hookSource = "source"
+	hookChunk  = "chunk"
+	hookJob    = "job"
+)
+
+// hookWaitDelay bounds the wait for the output of a killed hook
+const hookWaitDelay = time.Second
+
+// maxHookOutput bounds the hook output logged when it fails
+const maxHookOutput = 1024
+
+// jobHooks runs the hook commands of a split job
+type jobHooks struct {
+	tenant    string
+	sourceURL string
+	jobID     string
+}
+
+// newJobHooks returns the hooks of the job of tenant t splitting sourceURL,
+// record is nil when the job store is disabled
+func newJobHooks(t *tenant, sourceURL string, record *jobRecord) *jobHooks {
+	h := &jobHooks{
+		tenant:    t.ID,
+		sourceURL: sourceURL,
+	}
+	if record != nil {
+		h.jobID = record.ID
+	}
+	return h
+}
+
+// attach makes processor run the source and chunk hooks that are configured
+func (h *jobHooks) attach(processor *imageprocessor.Processor) {
+	if cfg.hooks.source != "" {
+		processor.SourceHook = func(ctx context.Context, path string) error {
+			return h.run(ctx, hookSource, cfg.hooks.source, []string{path}, "IMAGESPLITTER_PATH="+path)
+		}
+	}
+	if cfg.hooks.chunk != "" {
+		processor.ChunkHook = func(ctx context.Context, path string) error {
+			return h.run(ctx, hookChunk, cfg.hooks.chunk, []string{path}, "IMAGESPLITTER_PATH="+path)
+		}
+	}
+}
+
+// finish runs the job hook on the output of a finished job, with the output
+// directory and the chunk paths as arguments
+func (h *jobHooks) finish(ctx context.Context, result *imageprocessor.ImageResponse) error {
+	if cfg.hooks.job == "" {
+		return nil
+	}
+
+	outputDir, err := filepath.Abs(result.OutputDir)
+	if err != nil {
+		return fmt.Errorf("failed to resolve the output directory: %v", err)
+	}
+
+	args := append([]string{outputDir}, result.Images...)
+	return h.run(ctx, hookJob, cfg.hooks.job, args,
+		"IMAGESPLITTER_PATH="+outputDir,
+		"IMAGESPLITTER_ZIP="+result.ZipURL,
+		fmt.Sprintf("IMAGESPLITTER_CHUNK_COUNT=%d", result.ChunkCount),
+	)
+}
+
+// run runs command with args appended and the job described in its
+// environment. A hook is killed after --hook-timeout.
+func (h *jobHooks) run(ctx context.Context, hook string, command string, args []string, env ...string) error {
+	ctx, cancel := context.WithTimeout(ctx, cfg.hooks.timeout)
+	defer cancel()
+
+	// Validated by splitHookCommand at startup
+	name, commandArgs := splitHookCommand(command)
+	cmd := exec.CommandContext(ctx, name, append(commandArgs, args...)...)
+	cmd.Env = append(os.Environ(),
+		"IMAGESPLITTER_HOOK="+hook,
+		"IMAGESPLITTER_TENANT="+h.tenant,
+		"IMAGESPLITTER_SOURCE_URL="+h.sourceURL,
+		"IMAGESPLITTER_JOB_ID="+h.jobID,
+	)
+	cmd.Env = append(cmd.Env, env...)
+	// Children of the hook keeping its output open don't hold the job
+	cmd.WaitDelay = hookWaitDelay
+
+	output, err := cmd.CombinedOutput()
+	if err == nil {
+		return nil
+	}
+
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		err = fmt.Errorf("timed out after %s", cfg.hooks.timeout)
+	}
+
+	if len(output) > maxHookOutput {
+		output = output[len(output)-maxHookOutput:]
+	}
+	logger.PrintError(fmt.Errorf("%s hook failed: %v", hook, err), map[string]string{
+		"command": command,
+		"tenant":  h.tenant,
+		"url":     h.sourceURL,
+		"output":  strings.TrimSpace(string(output)),
+	})
+
+	return fmt.Errorf("%w: %s hook: %v", errHookFailed, hook, err)
+}
+
+// splitHookCommand splits a hook command in the executable and its
+// arguments, separated by spaces
+func splitHookCommand(command string) (string, []string) {
+	fields := strings.Fields(command)
+	if len(fields) == 0 {
+		return "", nil
+	}
+	return fields[0], fields[1:]
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// dummyHash is compared against when the user does not exist, so unknown and
+// known users take the same time to reject
+var dummyHash = []byte("$2a$10$AFD4vPusQyFsIteSdlCHSuRQ/x7j8ZzrvvjSFmFiBvYjakBgsFXKC")
+
+// htpasswd holds the users of an htpasswd file and their bcrypt hashes
+type htpasswd struct {
+	path  string
+	users map[string][]byte
+}
+
+// credentials is swapped atomically when the htpasswd file is reloaded
+var credentials atomic.Pointer[htpasswd]
+
+// loadHtpasswd parses an htpasswd file with one "user:hash" entry per line.
+// Only bcrypt hashes ($2a$, $2b$, $2y$) are accepted; blank lines and lines
+// starting with # are ignored.
+func loadHtpasswd(path string) (*htpasswd, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open htpasswd file: %v", err)
+	}
+	defer file.Close()
+
+	h := &htpasswd{
+		path:  path,
+		users: make(map[string][]byte),
+	}
+
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		user, hash, found := strings.Cut(line, ":")
+		if !found || user == "" {
+			return nil, fmt.Errorf("htpasswd line %d: expected user:hash", lineNumber)
+		}
+
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("htpasswd line %d: user %q does not have a bcrypt hash", lineNumber, user)
+		}
+
+		if _, exists := h.users[user]; exists {
+			return nil, fmt.Errorf("htpasswd line %d: duplicate user %q", lineNumber, user)
+		}
+
+		h.users[user] = []byte(hash)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read htpasswd file: %v", err)
+	}
+
+	if len(h.users) == 0 {
+		return nil, errors.New("htpasswd file does not define any user")
+	}
+
+	return h, nil
+}
+
+// authenticate reports whether password matches the hash stored for user
+func (h *htpasswd) authenticate(user, password string) bool {
+	hash, ok := h.users[user]
+	if !ok {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return false
+	}
+
+	return bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil
+}
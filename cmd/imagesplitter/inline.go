@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/jempe/imagesplitter/imageprocessor"
+)
+
+// errInlineTooLarge is returned when the chunks of a return_inline job
+// exceed --max-inline-bytes
+var errInlineTooLarge = errors.New("output too large to return inline")
+
+// inlineImages returns the chunks of result encoded in base64, in the order
+// of its Images. They are read from the output directory, so it works with
+// public and S3 URLs alike.
+func inlineImages(result *imageprocessor.ImageResponse) ([]string, error) {
+	paths := make([]string, len(result.Images))
+	var total int64
+	for i, image := range result.Images {
+		paths[i] = filepath.Join(result.OutputDir, filepath.Base(image))
+
+		info, err := os.Stat(paths[i])
+		if err != nil {
+			return nil, fmt.Errorf("failed to read chunk: %v", err)
+		}
+		total += info.Size()
+	}
+
+	// Checked before reading, the limit bounds the memory of the response
+	if total > cfg.maxInlineBytes {
+		return nil, fmt.Errorf("%w: the chunks total %d bytes, the limit is %d", errInlineTooLarge, total, cfg.maxInlineBytes)
+	}
+
+	encoded := make([]string, len(paths))
+	for i, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read chunk: %v", err)
+		}
+		encoded[i] = base64.StdEncoding.EncodeToString(data)
+	}
+
+	return encoded, nil
+}
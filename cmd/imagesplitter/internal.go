@@ -0,0 +1,207 @@
+package main
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"strconv"
+	"time"
+
+	"github.com/jempe/imagesplitter/imageprocessor"
+)
+
+// internalRoutes serves the operational endpoints on the internal listener so
+// the public port only exposes the split API
+func internalRoutes() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/healthz", handleHealthcheck)
+	mux.HandleFunc("/readyz", handleReadiness)
+	mux.HandleFunc("/capabilities", handleCapabilities)
+	mux.HandleFunc("/version", handleVersion)
+	mux.HandleFunc("/selftest", handleSelftest)
+	mux.Handle("/debug/vars", expvar.Handler())
+
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	return mux
+}
+
+// handleHealthcheck reports whether the server is available or in maintenance
+func handleHealthcheck(w http.ResponseWriter, r *http.Request) {
+	status := "available"
+	if settings.Load().Maintenance {
+		status = "maintenance"
+	}
+
+	apiResponse(w, http.StatusOK, map[string]any{
+		"status":        status,
+		"version":       version,
+		"running_jobs":  jobs.running(),
+		"disk_pressure": diskPressure.Load(),
+	})
+}
+
+// handleReadiness fails while in maintenance so load balancers stop routing
+// new requests to the server during a deploy, and while the disk is above
+// the high-water mark
+func handleReadiness(w http.ResponseWriter, r *http.Request) {
+	if settings.Load().Maintenance {
+		errMessage := map[string]string{
+			"error": "server is in maintenance mode",
+		}
+		apiResponse(w, http.StatusServiceUnavailable, errMessage)
+		return
+	}
+
+	if diskPressure.Load() {
+		errMessage := map[string]string{
+			"error": "disk usage is above the high-water mark",
+		}
+		apiResponse(w, http.StatusServiceUnavailable, errMessage)
+		return
+	}
+
+	apiResponse(w, http.StatusOK, map[string]any{
+		"status":       "ready",
+		"capabilities": capabilities,
+	})
+}
+
+// handleCapabilities reports the programs and the vips formats detected at startup
+func handleCapabilities(w http.ResponseWriter, r *http.Request) {
+	apiResponse(w, http.StatusOK, capabilities)
+}
+
+// gauges are the process and job gauges served on /debug/vars and pushed to
+// the statsd agent
+var gauges = []struct {
+	name  string
+	value func() int64
+}{
+	{"goroutines", func() int64 { return int64(runtime.NumGoroutine()) }},
+	{"running_jobs", func() int64 { return int64(jobs.running()) }},
+	{"queued_jobs", func() int64 { return int64(jobs.queued()) }},
+	{"active_downloads", func() int64 { return int64(downloadSlots.InUse()) }},
+	{"active_encodes", func() int64 { return int64(encodeSlots.InUse()) }},
+	{"open_circuits", func() int64 { return int64(len(sourceCircuits.OpenHosts())) }},
+	{"stored_bytes", func() int64 {
+		total, _ := usage.get(defaultTenant.ID)
+		return total
+	}},
+}
+
+// publishMetrics registers the process and job gauges served on /debug/vars
+func publishMetrics() {
+	expvar.NewString("version").Set(version)
+
+	expvar.Publish("timestamp", expvar.Func(func() any {
+		return time.Now().Unix()
+	}))
+
+	for _, g := range gauges {
+		value := g.value
+		expvar.Publish(g.name, expvar.Func(func() any {
+			return value()
+		}))
+	}
+}
+
+var (
+	totalRequestsReceived     = expvar.NewInt("total_requests_received")
+	totalResponsesSent        = expvar.NewInt("total_responses_sent")
+	totalProcessingTimeMicros = expvar.NewInt("total_processing_time_μs")
+	totalResponsesByStatus    = expvar.NewMap("total_responses_sent_by_status")
+)
+
+// Histograms of the split jobs labeled by backend, go or cli, to tune the
+// max height and the encoders
+var (
+	sourceWidthPixels  = newHistogramVec([]float64{500, 1000, 2000, 4000, 8000, 16000, 32000})
+	sourceHeightPixels = newHistogramVec([]float64{1000, 5000, 10000, 20000, 50000, 100000, 200000})
+	jobChunkCount      = newHistogramVec([]float64{1, 2, 5, 10, 20, 50, 100, 200})
+	chunkEncodeSeconds = newHistogramVec([]float64{0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5})
+	chunkBytes         = newHistogramVec([]float64{16 << 10, 64 << 10, 256 << 10, 512 << 10, 1 << 20, 2 << 20, 5 << 20, 10 << 20})
+)
+
+func init() {
+	expvar.Publish("source_width_pixels", sourceWidthPixels)
+	expvar.Publish("source_height_pixels", sourceHeightPixels)
+	expvar.Publish("job_chunk_count", jobChunkCount)
+	expvar.Publish("chunk_encode_seconds", chunkEncodeSeconds)
+	expvar.Publish("chunk_bytes", chunkBytes)
+}
+
+// backendLabel is the backend label of the histograms of processor
+func backendLabel(processor *imageprocessor.Processor) string {
+	return processor.BackendName()
+}
+
+// observeChunks makes processor record its chunks in the histograms
+func observeChunks(processor *imageprocessor.Processor) {
+	backend := backendLabel(processor)
+	processor.ChunkWritten = func(encodeTime time.Duration, size int64) {
+		chunkEncodeSeconds.observe(backend, encodeTime.Seconds())
+		chunkBytes.observe(backend, float64(size))
+
+		stats.timing("chunk_encode_time", encodeTime, "backend:"+backend)
+		stats.histogram("chunk_bytes", float64(size), "backend:"+backend)
+	}
+}
+
+// observeJob records a finished job in the histograms
+func observeJob(processor *imageprocessor.Processor, result *imageprocessor.ImageResponse) {
+	backend := backendLabel(processor)
+	if result.OriginalWidth > 0 {
+		sourceWidthPixels.observe(backend, float64(result.OriginalWidth))
+		sourceHeightPixels.observe(backend, float64(result.OriginalHeight))
+	}
+	jobChunkCount.observe(backend, float64(result.ChunkCount))
+
+	if result.OriginalWidth > 0 {
+		stats.histogram("source_width_pixels", float64(result.OriginalWidth), "backend:"+backend)
+		stats.histogram("source_height_pixels", float64(result.OriginalHeight), "backend:"+backend)
+	}
+	stats.histogram("job_chunk_count", float64(result.ChunkCount), "backend:"+backend)
+}
+
+// statusRecorder captures the status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (rec *statusRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// metrics is a middleware counting the requests and responses of the public API
+func metrics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		totalRequestsReceived.Add(1)
+		stats.count("requests_received", 1)
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		status, elapsed := strconv.Itoa(rec.status), time.Since(start)
+		totalResponsesSent.Add(1)
+		totalResponsesByStatus.Add(status, 1)
+		totalProcessingTimeMicros.Add(elapsed.Microseconds())
+
+		stats.count("responses_sent", 1, "status:"+status)
+		stats.timing("processing_time", elapsed, "status:"+status)
+	})
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jempe/imagesplitter/imageprocessor"
+)
+
+// Statuses of the recorded jobs
+const (
+	jobStatusProcessing = "processing"
+	jobStatusCompleted  = "completed"
+	jobStatusFailed     = "failed"
+)
+
+// jobRecord is the stored state of a split job
+type jobRecord struct {
+	ID     string `json:"id"`
+	Tenant string `json:"tenant"`
+	Status string `json:"status"`
+	// Request is the split request without its headers, which may hold
+	// credentials, so failed jobs can be submitted again
+	Request    ImageRequest `json:"request"`
+	Error      string       `json:"error,omitempty"`
+	ZipURL     string       `json:"zip_url,omitempty"`
+	ChunkCount int          `json:"chunk_count,omitempty"`
+	// OutputDir is the output directory relative to the output root of the
+	// tenant, recorded once it is created so the cleanup of an interrupted
+	// job finds it
+	OutputDir string `json:"output_dir,omitempty"`
+	// Recovered is set on the jobs run again by --recover-jobs retry
+	Recovered  bool       `json:"recovered,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+// jobFilter selects the records returned by jobStore.list, zero fields match
+// every job
+type jobFilter struct {
+	prefix string
+	status string
+	since  time.Time
+	until  time.Time
+	limit  int
+}
+
+// jobStore keeps a JSON file per job below dir, one directory per tenant
+type jobStore struct {
+	dir string
+	mu  sync.Mutex
+}
+
+// jobHistory is nil unless --jobs-path is set
+var jobHistory *jobStore
+
+// openJobStore returns the store of the records below dir, creating it if needed
+func openJobStore(dir string) (*jobStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create jobs path: %v", err)
+	}
+	return &jobStore{dir: dir}, nil
+}
+
+// newJobID returns a random job id that sorts by creation time
+func newJobID() (string, error) {
+	random := make([]byte, 4)
+	if _, err := rand.Read(random); err != nil {
+		return "", fmt.Errorf("failed to generate job id: %v", err)
+	}
+	return time.Now().UTC().Format("20060102T150405.000000") + "-" + hex.EncodeToString(random), nil
+}
+
+// create records a new processing job of tenant t
+func (s *jobStore) create(t *tenant, req *ImageRequest) (*jobRecord, error) {
+	id, err := newJobID()
+	if err != nil {
+		return nil, err
+	}
+
+	record := &jobRecord{
+		ID:        id,
+		Tenant:    t.ID,
+		Status:    jobStatusProcessing,
+		Request:   *req,
+		CreatedAt: time.Now().UTC(),
+	}
+	record.Request.Headers = nil
+
+	return record, s.save(record)
+}
+
+// recordJob records a new job of tenant t when the job store is enabled. A
+// failure to record it does not fail the job.
+func recordJob(t *tenant, req *ImageRequest) *jobRecord {
+	if jobHistory == nil {
+		return nil
+	}
+
+	record, err := jobHistory.create(t, req)
+	if err != nil {
+		logger.PrintError(err, nil)
+		return nil
+	}
+	return record
+}
+
+// watchOutputDir makes processor record the output directory of the job of
+// tenant t in record
+func watchOutputDir(t *tenant, record *jobRecord, processor *imageprocessor.Processor) {
+	if record == nil {
+		return
+	}
+
+	processor.OutputDirCreated = func(outputDir string) {
+		rel, err := filepath.Rel(t.outputPath, outputDir)
+		if err != nil {
+			return
+		}
+		record.OutputDir = rel
+		if err := jobHistory.save(record); err != nil {
+			logger.PrintError(err, nil)
+		}
+	}
+}
+
+// finishJob records the outcome of a job recorded by recordJob
+func finishJob(record *jobRecord, result *imageprocessor.ImageResponse, jobErr error) {
+	if record == nil {
+		return
+	}
+
+	if err := jobHistory.finish(record, result, jobErr); err != nil {
+		logger.PrintError(err, nil)
+	}
+}
+
+// finish records the outcome of a job, result is ignored when jobErr is set
+func (s *jobStore) finish(record *jobRecord, result *imageprocessor.ImageResponse, jobErr error) error {
+	finished := time.Now().UTC()
+	record.FinishedAt = &finished
+
+	if jobErr != nil {
+		record.Status = jobStatusFailed
+		record.Error = jobErr.Error()
+	} else {
+		record.Status = jobStatusCompleted
+		record.ZipURL = result.ZipURL
+		record.ChunkCount = result.ChunkCount
+	}
+
+	return s.save(record)
+}
+
+// save writes record through a temporary file, so readers never see a
+// partial record
+func (s *jobStore) save(record *jobRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tenantDir := filepath.Join(s.dir, record.Tenant)
+	if err := os.MkdirAll(tenantDir, 0755); err != nil {
+		return fmt.Errorf("failed to save job record: %v", err)
+	}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to save job record: %v", err)
+	}
+
+	path := filepath.Join(tenantDir, record.ID+".json")
+	if err := os.WriteFile(path+".tmp", data, 0644); err != nil {
+		return fmt.Errorf("failed to save job record: %v", err)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return fmt.Errorf("failed to save job record: %v", err)
+	}
+
+	return nil
+}
+
+// errJobNotFound is returned by jobStore.get for an unknown job
+var errJobNotFound = errors.New("job not found")
+
+// get returns the job id of a tenant
+func (s *jobStore) get(tenantID string, id string) (*jobRecord, error) {
+	// The ids name files below the directory of the tenant
+	if id == "" || id == "." || id == ".." || strings.ContainsAny(id, `/\`) {
+		return nil, errJobNotFound
+	}
+
+	data, err := os.ReadFile(filepath.Join(s.dir, tenantID, id+".json"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errJobNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read job record: %v", err)
+	}
+
+	var record jobRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, fmt.Errorf("failed to decode job record: %v", err)
+	}
+	return &record, nil
+}
+
+// list returns the jobs of a tenant matching filter, newest first
+func (s *jobStore) list(tenantID string, filter jobFilter) ([]jobRecord, error) {
+	paths, err := filepath.Glob(filepath.Join(s.dir, tenantID, "*.json"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list jobs: %v", err)
+	}
+
+	// The ids sort by creation time
+	sort.Sort(sort.Reverse(sort.StringSlice(paths)))
+
+	records := []jobRecord{}
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read job record: %v", err)
+		}
+
+		var record jobRecord
+		if err := json.Unmarshal(data, &record); err != nil {
+			logger.PrintError(fmt.Errorf("failed to decode job record: %v", err), map[string]string{
+				"path": path,
+			})
+			continue
+		}
+
+		if filter.matches(&record) {
+			records = append(records, record)
+			if filter.limit > 0 && len(records) == filter.limit {
+				break
+			}
+		}
+	}
+
+	return records, nil
+}
+
+// interrupted returns the jobs of every tenant still processing, which were
+// running when the server stopped if it is starting
+func (s *jobStore) interrupted() ([]jobRecord, error) {
+	paths, err := filepath.Glob(filepath.Join(s.dir, "*", "*.json"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list jobs: %v", err)
+	}
+	sort.Strings(paths)
+
+	var records []jobRecord
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read job record: %v", err)
+		}
+
+		var record jobRecord
+		if err := json.Unmarshal(data, &record); err != nil {
+			logger.PrintError(fmt.Errorf("failed to decode job record: %v", err), map[string]string{
+				"path": path,
+			})
+			continue
+		}
+
+		if record.Status == jobStatusProcessing {
+			records = append(records, record)
+		}
+	}
+
+	return records, nil
+}
+
+// matches reports whether record is selected by f
+func (f jobFilter) matches(record *jobRecord) bool {
+	if f.prefix != "" && !strings.HasPrefix(record.Request.ImagesPrefix, f.prefix) {
+		return false
+	}
+	if f.status != "" && record.Status != f.status {
+		return false
+	}
+	if !f.since.IsZero() && record.CreatedAt.Before(f.since) {
+		return false
+	}
+	if !f.until.IsZero() && !record.CreatedAt.Before(f.until) {
+		return false
+	}
+	return true
+}
+
+// Bounds of the limit query parameter of the job listing
+const (
+	defaultJobListLimit = 100
+	maxJobListLimit     = 1000
+)
+
+// parseJobTime parses the since and until query parameters, RFC 3339
+// timestamps or dates
+func parseJobTime(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.DateOnly, value)
+}
+
+// handleListJobs lists the jobs of the tenant of the request, filtered by the
+// prefix, status, since, until and limit query parameters
+func handleListJobs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		errMessage := map[string]string{
+			"error": "Method not allowed",
+		}
+		apiResponse(w, http.StatusMethodNotAllowed, errMessage)
+		return
+	}
+
+	query := r.URL.Query()
+	v := newValidator()
+
+	filter := jobFilter{
+		prefix: query.Get("prefix"),
+		status: query.Get("status"),
+		limit:  defaultJobListLimit,
+	}
+
+	switch filter.status {
+	case "", jobStatusProcessing, jobStatusCompleted, jobStatusFailed:
+	default:
+		v.AddError("status", "status must be processing, completed or failed")
+	}
+
+	for _, param := range []struct {
+		name   string
+		target *time.Time
+	}{
+		{"since", &filter.since},
+		{"until", &filter.until},
+	} {
+		if value := query.Get(param.name); value != "" {
+			parsed, err := parseJobTime(value)
+			if err != nil {
+				v.AddError(param.name, fmt.Sprintf("%s must be an RFC 3339 timestamp or a date", param.name))
+				continue
+			}
+			*param.target = parsed
+		}
+	}
+
+	if value := query.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		v.Check(err == nil && limit > 0 && limit <= maxJobListLimit, "limit", fmt.Sprintf("limit must be between 1 and %d", maxJobListLimit))
+		filter.limit = limit
+	}
+
+	if !v.Valid() {
+		failedValidationResponse(w, v)
+		return
+	}
+
+	records, err := jobHistory.list(contextGetTenant(r).ID, filter)
+	if err != nil {
+		logger.PrintError(err, nil)
+		errMessage := map[string]string{
+			"error": "failed to list jobs",
+		}
+		apiResponse(w, http.StatusInternalServerError, errMessage)
+		return
+	}
+
+	apiResponse(w, http.StatusOK, map[string]any{"jobs": records})
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// handleJob serves the routes below /jobs/, GET /jobs/{id}/zip for now
+func handleJob(w http.ResponseWriter, r *http.Request) {
+	rest := r.URL.Path[strings.Index(r.URL.Path, "/jobs/")+len("/jobs/"):]
+	id, resource, _ := strings.Cut(rest, "/")
+	if resource != "zip" {
+		http.NotFound(w, r)
+		return
+	}
+
+	handleJobZip(w, r, id)
+}
+
+// handleJobZip sends the zip of a completed job of the tenant of the request.
+// Range requests are honored, so an interrupted download can be resumed, and
+// the body is sent within the download bandwidth.
+func handleJobZip(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		errMessage := map[string]string{
+			"error": "Method not allowed",
+		}
+		apiResponse(w, http.StatusMethodNotAllowed, errMessage)
+		return
+	}
+
+	t := contextGetTenant(r)
+
+	record, err := jobHistory.get(t.ID, id)
+	if errors.Is(err, errJobNotFound) {
+		errMessage := map[string]string{
+			"error": err.Error(),
+		}
+		apiResponse(w, http.StatusNotFound, errMessage)
+		return
+	}
+	if err != nil {
+		logger.PrintError(err, nil)
+		errMessage := map[string]string{
+			"error": "failed to read the job",
+		}
+		apiResponse(w, http.StatusInternalServerError, errMessage)
+		return
+	}
+
+	if record.Status != jobStatusCompleted {
+		errMessage := map[string]string{
+			"error": fmt.Sprintf("the job is %s", record.Status),
+		}
+		apiResponse(w, http.StatusConflict, errMessage)
+		return
+	}
+	if record.ZipURL == "" || record.OutputDir == "" {
+		errMessage := map[string]string{
+			"error": "the job has no zip",
+		}
+		apiResponse(w, http.StatusNotFound, errMessage)
+		return
+	}
+
+	// The recorded zip_url may be a public URL, the file is named after it
+	name := path.Base(record.ZipURL)
+	file, err := os.Open(filepath.Join(t.outputPath, record.OutputDir, name))
+	if err != nil {
+		message := "the zip of the job was removed"
+		if outputBucket != nil {
+			message = "the zip of the job is stored in the S3 bucket, see its zip_url"
+		}
+		errMessage := map[string]string{
+			"error": message,
+		}
+		apiResponse(w, http.StatusNotFound, errMessage)
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		logger.PrintError(fmt.Errorf("failed to read the zip of a job: %v", err), nil)
+		errMessage := map[string]string{
+			"error": "failed to read the zip of the job",
+		}
+		apiResponse(w, http.StatusInternalServerError, errMessage)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+	http.ServeContent(throttleDownload(w, r), r, name, info.ModTime(), file)
+}
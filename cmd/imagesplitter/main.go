@@ -2,14 +2,20 @@ package main
 
 import (
 	"context"
-	"crypto/subtle"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/exec"
 	"os/signal"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
@@ -17,63 +23,363 @@ import (
 
 	"github.com/jempe/imagesplitter/imageprocessor"
 	"github.com/jempe/imagesplitter/internal/jsonlog"
+	"github.com/jempe/imagesplitter/internal/oidc"
 )
 
 const version = "1.0.0"
 
+// allowedPrefixChars is the set of characters accepted in the prefixes of
+// the split and batch commands and in images_prefix by default, see
+// --prefix-chars
+const allowedPrefixChars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_"
+
 type config struct {
-	port      int
-	urlHost   string
-	filePath  string
-	username  string
-	password  string
-	maxHeight int
-	useCLI    bool
+	port         int
+	internalAddr string
+	urlHost      string
+	filePath     string
+
+	// publicSelftest also serves POST /selftest on the public port
+	publicSelftest bool
+
+	// Bounds of the length of images_prefix
+	prefixMinLength int
+	prefixMaxLength int
+	// prefixChars is the character class of the characters of images_prefix
+	prefixChars string
+	// normalizePrefix slugifies images_prefix instead of refusing it
+	normalizePrefix bool
+
+	// outputNameCollision is the policy of an output_name whose directory exists
+	outputNameCollision string
+
+	// contentAddressed names the job directories by the digest of the source
+	// and the options, and reuses the result of identical jobs
+	contentAddressed bool
+
+	// tempPath holds the downloads and intermediate files, file-path when empty
+	tempPath string
+
+	// inMemory processes the zip jobs in memory, up to memoryBudget bytes each
+	inMemory     bool
+	memoryBudget int64
+
+	// s3 receives the zips instead of file-path and a copy of the chunks
+	// when bucket is set
+	s3 struct {
+		endpoint          string
+		region            string
+		bucket            string
+		prefix            string
+		pathStyle         bool
+		partSize          int64
+		uploadConcurrency int
+	}
+
+	// publicBaseURL serves file-path, the responses use absolute URLs when set
+	publicBaseURL string
+
+	// maxInlineBytes bounds the chunks of a return_inline job, zero disables it
+	maxInlineBytes int64
+
+	// sourceHeaders lists the header names requests may send to the source
+	sourceHeaders string
+
+	// hmacKeysFile holds the shared secrets of the clients signing their requests
+	hmacKeysFile string
+	// hmacMaxSkew is the largest difference between the timestamp of a signed
+	// request and the server clock
+	hmacMaxSkew time.Duration
+
+	htpasswdFile string
+	maxHeight    int
+	useCLI       bool
+
+	// backend is the registered imageprocessor backend, the one of useCLI when empty
+	backend string
+
+	jpegEncoder string
+	cjpegPath   string
+
+	rsvgConvertPath string
+
+	// Limits of the sources decoded in Go
+	maxSourcePixels int64
+	decodeTimeout   time.Duration
+
+	// maxChunks fails the jobs that would write more chunks, zero is unlimited
+	maxChunks int
+
+	// hooks are the commands run on the sources, the chunks and the outputs
+	// of the split jobs, each one disabled when empty
+	hooks struct {
+		source  string
+		chunk   string
+		job     string
+		timeout time.Duration
+	}
+
+	// defaults are the values of the request fields a request omits
+	defaults struct {
+		width     int
+		maxImages int
+		quality   int
+	}
+
+	tenantsFile string
+
+	// jobsPath holds the job records, the job listing is disabled when empty
+	jobsPath string
+	// recoverJobs is the policy of the jobs a crash left processing, fail or retry
+	recoverJobs string
+
+	// auditLog is the append-only log of the split jobs, disabled when empty
+	auditLog string
+
+	// usageFile persists the request and megapixel usage across restarts
+	usageFile string
+
+	// Periodic export of the usage records
+	metering struct {
+		interval time.Duration
+		path     string
+		url      string
+	}
+
+	// statsd receives the metrics of /debug/vars when addr is set
+	statsd struct {
+		addr     string
+		prefix   string
+		format   string
+		tags     string
+		interval time.Duration
+	}
+
+	oidcIssuer   string
+	oidcAudience string
+	oidcKeysTTL  time.Duration
+
+	diskQuota   int64
+	minFreeDisk int64
+	// diskPrecheck refuses the jobs whose estimated output exceeds the free space
+	diskPrecheck bool
+
+	// New jobs are refused from diskHighWater until diskLowWater percent of
+	// the volume is used, checked every diskMonitorInterval
+	diskHighWater       float64
+	diskLowWater        float64
+	diskMonitorInterval time.Duration
+
+	// Outputs older than outputTTL are removed every cleanupInterval, zero keeps them
+	outputTTL       time.Duration
+	cleanupInterval time.Duration
+
+	adminTokenFile string
+	configFile     string
+	trustedProxies string
+	logLevel       string
+
+	// HTTP server timeouts
+	readTimeout       time.Duration
+	readHeaderTimeout time.Duration
+	writeTimeout      time.Duration
+	idleTimeout       time.Duration
+
+	// jobTimeout is the deadline of every split job
+	jobTimeout time.Duration
+	// slowJobThreshold logs the stage timings of the jobs taking longer, zero disables it
+	slowJobThreshold time.Duration
+
+	// shutdownTimeout bounds how long running jobs may take to finish on shutdown
+	shutdownTimeout time.Duration
+
+	// maintenanceRetryAfter is advertised to clients refused during maintenance
+	maintenanceRetryAfter time.Duration
+
+	// Initial runtime settings, adjustable later through the admin API
+	maxConcurrentJobs int
+	maintenance       bool
+
+	// Jobs waiting up to queueTimeout for a slot of max_concurrent_jobs, the
+	// others are refused at once
+	maxQueuedJobs int
+	queueTimeout  time.Duration
+
+	// Slots of the download and encode stages of the running jobs
+	maxConcurrentDownloads int
+	maxConcurrentEncodes   int
+
+	// Bytes per second of an output download and of all of them, unlimited
+	// when zero
+	downloadBandwidth      int64
+	downloadBandwidthTotal int64
+
+	limiter struct {
+		enabled bool
+		rps     float64
+		burst   int
+	}
+
+	// HTTP client of the source downloads
+	fetch struct {
+		connectTimeout        time.Duration
+		responseHeaderTimeout time.Duration
+		maxIdleConns          int
+		maxIdleConnsPerHost   int
+		idleTimeout           time.Duration
+		disableKeepAlives     bool
+		noKeepAliveHosts      string
+		userAgent             string
+		maxRedirects          int
+		sameHostRedirects     bool
+		dnsCacheTTL           time.Duration
+		preferIP              string
+		dnsServers            string
+	}
+
+	// The downloads from a source host fail fast for cooldown after failures
+	// of them failed in a row, zero disables it
+	circuit struct {
+		failures int
+		cooldown time.Duration
+	}
 }
 
 type ImageRequest struct {
-	URL          string `json:"url"`
-	ImagesPrefix string `json:"images_prefix"`
-	Width        int    `json:"width"`
-	MaxImages    int    `json:"max_images"`
-	CreateZip    bool   `json:"create_zip"`
+	URL string `json:"url"`
+	// Headers are sent with the source download, limited to --source-headers
+	Headers map[string]string `json:"headers"`
+	// FallbackURLs are mirrors of the source, relative to the URL host like URL
+	FallbackURLs []string `json:"fallback_urls"`
+	// ExpectedSHA256 is the hex SHA-256 digest the source must have
+	ExpectedSHA256 string `json:"expected_sha256"`
+	// OutputName names the output directory instead of the job start time
+	OutputName string `json:"output_name"`
+	// Layout "flat" writes the output to a directory named by ImagesPrefix,
+	// replacing the previous one
+	Layout string `json:"layout"`
+	// Metadata is stored with the job and returned as is
+	Metadata     json.RawMessage `json:"metadata"`
+	ImagesPrefix string          `json:"images_prefix"`
+	Width        int             `json:"width"`
+	MaxImages    int             `json:"max_images"`
+	Anchor       string          `json:"anchor"`
+	Fit          string          `json:"fit"`
+	ChunkAspect  string          `json:"chunk_aspect"`
+	MaxPixels    int             `json:"max_pixels"`
+	SplitMode    string          `json:"split_mode"`
+	CreateZip    bool            `json:"create_zip"`
+	Verify       bool            `json:"verify"`
+	SkipBlank    bool            `json:"skip_blank"`
+	Dedupe       bool            `json:"dedupe"`
+	DryRun       bool            `json:"dry_run"`
+	ReturnInline bool            `json:"return_inline"`
+
+	// TimeoutSeconds shortens the job deadline below --job-timeout
+	TimeoutSeconds int `json:"timeout_seconds"`
+
+	// Size SVG sources are rasterized at
+	SVGWidth int `json:"svg_width"`
+	SVGDPI   int `json:"svg_dpi"`
+
+	// Transformations applied to the source before it is split
+	Rotate     int         `json:"rotate"`
+	Crop       *cropRegion `json:"crop"`
+	ColorSpace string      `json:"colorspace"`
+	// Sharpen is the unsharp mask amount of the scaled sources
+	Sharpen     float64 `json:"sharpen"`
+	ConvertSRGB bool    `json:"convert_srgb"`
+
+	// Encoding options
+	Format           string `json:"format"`
+	Background       string `json:"background"`
+	Quality          int    `json:"quality"`
+	PNGOptimize      int    `json:"png_optimize"`
+	TargetChunkBytes int    `json:"target_chunk_bytes"`
+	Subsampling      string `json:"subsampling"`
+	BitDepth         int    `json:"bit_depth"`
+	DPI              int    `json:"dpi"`
+
+	// Preset replaces the fixed height chunks
+	Preset   string `json:"preset"`
+	PadColor string `json:"pad_color"`
+
+	// Widths produces a chunk set per width, scaled down from the source
+	Widths []int `json:"widths"`
+
+	// Previews
+	ContactSheet bool `json:"contact_sheet"`
+	HTMLPreview  bool `json:"html_preview"`
+	StripWidth   int  `json:"strip_width"`
 }
 
 var logger *jsonlog.Logger
 var cfg config
 var wg sync.WaitGroup
 
-func main() {
-	logger = jsonlog.New(os.Stdout, jsonlog.LevelInfo)
+// jobsCtx is cancelled once a shutdown starts, stopping the jobs that run
+// outside of a request, see retryInterruptedJobs
+var jobsCtx, cancelJobs = context.WithCancel(context.Background())
 
-	// API Web Server Settings
-	flag.IntVar(&cfg.port, "port", 4000, "API server port")
+// downloadSlots and encodeSlots are shared by the processors of all requests
+var downloadSlots, encodeSlots imageprocessor.Semaphore
 
-	flag.StringVar(&cfg.urlHost, "url-host", "", "Base path for image processing")
-	flag.StringVar(&cfg.filePath, "file-path", "", "File path for image processing")
+// fetchClient downloads the sources of all requests, built from fetchOptions
+var (
+	fetchClient  *http.Client
+	fetchOptions imageprocessor.FetchOptions
+)
 
-	// Authentication settings
-	flag.StringVar(&cfg.username, "username", "", "Username for basic authentication")
-	flag.StringVar(&cfg.password, "password", "", "Password for basic authentication")
+// sourceCircuits fails the downloads from the failing source hosts fast, nil
+// without --circuit-failures
+var sourceCircuits *imageprocessor.CircuitBreaker
 
-	// Image processing settings
-	flag.IntVar(&cfg.maxHeight, "max-height", 5000, "Maximum height for image processing")
+// capabilities are detected at startup and route the sources of all requests
+var capabilities *imageprocessor.Capabilities
 
-	// Implementation selection
-	flag.BoolVar(&cfg.useCLI, "use-cli", false, "Use command line tools (vips and zip) instead of Go implementation")
+func main() {
+	logger = jsonlog.New(os.Stdout, jsonlog.LevelInfo)
 
-	flag.Parse()
+	// Subcommands
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "batch":
+			os.Exit(runBatch(os.Args[2:]))
+		case "split":
+			os.Exit(runSplit(os.Args[2:]))
+		case "bench":
+			os.Exit(runBench(os.Args[2:]))
+		}
+	}
+
+	var err error
+	cfg, err = parseConfig(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+	loadedConfig = cfg
+
+	level, err := jsonlog.ParseLevel(cfg.logLevel)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+	logger.SetMinLevel(level)
 
 	if cfg.urlHost == "" || cfg.filePath == "" {
 		logger.PrintFatal(errors.New("url host and file path cannot be empty"), nil)
 	}
 
-	if (strings.HasPrefix(cfg.urlHost, "http://") || strings.HasPrefix(cfg.urlHost, "https://")) == false {
-		logger.PrintFatal(errors.New("url host must start with http:// or https://"), nil)
+	if err := validateURLHost(cfg.urlHost); err != nil {
+		logger.PrintFatal(err, nil)
 	}
 
-	if strings.HasSuffix(cfg.urlHost, "/") == false {
-		logger.PrintFatal(errors.New("url host must end with a slash"), nil)
+	if cfg.publicBaseURL != "" {
+		if err := validatePublicBaseURL(cfg.publicBaseURL); err != nil {
+			logger.PrintFatal(err, nil)
+		}
 	}
 
 	if !(strings.HasSuffix(cfg.filePath, "/") && strings.HasPrefix(cfg.filePath, "/")) {
@@ -92,125 +398,904 @@ func main() {
 		logger.PrintFatal(errors.New("file path is not writable"), nil)
 	}
 
-	// Wrap the handler with basic authentication if credentials are provided
-	if cfg.username != "" && cfg.password != "" {
-		logger.PrintInfo("Basic authentication enabled", nil)
-		http.HandleFunc("/split-image", basicAuth(handleSplitImage))
+	switch cfg.outputNameCollision {
+	case imageprocessor.OutputCollisionReject, imageprocessor.OutputCollisionSuffix, imageprocessor.OutputCollisionResume:
+	default:
+		logger.PrintFatal(errors.New("output name collision must be reject, suffix or resume"), nil)
+	}
+
+	if cfg.tempPath != "" {
+		if err := os.MkdirAll(cfg.tempPath, 0755); err != nil {
+			logger.PrintFatal(fmt.Errorf("failed to create temp path: %v", err), nil)
+		}
+		if !checkIfIsWritable(cfg.tempPath) {
+			logger.PrintFatal(errors.New("temp path is not writable"), nil)
+		}
+	}
+
+	if cfg.s3.bucket != "" {
+		bucket, err := newOutputBucket()
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+		outputBucket = bucket
+	}
+
+	if cfg.usageFile != "" {
+		if err := keyUsages.load(cfg.usageFile); err != nil {
+			logger.PrintFatal(err, nil)
+		}
+	}
+
+	if meteringEnabled() {
+		if cfg.metering.interval <= 0 {
+			logger.PrintFatal(errors.New("metering interval must be positive"), nil)
+		}
+
+		if cfg.metering.url != "" && !(strings.HasPrefix(cfg.metering.url, "http://") || strings.HasPrefix(cfg.metering.url, "https://")) {
+			logger.PrintFatal(errors.New("metering url must start with http:// or https://"), nil)
+		}
+
+		if cfg.metering.path != "" {
+			if err := os.MkdirAll(cfg.metering.path, 0755); err != nil {
+				logger.PrintFatal(fmt.Errorf("failed to create metering path: %v", err), nil)
+			}
+		}
+	}
+
+	if cfg.statsd.addr != "" {
+		if cfg.statsd.interval <= 0 {
+			logger.PrintFatal(errors.New("statsd interval must be positive"), nil)
+		}
+
+		client, err := newStatsdClient(cfg.statsd.addr, cfg.statsd.prefix, cfg.statsd.format, cfg.statsd.tags)
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+		stats = client
+	}
+
+	if cfg.recoverJobs != recoverJobsFail && cfg.recoverJobs != recoverJobsRetry {
+		logger.PrintFatal(errors.New("recover jobs must be fail or retry"), nil)
+	}
+
+	if cfg.jobsPath != "" {
+		jobHistory, err = openJobStore(cfg.jobsPath)
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+	}
+
+	if cfg.auditLog != "" {
+		audit, err = openAuditLog(cfg.auditLog)
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+	}
+
+	defaultTenant = newDefaultTenant()
+
+	if cfg.tenantsFile != "" {
+		if cfg.htpasswdFile != "" || cfg.oidcIssuer != "" || cfg.hmacKeysFile != "" {
+			logger.PrintFatal(errors.New("basic, OIDC and HMAC authentication cannot be combined with a tenants file"), nil)
+		}
+
+		reg, err := loadTenants(cfg.tenantsFile)
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+		tenants.Store(reg)
+
+		logger.PrintInfo("API key authentication enabled", map[string]string{
+			"tenants": fmt.Sprintf("%d", len(reg.tenants)),
+		})
 	} else {
-		logger.PrintInfo("Basic authentication disabled", nil)
-		http.HandleFunc("/split-image", handleSplitImage)
+		if cfg.htpasswdFile != "" {
+			h, err := loadHtpasswd(cfg.htpasswdFile)
+			if err != nil {
+				logger.PrintFatal(err, nil)
+			}
+			credentials.Store(h)
+
+			logger.PrintInfo("Basic authentication enabled", map[string]string{
+				"users": fmt.Sprintf("%d", len(h.users)),
+			})
+		} else {
+			logger.PrintInfo("Basic authentication disabled", nil)
+		}
+
+		if cfg.hmacKeysFile != "" {
+			if cfg.hmacMaxSkew <= 0 {
+				logger.PrintFatal(errors.New("hmac max skew must be positive"), nil)
+			}
+
+			k, err := loadHMACKeys(cfg.hmacKeysFile)
+			if err != nil {
+				logger.PrintFatal(err, nil)
+			}
+			signingKeys.Store(k)
+
+			logger.PrintInfo("HMAC authentication enabled", map[string]string{
+				"clients": fmt.Sprintf("%d", len(k.secrets)),
+			})
+		}
+
+		if cfg.oidcIssuer != "" {
+			if cfg.oidcAudience == "" {
+				logger.PrintFatal(errors.New("oidc audience cannot be empty when an oidc issuer is set"), nil)
+			}
+
+			oidcVerifier = oidc.NewVerifier(cfg.oidcIssuer, cfg.oidcAudience, cfg.oidcKeysTTL)
+
+			// A failure here is not fatal, the keys are fetched again on the first request
+			if err := oidcVerifier.Refresh(); err != nil {
+				logger.PrintError(err, nil)
+			}
+
+			logger.PrintInfo("OIDC authentication enabled", map[string]string{
+				"issuer":   cfg.oidcIssuer,
+				"audience": cfg.oidcAudience,
+			})
+		}
+	}
+
+	if err := scanDiskUsage(); err != nil {
+		logger.PrintFatal(err, nil)
+	}
+
+	if cfg.maxConcurrentJobs < 0 {
+		logger.PrintFatal(errors.New("max concurrent jobs must be a positive integer"), nil)
+	}
+
+	if cfg.maxQueuedJobs < 0 || cfg.queueTimeout <= 0 {
+		logger.PrintFatal(errors.New("max queued jobs cannot be negative and the queue timeout must be positive"), nil)
+	}
+
+	// use-cli is kept as the selector of the CLI backend
+	if cfg.useCLI {
+		if cfg.backend != "" && cfg.backend != imageprocessor.BackendCLI && cfg.backend != imageprocessor.BackendVips {
+			logger.PrintFatal(errors.New("use-cli cannot be combined with another backend"), nil)
+		}
+		cfg.backend = imageprocessor.BackendCLI
+	}
+	if cfg.backend == "" {
+		cfg.backend = imageprocessor.BackendGo
+	}
+	if !slices.Contains(imageprocessor.Backends(), cfg.backend) {
+		logger.PrintFatal(fmt.Errorf("backend must be one of %s", strings.Join(imageprocessor.Backends(), ", ")), nil)
+	}
+
+	// Missing programs fail the startup rather than the jobs
+	capabilities = imageprocessor.DetectCapabilities(context.Background(), cfg.cjpegPath, cfg.rsvgConvertPath)
+	if missing := capabilities.Missing(cfg.backend); len(missing) > 0 {
+		logger.PrintFatal(fmt.Errorf("backend %s needs %s installed", cfg.backend, strings.Join(missing, ", ")), nil)
+	}
+	vipsBackend := cfg.backend == imageprocessor.BackendCLI || cfg.backend == imageprocessor.BackendVips
+	if !vipsBackend && !capabilities.Has(imageprocessor.ProgramRSVGConvert) && !capabilities.Loads("svg") {
+		logger.PrintWarning("neither rsvg-convert nor vips with an svg loader is installed, SVG sources are refused", nil)
 	}
+
+	switch cfg.jpegEncoder {
+	case imageprocessor.JPEGEncoderStdlib:
+	case imageprocessor.JPEGEncoderMozJPEG:
+		// The CLI backends encode with vips or ImageMagick, the others run cjpeg
+		if !vipsBackend && cfg.backend != imageprocessor.BackendImageMagick && !capabilities.Has(imageprocessor.ProgramCJPEG) {
+			logger.PrintFatal(fmt.Errorf("cjpeg binary %q not found", cfg.cjpegPath), nil)
+		}
+	default:
+		logger.PrintFatal(errors.New("jpeg encoder must be stdlib or mozjpeg"), nil)
+	}
+
+	if cfg.maxSourcePixels < 0 || cfg.decodeTimeout < 0 {
+		logger.PrintFatal(errors.New("max source pixels and decode timeout cannot be negative"), nil)
+	}
+
+	if cfg.maxChunks < 0 {
+		logger.PrintFatal(errors.New("max chunks cannot be negative"), nil)
+	}
+
+	for _, command := range []string{cfg.hooks.source, cfg.hooks.chunk, cfg.hooks.job} {
+		if command == "" {
+			continue
+		}
+		name, _ := splitHookCommand(command)
+		if _, err := exec.LookPath(name); err != nil {
+			logger.PrintFatal(fmt.Errorf("hook command not found: %v", err), nil)
+		}
+	}
+	if cfg.hooks.timeout <= 0 {
+		logger.PrintFatal(errors.New("hook timeout must be positive"), nil)
+	}
+
+	if cfg.defaults.width < 0 || cfg.defaults.maxImages < 0 {
+		logger.PrintFatal(errors.New("default width and max images cannot be negative"), nil)
+	}
+	if cfg.defaults.quality < 0 || cfg.defaults.quality > 100 {
+		logger.PrintFatal(errors.New("default quality must be between 1 and 100"), nil)
+	}
+
+	pattern, err := compilePrefixChars(cfg.prefixChars)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+	prefixCharPattern = pattern
+
+	if cfg.prefixMinLength < 0 || cfg.prefixMaxLength < 1 || cfg.prefixMinLength > cfg.prefixMaxLength {
+		logger.PrintFatal(errors.New("prefix max length must be positive and at least the min length"), nil)
+	}
+
+	if cfg.maxConcurrentDownloads < 0 || cfg.maxConcurrentEncodes < 0 {
+		logger.PrintFatal(errors.New("max concurrent downloads and encodes must be positive integers"), nil)
+	}
+
+	if cfg.fetch.connectTimeout < 0 || cfg.fetch.responseHeaderTimeout < 0 || cfg.fetch.idleTimeout < 0 {
+		logger.PrintFatal(errors.New("fetch timeouts cannot be negative"), nil)
+	}
+
+	if cfg.fetch.maxIdleConns < 0 || cfg.fetch.maxIdleConnsPerHost < 0 {
+		logger.PrintFatal(errors.New("fetch max idle connections must be positive integers"), nil)
+	}
+
+	if cfg.fetch.maxRedirects < 0 {
+		logger.PrintFatal(errors.New("fetch max redirects cannot be negative"), nil)
+	}
+
+	if cfg.fetch.dnsCacheTTL < 0 {
+		logger.PrintFatal(errors.New("fetch dns cache ttl cannot be negative"), nil)
+	}
+
+	if cfg.fetch.preferIP != "" && cfg.fetch.preferIP != imageprocessor.PreferIPv4 && cfg.fetch.preferIP != imageprocessor.PreferIPv6 {
+		logger.PrintFatal(errors.New("fetch prefer ip must be ipv4 or ipv6"), nil)
+	}
+
+	fetchOptions = imageprocessor.FetchOptions{
+		ConnectTimeout:        cfg.fetch.connectTimeout,
+		ResponseHeaderTimeout: cfg.fetch.responseHeaderTimeout,
+		MaxIdleConns:          cfg.fetch.maxIdleConns,
+		MaxIdleConnsPerHost:   cfg.fetch.maxIdleConnsPerHost,
+		IdleConnTimeout:       cfg.fetch.idleTimeout,
+		DisableKeepAlives:     cfg.fetch.disableKeepAlives,
+		NoKeepAliveHosts:      splitList(cfg.fetch.noKeepAliveHosts),
+		UserAgent:             cfg.fetch.userAgent,
+		MaxRedirects:          cfg.fetch.maxRedirects,
+		DisableRedirects:      cfg.fetch.maxRedirects == 0,
+		SameHostRedirects:     cfg.fetch.sameHostRedirects,
+		DNSCacheTTL:           cfg.fetch.dnsCacheTTL,
+		PreferIP:              cfg.fetch.preferIP,
+		DNSServers:            splitList(cfg.fetch.dnsServers),
+	}
+	fetchClient = imageprocessor.NewHTTPClient(fetchOptions)
+
+	if cfg.circuit.failures < 0 || cfg.circuit.cooldown <= 0 {
+		logger.PrintFatal(errors.New("circuit failures cannot be negative and the circuit cooldown must be positive"), nil)
+	}
+	sourceCircuits = imageprocessor.NewCircuitBreaker(cfg.circuit.failures, cfg.circuit.cooldown)
+
+	downloadSlots = imageprocessor.NewSemaphore(cfg.maxConcurrentDownloads)
+	encodeSlots = imageprocessor.NewSemaphore(cfg.maxConcurrentEncodes)
+
+	if cfg.downloadBandwidth < 0 || cfg.downloadBandwidthTotal < 0 {
+		logger.PrintFatal(errors.New("download bandwidth cannot be negative"), nil)
+	}
+	downloadBandwidth = newBandwidthLimiter(cfg.downloadBandwidthTotal)
+
+	if cfg.jobTimeout <= 0 {
+		logger.PrintFatal(errors.New("job timeout must be greater than zero"), nil)
+	}
+
+	if cfg.diskHighWater < 0 || cfg.diskHighWater > 100 {
+		logger.PrintFatal(errors.New("disk high-water mark must be between 0 and 100"), nil)
+	}
+	if cfg.diskHighWater > 0 && (cfg.diskLowWater <= 0 || cfg.diskLowWater >= cfg.diskHighWater) {
+		logger.PrintFatal(errors.New("disk low-water mark must be greater than zero and below the high-water mark"), nil)
+	}
+	if cfg.diskMonitorInterval <= 0 || cfg.cleanupInterval <= 0 {
+		logger.PrintFatal(errors.New("disk monitor and cleanup intervals must be greater than zero"), nil)
+	}
+
+	// Outputs of the running jobs must not expire
+	if cfg.outputTTL < 0 || (cfg.outputTTL > 0 && cfg.outputTTL <= cfg.jobTimeout) {
+		logger.PrintFatal(errors.New("output TTL must exceed the job timeout"), nil)
+	}
+	setExpiry(cfg.outputTTL, cfg.cleanupInterval)
+
+	if cfg.slowJobThreshold < 0 {
+		logger.PrintFatal(errors.New("slow job threshold must not be negative"), nil)
+	}
+
+	if cfg.readTimeout < 0 || cfg.writeTimeout < 0 || cfg.readHeaderTimeout <= 0 || cfg.idleTimeout <= 0 {
+		logger.PrintFatal(errors.New("read and write timeouts must be positive, read header and idle timeouts greater than zero"), nil)
+	}
+
+	// A synchronous job answering after the write timeout gets its response dropped
+	if cfg.writeTimeout > 0 && cfg.writeTimeout <= cfg.jobTimeout {
+		logger.PrintInfo("write timeout does not exceed the job timeout, responses of long jobs may be lost", map[string]string{
+			"write-timeout": cfg.writeTimeout.String(),
+			"job-timeout":   cfg.jobTimeout.String(),
+		})
+	}
+
+	if cfg.shutdownTimeout <= 0 {
+		logger.PrintFatal(errors.New("shutdown timeout must be greater than zero"), nil)
+	}
+
+	if cfg.limiter.rps <= 0 || cfg.limiter.burst <= 0 {
+		logger.PrintFatal(errors.New("limiter rps and burst must be greater than zero"), nil)
+	}
+
+	networks, err := parseTrustedProxies(cfg.trustedProxies)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+	trustedProxies.Store(&proxyList{list: cfg.trustedProxies, networks: networks})
+
+	headerNames := splitList(cfg.sourceHeaders)
+	sourceHeaderNames.Store(&headerNames)
+
+	settings.Store(&runtimeSettings{
+		MaxConcurrentJobs: cfg.maxConcurrentJobs,
+		RateLimitEnabled:  cfg.limiter.enabled,
+		RateLimitRPS:      cfg.limiter.rps,
+		RateLimitBurst:    cfg.limiter.burst,
+		Maintenance:       cfg.maintenance,
+	})
+
+	if cfg.adminTokenFile != "" {
+		adminToken, err = loadAdminToken(cfg.adminTokenFile)
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+
+		logger.PrintInfo("admin API enabled", nil)
+	}
+
+	recoverJobs()
+
 	logger.PrintInfo("Starting server", map[string]string{
 		"port":      fmt.Sprintf("%d", cfg.port),
 		"url-host":  cfg.urlHost,
 		"file-path": cfg.filePath,
-		"use-cli":   fmt.Sprintf("%t", cfg.useCLI),
+		"backend":   cfg.backend,
+		"vips":      capabilities.VipsVersion,
 	})
 
-	err := serve()
+	err = serve()
 	if err != nil {
 		logger.PrintFatal(err, nil)
 	}
 }
 
-// basicAuth is a middleware that wraps an http.HandlerFunc with basic authentication
-func basicAuth(next http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		// Get credentials from the request header
-		username, password, ok := r.BasicAuth()
-		if !ok {
-			// No credentials provided, return 401 Unauthorized
-			w.Header().Set("WWW-Authenticate", `Basic realm="Restricted"`)
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+func handleSplitImage(w http.ResponseWriter, r *http.Request) {
+	req := defaultImageRequest()
+	v := newValidator()
+
+	switch r.Method {
+	case http.MethodGet:
+		// Query parameter variant for simple integrations
+		readQueryRequest(r.URL.Query(), &req, v)
+	case http.MethodPost:
+		// Parse JSON request
+		decoder := json.NewDecoder(r.Body)
+		if err := decoder.Decode(&req); err != nil {
+			errMessage := map[string]string{
+				"error": "Invalid JSON",
+			}
+			apiResponse(w, http.StatusBadRequest, errMessage)
 			return
 		}
+	default:
+		errMessage := map[string]string{
+			"error": "Method not allowed",
+		}
+		apiResponse(w, http.StatusMethodNotAllowed, errMessage)
+		return
+	}
+
+	splitImage(w, r, &req, v)
+}
+
+// splitImage validates req, recording the failures in v, and runs the split
+// job of a request read by any version of the split-image routes
+func splitImage(w http.ResponseWriter, r *http.Request, req *ImageRequest, v *validator) {
+	validateImageRequest(v, req)
+
+	// The normalized prefix is returned when it differs from the request. A
+	// title without a letter to keep, e.g. in CJK, is refused as is.
+	var normalizedPrefix string
+	if cfg.normalizePrefix {
+		if slug := slugifyPrefix(req.ImagesPrefix); slug != req.ImagesPrefix && slug != "" {
+			req.ImagesPrefix, normalizedPrefix = slug, slug
+		}
+	}
+	validatePrefix(v, req.ImagesPrefix)
+
+	validateMetadata(v, req.Metadata)
+
+	// Validate timeout_seconds, which can only shorten the server deadline
+	v.Check(req.TimeoutSeconds >= 0 && time.Duration(req.TimeoutSeconds)*time.Second <= cfg.jobTimeout,
+		"timeout_seconds", fmt.Sprintf("timeout_seconds must be 0 (default) or between 1 and %d", int(cfg.jobTimeout.Seconds())))
+
+	v.Check(!req.ReturnInline || cfg.maxInlineBytes > 0, "return_inline", "return_inline is disabled on this server")
+
+	if !v.Valid() {
+		failedValidationResponse(w, v)
+		return
+	}
 
-		// Check if credentials are valid using constant-time comparison to prevent timing attacks
-		usernameMatch := subtle.ConstantTimeCompare([]byte(username), []byte(cfg.username)) == 1
-		passwordMatch := subtle.ConstantTimeCompare([]byte(password), []byte(cfg.password)) == 1
+	timeout := cfg.jobTimeout
+	if req.TimeoutSeconds > 0 {
+		timeout = time.Duration(req.TimeoutSeconds) * time.Second
+	}
+
+	t := contextGetTenant(r)
+	imageURL := t.URLHost + req.URL
 
-		if !usernameMatch || !passwordMatch {
-			// Invalid credentials, return 401 Unauthorized
-			w.Header().Set("WWW-Authenticate", `Basic realm="Restricted"`)
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	processor := newProcessor(t, req)
+
+	// Only compute the split plan without producing any files
+	if req.DryRun {
+		plan, err := processor.PlanImage(imageURL, req.ImagesPrefix, req.Width, req.MaxImages)
+		if err != nil {
+			errMessage := map[string]string{
+				"error": err.Error(),
+			}
+			setCircuitRetryAfter(w, err)
+			apiResponse(w, processingErrorStatus(err), errMessage)
 			return
 		}
 
-		// Credentials are valid, call the next handler
-		next(w, r)
+		apiResponse(w, http.StatusOK, plan)
+		return
 	}
-}
 
-func handleSplitImage(w http.ResponseWriter, r *http.Request) {
-	// Only allow POST requests
-	if r.Method != http.MethodPost {
+	// Refuse new jobs while the server is in maintenance, running jobs go on
+	if settings.Load().Maintenance {
+		w.Header().Set("Retry-After", strconv.Itoa(int(cfg.maintenanceRetryAfter.Seconds())))
 		errMessage := map[string]string{
-			"error": "Method not allowed",
+			"error": "server is in maintenance mode",
 		}
-		apiResponse(w, http.StatusMethodNotAllowed, errMessage)
+		apiResponse(w, http.StatusServiceUnavailable, errMessage)
 		return
 	}
 
-	// Parse JSON request
-	var req ImageRequest
-	decoder := json.NewDecoder(r.Body)
-	if err := decoder.Decode(&req); err != nil {
+	// Refuse new jobs until the cleanup brings the volume below the low-water mark
+	if diskPressure.Load() {
+		w.Header().Set("Retry-After", strconv.Itoa(int(cfg.diskMonitorInterval.Seconds())))
 		errMessage := map[string]string{
-			"error": "Invalid JSON",
+			"error": "disk usage is above the high-water mark",
 		}
-		apiResponse(w, http.StatusBadRequest, errMessage)
+		apiResponse(w, http.StatusServiceUnavailable, errMessage)
 		return
 	}
 
-	// Validate URL
-	if req.URL == "" {
+	// Refuse the job instead of filling the volume
+	if err := checkDiskQuota(t); err != nil {
 		errMessage := map[string]string{
-			"error": "URL is required",
+			"error": err.Error(),
 		}
-		apiResponse(w, http.StatusBadRequest, errMessage)
+		apiResponse(w, http.StatusInsufficientStorage, errMessage)
 		return
 	}
 
-	// Validate max_images
-	if req.MaxImages < 0 {
+	// Refuse the job once a daily or monthly quota of its key is used up
+	keyID := apiKeyID(r)
+	if usageQuotaResponse(w, t, keyID) {
+		return
+	}
+
+	// Enforce the tenant concurrency quota
+	if !t.acquireJob() {
 		errMessage := map[string]string{
-			"error": "max_images must be a positive integer",
+			"error": "too many concurrent jobs for this tenant",
 		}
-		apiResponse(w, http.StatusBadRequest, errMessage)
+		apiResponse(w, http.StatusTooManyRequests, errMessage)
 		return
 	}
+	defer t.releaseJob()
 
-	// Validate images_prefix contains only alphanumeric characters and underscores
-	if !containsOnlyAllowedChars(req.ImagesPrefix, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_") {
+	// Enforce the server wide concurrency limit, the job waits in the queue
+	// for a slot or is refused with the estimated wait
+	releaseJob, retryAfter := jobs.acquire(r.Context())
+	if releaseJob == nil {
+		w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())+1))
 		errMessage := map[string]string{
-			"error": "images_prefix contains invalid characters",
+			"error": "too many concurrent jobs",
 		}
-		apiResponse(w, http.StatusBadRequest, errMessage)
+		apiResponse(w, http.StatusTooManyRequests, errMessage)
 		return
 	}
+	defer releaseJob()
 
-	imageURL := cfg.urlHost + req.URL
+	// Refuse the job before the download when the disk quotas or the volume
+	// cannot hold its output. Sources whose header cannot be planned are
+	// left to the job.
+	if cfg.diskPrecheck || hasDiskQuota(t) {
+		plan, err := processor.PlanImage(imageURL, req.ImagesPrefix, req.Width, req.MaxImages)
+		if errors.Is(err, imageprocessor.ErrTooManyChunks) {
+			errMessage := map[string]string{
+				"error": err.Error(),
+			}
+			apiResponse(w, http.StatusUnprocessableEntity, errMessage)
+			return
+		}
+		if err == nil {
+			// An uploaded zip takes no space in file-path
+			required := estimateJobBytes(plan, req.CreateZip && outputBucket == nil)
+
+			releaseQuota, err := reserveDiskQuota(t, required)
+			if err != nil {
+				errMessage := map[string]string{
+					"error": err.Error(),
+				}
+				apiResponse(w, http.StatusInsufficientStorage, errMessage)
+				return
+			}
+			defer releaseQuota()
 
-	processor := imageprocessor.Processor{
-		OutputBaseDir: cfg.filePath,
-		MaxHeight:     cfg.maxHeight,
-		UseCLI:        cfg.useCLI,
+			if cfg.diskPrecheck {
+				releaseSpace, err := reserveDiskSpace(required)
+				if err != nil {
+					errMessage := map[string]string{
+						"error": err.Error(),
+					}
+					apiResponse(w, http.StatusInsufficientStorage, errMessage)
+					return
+				}
+				defer releaseSpace()
+			}
+		}
+	}
+
+	// The previous output of a flat layout is replaced once the job succeeds
+	var replaced int64
+	if req.Layout == outputLayoutFlat {
+		release, size, err := claimFlatOutput(t, req.ImagesPrefix)
+		if err != nil {
+			errMessage := map[string]string{
+				"error": err.Error(),
+			}
+			apiResponse(w, http.StatusConflict, errMessage)
+			return
+		}
+		defer release()
+		replaced = size
+	}
+
+	// A resumed output_name is written by one job at a time
+	if req.OutputName != "" && cfg.outputNameCollision == imageprocessor.OutputCollisionResume {
+		release, err := claimOutputName(t, req.OutputName)
+		if err != nil {
+			errMessage := map[string]string{
+				"error": err.Error(),
+			}
+			apiResponse(w, http.StatusConflict, errMessage)
+			return
+		}
+		defer release()
 	}
 
-	// Download and process the image
-	result, err := processor.ProcessImage(imageURL, req.ImagesPrefix, req.Width, req.MaxImages, req.CreateZip)
+	record := recordJob(t, req)
+	events := newJobEvents(t, imageURL, record)
+
+	keyUsages.add(t.ID, keyID, usagePeriod{Requests: 1})
+	meter.add(t.ID, meteringCounts{jobs: 1})
+
+	observeChunks(&processor)
+	timings := timeStages(&processor)
+	hooks := newJobHooks(t, imageURL, record)
+	hooks.attach(&processor)
+	events.observe(&processor)
+	watchOutputDir(t, record, &processor)
+
+	// Download and process the image, the job is cancelled at the deadline
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	events.started()
+	jobStart := time.Now()
+	result, err := processor.ProcessImageContext(ctx, imageURL, req.ImagesPrefix, req.Width, req.MaxImages, req.CreateZip)
+	if err == nil && replaced > 0 {
+		// A failed split leaves the previous flat output in place
+		usage.add(t.ID, -replaced)
+	}
+	if err == nil {
+		err = hooks.finish(ctx, &result)
+	}
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		logger.PrintError(errors.New("split job timed out"), map[string]string{
+			"url":     imageURL,
+			"tenant":  t.ID,
+			"timeout": timeout.String(),
+		})
+
+		err = fmt.Errorf("job timed out after %s", timeout)
+		finishJob(record, nil, err)
+		auditJob(r, imageURL, record, auditOutcomeTimedOut, nil, err)
+		events.failed(err)
+		logSlowJob(t, imageURL, record, auditOutcomeTimedOut, time.Since(jobStart), timings)
+
+		errMessage := map[string]string{
+			"error": err.Error(),
+		}
+		apiResponse(w, http.StatusGatewayTimeout, errMessage)
+		return
+	}
 	if err != nil {
+		finishJob(record, nil, err)
+		auditJob(r, imageURL, record, auditOutcomeFailed, nil, err)
+		events.failed(err)
+		logSlowJob(t, imageURL, record, auditOutcomeFailed, time.Since(jobStart), timings)
+
 		errMessage := map[string]string{
 			"error": err.Error(),
 		}
-		apiResponse(w, http.StatusInternalServerError, errMessage)
+		setCircuitRetryAfter(w, err)
+		apiResponse(w, processingErrorStatus(err), errMessage)
 		return
 	}
 
+	// A reused output keeps the metadata of the job that wrote it
+	if len(req.Metadata) > 0 {
+		if !result.Reused {
+			if err := writeJobMetadata(result.OutputDir, req.Metadata); err != nil {
+				logger.PrintError(err, nil)
+			}
+		}
+		result.Metadata = req.Metadata
+	}
+	result.ImagesPrefix = normalizedPrefix
+
+	observeJob(&processor, &result)
+
+	megapixels := float64(result.OriginalWidth) * float64(result.OriginalHeight) / 1e6
+	keyUsages.add(t.ID, keyID, usagePeriod{Megapixels: megapixels})
+
+	// Account the bytes written by the job, none when it reused an output
+	var written int64
+	if !result.Reused {
+		written, err = dirSize(result.OutputDir)
+		if err != nil {
+			logger.PrintError(err, nil)
+		} else {
+			usage.add(t.ID, written)
+		}
+	}
+
+	meter.add(t.ID, meteringCounts{megapixels: megapixels, bytesDownloaded: result.SourceBytes, bytesWritten: written})
+
+	setPublicURLs(t, &result)
+
+	if record != nil {
+		// A reused output was not created by the job
+		if result.Reused {
+			if rel, err := filepath.Rel(t.outputPath, result.OutputDir); err == nil {
+				record.OutputDir = rel
+			}
+		}
+		result.JobID = record.ID
+		finishJob(record, &result, nil)
+	}
+	auditJob(r, imageURL, record, auditOutcomeCompleted, &result, nil)
+	events.completed(&result)
+	logSlowJob(t, imageURL, record, auditOutcomeCompleted, time.Since(jobStart), timings)
+
+	// The job succeeded, so chunks too large to be returned inline are only
+	// returned by their URLs
+	if req.ReturnInline {
+		result.InlineImages, err = inlineImages(&result)
+		if err != nil {
+			properties := map[string]string{
+				"url": imageURL,
+				"job": result.JobID,
+			}
+			if errors.Is(err, errInlineTooLarge) {
+				logger.PrintWarning(err.Error(), properties)
+			} else {
+				logger.PrintError(err, properties)
+			}
+		}
+	}
+
 	// Return success response
 	apiResponse(w, http.StatusOK, result)
 }
 
+// handleImageInfo returns the metadata of a source image and the number of
+// chunks it would be split into. It accepts the url, width and max_images
+// either as query parameters (GET) or as a JSON body (POST).
+func handleImageInfo(w http.ResponseWriter, r *http.Request) {
+	req := defaultImageRequest()
+	v := newValidator()
+
+	switch r.Method {
+	case http.MethodGet:
+		readQueryRequest(r.URL.Query(), &req, v)
+	case http.MethodPost:
+		decoder := json.NewDecoder(r.Body)
+		if err := decoder.Decode(&req); err != nil {
+			errMessage := map[string]string{
+				"error": "Invalid JSON",
+			}
+			apiResponse(w, http.StatusBadRequest, errMessage)
+			return
+		}
+	default:
+		errMessage := map[string]string{
+			"error": "Method not allowed",
+		}
+		apiResponse(w, http.StatusMethodNotAllowed, errMessage)
+		return
+	}
+
+	validateImageRequest(v, &req)
+
+	if !v.Valid() {
+		failedValidationResponse(w, v)
+		return
+	}
+
+	t := contextGetTenant(r)
+
+	processor := newProcessor(t, &req)
+
+	info, err := processor.InfoImage(t.URLHost+req.URL, req.Width, req.MaxImages)
+	if err != nil {
+		errMessage := map[string]string{
+			"error": err.Error(),
+		}
+		setCircuitRetryAfter(w, err)
+		apiResponse(w, processingErrorStatus(err), errMessage)
+		return
+	}
+
+	apiResponse(w, http.StatusOK, info)
+}
+
+// readQueryRequest fills req from the query string of a GET request. The
+// parameter names match the JSON fields, with "prefix" accepted as a shorter
+// alias of "images_prefix". Parameters that cannot be parsed are recorded in v.
+func readQueryRequest(query url.Values, req *ImageRequest, v *validator) {
+	req.URL = query.Get("url")
+
+	req.ImagesPrefix = query.Get("images_prefix")
+	if req.ImagesPrefix == "" {
+		req.ImagesPrefix = query.Get("prefix")
+	}
+
+	intParams := []struct {
+		name   string
+		target *int
+	}{
+		{"width", &req.Width},
+		{"max_images", &req.MaxImages},
+		{"max_pixels", &req.MaxPixels},
+		{"timeout_seconds", &req.TimeoutSeconds},
+		{"rotate", &req.Rotate},
+		{"quality", &req.Quality},
+		{"png_optimize", &req.PNGOptimize},
+		{"target_chunk_bytes", &req.TargetChunkBytes},
+		{"bit_depth", &req.BitDepth},
+		{"dpi", &req.DPI},
+		{"svg_width", &req.SVGWidth},
+		{"svg_dpi", &req.SVGDPI},
+		{"strip_width", &req.StripWidth},
+	}
+
+	for _, param := range intParams {
+		if value := query.Get(param.name); value != "" {
+			parsed, err := strconv.Atoi(value)
+			if err != nil {
+				v.AddError(param.name, fmt.Sprintf("%s must be an integer", param.name))
+				continue
+			}
+			*param.target = parsed
+		}
+	}
+
+	req.FallbackURLs = query["fallback_url"]
+	req.ExpectedSHA256 = query.Get("expected_sha256")
+	req.OutputName = query.Get("output_name")
+	req.Layout = query.Get("layout")
+	req.ColorSpace = query.Get("colorspace")
+	if value := query.Get("sharpen"); value != "" {
+		if sharpen, err := strconv.ParseFloat(value, 64); err != nil {
+			v.AddError("sharpen", "sharpen must be a number")
+		} else {
+			req.Sharpen = sharpen
+		}
+	}
+	if value := query.Get("metadata"); value != "" {
+		req.Metadata = json.RawMessage(value)
+	}
+	req.Format = query.Get("format")
+	req.Background = query.Get("background")
+	req.Subsampling = query.Get("subsampling")
+	req.Anchor = query.Get("anchor")
+	req.Fit = query.Get("fit")
+	req.ChunkAspect = query.Get("chunk_aspect")
+	req.SplitMode = query.Get("split_mode")
+	req.Preset = query.Get("preset")
+	req.PadColor = query.Get("pad_color")
+
+	if value := query.Get("widths"); value != "" {
+		for _, field := range strings.Split(value, ",") {
+			width, err := strconv.Atoi(strings.TrimSpace(field))
+			if err != nil {
+				v.AddError("widths", "widths must be a comma separated list of integers")
+				break
+			}
+			req.Widths = append(req.Widths, width)
+		}
+	}
+
+	if value := query.Get("crop"); value != "" {
+		crop, err := parseCropRegion(value)
+		if err != nil {
+			v.AddError("crop", err.Error())
+		}
+		req.Crop = crop
+	}
+
+	boolParams := []struct {
+		name   string
+		target *bool
+	}{
+		{"create_zip", &req.CreateZip},
+		{"verify", &req.Verify},
+		{"skip_blank", &req.SkipBlank},
+		{"dedupe", &req.Dedupe},
+		{"contact_sheet", &req.ContactSheet},
+		{"html_preview", &req.HTMLPreview},
+		{"dry_run", &req.DryRun},
+		{"return_inline", &req.ReturnInline},
+		{"convert_srgb", &req.ConvertSRGB},
+	}
+
+	for _, param := range boolParams {
+		if value := query.Get(param.name); value != "" {
+			parsed, err := strconv.ParseBool(value)
+			if err != nil {
+				v.AddError(param.name, fmt.Sprintf("%s must be a boolean", param.name))
+				continue
+			}
+			*param.target = parsed
+		}
+	}
+}
+
+// processingErrorStatus returns the status of a failed job, a client error
+// when the request options don't fit the source image
+func processingErrorStatus(err error) int {
+	if errors.Is(err, imageprocessor.ErrInvalidOptions) {
+		return http.StatusBadRequest
+	}
+	if errors.Is(err, imageprocessor.ErrUnsupportedInput) {
+		return http.StatusUnsupportedMediaType
+	}
+	if errors.Is(err, imageprocessor.ErrInvalidSource) || errors.Is(err, imageprocessor.ErrTooManyChunks) || errors.Is(err, errHookFailed) {
+		return http.StatusUnprocessableEntity
+	}
+	if errors.Is(err, imageprocessor.ErrChecksumMismatch) {
+		return http.StatusPreconditionFailed
+	}
+	if errors.Is(err, imageprocessor.ErrOutputExists) {
+		return http.StatusConflict
+	}
+	if errors.Is(err, imageprocessor.ErrCircuitOpen) {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+// setCircuitRetryAfter advertises the rest of the cooldown of a source host
+// whose circuit is open
+func setCircuitRetryAfter(w http.ResponseWriter, err error) {
+	var open *imageprocessor.CircuitOpenError
+	if errors.As(err, &open) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(open.RetryAfter.Seconds())+1))
+	}
+}
+
 // containsOnlyAllowedChars checks if a string contains only characters from the allowed set
 func containsOnlyAllowedChars(s, allowed string) bool {
 	for _, char := range s {
@@ -229,15 +1314,99 @@ func apiResponse(w http.ResponseWriter, status int, message any) {
 
 func serve() error {
 	srv := &http.Server{
-		Addr:         fmt.Sprintf(":%d", cfg.port),
-		Handler:      nil,
-		IdleTimeout:  time.Minute,
-		ReadTimeout:  5 * time.Second,
-		WriteTimeout: 10 * time.Second,
+		Addr:              fmt.Sprintf(":%d", cfg.port),
+		Handler:           routes(),
+		IdleTimeout:       cfg.idleTimeout,
+		ReadTimeout:       cfg.readTimeout,
+		ReadHeaderTimeout: cfg.readHeaderTimeout,
+		WriteTimeout:      cfg.writeTimeout,
+	}
+	srv.RegisterOnShutdown(serverEvents.close)
+
+	// The operational endpoints get their own listener, usually bound to
+	// localhost or the pod network
+	var internalSrv *http.Server
+	if cfg.internalAddr != "" {
+		publishMetrics()
+
+		internalSrv = &http.Server{
+			Addr:        cfg.internalAddr,
+			Handler:     internalRoutes(),
+			IdleTimeout: time.Minute,
+			ReadTimeout: 5 * time.Second,
+		}
+
+		listener, err := net.Listen("tcp", internalSrv.Addr)
+		if err != nil {
+			return err
+		}
+
+		go func() {
+			logger.PrintInfo("starting internal server", map[string]string{
+				"addr": internalSrv.Addr,
+			})
+
+			if err := internalSrv.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+				logger.PrintError(err, nil)
+			}
+		}()
+	}
+
+	var meteringStop, meteringDone chan struct{}
+	if meteringEnabled() {
+		meteringStop, meteringDone = make(chan struct{}), make(chan struct{})
+		go runMetering(meteringStop, meteringDone)
+	}
+
+	var usageStop, usageDone chan struct{}
+	if cfg.usageFile != "" {
+		usageStop, usageDone = make(chan struct{}), make(chan struct{})
+		go runUsageSaver(usageStop, usageDone)
+	}
+
+	var statsdStop, statsdDone chan struct{}
+	if stats != nil {
+		statsdStop, statsdDone = make(chan struct{}), make(chan struct{})
+		go runStatsd(statsdStop, statsdDone)
 	}
 
+	diskMonitorStop := make(chan struct{})
+	defer close(diskMonitorStop)
+	go runDiskMonitor(diskMonitorStop)
+
 	shutdownError := make(chan error)
 
+	go func() {
+		reload := make(chan os.Signal, 1)
+		signal.Notify(reload, syscall.SIGHUP)
+
+		for s := range reload {
+			logger.PrintInfo("caught signal", map[string]string{
+				"signal": s.String(),
+			})
+
+			reloadConfig()
+		}
+	}()
+
+	if maintenanceSignal != nil {
+		go func() {
+			toggle := make(chan os.Signal, 1)
+			signal.Notify(toggle, maintenanceSignal)
+
+			for s := range toggle {
+				previous, next := updateSettings(func(s *runtimeSettings) {
+					s.Maintenance = !s.Maintenance
+				})
+
+				changes := settingsDiff(previous, next)
+				changes["source"] = "signal"
+				changes["signal"] = s.String()
+				logger.PrintInfo("updated runtime settings", changes)
+			}
+		}()
+	}
+
 	go func() {
 		quit := make(chan os.Signal, 1)
 		signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
@@ -247,20 +1416,62 @@ func serve() error {
 			"signal": s.String(),
 		})
 
-		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		// The retries of interrupted jobs stop now, the running requests get
+		// until the drain timeout to finish
+		cancelJobs()
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.shutdownTimeout)
 		defer cancel()
 
+		// Readiness checks fail from now on
+		updateSettings(func(s *runtimeSettings) {
+			s.Maintenance = true
+		})
+
+		// Stop accepting connections and wait for the running handlers
 		err := srv.Shutdown(ctx)
-		if err != nil {
-			shutdownError <- err
+
+		if err == nil {
+			logger.PrintInfo("completing background tasks", map[string]string{
+				"addr":         srv.Addr,
+				"running_jobs": strconv.Itoa(jobs.running()),
+			})
+
+			drained := make(chan struct{})
+			go func() {
+				wg.Wait()
+				close(drained)
+			}()
+
+			select {
+			case <-drained:
+			case <-ctx.Done():
+				err = ctx.Err()
+			}
 		}
 
-		logger.PrintInfo("completing background tasks", map[string]string{
-			"addr": srv.Addr,
-		})
+		// The last partial interval includes the drained jobs
+		if meteringStop != nil {
+			close(meteringStop)
+			<-meteringDone
+		}
+		if statsdStop != nil {
+			close(statsdStop)
+			<-statsdDone
+		}
+		if usageStop != nil {
+			close(usageStop)
+			<-usageDone
+		}
 
-		wg.Wait()
-		shutdownError <- nil
+		if errors.Is(err, context.DeadlineExceeded) {
+			err = fmt.Errorf("drain timeout of %s exceeded with %d jobs still running", cfg.shutdownTimeout, jobs.running())
+		}
+
+		if internalSrv != nil {
+			internalSrv.Close()
+		}
+
+		shutdownError <- err
 	}()
 
 	logger.PrintInfo("starting server", map[string]string{
@@ -285,6 +1496,157 @@ func serve() error {
 	return nil
 }
 
+// defineFlags registers every server flag on fs, bound to the fields of c
+func defineFlags(fs *flag.FlagSet, c *config) {
+	// Configuration file
+	fs.StringVar(&c.configFile, "config", "", "JSON file with flag values keyed by flag name, reloaded on SIGHUP")
+
+	// API Web Server Settings
+	fs.IntVar(&c.port, "port", 4000, "API server port")
+	fs.DurationVar(&c.readTimeout, "read-timeout", 5*time.Minute, "Maximum duration for reading a request, including its body (0 means no timeout)")
+	fs.DurationVar(&c.readHeaderTimeout, "read-header-timeout", 10*time.Second, "Maximum duration for reading the request headers")
+	fs.DurationVar(&c.writeTimeout, "write-timeout", 15*time.Minute, "Maximum duration from the end of the request headers to the end of the response, should exceed job-timeout (0 means no timeout)")
+	fs.DurationVar(&c.idleTimeout, "idle-timeout", time.Minute, "Maximum time to wait for the next request on a keep-alive connection")
+	fs.StringVar(&c.internalAddr, "internal-addr", "", "Listen address of the health, metrics and pprof endpoints, e.g. localhost:4001 (disabled if empty)")
+	fs.BoolVar(&c.publicSelftest, "public-selftest", false, "Also serve POST /selftest on the API port, behind the authentication of the split API")
+
+	fs.StringVar(&c.urlHost, "url-host", "", "Base path for image processing")
+	fs.StringVar(&c.filePath, "file-path", "", "File path for image processing")
+	fs.BoolVar(&c.inMemory, "in-memory", false, "Download, split and zip the jobs creating a zip in memory and only write the zip (Go implementation)")
+	fs.Var(byteSizeValue{&c.memoryBudget}, "memory-budget", "Bytes of the source and the zip an in-memory job may hold before falling back to the disk, e.g. 512MB (default 256MB)")
+	fs.IntVar(&c.prefixMinLength, "prefix-min-length", 0, "Minimum number of characters of images_prefix")
+	fs.IntVar(&c.prefixMaxLength, "prefix-max-length", defaultMaxPrefixLength, "Maximum number of characters of images_prefix")
+	fs.StringVar(&c.prefixChars, "prefix-chars", defaultPrefixChars, "Regular expression matching one character allowed in images_prefix and output_name, e.g. [A-Za-z0-9_.-] to also allow dots and hyphens. Slashes are never allowed")
+	fs.BoolVar(&c.normalizePrefix, "normalize-prefix", false, "Turn images_prefix into a slug, lowercased and transliterated to ASCII with underscores between the words, instead of refusing the characters it cannot contain")
+	fs.StringVar(&c.outputNameCollision, "output-name-collision", imageprocessor.OutputCollisionReject, "What to do when the directory of an output_name exists: reject the job with a 409, suffix the name with _2, _3..., or resume the job that wrote it")
+	fs.BoolVar(&c.contentAddressed, "content-addressed-output", false, "Name the job directories without an output_name by the digest of the source and the options, and return the result of an identical earlier job instead of splitting again")
+	fs.StringVar(&c.tempPath, "temp-path", "", "Directory of the downloads and intermediate files, removed after every job, so only the chunks, zips and previews are published in file-path")
+	fs.StringVar(&c.s3.bucket, "s3-bucket", "", "S3 bucket receiving the zips through multipart uploads instead of file-path and the chunks as they are encoded, with the credentials of AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN")
+	fs.StringVar(&c.s3.region, "s3-region", "us-east-1", "Region of the S3 bucket")
+	fs.StringVar(&c.s3.endpoint, "s3-endpoint", "", "Endpoint of an S3 compatible storage, e.g. https://minio.example.com (default: the AWS endpoint of s3-region)")
+	fs.StringVar(&c.s3.prefix, "s3-prefix", "", "Key prefix of the zips in the S3 bucket, e.g. splits/")
+	fs.BoolVar(&c.s3.pathStyle, "s3-path-style", false, "Address the S3 bucket in the URL path instead of the host name, as most S3 compatible storages expect")
+	c.s3.partSize = 8 << 20
+	fs.Var(byteSizeValue{&c.s3.partSize}, "s3-part-size", "Size of the parts of the S3 multipart uploads, at least 5MB")
+	fs.IntVar(&c.s3.uploadConcurrency, "s3-upload-concurrency", imageprocessor.DefaultConcurrentUploads, "Chunks of a job uploaded to the S3 bucket at once, while the next ones are encoded")
+	fs.StringVar(&c.sourceHeaders, "source-headers", "", "Comma separated header names requests may send with the source download, e.g. Authorization,Cookie,Referer (none if empty)")
+	fs.StringVar(&c.auditLog, "audit-log", "", "Append-only NDJSON log of who split which source URL, when, and the outcome")
+	fs.StringVar(&c.jobsPath, "jobs-path", "", "Directory of the job records, enables the job listing. Keep it out of file-path, the records hold the source URLs")
+	fs.StringVar(&c.recoverJobs, "recover-jobs", recoverJobsFail, "What happens at startup to the recorded jobs a crash left processing: fail marks them failed and removes their partial output, retry runs them again")
+	fs.StringVar(&c.usageFile, "usage-file", "", "File persisting the request and megapixel usage of the API keys, the usage restarts from zero when empty")
+	fs.DurationVar(&c.metering.interval, "metering-interval", time.Hour, "Interval of the usage records exported to the metering path and url")
+	fs.StringVar(&c.metering.path, "metering-path", "", "Directory receiving the usage records as a NDJSON file per UTC day")
+	fs.StringVar(&c.metering.url, "metering-url", "", "Endpoint receiving the usage records as a NDJSON POST body")
+	fs.StringVar(&c.statsd.addr, "statsd-addr", "", "UDP address of a statsd or DogStatsD agent receiving the metrics, e.g. localhost:8125 (disabled if empty)")
+	fs.StringVar(&c.statsd.prefix, "statsd-prefix", "imagesplitter", "Prefix of the metric names pushed to the statsd agent")
+	fs.StringVar(&c.statsd.format, "statsd-format", statsdFormatDogStatsD, "Line format of the statsd agent, dogstatsd or statsd")
+	fs.StringVar(&c.statsd.tags, "statsd-tags", "", "Comma separated tags added to every pushed metric, e.g. env:prod,service:imagesplitter")
+	fs.DurationVar(&c.statsd.interval, "statsd-interval", 10*time.Second, "Interval of the gauges and the batched metrics pushed to the statsd agent")
+	fs.StringVar(&c.publicBaseURL, "public-base-url", "", "Base URL serving file-path, e.g. https://cdn.example.com/splits/, returns absolute URLs of the generated files")
+	c.maxInlineBytes = 1 << 20
+	fs.Var(byteSizeValue{&c.maxInlineBytes}, "max-inline-bytes", "Total size of the chunks a return_inline request may get base64 encoded in the response, e.g. 4MB (0 disables return_inline)")
+
+	// Authentication settings
+	fs.StringVar(&c.htpasswdFile, "htpasswd-file", "", "htpasswd file with bcrypt hashes for basic authentication, reloaded on SIGHUP")
+	fs.StringVar(&c.hmacKeysFile, "hmac-keys-file", "", "File with the client:secret shared secrets of the clients signing their requests with HMAC-SHA256, reloaded on SIGHUP")
+	fs.DurationVar(&c.hmacMaxSkew, "hmac-max-skew", 5*time.Minute, "Largest difference between the timestamp of a signed request and the server clock, identical signed requests are refused within it")
+	fs.StringVar(&c.oidcIssuer, "oidc-issuer", "", "OIDC issuer URL whose access tokens are accepted as bearer tokens")
+	fs.StringVar(&c.oidcAudience, "oidc-audience", "", "Audience that OIDC access tokens must contain")
+	fs.DurationVar(&c.oidcKeysTTL, "oidc-keys-ttl", time.Hour, "How long the OIDC signing keys are cached")
+	fs.StringVar(&c.tenantsFile, "tenants-file", "", "JSON file mapping API keys to tenants with their own output directory, url host and quotas")
+
+	// Image processing settings
+	fs.IntVar(&c.maxHeight, "max-height", 5000, "Maximum height for image processing")
+	fs.IntVar(&c.defaults.width, "default-width", 0, "Width of the requests that omit it (0 keeps the source width)")
+	fs.IntVar(&c.defaults.maxImages, "default-max-images", 0, "max_images of the requests that omit it (0 means unlimited)")
+	fs.IntVar(&c.defaults.quality, "default-quality", 0, "JPEG and WebP quality of the requests that omit it (0 keeps the encoder default)")
+	fs.IntVar(&c.maxChunks, "max-chunks", 1000, "Most chunks a job may write, across all its widths, whatever its parameters. Larger jobs fail before any chunk is encoded (0 means unlimited)")
+	fs.Int64Var(&c.maxSourcePixels, "max-source-pixels", imageprocessor.DefaultMaxSourcePixels, "Largest width x height of the sources decoded in Go, larger ones are refused before their pixels are decoded")
+	fs.DurationVar(&c.decodeTimeout, "decode-timeout", 2*time.Minute, "Maximum duration of decoding a source in Go (0 leaves it to job-timeout)")
+	fs.StringVar(&c.jpegEncoder, "jpeg-encoder", imageprocessor.JPEGEncoderStdlib, "JPEG encoder of the chunks, stdlib or mozjpeg (cjpeg binary, or vips optimize_coding and trellis_quant with use-cli)")
+	fs.StringVar(&c.cjpegPath, "cjpeg-path", "cjpeg", "Path of the mozjpeg cjpeg binary used by jpeg-encoder=mozjpeg")
+	fs.StringVar(&c.hooks.source, "hook-source", "", "Command run on every downloaded source before it is split, with its path as last argument. A failure refuses the job")
+	fs.StringVar(&c.hooks.chunk, "hook-chunk", "", "Command run on every chunk once written, before it is zipped or uploaded, with its path as last argument. A failure fails the job")
+	fs.StringVar(&c.hooks.job, "hook-job", "", "Command run after every job, with the output directory and the chunk paths as arguments. A failure fails the job")
+	fs.DurationVar(&c.hooks.timeout, "hook-timeout", time.Minute, "Maximum duration of a hook command, it is killed past it")
+	fs.StringVar(&c.rsvgConvertPath, "rsvg-convert-path", "rsvg-convert", "Path of the librsvg rsvg-convert binary that rasterizes SVG sources without use-cli")
+
+	// Storage limits
+	fs.Var(byteSizeValue{&c.diskQuota}, "disk-quota", "Maximum bytes stored below file-path across all tenants, e.g. 200GB (0 means unlimited)")
+	fs.Var(byteSizeValue{&c.minFreeDisk}, "min-free-disk", "Refuse new jobs when the free space of the file-path volume drops below this size, e.g. 5GB")
+	fs.Float64Var(&c.diskHighWater, "disk-high-water", 0, "Refuse new jobs with 503 once this percentage of the file-path volume is used (0 disables it)")
+	fs.Float64Var(&c.diskLowWater, "disk-low-water", 80, "Accept new jobs again once the used percentage of the file-path volume drops below this")
+	fs.DurationVar(&c.diskMonitorInterval, "disk-monitor-interval", 30*time.Second, "Interval of the file-path volume usage checks")
+	fs.DurationVar(&c.outputTTL, "output-ttl", 0, "Remove the job outputs older than this, and as soon as the disk high-water mark is crossed (0 keeps them)")
+	fs.DurationVar(&c.cleanupInterval, "cleanup-interval", time.Hour, "Interval of the removal of the outputs older than output-ttl")
+	fs.BoolVar(&c.diskPrecheck, "disk-precheck", true, "Estimate the space of every job from the source header and refuse it when the file-path volume cannot hold it")
+
+	// Operational settings
+	fs.IntVar(&c.maxConcurrentJobs, "max-concurrent-jobs", 0, "Maximum number of splits running at once across all tenants (0 means unlimited)")
+	fs.IntVar(&c.maxQueuedJobs, "max-queued-jobs", 0, "Maximum number of splits waiting for a slot of max-concurrent-jobs (0 refuses them at once)")
+	fs.DurationVar(&c.queueTimeout, "queue-timeout", 30*time.Second, "Longest time a split waits in the queue before it is refused")
+	fs.IntVar(&c.maxConcurrentDownloads, "max-concurrent-downloads", 0, "Maximum number of source images downloaded at once (0 means unlimited)")
+	fs.IntVar(&c.maxConcurrentEncodes, "max-concurrent-encodes", runtime.NumCPU(), "Maximum number of images split and encoded at once (0 means unlimited)")
+	fs.Var(byteSizeValue{&c.downloadBandwidth}, "download-bandwidth", "Bytes per second sent to each download of a job zip, e.g. 10MB (0 means unlimited)")
+	fs.Var(byteSizeValue{&c.downloadBandwidthTotal}, "download-bandwidth-total", "Bytes per second sent to all the downloads of job zips together, e.g. 50MB (0 means unlimited)")
+	fs.DurationVar(&c.fetch.connectTimeout, "fetch-connect-timeout", imageprocessor.DefaultFetchOptions.ConnectTimeout, "Maximum duration of connecting to a source host, TLS handshake included")
+	fs.DurationVar(&c.fetch.responseHeaderTimeout, "fetch-response-header-timeout", imageprocessor.DefaultFetchOptions.ResponseHeaderTimeout, "Maximum wait for the response headers of a source download")
+	fs.IntVar(&c.fetch.maxIdleConns, "fetch-max-idle-conns", imageprocessor.DefaultFetchOptions.MaxIdleConns, "Maximum number of idle connections kept to the source hosts")
+	fs.IntVar(&c.fetch.maxIdleConnsPerHost, "fetch-max-idle-conns-per-host", imageprocessor.DefaultFetchOptions.MaxIdleConnsPerHost, "Maximum number of idle connections kept to a single source host")
+	fs.DurationVar(&c.fetch.idleTimeout, "fetch-idle-timeout", imageprocessor.DefaultFetchOptions.IdleConnTimeout, "How long idle connections to the source hosts are kept")
+	fs.BoolVar(&c.fetch.disableKeepAlives, "fetch-disable-keepalives", false, "Close the connection after every source download")
+	fs.StringVar(&c.fetch.noKeepAliveHosts, "fetch-no-keepalive-hosts", "", "Comma separated source hosts whose connections are closed after every download")
+	fs.StringVar(&c.fetch.userAgent, "fetch-user-agent", "imagesplitter/"+version, "User-Agent of the source downloads")
+	fs.IntVar(&c.fetch.maxRedirects, "fetch-max-redirects", imageprocessor.DefaultFetchOptions.MaxRedirects, "Maximum number of redirects followed by a source download (0 follows none)")
+	fs.BoolVar(&c.fetch.sameHostRedirects, "fetch-same-host-redirects", false, "Only follow redirects to the host of the source")
+	fs.DurationVar(&c.fetch.dnsCacheTTL, "fetch-dns-cache-ttl", 0, "How long the addresses of the source hosts are cached (0 disables the cache)")
+	fs.StringVar(&c.fetch.preferIP, "fetch-prefer-ip", "", "Address family of the source hosts tried first, ipv4 or ipv6 (the order of the resolver if empty)")
+	fs.StringVar(&c.fetch.dnsServers, "fetch-dns-servers", "", "Comma separated DNS servers resolving the source hosts instead of the system ones, e.g. 10.0.0.2,10.0.0.3:5353")
+	fs.IntVar(&c.circuit.failures, "circuit-failures", 0, "Consecutive failed downloads from a source host that open its circuit (0 disables the circuit breaker)")
+	fs.DurationVar(&c.circuit.cooldown, "circuit-cooldown", 30*time.Second, "How long the downloads from a source host with an open circuit fail fast")
+	fs.BoolVar(&c.limiter.enabled, "limiter-enabled", false, "Enable the per client IP rate limiter")
+	fs.Float64Var(&c.limiter.rps, "limiter-rps", 2, "Rate limiter maximum requests per second")
+	fs.IntVar(&c.limiter.burst, "limiter-burst", 4, "Rate limiter maximum burst")
+	fs.BoolVar(&c.maintenance, "maintenance", false, "Start in maintenance mode, refusing new split jobs (toggled with SIGUSR1 or the admin API)")
+	fs.DurationVar(&c.maintenanceRetryAfter, "maintenance-retry-after", time.Minute, "Retry-After advertised to clients refused during maintenance")
+	fs.DurationVar(&c.jobTimeout, "job-timeout", 10*time.Minute, "Maximum duration of a split job, requests can only ask for a shorter timeout")
+	fs.DurationVar(&c.slowJobThreshold, "slow-job-threshold", 0, "Log a warning with the stage timings of the split jobs taking longer (0 disables it)")
+	fs.DurationVar(&c.shutdownTimeout, "shutdown-timeout", 30*time.Second, "How long running jobs may take to finish after SIGINT or SIGTERM")
+	fs.StringVar(&c.logLevel, "log-level", "INFO", "Minimum level of the logs written (INFO, WARNING, ERROR or OFF)")
+	fs.StringVar(&c.trustedProxies, "trusted-proxies", "", "Comma separated IPs and CIDR ranges of the proxies whose X-Forwarded-For and X-Forwarded-Proto headers are trusted")
+	fs.StringVar(&c.adminTokenFile, "admin-token-file", "", "File containing the bearer token for the /admin API (disabled if empty)")
+
+	// Implementation selection
+	fs.BoolVar(&c.useCLI, "use-cli", false, "Use command line tools (vips and zip) instead of Go implementation, same as backend cli")
+	fs.StringVar(&c.backend, "backend", "", "Processing backend splitting the sources: "+strings.Join(imageprocessor.Backends(), ", ")+" (default go)")
+
+}
+
+// splitList splits a comma separated flag value, trimming the entries and
+// dropping the empty ones
+func splitList(list string) []string {
+	var entries []string
+	for _, entry := range strings.Split(list, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// validateURLHost checks that a source base URL is an http(s) URL ending with a slash
+func validateURLHost(urlHost string) error {
+	if !(strings.HasPrefix(urlHost, "http://") || strings.HasPrefix(urlHost, "https://")) {
+		return errors.New("url host must start with http:// or https://")
+	}
+
+	if !strings.HasSuffix(urlHost, "/") {
+		return errors.New("url host must end with a slash")
+	}
+
+	return nil
+}
+
 func checkIfFileExists(file string) bool {
 	_, err := os.Stat(file)
 	if errors.Is(err, os.ErrNotExist) {
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// maxMetadataBytes bounds the metadata object of a request
+const maxMetadataBytes = 4096
+
+// jobMetadataFile holds the metadata of a request in the output directory of
+// its job
+const jobMetadataFile = "metadata.json"
+
+// validateMetadata checks that the metadata of a request is a small JSON object
+func validateMetadata(v *validator, metadata json.RawMessage) {
+	if len(metadata) == 0 {
+		return
+	}
+
+	v.Check(len(metadata) <= maxMetadataBytes, "metadata", fmt.Sprintf("metadata cannot be larger than %d bytes", maxMetadataBytes))
+	v.Check(json.Valid(metadata) && bytes.HasPrefix(bytes.TrimSpace(metadata), []byte("{")), "metadata", "metadata must be a JSON object")
+}
+
+// writeJobMetadata stores the metadata of a request with the output of its job
+func writeJobMetadata(outputDir string, metadata json.RawMessage) error {
+	if err := os.WriteFile(filepath.Join(outputDir, jobMetadataFile), metadata, 0644); err != nil {
+		return fmt.Errorf("failed to save job metadata: %v", err)
+	}
+	return nil
+}
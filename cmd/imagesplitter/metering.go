@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxPendingMeteringRecords bounds the records kept for the next export when
+// the metering endpoint fails
+const maxPendingMeteringRecords = 10000
+
+// meteringRecord is the consumption of a tenant during an export interval
+type meteringRecord struct {
+	Tenant          string    `json:"tenant"`
+	PeriodStart     time.Time `json:"period_start"`
+	PeriodEnd       time.Time `json:"period_end"`
+	Jobs            int64     `json:"jobs"`
+	Megapixels      float64   `json:"megapixels"`
+	BytesDownloaded int64     `json:"bytes_downloaded"`
+	BytesWritten    int64     `json:"bytes_written"`
+	// BytesStored is the size of the tenant output directory at PeriodEnd
+	BytesStored int64 `json:"bytes_stored"`
+}
+
+// meteringCounts is what a tenant consumed since the last export
+type meteringCounts struct {
+	jobs            int64
+	megapixels      float64
+	bytesDownloaded int64
+	bytesWritten    int64
+}
+
+// usageMeter accumulates the consumption of every tenant between exports
+type usageMeter struct {
+	mu       sync.Mutex
+	start    time.Time
+	byTenant map[string]*meteringCounts
+	// pending are the records the endpoint did not accept yet
+	pending []meteringRecord
+}
+
+var meter = &usageMeter{start: time.Now().UTC(), byTenant: make(map[string]*meteringCounts)}
+
+// meteringEnabled reports whether usage records are exported
+func meteringEnabled() bool {
+	return cfg.metering.path != "" || cfg.metering.url != ""
+}
+
+// add records consumption of a tenant
+func (m *usageMeter) add(tenantID string, consumed meteringCounts) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	counts, ok := m.byTenant[tenantID]
+	if !ok {
+		counts = &meteringCounts{}
+		m.byTenant[tenantID] = counts
+	}
+
+	counts.jobs += consumed.jobs
+	counts.megapixels += consumed.megapixels
+	counts.bytesDownloaded += consumed.bytesDownloaded
+	counts.bytesWritten += consumed.bytesWritten
+}
+
+// records returns the records of the interval ending at end and starts the
+// next one. Every tenant gets a record, so the stored bytes are reported
+// when it was idle.
+func (m *usageMeter) records(end time.Time) []meteringRecord {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	tenantIDs := []string{defaultTenant.ID}
+	if reg := tenants.Load(); reg != nil {
+		tenantIDs = tenantIDs[:0]
+		for _, t := range reg.tenants {
+			tenantIDs = append(tenantIDs, t.ID)
+		}
+	}
+	sort.Strings(tenantIDs)
+
+	records := make([]meteringRecord, 0, len(tenantIDs))
+	for _, tenantID := range tenantIDs {
+		counts := m.byTenant[tenantID]
+		if counts == nil {
+			counts = &meteringCounts{}
+		}
+		_, stored := usage.get(tenantID)
+
+		records = append(records, meteringRecord{
+			Tenant:          tenantID,
+			PeriodStart:     m.start,
+			PeriodEnd:       end,
+			Jobs:            counts.jobs,
+			Megapixels:      counts.megapixels,
+			BytesDownloaded: counts.bytesDownloaded,
+			BytesWritten:    counts.bytesWritten,
+			BytesStored:     stored,
+		})
+	}
+
+	m.start = end
+	m.byTenant = make(map[string]*meteringCounts)
+
+	return records
+}
+
+// export writes the records of the interval ending now as NDJSON to the
+// metering path and endpoint
+func (m *usageMeter) export() {
+	records := m.records(time.Now().UTC())
+
+	if cfg.metering.path != "" {
+		if err := appendMeteringRecords(cfg.metering.path, records); err != nil {
+			logger.PrintError(err, nil)
+		}
+	}
+
+	if cfg.metering.url != "" {
+		m.mu.Lock()
+		records = append(m.pending, records...)
+		m.pending = nil
+		m.mu.Unlock()
+
+		if err := postMeteringRecords(cfg.metering.url, records); err != nil {
+			logger.PrintError(err, map[string]string{
+				"pending_records": fmt.Sprintf("%d", len(records)),
+			})
+
+			// Sent again with the next export, oldest dropped first
+			m.mu.Lock()
+			m.pending = append(records, m.pending...)
+			if len(m.pending) > maxPendingMeteringRecords {
+				m.pending = m.pending[len(m.pending)-maxPendingMeteringRecords:]
+			}
+			m.mu.Unlock()
+		}
+	}
+}
+
+// encodeMeteringRecords returns the records as NDJSON
+func encodeMeteringRecords(records []meteringRecord) ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, record := range records {
+		if err := encoder.Encode(record); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// appendMeteringRecords appends the records to the NDJSON file of their UTC
+// day in dir
+func appendMeteringRecords(dir string, records []meteringRecord) error {
+	if len(records) == 0 {
+		return nil
+	}
+
+	data, err := encodeMeteringRecords(records)
+	if err != nil {
+		return fmt.Errorf("failed to encode usage records: %v", err)
+	}
+
+	name := fmt.Sprintf("usage-%s.ndjson", records[0].PeriodEnd.Format(time.DateOnly))
+	file, err := os.OpenFile(filepath.Join(dir, name), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open usage records file: %v", err)
+	}
+	defer file.Close()
+
+	if _, err := file.Write(data); err != nil {
+		return fmt.Errorf("failed to write usage records: %v", err)
+	}
+	return nil
+}
+
+// meteringClient posts the usage records
+var meteringClient = &http.Client{Timeout: 30 * time.Second}
+
+// postMeteringRecords sends the records to url as an NDJSON body
+func postMeteringRecords(url string, records []meteringRecord) error {
+	if len(records) == 0 {
+		return nil
+	}
+
+	data, err := encodeMeteringRecords(records)
+	if err != nil {
+		return fmt.Errorf("failed to encode usage records: %v", err)
+	}
+
+	resp, err := meteringClient.Post(url, "application/x-ndjson", bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("failed to send usage records: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("failed to send usage records: unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// runMetering exports the usage records every metering interval until stop
+// is closed, then exports the last partial interval
+func runMetering(stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+
+	ticker := time.NewTicker(cfg.metering.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			meter.export()
+		case <-stop:
+			meter.export()
+			return
+		}
+	}
+}
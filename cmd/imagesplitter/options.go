@@ -0,0 +1,392 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/jempe/imagesplitter/imageprocessor"
+)
+
+// maxOutputWidths is the number of chunk sets a request can ask for
+const maxOutputWidths = 8
+
+// maxFallbackURLs bounds the mirrors of a source
+const maxFallbackURLs = 5
+
+// maxStripWidth bounds the width of the scroll preview strip
+const maxStripWidth = 1000
+
+// Output layouts of a request
+const (
+	// outputLayoutJob writes each job to a new directory, the default
+	outputLayoutJob = "job"
+	// outputLayoutFlat writes the jobs of an images_prefix to the same
+	// directory, named by the prefix
+	outputLayoutFlat = "flat"
+)
+
+// cropRegion is the part of the source a request wants split
+type cropRegion struct {
+	X      int `json:"x"`
+	Y      int `json:"y"`
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+// parseCropRegion parses the "x,y,width,height" form used by query parameters
+func parseCropRegion(value string) (*cropRegion, error) {
+	parts := strings.Split(value, ",")
+	if len(parts) != 4 {
+		return nil, errors.New("crop must be x,y,width,height")
+	}
+
+	var numbers [4]int
+	for i, part := range parts {
+		n, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil {
+			return nil, errors.New("crop must be x,y,width,height")
+		}
+		numbers[i] = n
+	}
+
+	return &cropRegion{X: numbers[0], Y: numbers[1], Width: numbers[2], Height: numbers[3]}, nil
+}
+
+// parseAspectRatio parses a "width:height" ratio such as "9:16", the zero
+// point when value is empty
+func parseAspectRatio(value string) (image.Point, error) {
+	if value == "" {
+		return image.Point{}, nil
+	}
+
+	width, height, found := strings.Cut(value, ":")
+	if !found {
+		return image.Point{}, errors.New("chunk_aspect must be width:height")
+	}
+
+	x, errX := strconv.Atoi(strings.TrimSpace(width))
+	y, errY := strconv.Atoi(strings.TrimSpace(height))
+	if errX != nil || errY != nil || x <= 0 || y <= 0 {
+		return image.Point{}, errors.New("chunk_aspect must be width:height with positive integers")
+	}
+
+	return image.Pt(x, y), nil
+}
+
+// parseHexColor parses a "#rrggbb" color, nil when value is empty
+func parseHexColor(value string) (color.Color, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	hex, found := strings.CutPrefix(value, "#")
+	if !found || len(hex) != 6 {
+		return nil, errors.New("colors must be #rrggbb")
+	}
+
+	rgb, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil {
+		return nil, errors.New("colors must be #rrggbb")
+	}
+
+	return color.RGBA{R: uint8(rgb >> 16), G: uint8(rgb >> 8), B: uint8(rgb), A: 0xFF}, nil
+}
+
+// rect returns the region as an image rectangle, empty when c is nil
+func (c *cropRegion) rect() image.Rectangle {
+	if c == nil {
+		return image.Rectangle{}
+	}
+	return image.Rect(c.X, c.Y, c.X+c.Width, c.Y+c.Height)
+}
+
+// sourceHeaderNames are the header names of --source-headers, swapped
+// atomically when the configuration is reloaded
+var sourceHeaderNames atomic.Pointer[[]string]
+
+// validateSourceHeaders checks that the extra headers of the source download
+// are allowed by --source-headers and fit in a header line
+func validateSourceHeaders(headers map[string]string) error {
+	allowed := *sourceHeaderNames.Load()
+
+	for name, value := range headers {
+		if !slices.ContainsFunc(allowed, func(allowedName string) bool {
+			return strings.EqualFold(allowedName, name)
+		}) {
+			return fmt.Errorf("header %q is not allowed", name)
+		}
+
+		if strings.ContainsAny(value, "\r\n\x00") {
+			return fmt.Errorf("header %q contains invalid characters", name)
+		}
+	}
+
+	return nil
+}
+
+// sourceHeaders returns the extra headers of the source download
+func sourceHeaders(headers map[string]string) http.Header {
+	if len(headers) == 0 {
+		return nil
+	}
+
+	header := make(http.Header, len(headers))
+	for name, value := range headers {
+		header.Set(name, value)
+	}
+	return header
+}
+
+// validateImageRequest records the failures of the fields shared by the split
+// and the image info requests
+func validateImageRequest(v *validator, req *ImageRequest) {
+	v.Check(req.URL != "", "url", "URL is required")
+
+	v.Check(len(req.FallbackURLs) <= maxFallbackURLs, "fallback_urls", fmt.Sprintf("at most %d fallback URLs are accepted", maxFallbackURLs))
+	v.Check(!slices.Contains(req.FallbackURLs, ""), "fallback_urls", "fallback URLs must not be empty")
+
+	if err := validateSourceHeaders(req.Headers); err != nil {
+		v.AddError("headers", err.Error())
+	}
+
+	// Names made of digits only are left to the job start times
+	if req.OutputName != "" {
+		validateName(v, "output_name", req.OutputName)
+		v.Check(strings.Trim(req.OutputName, "0123456789") != "", "output_name", "output_name cannot be only digits")
+	}
+
+	switch req.Layout {
+	case "", outputLayoutJob:
+	case outputLayoutFlat:
+		v.Check(req.ImagesPrefix != "", "images_prefix", "images_prefix is required with the flat layout")
+		v.Check(strings.Trim(req.ImagesPrefix, "0123456789") != "", "images_prefix", "images_prefix cannot be only digits with the flat layout")
+		v.Check(req.OutputName == "", "output_name", "output_name cannot be used with the flat layout")
+	default:
+		v.AddError("layout", "layout must be job or flat")
+	}
+
+	if req.ExpectedSHA256 != "" {
+		_, err := hex.DecodeString(req.ExpectedSHA256)
+		v.Check(err == nil && len(req.ExpectedSHA256) == 2*sha256.Size, "expected_sha256", "expected_sha256 must be a hex SHA-256 digest")
+	}
+
+	v.Check(req.MaxImages >= 0, "max_images", "max_images must be a positive integer")
+
+	validateImageOptions(v, req)
+}
+
+// validateImageOptions checks the options that change how the source is
+// transformed before it is split. Whether they fit the source is only known
+// once its header is read.
+func validateImageOptions(v *validator, req *ImageRequest) {
+	switch req.Rotate {
+	case 0, 90, 180, 270:
+	default:
+		v.AddError("rotate", "rotate must be 90, 180 or 270")
+	}
+
+	v.Check(req.Sharpen >= 0 && req.Sharpen <= imageprocessor.MaxSharpen,
+		"sharpen", fmt.Sprintf("sharpen must be between 0 and %d", imageprocessor.MaxSharpen))
+
+	switch req.ColorSpace {
+	case "", imageprocessor.ColorSpaceKeep, imageprocessor.ColorSpaceGrayscale, imageprocessor.ColorSpaceSRGB:
+	default:
+		v.AddError("colorspace", "colorspace must be keep, grayscale or srgb")
+	}
+
+	switch req.Format {
+	case "", imageprocessor.OutputFormatSource, imageprocessor.OutputFormatJPEG:
+	default:
+		v.AddError("format", "format must be source or jpeg")
+	}
+
+	if _, err := parseHexColor(req.Background); err != nil {
+		v.AddError("background", fmt.Sprintf("background: %v", err))
+	}
+
+	v.Check(req.Quality >= 0 && req.Quality <= 100, "quality", "quality must be between 1 and 100")
+
+	v.Check(req.PNGOptimize >= imageprocessor.PNGOptimizeNone && req.PNGOptimize <= imageprocessor.PNGOptimizePalette,
+		"png_optimize", "png_optimize must be 0, 1 or 2")
+
+	switch req.Subsampling {
+	case "", imageprocessor.Subsampling420, imageprocessor.Subsampling444:
+	default:
+		v.AddError("subsampling", "subsampling must be 4:2:0 or 4:4:4")
+	}
+
+	v.Check(req.BitDepth == 0 || req.BitDepth == 8, "bit_depth", "bit_depth must be 8")
+
+	v.Check(req.DPI >= 0 && req.DPI <= imageprocessor.MaxDPI,
+		"dpi", fmt.Sprintf("dpi must be between 0 and %d", imageprocessor.MaxDPI))
+
+	v.Check(req.SVGWidth >= 0 && req.SVGWidth <= imageprocessor.MaxSVGWidth,
+		"svg_width", fmt.Sprintf("svg_width must be between 0 and %d", imageprocessor.MaxSVGWidth))
+	v.Check(req.SVGDPI >= 0 && req.SVGDPI <= imageprocessor.MaxSVGDPI,
+		"svg_dpi", fmt.Sprintf("svg_dpi must be between 0 and %d", imageprocessor.MaxSVGDPI))
+	v.Check(req.SVGWidth <= 0 || req.SVGDPI <= 0, "svg_dpi", "svg_width and svg_dpi cannot be combined")
+
+	v.Check(req.TargetChunkBytes >= 0, "target_chunk_bytes", "target_chunk_bytes must be a positive integer")
+
+	switch req.SplitMode {
+	case "", imageprocessor.SplitModeFixed:
+	case imageprocessor.SplitModePanels:
+		v.Check(req.Preset == "", "split_mode", "split_mode panels cannot be combined with a preset")
+	default:
+		v.AddError("split_mode", "split_mode must be fixed or panels")
+	}
+
+	switch req.Preset {
+	case "":
+	case imageprocessor.PresetInstagram:
+		v.Check(!req.Verify, "verify", "verify cannot be combined with a preset")
+	default:
+		v.AddError("preset", "preset must be instagram")
+	}
+
+	v.Check(imageprocessor.ValidAnchor(req.Anchor), "anchor", "anchor must be left, center, right or a pixel offset")
+
+	switch req.Fit {
+	case "", imageprocessor.FitNone:
+	case imageprocessor.FitPad, imageprocessor.FitScale:
+		v.Check(req.Preset == "" && len(req.Widths) == 0, "fit", "fit cannot be combined with a preset or widths")
+	default:
+		v.AddError("fit", "fit must be none, pad or scale")
+	}
+
+	if _, err := parseAspectRatio(req.ChunkAspect); err != nil {
+		v.AddError("chunk_aspect", err.Error())
+	}
+	v.Check(req.ChunkAspect == "" || req.Preset == "", "chunk_aspect", "chunk_aspect cannot be combined with a preset")
+
+	v.Check(req.MaxPixels >= 0, "max_pixels", "max_pixels must be a positive integer")
+	v.Check(req.MaxPixels <= 0 || (req.SplitMode != imageprocessor.SplitModePanels && req.Preset == ""),
+		"max_pixels", "max_pixels cannot be combined with split_mode panels or a preset")
+
+	v.Check(len(req.Widths) <= maxOutputWidths, "widths", fmt.Sprintf("widths cannot have more than %d entries", maxOutputWidths))
+	for i, width := range req.Widths {
+		v.Check(width > 0, "widths", "widths must be positive integers")
+		v.Check(!slices.Contains(req.Widths[:i], width), "widths", fmt.Sprintf("width %d is repeated in widths", width))
+	}
+	v.Check(len(req.Widths) == 0 || (req.Preset == "" && !req.HTMLPreview && !req.DryRun),
+		"widths", "widths cannot be combined with a preset, html_preview or dry_run")
+
+	v.Check(req.StripWidth >= 0 && req.StripWidth <= maxStripWidth,
+		"strip_width", fmt.Sprintf("strip_width must be between 0 and %d", maxStripWidth))
+
+	if _, err := parseHexColor(req.PadColor); err != nil {
+		v.AddError("pad_color", fmt.Sprintf("pad_color: %v", err))
+	}
+
+	if req.Crop != nil {
+		v.Check(req.Crop.X >= 0 && req.Crop.Y >= 0, "crop", "crop x and y cannot be negative")
+		v.Check(req.Crop.Width > 0 && req.Crop.Height > 0, "crop", "crop width and height must be greater than zero")
+	}
+}
+
+// defaultImageRequest returns the request the fields of a split or image
+// info request are read into, so the omitted ones keep the --default-* values
+func defaultImageRequest() ImageRequest {
+	return ImageRequest{
+		Width:     cfg.defaults.width,
+		MaxImages: cfg.defaults.maxImages,
+		Quality:   cfg.defaults.quality,
+	}
+}
+
+// defaultImageRequestV2 is defaultImageRequest for the v2 requests
+func defaultImageRequestV2() ImageRequestV2 {
+	var req ImageRequestV2
+	req.Split.Width = cfg.defaults.width
+	req.Split.MaxImages = cfg.defaults.maxImages
+	req.Output.Quality = cfg.defaults.quality
+	return req
+}
+
+// newProcessor returns the processor of a request of tenant t
+func newProcessor(t *tenant, req *ImageRequest) imageprocessor.Processor {
+	// Validated by validateImageOptions
+	padColor, _ := parseHexColor(req.PadColor)
+	background, _ := parseHexColor(req.Background)
+	chunkAspect, _ := parseAspectRatio(req.ChunkAspect)
+
+	// The mirrors are relative to the URL host like the source
+	var fallbackURLs []string
+	for _, fallback := range req.FallbackURLs {
+		fallbackURLs = append(fallbackURLs, t.URLHost+fallback)
+	}
+
+	outputName, outputCollision := req.OutputName, cfg.outputNameCollision
+	if req.Layout == outputLayoutFlat {
+		outputName, outputCollision = req.ImagesPrefix, imageprocessor.OutputCollisionOverwrite
+	}
+
+	return imageprocessor.Processor{
+		OutputBaseDir:        t.outputPath,
+		OutputName:           outputName,
+		OutputCollision:      outputCollision,
+		ContentAddressed:     cfg.contentAddressed,
+		TempDir:              cfg.tempPath,
+		InMemory:             cfg.inMemory,
+		MemoryBudget:         cfg.memoryBudget,
+		ZipUploader:          t.zipUploader(),
+		ChunkUploader:        t.chunkUploader(),
+		MaxConcurrentUploads: cfg.s3.uploadConcurrency,
+		MaxHeight:            cfg.maxHeight,
+		UseCLI:               cfg.useCLI,
+		Backend:              cfg.backend,
+		Capabilities:         capabilities,
+		JPEGEncoder:          cfg.jpegEncoder,
+		CJPEGPath:            cfg.cjpegPath,
+		RSVGConvertPath:      cfg.rsvgConvertPath,
+		MaxSourcePixels:      cfg.maxSourcePixels,
+		MaxChunks:            cfg.maxChunks,
+		DecodeTimeout:        cfg.decodeTimeout,
+		Downloads:            downloadSlots,
+		Circuits:             sourceCircuits,
+		HTTPClient:           fetchClient,
+		FetchOptions:         fetchOptions,
+		SourceHeaders:        sourceHeaders(req.Headers),
+		Encodes:              encodeSlots,
+		SVGWidth:             req.SVGWidth,
+		SVGDPI:               req.SVGDPI,
+		Rotate:               req.Rotate,
+		Sharpen:              req.Sharpen,
+		ConvertSRGB:          req.ConvertSRGB,
+		ColorSpace:           req.ColorSpace,
+		OutputFormat:         req.Format,
+		Background:           background,
+		Quality:              req.Quality,
+		PNGOptimize:          req.PNGOptimize,
+		TargetChunkBytes:     int64(req.TargetChunkBytes),
+		Subsampling:          req.Subsampling,
+		BitDepth:             req.BitDepth,
+		DPI:                  req.DPI,
+		Crop:                 req.Crop.rect(),
+		Verify:               req.Verify,
+		SkipBlank:            req.SkipBlank,
+		Dedupe:               req.Dedupe,
+		ContactSheet:         req.ContactSheet,
+		StripWidth:           req.StripWidth,
+		SplitMode:            req.SplitMode,
+		ChunkAspect:          chunkAspect,
+		Anchor:               req.Anchor,
+		Fit:                  req.Fit,
+		MaxPixels:            req.MaxPixels,
+		Preset:               req.Preset,
+		PadColor:             padColor,
+		ExpectedSHA256:       req.ExpectedSHA256,
+		FallbackURLs:         fallbackURLs,
+		HTMLPreview:          req.HTMLPreview,
+		OutputWidths:         req.Widths,
+	}
+}
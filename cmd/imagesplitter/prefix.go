@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/jempe/imagesplitter/imageprocessor"
+)
+
+// defaultMaxPrefixLength leaves room in a 255 byte file name for the longest
+// suffixes, e.g. _w1600_contact.jpg, and the temporary files
+const defaultMaxPrefixLength = 200
+
+// defaultPrefixChars is the character class of --prefix-chars, the
+// characters of allowedPrefixChars
+const defaultPrefixChars = "[A-Za-z0-9_]"
+
+// prefixCharPattern matches one character allowed in images_prefix and
+// output_name, compiled from --prefix-chars
+var prefixCharPattern = regexp.MustCompile("^" + defaultPrefixChars + "$")
+
+// compilePrefixChars compiles the character class of --prefix-chars
+func compilePrefixChars(class string) (*regexp.Regexp, error) {
+	pattern, err := regexp.Compile("^(?:" + class + ")$")
+	if err != nil {
+		return nil, fmt.Errorf("invalid prefix chars: %v", err)
+	}
+	return pattern, nil
+}
+
+// prefixCharAllowed reports whether char may appear in images_prefix. The
+// path separators never may, whatever --prefix-chars allows.
+func prefixCharAllowed(char rune) bool {
+	if char == '/' || char == '\\' || char == 0 {
+		return false
+	}
+	return prefixCharPattern.MatchString(string(char))
+}
+
+// invalidPrefixChar returns the first character of name not allowed in
+// images_prefix and whether there is one
+func invalidPrefixChar(name string) (rune, bool) {
+	for _, char := range name {
+		if !prefixCharAllowed(char) {
+			return char, true
+		}
+	}
+	return 0, false
+}
+
+// prefixCharsMessage describes the characters allowed in images_prefix
+func prefixCharsMessage() string {
+	if cfg.prefixChars == defaultPrefixChars {
+		return "only letters, digits and underscores are allowed"
+	}
+	return "only the characters of " + cfg.prefixChars + " are allowed"
+}
+
+// reservedPrefixes are the names of the files stored next to the chunks, an
+// images_prefix taking one of them would collide with them. manifest is
+// kept for a job manifest.
+var reservedPrefixes = append(slices.Clone(imageprocessor.ReservedNames), "metadata", "manifest")
+
+// validatePrefix checks images_prefix against the length limits, the allowed
+// characters and the reserved names, each with its own message
+func validatePrefix(v *validator, prefix string) {
+	validateName(v, "images_prefix", prefix)
+}
+
+// validateName checks the images_prefix or output_name name of the field key
+// like validatePrefix
+func validateName(v *validator, key string, name string) {
+	length := utf8.RuneCountInString(name)
+	v.Check(length >= cfg.prefixMinLength, key, fmt.Sprintf("%s must be at least %d characters long", key, cfg.prefixMinLength))
+	v.Check(length <= cfg.prefixMaxLength, key, fmt.Sprintf("%s must be at most %d characters long", key, cfg.prefixMaxLength))
+
+	if char, ok := invalidPrefixChar(name); ok {
+		v.AddError(key, fmt.Sprintf("%s contains %q, %s", key, char, prefixCharsMessage()))
+	}
+	// Nor "." and "..", nor hidden files
+	v.Check(!strings.HasPrefix(name, "."), key, fmt.Sprintf("%s cannot start with a dot", key))
+
+	for _, reserved := range reservedPrefixes {
+		v.Check(!strings.EqualFold(name, reserved), key, fmt.Sprintf("%s cannot be %q, the name of a file stored with the chunks", key, reserved))
+	}
+}
+
+// transliterations spell the common Latin letters with accents and ligatures
+// in ASCII, the other characters outside --prefix-chars become separators
+var transliterations = map[rune]string{
+	'à': "a", 'á': "a", 'â': "a", 'ã': "a", 'ä': "a", 'å': "a", 'ā': "a", 'ă': "a", 'ą': "a",
+	'æ': "ae", 'ç': "c", 'ć': "c", 'č': "c", 'ĉ': "c", 'ċ': "c", 'ď': "d", 'đ': "d", 'ð': "d",
+	'è': "e", 'é': "e", 'ê': "e", 'ë': "e", 'ē': "e", 'ė': "e", 'ę': "e", 'ě': "e",
+	'ğ': "g", 'ĝ': "g", 'ģ': "g", 'ĥ': "h", 'ħ': "h",
+	'ì': "i", 'í': "i", 'î': "i", 'ï': "i", 'ī': "i", 'į': "i", 'ı': "i", 'ĵ': "j", 'ķ': "k",
+	'ĺ': "l", 'ļ': "l", 'ľ': "l", 'ł': "l", 'ñ': "n", 'ń': "n", 'ņ': "n", 'ň': "n",
+	'ò': "o", 'ó': "o", 'ô': "o", 'õ': "o", 'ö': "o", 'ø': "o", 'ō': "o", 'ő': "o", 'œ': "oe",
+	'ŕ': "r", 'ř': "r", 'ś': "s", 'ŝ': "s", 'ş': "s", 'š': "s", 'ș': "s", 'ß': "ss",
+	'ţ': "t", 'ť': "t", 'ț': "t", 'þ': "th",
+	'ù': "u", 'ú': "u", 'û': "u", 'ü': "u", 'ū': "u", 'ŭ': "u", 'ů': "u", 'ű': "u", 'ų': "u",
+	'ŵ': "w", 'ý': "y", 'ÿ': "y", 'ŷ': "y", 'ź': "z", 'ż': "z", 'ž': "z",
+}
+
+// slugifyPrefix turns a title into an images_prefix, see --normalize-prefix:
+// it is lowercased and transliterated, and every run of other characters,
+// e.g. spaces, becomes a single underscore. The result is cut to
+// --prefix-max-length.
+func slugifyPrefix(title string) string {
+	var b strings.Builder
+	separator := false
+	for _, char := range strings.ToLower(title) {
+		replacement, ok := transliterations[char]
+		if !ok && prefixCharAllowed(char) && char != '_' {
+			replacement, ok = string(char), true
+		}
+		if !ok {
+			separator = b.Len() > 0
+			continue
+		}
+
+		if separator {
+			b.WriteRune('_')
+			separator = false
+		}
+		b.WriteString(replacement)
+	}
+
+	// Cut by characters like validatePrefix counts them, --prefix-chars may
+	// allow multi-byte ones
+	slug := []rune(b.String())
+	if len(slug) > cfg.prefixMaxLength {
+		slug = slug[:cfg.prefixMaxLength]
+	}
+	return strings.TrimRight(string(slug), "_")
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// proxyList is the parsed --trusted-proxies
+type proxyList struct {
+	list     string
+	networks []*net.IPNet
+}
+
+// trustedProxies holds the networks whose forwarding headers are honored,
+// swapped atomically when the configuration is reloaded. Requests from any
+// other address are attributed to their peer address.
+var trustedProxies atomic.Pointer[proxyList]
+
+// parseTrustedProxies parses a comma separated list of IP addresses and CIDR
+// ranges, e.g. "10.0.0.0/8, 192.168.1.10"
+func parseTrustedProxies(list string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy address %q", entry)
+			}
+
+			bits := 128
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy range %q", entry)
+		}
+		networks = append(networks, network)
+	}
+
+	return networks, nil
+}
+
+// isTrustedProxy reports whether ip belongs to one of the trusted proxies
+func isTrustedProxy(ip net.IP) bool {
+	for _, network := range trustedProxies.Load().networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientInfo is the origin of a request once the trusted proxies are accounted for
+type clientInfo struct {
+	IP     string
+	Scheme string
+}
+
+// resolveClient returns the client address and scheme of r. X-Forwarded-For is
+// walked from right to left, skipping trusted proxies, so a client cannot
+// spoof its address by sending the header itself. X-Forwarded-Proto is only
+// used when the peer is a trusted proxy.
+func resolveClient(r *http.Request) clientInfo {
+	client := clientInfo{
+		IP:     r.RemoteAddr,
+		Scheme: "http",
+	}
+
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		client.IP = host
+	}
+
+	if r.TLS != nil {
+		client.Scheme = "https"
+	}
+
+	peer := net.ParseIP(client.IP)
+	if peer == nil || !isTrustedProxy(peer) {
+		return client
+	}
+
+	if proto := strings.ToLower(strings.TrimSpace(r.Header.Get("X-Forwarded-Proto"))); proto == "http" || proto == "https" {
+		client.Scheme = proto
+	}
+
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(hops[i]))
+		if ip == nil {
+			// A malformed entry ends the chain we can trust
+			break
+		}
+
+		client.IP = ip.String()
+		if !isTrustedProxy(ip) {
+			break
+		}
+	}
+
+	return client
+}
+
+// realClient is a middleware storing the resolved client of the request in its context
+func realClient(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, contextSetClient(r, resolveClient(r)))
+	})
+}
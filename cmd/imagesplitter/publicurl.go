@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/jempe/imagesplitter/imageprocessor"
+)
+
+// validatePublicBaseURL checks that the public base URL is an http(s) URL
+// ending with a slash, like the url host
+func validatePublicBaseURL(baseURL string) error {
+	if !(strings.HasPrefix(baseURL, "http://") || strings.HasPrefix(baseURL, "https://")) {
+		return errors.New("public base url must start with http:// or https://")
+	}
+
+	if !strings.HasSuffix(baseURL, "/") {
+		return errors.New("public base url must end with a slash")
+	}
+
+	return nil
+}
+
+// publicURL returns the absolute URL of a file generated for tenant t, given
+// as an absolute path or relative to the tenant output root. The base URL
+// serves file-path, so the tenant output directory is part of the URL. The
+// URLs of uploaded files are returned as is.
+func (t *tenant) publicURL(file string) string {
+	if file == "" || strings.HasPrefix(file, "http://") || strings.HasPrefix(file, "https://") {
+		return file
+	}
+
+	if filepath.IsAbs(file) {
+		if rel, err := filepath.Rel(t.outputPath, file); err == nil {
+			file = rel
+		}
+	}
+
+	tenantDir, err := filepath.Rel(cfg.filePath, t.outputPath)
+	if err != nil {
+		tenantDir = ""
+	}
+
+	filePath := path.Join(filepath.ToSlash(tenantDir), filepath.ToSlash(file))
+	return cfg.publicBaseURL + (&url.URL{Path: filePath}).EscapedPath()
+}
+
+// setPublicURLs rewrites the paths of a split response of tenant t as
+// absolute URLs when a public base URL is configured
+func setPublicURLs(t *tenant, result *imageprocessor.ImageResponse) {
+	if cfg.publicBaseURL == "" {
+		return
+	}
+
+	publicURLs := func(files []string) []string {
+		urls := make([]string, len(files))
+		for i, file := range files {
+			urls[i] = t.publicURL(file)
+		}
+		return urls
+	}
+
+	result.ZipURL = t.publicURL(result.ZipURL)
+	result.Images = publicURLs(result.Images)
+	result.OriginalImage = t.publicURL(result.OriginalImage)
+	result.ContactSheet = t.publicURL(result.ContactSheet)
+	result.Strip = t.publicURL(result.Strip)
+
+	for i := range result.Sets {
+		result.Sets[i].Images = publicURLs(result.Sets[i].Images)
+		result.Sets[i].ContactSheet = t.publicURL(result.Sets[i].ContactSheet)
+	}
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/jempe/imagesplitter/imageprocessor"
+)
+
+// diskUsage tracks the bytes stored below file-path, globally and per tenant
+type diskUsage struct {
+	mu       sync.Mutex
+	total    int64
+	byTenant map[string]int64
+}
+
+var usage = &diskUsage{byTenant: make(map[string]int64)}
+
+// add records n bytes written for the tenant
+func (u *diskUsage) add(tenantID string, n int64) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.total += n
+	u.byTenant[tenantID] += n
+}
+
+// set records the bytes stored by the tenant, counted from the disk
+func (u *diskUsage) set(tenantID string, n int64) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.byTenant[tenantID] = n
+}
+
+// get returns the global usage and the usage of the tenant
+func (u *diskUsage) get(tenantID string) (int64, int64) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return u.total, u.byTenant[tenantID]
+}
+
+// scanDiskUsage seeds the usage counters from what is already on disk, so
+// quotas survive restarts
+func scanDiskUsage() error {
+	total, err := dirSize(cfg.filePath)
+	if err != nil {
+		return err
+	}
+
+	usage.mu.Lock()
+	defer usage.mu.Unlock()
+
+	usage.total = total
+	usage.byTenant[defaultTenant.ID] = total
+
+	if reg := tenants.Load(); reg != nil {
+		for _, t := range reg.tenants {
+			size, err := dirSize(t.outputPath)
+			if err != nil {
+				return err
+			}
+			usage.byTenant[t.ID] = size
+		}
+	}
+
+	return nil
+}
+
+// checkDiskQuota returns an error describing why a new job for t must be
+// refused, or nil when the job fits in the configured quotas
+func checkDiskQuota(t *tenant) error {
+	total, tenantBytes := usage.get(t.ID)
+
+	if cfg.diskQuota > 0 && total >= cfg.diskQuota {
+		return fmt.Errorf("global disk quota of %s exceeded", formatByteSize(cfg.diskQuota))
+	}
+
+	if t.Quota.MaxBytes > 0 && tenantBytes >= t.Quota.MaxBytes {
+		return fmt.Errorf("tenant disk quota of %s exceeded", formatByteSize(t.Quota.MaxBytes))
+	}
+
+	if cfg.minFreeDisk > 0 {
+		free, err := freeDiskSpace(cfg.filePath)
+		if err != nil {
+			logger.PrintError(err, nil)
+		} else if int64(free) < cfg.minFreeDisk {
+			return fmt.Errorf("free disk space is below the minimum of %s", formatByteSize(cfg.minFreeDisk))
+		}
+	}
+
+	return nil
+}
+
+// diskReservations are the bytes the running jobs are expected to write,
+// which the free space of the volume does not reflect yet
+var diskReservations struct {
+	mu    sync.Mutex
+	bytes int64
+}
+
+// estimateJobBytes returns the bytes a job is expected to write: the source,
+// the chunks and the zip, which stores the chunks as they are
+func estimateJobBytes(plan imageprocessor.SplitPlan, createZip bool) int64 {
+	required := plan.SourceBytes + plan.EstimatedTotalBytes
+	if createZip {
+		required += plan.EstimatedTotalBytes
+	}
+	return required
+}
+
+// reserveDiskSpace reserves the estimated bytes of a job when the volume
+// of file-path has room for them, on top of --min-free-disk and the other
+// running jobs. It returns the function releasing the reservation.
+func reserveDiskSpace(required int64) (func(), error) {
+	free, err := freeDiskSpace(cfg.filePath)
+	if err != nil {
+		// The job still runs where free space cannot be read
+		logger.PrintError(err, nil)
+		return func() {}, nil
+	}
+
+	diskReservations.mu.Lock()
+	defer diskReservations.mu.Unlock()
+
+	available := int64(free) - cfg.minFreeDisk - diskReservations.bytes
+	if required > available {
+		return nil, fmt.Errorf("not enough free disk space for the job: it needs about %s, %s is available",
+			formatApproxByteSize(required), formatApproxByteSize(max(available, 0)))
+	}
+
+	diskReservations.bytes += required
+	return func() {
+		diskReservations.mu.Lock()
+		defer diskReservations.mu.Unlock()
+		diskReservations.bytes -= required
+	}, nil
+}
+
+// quotaReservations are the bytes the running jobs are expected to add to
+// the disk quotas, globally and per tenant
+var quotaReservations = struct {
+	mu       sync.Mutex
+	total    int64
+	byTenant map[string]int64
+}{byTenant: make(map[string]int64)}
+
+// hasDiskQuota reports whether a job of t is bounded by a disk quota
+func hasDiskQuota(t *tenant) bool {
+	return cfg.diskQuota > 0 || t.Quota.MaxBytes > 0
+}
+
+// reserveDiskQuota reserves the estimated bytes of a job of t when they fit
+// in the global and the tenant disk quotas, on top of the bytes stored and
+// the other running jobs. It returns the function releasing the reservation.
+func reserveDiskQuota(t *tenant, required int64) (func(), error) {
+	total, tenantBytes := usage.get(t.ID)
+
+	quotaReservations.mu.Lock()
+	defer quotaReservations.mu.Unlock()
+
+	if cfg.diskQuota > 0 {
+		left := cfg.diskQuota - total - quotaReservations.total
+		if required > left {
+			return nil, fmt.Errorf("global disk quota of %s would be exceeded: the job needs about %s, %s is left",
+				formatByteSize(cfg.diskQuota), formatApproxByteSize(required), formatApproxByteSize(max(left, 0)))
+		}
+	}
+
+	if t.Quota.MaxBytes > 0 {
+		left := t.Quota.MaxBytes - tenantBytes - quotaReservations.byTenant[t.ID]
+		if required > left {
+			return nil, fmt.Errorf("tenant disk quota of %s would be exceeded: the job needs about %s, %s is left",
+				formatByteSize(t.Quota.MaxBytes), formatApproxByteSize(required), formatApproxByteSize(max(left, 0)))
+		}
+	}
+
+	quotaReservations.total += required
+	quotaReservations.byTenant[t.ID] += required
+	return func() {
+		quotaReservations.mu.Lock()
+		defer quotaReservations.mu.Unlock()
+		quotaReservations.total -= required
+		quotaReservations.byTenant[t.ID] -= required
+	}, nil
+}
+
+// dirSize returns the total size of the regular files below path
+func dirSize(path string) (int64, error) {
+	var size int64
+
+	err := filepath.WalkDir(path, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if d.Type().IsRegular() {
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			size += info.Size()
+		}
+
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to compute disk usage: %v", err)
+	}
+
+	return size, nil
+}
+
+var byteSizeUnits = []struct {
+	suffix string
+	factor int64
+}{
+	{"TB", 1 << 40},
+	{"GB", 1 << 30},
+	{"MB", 1 << 20},
+	{"KB", 1 << 10},
+	{"B", 1},
+}
+
+// parseByteSize parses sizes such as "512MB", "10GB" or a plain number of bytes
+func parseByteSize(value string) (int64, error) {
+	value = strings.ToUpper(strings.TrimSpace(value))
+
+	factor := int64(1)
+	for _, unit := range byteSizeUnits {
+		if strings.HasSuffix(value, unit.suffix) {
+			factor = unit.factor
+			value = strings.TrimSpace(strings.TrimSuffix(value, unit.suffix))
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid byte size %q", value)
+	}
+
+	return n * factor, nil
+}
+
+// formatByteSize formats n with the largest unit that divides it evenly
+func formatByteSize(n int64) string {
+	for _, unit := range byteSizeUnits {
+		if n >= unit.factor && n%unit.factor == 0 {
+			return fmt.Sprintf("%d%s", n/unit.factor, unit.suffix)
+		}
+	}
+	return fmt.Sprintf("%dB", n)
+}
+
+// formatApproxByteSize formats n with the largest unit not above it and one
+// decimal, e.g. 1.5GB
+func formatApproxByteSize(n int64) string {
+	for _, unit := range byteSizeUnits {
+		if n >= unit.factor && unit.factor > 1 {
+			return strconv.FormatFloat(float64(n)/float64(unit.factor), 'f', 1, 64) + unit.suffix
+		}
+	}
+	return fmt.Sprintf("%dB", n)
+}
+
+// byteSizeValue is a flag.Value holding a size parsed by parseByteSize
+type byteSizeValue struct {
+	target *int64
+}
+
+func (v byteSizeValue) String() string {
+	if v.target == nil || *v.target == 0 {
+		return "0"
+	}
+	return formatByteSize(*v.target)
+}
+
+func (v byteSizeValue) Set(value string) error {
+	n, err := parseByteSize(value)
+	if err != nil {
+		return err
+	}
+	*v.target = n
+	return nil
+}
+
+// flatOutputs are the flat layout directories being replaced by a job, and
+// the output_name directories being resumed
+var flatOutputs sync.Map
+
+// claimFlatOutput reserves the flat layout directory of prefix for one job of
+// tenant t and returns its release and the size of the output it replaces.
+// The next job of the prefix is refused with ErrOutputExists meanwhile.
+func claimFlatOutput(t *tenant, prefix string) (func(), int64, error) {
+	dir := filepath.Join(t.outputPath, prefix)
+	if _, busy := flatOutputs.LoadOrStore(dir, struct{}{}); busy {
+		return nil, 0, fmt.Errorf("%w: %s is being replaced by a running job", imageprocessor.ErrOutputExists, prefix)
+	}
+
+	// A first split has nothing to replace
+	replaced, err := dirSize(dir)
+	if err != nil {
+		replaced = 0
+	}
+
+	return func() { flatOutputs.Delete(dir) }, replaced, nil
+}
+
+// claimOutputName reserves the output_name directory resumed by a job of
+// tenant t and returns its release. The next job of the name is refused
+// with ErrOutputExists meanwhile.
+func claimOutputName(t *tenant, name string) (func(), error) {
+	dir := filepath.Join(t.outputPath, name)
+	if _, busy := flatOutputs.LoadOrStore(dir, struct{}{}); busy {
+		return nil, fmt.Errorf("%w: %s is being written by a running job", imageprocessor.ErrOutputExists, name)
+	}
+	return func() { flatOutputs.Delete(dir) }, nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// rateLimiter applies a token bucket per client IP using the rate limit
+// settings, which may change at runtime
+type rateLimiter struct {
+	mu      sync.Mutex
+	clients map[string]*rateLimitClient
+}
+
+type rateLimitClient struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+func newRateLimiter() *rateLimiter {
+	rl := &rateLimiter{
+		clients: make(map[string]*rateLimitClient),
+	}
+
+	// Forget clients that have not been seen for a while
+	go func() {
+		for {
+			time.Sleep(time.Minute)
+
+			rl.mu.Lock()
+			for ip, client := range rl.clients {
+				if time.Since(client.lastSeen) > 3*time.Minute {
+					delete(rl.clients, ip)
+				}
+			}
+			rl.mu.Unlock()
+		}
+	}()
+
+	return rl
+}
+
+// allow reports whether the client at ip may make another request now
+func (rl *rateLimiter) allow(ip string, rps float64, burst int) bool {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	client, found := rl.clients[ip]
+	if !found {
+		client = &rateLimitClient{
+			limiter: rate.NewLimiter(rate.Limit(rps), burst),
+		}
+		rl.clients[ip] = client
+	}
+
+	// Pick up limits changed through the admin API
+	if client.limiter.Limit() != rate.Limit(rps) {
+		client.limiter.SetLimit(rate.Limit(rps))
+	}
+	if client.limiter.Burst() != burst {
+		client.limiter.SetBurst(burst)
+	}
+
+	client.lastSeen = time.Now()
+
+	return client.limiter.Allow()
+}
+
+// rateLimit is a middleware rejecting clients that exceed the configured rate
+func (rl *rateLimiter) rateLimit(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s := settings.Load()
+		if !s.RateLimitEnabled {
+			next(w, r)
+			return
+		}
+
+		if !rl.allow(contextGetClient(r).IP, s.RateLimitRPS, s.RateLimitBurst) {
+			errMessage := map[string]string{
+				"error": "rate limit exceeded",
+			}
+			apiResponse(w, http.StatusTooManyRequests, errMessage)
+			return
+		}
+
+		next(w, r)
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/jempe/imagesplitter/imageprocessor"
+)
+
+// Policies of the jobs interrupted by a crash, see --recover-jobs
+const (
+	// recoverJobsFail marks the interrupted jobs failed and removes their
+	// partial output
+	recoverJobsFail = "fail"
+	// recoverJobsRetry runs the interrupted jobs again, one at a time and
+	// each in a job slot, into their output directory
+	recoverJobsRetry = "retry"
+)
+
+// errJobInterrupted fails the jobs that were running when the server stopped
+var errJobInterrupted = errors.New("job interrupted by a server restart")
+
+// recoverJobs cleans up after the jobs left processing by a crash, before
+// the server accepts new jobs: the scratch directories of --temp-path and the
+// staging directories of the flat outputs are removed, and the recorded jobs
+// are failed or run again per --recover-jobs
+func recoverJobs() {
+	if cfg.tempPath != "" {
+		cleanTempPath(cfg.tempPath)
+	}
+	cleanOverwriteDirs()
+
+	if jobHistory == nil {
+		return
+	}
+
+	records, err := jobHistory.interrupted()
+	if err != nil {
+		logger.PrintError(err, nil)
+		return
+	}
+
+	var retries []*jobRecord
+	for i := range records {
+		record := &records[i]
+
+		t := recordTenant(record.Tenant)
+		if t == nil || cfg.recoverJobs != recoverJobsRetry || record.Recovered {
+			failInterruptedJob(t, record, errJobInterrupted)
+			continue
+		}
+		retries = append(retries, record)
+	}
+
+	if len(retries) > 0 {
+		logger.PrintInfo("retrying the interrupted jobs", map[string]string{
+			"jobs": fmt.Sprintf("%d", len(retries)),
+		})
+		go retryInterruptedJobs(retries)
+	}
+}
+
+// cleanTempPath removes the scratch directories of the jobs of dir, nothing
+// else runs yet
+func cleanTempPath(dir string) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		logger.PrintError(fmt.Errorf("failed to read temp path: %v", err), nil)
+		return
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() || !(strings.HasPrefix(entry.Name(), "job-") || strings.HasPrefix(entry.Name(), "encode-")) {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(dir, entry.Name())); err != nil {
+			logger.PrintError(fmt.Errorf("failed to remove a scratch directory: %v", err), nil)
+		}
+	}
+}
+
+// cleanOverwriteDirs removes the staging directories of the jobs replacing a
+// flat output of every tenant, nothing else runs yet
+func cleanOverwriteDirs() {
+	outputs := []string{defaultTenant.outputPath}
+	if reg := tenants.Load(); reg != nil {
+		for _, t := range reg.tenants {
+			outputs = append(outputs, t.outputPath)
+		}
+	}
+
+	for _, outputPath := range outputs {
+		entries, err := os.ReadDir(outputPath)
+		if err != nil {
+			continue
+		}
+
+		for _, entry := range entries {
+			if !entry.IsDir() || !strings.HasPrefix(entry.Name(), imageprocessor.OverwriteDirPrefix) {
+				continue
+			}
+			if err := os.RemoveAll(filepath.Join(outputPath, entry.Name())); err != nil {
+				logger.PrintError(fmt.Errorf("failed to remove a staging directory: %v", err), nil)
+			}
+		}
+	}
+}
+
+// recordTenant returns the tenant of a recorded job, nil when it no longer
+// exists
+func recordTenant(id string) *tenant {
+	reg := tenants.Load()
+	if reg == nil {
+		if id == defaultTenant.ID {
+			return defaultTenant
+		}
+		return nil
+	}
+
+	for _, t := range reg.tenants {
+		if t.ID == id {
+			return t
+		}
+	}
+	return nil
+}
+
+// failInterruptedJob marks record failed with jobErr and removes its partial
+// output, unless the next job of its output_name resumes it. The directory of
+// a flat job holds the previous output, its partial one was staged. t is nil
+// when the tenant no longer exists.
+func failInterruptedJob(t *tenant, record *jobRecord, jobErr error) {
+	resumable := record.Request.OutputName != "" && cfg.outputNameCollision == imageprocessor.OutputCollisionResume
+	flat := record.Request.Layout == outputLayoutFlat
+	if t != nil && record.OutputDir != "" && !resumable && !flat {
+		if err := os.RemoveAll(filepath.Join(t.outputPath, record.OutputDir)); err != nil {
+			logger.PrintError(fmt.Errorf("failed to remove the output of an interrupted job: %v", err), nil)
+		}
+	}
+
+	if err := jobHistory.finish(record, nil, jobErr); err != nil {
+		logger.PrintError(err, nil)
+	}
+
+	logger.PrintWarning("interrupted job marked as failed", map[string]string{
+		"tenant": record.Tenant,
+		"job":    record.ID,
+		"url":    record.Request.URL,
+		"error":  jobErr.Error(),
+	})
+}
+
+// retryInterruptedJobs runs the recorded jobs again in order, each in a job
+// slot so they count against --max-concurrent-jobs and a shutdown waits for
+// them. A job whose output directory was created writes to it again and keeps
+// the chunks its first run recorded, see OutputCollisionResume. The retries
+// stop once a shutdown starts, the rest run at the next startup.
+func retryInterruptedJobs(records []*jobRecord) {
+	for i, record := range records {
+		releaseJob := waitForJobSlot(jobsCtx)
+		if releaseJob == nil {
+			logger.PrintInfo("interrupted job retries stopped by the shutdown", map[string]string{
+				"jobs": fmt.Sprintf("%d", len(records)-i),
+			})
+			return
+		}
+
+		retryInterruptedJob(recordTenant(record.Tenant), record)
+		releaseJob()
+	}
+}
+
+// waitForJobSlot takes a job slot, waiting out the refusals of a full queue
+// until ctx is done, when it returns nil
+func waitForJobSlot(ctx context.Context) func() {
+	for ctx.Err() == nil {
+		releaseJob, retryAfter := jobs.acquire(ctx)
+		if releaseJob != nil {
+			return releaseJob
+		}
+
+		select {
+		case <-time.After(max(retryAfter, time.Second)):
+		case <-ctx.Done():
+		}
+	}
+	return nil
+}
+
+func retryInterruptedJob(t *tenant, record *jobRecord) {
+	record.Recovered = true
+	if err := jobHistory.save(record); err != nil {
+		logger.PrintError(err, nil)
+	}
+
+	req := &record.Request
+	imageURL := t.URLHost + req.URL
+
+	// A request without metadata is recorded with a null one
+	if string(req.Metadata) == "null" {
+		req.Metadata = nil
+	}
+
+	processor := newProcessor(t, req)
+	if record.OutputDir != "" {
+		release, err := claimOutputName(t, record.OutputDir)
+		if err != nil {
+			failInterruptedJob(nil, record, err)
+			return
+		}
+		defer release()
+
+		processor.OutputName = record.OutputDir
+		processor.OutputCollision = imageprocessor.OutputCollisionResume
+	}
+
+	events := newJobEvents(t, imageURL, record)
+	hooks := newJobHooks(t, imageURL, record)
+	hooks.attach(&processor)
+	events.observe(&processor)
+	watchOutputDir(t, record, &processor)
+
+	timeout := cfg.jobTimeout
+	if req.TimeoutSeconds > 0 {
+		timeout = time.Duration(req.TimeoutSeconds) * time.Second
+	}
+	ctx, cancel := context.WithTimeout(jobsCtx, timeout)
+	defer cancel()
+
+	events.started()
+	result, err := processor.ProcessImageContext(ctx, imageURL, req.ImagesPrefix, req.Width, req.MaxImages, req.CreateZip)
+	if err == nil {
+		err = hooks.finish(ctx, &result)
+	}
+	if err != nil && jobsCtx.Err() != nil {
+		// Stopped by a shutdown rather than interrupted again, so the next
+		// startup retries it
+		record.Recovered = false
+		if err := jobHistory.save(record); err != nil {
+			logger.PrintError(err, nil)
+		}
+
+		logger.PrintInfo("interrupted job retry stopped by the shutdown", map[string]string{
+			"tenant": t.ID,
+			"job":    record.ID,
+			"url":    imageURL,
+		})
+		return
+	}
+	if err != nil {
+		failInterruptedJob(t, record, err)
+		events.failed(err)
+		return
+	}
+
+	if len(req.Metadata) > 0 {
+		if err := writeJobMetadata(result.OutputDir, req.Metadata); err != nil {
+			logger.PrintError(err, nil)
+		}
+	}
+
+	if written, err := dirSize(result.OutputDir); err != nil {
+		logger.PrintError(err, nil)
+	} else {
+		usage.add(t.ID, written)
+	}
+
+	setPublicURLs(t, &result)
+	finishJob(record, &result, nil)
+	events.completed(&result)
+
+	logger.PrintInfo("interrupted job retried", map[string]string{
+		"tenant": t.ID,
+		"job":    record.ID,
+		"url":    imageURL,
+	})
+}
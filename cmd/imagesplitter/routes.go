@@ -0,0 +1,35 @@
+package main
+
+import "net/http"
+
+func routes() http.Handler {
+	mux := http.NewServeMux()
+	limiter := newRateLimiter()
+
+	// The unversioned routes are aliases of /v1, kept for existing callers
+	for _, prefix := range []string{"", "/v1"} {
+		mux.HandleFunc(prefix+"/split-image", limiter.rateLimit(requireAuth(handleSplitImage)))
+		mux.HandleFunc(prefix+"/image-info", limiter.rateLimit(requireAuth(handleImageInfo)))
+		mux.HandleFunc(prefix+"/usage", limiter.rateLimit(requireAuth(handleUsage)))
+		mux.HandleFunc(prefix+"/events", limiter.rateLimit(requireAuth(handleEvents)))
+
+		if jobHistory != nil {
+			mux.HandleFunc(prefix+"/jobs", limiter.rateLimit(requireAuth(handleListJobs)))
+			mux.HandleFunc(prefix+"/jobs/", limiter.rateLimit(requireAuth(handleJob)))
+		}
+	}
+	mux.HandleFunc("/v2/split-image", limiter.rateLimit(requireAuth(handleSplitImageV2)))
+
+	// Fleet tooling checks the build of every node without --internal-addr
+	mux.HandleFunc("/version", limiter.rateLimit(handleVersion))
+	if cfg.publicSelftest {
+		mux.HandleFunc("/selftest", limiter.rateLimit(requireAuth(handleSelftest)))
+	}
+
+	if adminToken != "" {
+		mux.HandleFunc("/admin/config", requireAdmin(handleAdminConfig))
+		mux.HandleFunc("/admin/settings", requireAdmin(handleAdminSettings))
+	}
+
+	return metrics(realClient(mux))
+}
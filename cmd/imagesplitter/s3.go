@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/jempe/imagesplitter/imageprocessor"
+	"github.com/jempe/imagesplitter/internal/s3"
+)
+
+// outputBucket receives the zips and the chunks of the jobs when --s3-bucket
+// is set, nil keeps them in file-path only
+var outputBucket *s3.Client
+
+// newOutputBucket returns the client of the --s3-bucket bucket, with the
+// credentials of the standard AWS environment variables
+func newOutputBucket() (*s3.Client, error) {
+	accessKeyID := os.Getenv("AWS_ACCESS_KEY_ID")
+	secretAccessKey := os.Getenv("AWS_SECRET_ACCESS_KEY")
+	if accessKeyID == "" || secretAccessKey == "" {
+		return nil, errors.New("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set with an s3 bucket")
+	}
+
+	if cfg.s3.uploadConcurrency < 1 {
+		return nil, errors.New("s3 upload concurrency must be at least 1")
+	}
+
+	if cfg.s3.partSize < s3.MinPartSize {
+		return nil, errors.New("s3 part size must be at least 5MB")
+	}
+
+	endpoint := cfg.s3.endpoint
+	if endpoint == "" {
+		endpoint = "https://s3." + cfg.s3.region + ".amazonaws.com"
+	}
+	if !(strings.HasPrefix(endpoint, "http://") || strings.HasPrefix(endpoint, "https://")) {
+		return nil, errors.New("s3 endpoint must start with http:// or https://")
+	}
+
+	return &s3.Client{
+		Endpoint:        strings.TrimSuffix(endpoint, "/"),
+		Region:          cfg.s3.region,
+		Bucket:          cfg.s3.bucket,
+		AccessKeyID:     accessKeyID,
+		SecretAccessKey: secretAccessKey,
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		PathStyle:       cfg.s3.pathStyle,
+	}, nil
+}
+
+// s3Destination uploads the zips and the chunks of a tenant below
+// --s3-prefix, in the output directory of the tenant like in file-path
+type s3Destination struct {
+	keyPrefix string
+}
+
+// bucketDestination returns the destination of the files of tenant t in
+// outputBucket
+func (t *tenant) bucketDestination() s3Destination {
+	tenantDir, err := filepath.Rel(cfg.filePath, t.outputPath)
+	if err != nil {
+		tenantDir = ""
+	}
+
+	keyPrefix := strings.TrimPrefix(path.Join(cfg.s3.prefix, filepath.ToSlash(tenantDir)), "/")
+	if keyPrefix == "." || keyPrefix == "" {
+		return s3Destination{}
+	}
+	return s3Destination{keyPrefix: keyPrefix + "/"}
+}
+
+// zipUploader returns the destination of the zips of tenant t, nil when
+// they are written to file-path
+func (t *tenant) zipUploader() imageprocessor.ZipUploader {
+	if outputBucket == nil {
+		return nil
+	}
+	return t.bucketDestination()
+}
+
+// chunkUploader returns the destination of the chunks of tenant t, nil
+// when they are only written to file-path
+func (t *tenant) chunkUploader() imageprocessor.ChunkUploader {
+	if outputBucket == nil {
+		return nil
+	}
+	return t.bucketDestination()
+}
+
+func (d s3Destination) UploadZip(ctx context.Context, name string) (imageprocessor.ZipUpload, error) {
+	key := d.keyPrefix + name
+
+	upload, err := outputBucket.CreateMultipartUpload(ctx, key, "application/zip", int(cfg.s3.partSize))
+	if err != nil {
+		return nil, err
+	}
+
+	return &s3ZipUpload{Upload: upload, url: outputBucket.ObjectURL(key)}, nil
+}
+
+func (d s3Destination) UploadChunk(ctx context.Context, name string, chunkPath string) (string, error) {
+	data, err := os.ReadFile(chunkPath)
+	if err != nil {
+		return "", err
+	}
+
+	key := d.keyPrefix + name
+	if err := outputBucket.PutObject(ctx, key, data, mime.TypeByExtension(filepath.Ext(chunkPath))); err != nil {
+		return "", err
+	}
+	return outputBucket.ObjectURL(key), nil
+}
+
+// s3ZipUpload is the multipart upload of a zip
+type s3ZipUpload struct {
+	*s3.Upload
+	url string
+}
+
+func (u *s3ZipUpload) Complete() (string, error) {
+	if err := u.Upload.Complete(); err != nil {
+		return "", err
+	}
+	return u.url, nil
+}
+
+func (u *s3ZipUpload) Abort() {
+	if err := u.Upload.Abort(); err != nil {
+		logger.PrintError(err, nil)
+	}
+}
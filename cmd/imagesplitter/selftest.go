@@ -0,0 +1,139 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	_ "embed"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/jempe/imagesplitter/imageprocessor"
+)
+
+// selftestImage is a 120x360 PNG of colored bands split by /selftest
+//
+//go:embed selftest.png
+var selftestImage []byte
+
+// The self-test splits selftestImage into chunks of selftestChunkHeight
+// pixels, the last one shorter, within selftestTimeout
+const (
+	selftestChunkHeight = 100
+	selftestChunks      = 4
+	selftestTimeout     = time.Minute
+)
+
+// handleSelftest splits the embedded sample image with the configured backend
+// and verifies the chunks and the zip, a smoke test after a deploy or a
+// config change
+func handleSelftest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		errMessage := map[string]string{
+			"error": "Method not allowed",
+		}
+		apiResponse(w, http.StatusMethodNotAllowed, errMessage)
+		return
+	}
+
+	// The self-test is a split job like the others, so it counts against
+	// the concurrency limit and the drain of a shutdown
+	releaseJob, retryAfter := jobs.acquire(r.Context())
+	if releaseJob == nil {
+		w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())+1))
+		errMessage := map[string]string{
+			"error": "too many concurrent jobs",
+		}
+		apiResponse(w, http.StatusTooManyRequests, errMessage)
+		return
+	}
+	defer releaseJob()
+
+	start := time.Now()
+	err := runSelftest(r.Context())
+	elapsed := time.Since(start).Milliseconds()
+
+	if err != nil {
+		logger.PrintError(fmt.Errorf("self-test failed: %v", err), map[string]string{
+			"backend": cfg.backend,
+		})
+
+		apiResponse(w, http.StatusInternalServerError, map[string]any{
+			"status":     "failed",
+			"backend":    cfg.backend,
+			"error":      err.Error(),
+			"elapsed_ms": elapsed,
+		})
+		return
+	}
+
+	apiResponse(w, http.StatusOK, map[string]any{
+		"status":     "passed",
+		"backend":    cfg.backend,
+		"chunks":     selftestChunks,
+		"elapsed_ms": elapsed,
+	})
+}
+
+// runSelftest splits selftestImage in a directory of the volume the jobs
+// write to, removed afterwards
+func runSelftest(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, selftestTimeout)
+	defer cancel()
+
+	base := cfg.tempPath
+	if base == "" {
+		base = cfg.filePath
+	}
+	dir, err := os.MkdirTemp(base, ".selftest-")
+	if err != nil {
+		return fmt.Errorf("failed to create the self-test directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	source := filepath.Join(dir, "selftest.png")
+	if err := os.WriteFile(source, selftestImage, 0644); err != nil {
+		return fmt.Errorf("failed to write the sample image: %v", err)
+	}
+
+	processor := imageprocessor.Processor{
+		OutputBaseDir: dir,
+		MaxHeight:     selftestChunkHeight,
+		UseCLI:        cfg.useCLI,
+		Backend:       cfg.backend,
+		Capabilities:  capabilities,
+		JPEGEncoder:   cfg.jpegEncoder,
+		CJPEGPath:     cfg.cjpegPath,
+		Encodes:       encodeSlots,
+		Quality:       cfg.defaults.quality,
+		Verify:        true,
+	}
+
+	outputDir := filepath.Join(dir, "output")
+	result, err := processor.ProcessFileContext(ctx, source, outputDir, "selftest", 0, 0, true)
+	if err != nil {
+		return err
+	}
+
+	if result.ChunkCount != selftestChunks {
+		return fmt.Errorf("expected %d chunks, got %d", selftestChunks, result.ChunkCount)
+	}
+	if !result.Verified {
+		return errors.New("the chunks were not verified")
+	}
+
+	archive, err := zip.OpenReader(filepath.Join(dir, result.ZipURL))
+	if err != nil {
+		return fmt.Errorf("failed to open the zip: %v", err)
+	}
+	defer archive.Close()
+
+	if len(archive.File) != selftestChunks {
+		return fmt.Errorf("expected %d chunks in the zip, found %d", selftestChunks, len(archive.File))
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// runtimeSettings are the operational knobs that can be changed through the
+// admin API without restarting the server. A snapshot is replaced as a whole
+// on every change, so readers never observe a half applied update.
+type runtimeSettings struct {
+	MaxConcurrentJobs int     `json:"max_concurrent_jobs"`
+	RateLimitEnabled  bool    `json:"rate_limit_enabled"`
+	RateLimitRPS      float64 `json:"rate_limit_rps"`
+	RateLimitBurst    int     `json:"rate_limit_burst"`
+	Maintenance       bool    `json:"maintenance"`
+}
+
+var settings atomic.Pointer[runtimeSettings]
+
+// settingsMu serializes writers of settings
+var settingsMu sync.Mutex
+
+// updateSettings applies fn to a copy of the current settings and stores the
+// result. It returns the previous and the new settings.
+func updateSettings(fn func(s *runtimeSettings)) (runtimeSettings, runtimeSettings) {
+	settingsMu.Lock()
+	defer settingsMu.Unlock()
+
+	previous := *settings.Load()
+	next := previous
+	fn(&next)
+	settings.Store(&next)
+
+	// A raised limit admits the queued jobs at once
+	jobs.admit()
+
+	return previous, next
+}
+
+// defaultJobEstimate is the job time the Retry-After of a refused job is
+// computed from before a job has finished
+const defaultJobEstimate = 10 * time.Second
+
+// jobLimiter counts the jobs running on the server and enforces the
+// max_concurrent_jobs setting. Lowering the limit never interrupts running
+// jobs, new jobs wait in the queue until enough of them have finished.
+type jobLimiter struct {
+	mu     sync.Mutex
+	active int
+	// queue holds the jobs waiting for a slot, first come first served. A
+	// freed slot is handed to the first one by closing its channel.
+	queue []chan struct{}
+	// averageJob is the moving average of the time the jobs held a slot
+	averageJob time.Duration
+}
+
+var jobs jobLimiter
+
+// acquire reserves a job slot, waiting in the queue up to --queue-timeout when
+// they are all taken and fewer than --max-queued-jobs are waiting. It returns
+// the function freeing the slot, which must be called once, or nil and the
+// estimated wait when the job is refused. Reserved jobs are tracked in wg so
+// a shutdown waits for them to finish.
+func (l *jobLimiter) acquire(ctx context.Context) (func(), time.Duration) {
+	limit := settings.Load().MaxConcurrentJobs
+
+	l.mu.Lock()
+	if len(l.queue) == 0 && (limit <= 0 || l.active < limit) {
+		l.reserveLocked()
+		l.mu.Unlock()
+		return l.releaser(), 0
+	}
+	if len(l.queue) >= cfg.maxQueuedJobs {
+		retryAfter := l.retryAfterLocked(limit)
+		l.mu.Unlock()
+		return nil, retryAfter
+	}
+
+	ready := make(chan struct{})
+	l.queue = append(l.queue, ready)
+	l.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, cfg.queueTimeout)
+	defer cancel()
+
+	select {
+	case <-ready:
+		return l.releaser(), 0
+	case <-ctx.Done():
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// The slot may have been handed over meanwhile
+	index := slices.Index(l.queue, ready)
+	if index < 0 {
+		return l.releaser(), 0
+	}
+	l.queue = slices.Delete(l.queue, index, index+1)
+	return nil, l.retryAfterLocked(settings.Load().MaxConcurrentJobs)
+}
+
+// reserveLocked takes a slot
+func (l *jobLimiter) reserveLocked() {
+	l.active++
+	wg.Add(1)
+}
+
+// releaser returns the function freeing a slot reserved now
+func (l *jobLimiter) releaser() func() {
+	start := time.Now()
+	var once sync.Once
+	return func() {
+		once.Do(func() { l.release(time.Since(start)) })
+	}
+}
+
+// release frees a slot held for elapsed and hands it to the next queued job
+func (l *jobLimiter) release(elapsed time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.averageJob == 0 {
+		l.averageJob = elapsed
+	} else {
+		l.averageJob += (elapsed - l.averageJob) / 5
+	}
+
+	l.active--
+	wg.Done()
+	l.admitLocked()
+}
+
+// admit hands the free slots to the queued jobs, after the limit was raised
+func (l *jobLimiter) admit() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.admitLocked()
+}
+
+func (l *jobLimiter) admitLocked() {
+	limit := settings.Load().MaxConcurrentJobs
+	for len(l.queue) > 0 && (limit <= 0 || l.active < limit) {
+		l.reserveLocked()
+		close(l.queue[0])
+		l.queue = l.queue[1:]
+	}
+}
+
+// retryAfterLocked estimates when a refused job would get a slot: the queued
+// jobs and itself served by the slots at the average job time
+func (l *jobLimiter) retryAfterLocked(limit int) time.Duration {
+	average := l.averageJob
+	if average == 0 {
+		average = defaultJobEstimate
+	}
+	return average * time.Duration(len(l.queue)+1) / time.Duration(max(limit, 1))
+}
+
+// queued returns the number of jobs waiting for a slot
+func (l *jobLimiter) queued() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return len(l.queue)
+}
+
+// running returns the number of jobs currently holding a slot
+func (l *jobLimiter) running() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.active
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// maintenanceSignal is not available on this platform, maintenance mode can
+// only be toggled through the admin API
+var maintenanceSignal os.Signal
@@ -0,0 +1,11 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// maintenanceSignal toggles maintenance mode
+var maintenanceSignal os.Signal = syscall.SIGUSR1
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jempe/imagesplitter/imageprocessor"
+)
+
+// jobTimings collects the stage durations of a split job for the slow job log
+type jobTimings struct {
+	mu     sync.Mutex
+	stages map[string]time.Duration
+	chunks []time.Duration
+}
+
+// timeStages makes processor report its stages and chunk encodes to the
+// returned timings, keeping the ChunkWritten hook already set
+func timeStages(processor *imageprocessor.Processor) *jobTimings {
+	timings := &jobTimings{stages: make(map[string]time.Duration)}
+
+	processor.StageDone = func(stage string, elapsed time.Duration) {
+		timings.mu.Lock()
+		defer timings.mu.Unlock()
+		// Jobs with several output widths decode and zip once per set
+		timings.stages[stage] += elapsed
+	}
+
+	chunkWritten := processor.ChunkWritten
+	processor.ChunkWritten = func(encodeTime time.Duration, size int64) {
+		if chunkWritten != nil {
+			chunkWritten(encodeTime, size)
+		}
+
+		timings.mu.Lock()
+		defer timings.mu.Unlock()
+		timings.chunks = append(timings.chunks, encodeTime)
+	}
+
+	return timings
+}
+
+// properties returns the timings as log properties, in milliseconds
+func (t *jobTimings) properties() map[string]string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	ms := func(d time.Duration) string {
+		return strconv.FormatInt(d.Milliseconds(), 10)
+	}
+
+	properties := make(map[string]string)
+	for _, stage := range []string{imageprocessor.StageDownload, imageprocessor.StageDecode, imageprocessor.StageZip} {
+		if elapsed, ok := t.stages[stage]; ok {
+			properties[stage+"_ms"] = ms(elapsed)
+		}
+	}
+
+	var encode time.Duration
+	chunks := make([]string, len(t.chunks))
+	for i, elapsed := range t.chunks {
+		encode += elapsed
+		chunks[i] = ms(elapsed)
+	}
+	properties["encode_ms"] = ms(encode)
+	properties["chunk_encode_ms"] = strings.Join(chunks, ",")
+
+	return properties
+}
+
+// logSlowJob logs a warning with the stage breakdown of a job of tenant t
+// that took longer than --slow-job-threshold
+func logSlowJob(t *tenant, imageURL string, record *jobRecord, outcome string, elapsed time.Duration, timings *jobTimings) {
+	if cfg.slowJobThreshold <= 0 || elapsed <= cfg.slowJobThreshold {
+		return
+	}
+
+	properties := timings.properties()
+	properties["url"] = imageURL
+	properties["tenant"] = t.ID
+	properties["outcome"] = outcome
+	properties["duration_ms"] = strconv.FormatInt(elapsed.Milliseconds(), 10)
+	properties["threshold"] = cfg.slowJobThreshold.String()
+	if record != nil {
+		properties["job_id"] = record.ID
+	}
+
+	logger.PrintWarning("slow split job", properties)
+}
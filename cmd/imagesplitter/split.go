@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/jempe/imagesplitter/imageprocessor"
+	"github.com/jempe/imagesplitter/internal/jsonlog"
+)
+
+// runSplit implements the "split" subcommand. It reads a single image from a
+// file or from stdin ("-") and writes the resulting archive to stdout, so the
+// tool can be used in shell pipelines. With -dry-run only the split plan is
+// printed. It returns the process exit code.
+func runSplit(args []string) int {
+	// stdout carries the archive, so logs must go elsewhere
+	logger = jsonlog.New(os.Stderr, jsonlog.LevelInfo)
+
+	var (
+		format       string
+		imagesPrefix string
+		maxHeight    int
+		width        int
+		maxImages    int
+		dryRun       bool
+		htmlPreview  bool
+	)
+
+	fset := flag.NewFlagSet("split", flag.ExitOnError)
+	fset.Usage = func() {
+		fmt.Fprintf(fset.Output(), "Usage: imagesplitter split [flags] <image|->\n\n")
+		fset.PrintDefaults()
+	}
+	fset.StringVar(&format, "format", imageprocessor.ArchiveZip, "Archive format written to stdout (zip or tar)")
+	fset.StringVar(&imagesPrefix, "prefix", "image", "Prefix for the chunk file names")
+	fset.IntVar(&maxHeight, "max-height", 5000, "Maximum height for image processing")
+	fset.IntVar(&width, "width", 0, "Crop chunks to this width (0 keeps the original width)")
+	fset.IntVar(&maxImages, "max-images", 0, "Maximum number of chunks (0 means unlimited)")
+	fset.BoolVar(&htmlPreview, "html", false, "Add an index.html displaying the chunks in order to the archive")
+	fset.BoolVar(&dryRun, "dry-run", false, "Print the split plan as JSON instead of writing an archive")
+	fset.Parse(args)
+
+	if fset.NArg() != 1 {
+		fset.Usage()
+		return 2
+	}
+
+	if format != imageprocessor.ArchiveZip && format != imageprocessor.ArchiveTar {
+		logger.PrintError(errors.New("format must be zip or tar"), nil)
+		return 2
+	}
+
+	if maxHeight <= 0 {
+		logger.PrintError(errors.New("max-height must be a positive integer"), nil)
+		return 2
+	}
+
+	if maxImages < 0 {
+		logger.PrintError(errors.New("max-images must be a positive integer"), nil)
+		return 2
+	}
+
+	if !containsOnlyAllowedChars(imagesPrefix, allowedPrefixChars) {
+		logger.PrintError(errors.New("prefix contains invalid characters"), nil)
+		return 2
+	}
+
+	if fi, err := os.Stdout.Stat(); !dryRun && err == nil && fi.Mode()&os.ModeCharDevice != 0 {
+		logger.PrintError(errors.New("refusing to write an archive to a terminal, redirect stdout"), nil)
+		return 2
+	}
+
+	var input io.Reader = os.Stdin
+	var sourceBytes int64 = -1
+	if source := fset.Arg(0); source != "-" {
+		file, err := os.Open(source)
+		if err != nil {
+			logger.PrintError(fmt.Errorf("failed to open image file: %v", err), nil)
+			return 1
+		}
+		defer file.Close()
+		input = file
+
+		if info, err := file.Stat(); err == nil {
+			sourceBytes = info.Size()
+		}
+	}
+
+	processor := imageprocessor.Processor{
+		MaxHeight:   maxHeight,
+		HTMLPreview: htmlPreview,
+	}
+
+	if dryRun {
+		plan, err := processor.PlanReader(input, sourceBytes, imagesPrefix, width, maxImages)
+		if err != nil {
+			logger.PrintError(err, nil)
+			return 1
+		}
+
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(plan); err != nil {
+			logger.PrintError(fmt.Errorf("failed to write plan: %v", err), nil)
+			return 1
+		}
+
+		return 0
+	}
+
+	output := bufio.NewWriter(os.Stdout)
+
+	splitCount, err := processor.SplitToArchive(bufio.NewReader(input), output, format, imagesPrefix, width, maxImages)
+	if err != nil {
+		logger.PrintError(err, nil)
+		return 1
+	}
+
+	if err := output.Flush(); err != nil {
+		logger.PrintError(fmt.Errorf("failed to write archive: %v", err), nil)
+		return 1
+	}
+
+	logger.PrintInfo("finished split", map[string]string{
+		"chunks": fmt.Sprintf("%d", splitCount),
+		"format": format,
+	})
+
+	return 0
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// statsdPacketSize bounds the datagrams sent to the agent, below the MTU of
+// most networks once the IP and UDP headers are added
+const statsdPacketSize = 1432
+
+// Formats of --statsd-format
+const (
+	statsdFormatDogStatsD = "dogstatsd"
+	statsdFormatStatsd    = "statsd"
+)
+
+// statsdClient pushes the metrics of /debug/vars to a statsd or DogStatsD
+// agent over UDP. The lines are batched into datagrams and a failed send is
+// dropped, so the agent never slows down a request.
+type statsdClient struct {
+	conn   net.Conn
+	prefix string
+	// dogstatsd sends the labels as tags, plain statsd appends their values
+	// to the metric name
+	dogstatsd bool
+	tags      []string
+
+	mu  sync.Mutex
+	buf []byte
+}
+
+// stats receives the pushed metrics, nil without --statsd-addr
+var stats *statsdClient
+
+// newStatsdClient returns a client of the agent listening on addr. prefix
+// starts the metric names and tags are added to every metric, in the
+// DogStatsD format only.
+func newStatsdClient(addr string, prefix string, format string, tags string) (*statsdClient, error) {
+	if format != statsdFormatDogStatsD && format != statsdFormatStatsd {
+		return nil, errors.New("statsd format must be dogstatsd or statsd")
+	}
+
+	var constantTags []string
+	if tags != "" {
+		if format != statsdFormatDogStatsD {
+			return nil, errors.New("statsd tags need the dogstatsd format")
+		}
+		for _, tag := range strings.Split(tags, ",") {
+			tag = strings.TrimSpace(tag)
+			if tag == "" || strings.ContainsAny(tag, "|#@ \n") {
+				return nil, fmt.Errorf("invalid statsd tag %q", tag)
+			}
+			constantTags = append(constantTags, tag)
+		}
+	}
+
+	if strings.ContainsAny(prefix, ":|@# \n") {
+		return nil, fmt.Errorf("invalid statsd prefix %q", prefix)
+	}
+	if prefix != "" && !strings.HasSuffix(prefix, ".") {
+		prefix += "."
+	}
+
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid statsd addr: %v", err)
+	}
+
+	return &statsdClient{
+		conn:      conn,
+		prefix:    prefix,
+		dogstatsd: format == statsdFormatDogStatsD,
+		tags:      constantTags,
+	}, nil
+}
+
+// count adds value to a counter
+func (c *statsdClient) count(name string, value int64, tags ...string) {
+	c.send(name, strconv.FormatInt(value, 10), "c", tags)
+}
+
+// gauge sets a gauge
+func (c *statsdClient) gauge(name string, value int64, tags ...string) {
+	c.send(name, strconv.FormatInt(value, 10), "g", tags)
+}
+
+// timing records a duration in milliseconds
+func (c *statsdClient) timing(name string, d time.Duration, tags ...string) {
+	c.send(name, strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', -1, 64), "ms", tags)
+}
+
+// histogram records a value, the agent computes the distribution
+func (c *statsdClient) histogram(name string, value float64, tags ...string) {
+	c.send(name, strconv.FormatFloat(value, 'f', -1, 64), "h", tags)
+}
+
+// send buffers a line, tags are "name:value" labels. A nil client drops it.
+func (c *statsdClient) send(name string, value string, kind string, tags []string) {
+	if c == nil {
+		return
+	}
+
+	var line strings.Builder
+	line.WriteString(c.prefix)
+	line.WriteString(name)
+	if !c.dogstatsd {
+		for _, tag := range tags {
+			_, label, _ := strings.Cut(tag, ":")
+			line.WriteString(".")
+			line.WriteString(label)
+		}
+	}
+	line.WriteString(":")
+	line.WriteString(value)
+	line.WriteString("|")
+	line.WriteString(kind)
+	if c.dogstatsd && len(c.tags)+len(tags) > 0 {
+		line.WriteString("|#")
+		line.WriteString(strings.Join(append(c.tags[:len(c.tags):len(c.tags)], tags...), ","))
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.buf) > 0 && len(c.buf)+1+line.Len() > statsdPacketSize {
+		c.flushLocked()
+	}
+	if len(c.buf) > 0 {
+		c.buf = append(c.buf, '\n')
+	}
+	c.buf = append(c.buf, line.String()...)
+}
+
+// flush sends the buffered lines
+func (c *statsdClient) flush() {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.flushLocked()
+}
+
+func (c *statsdClient) flushLocked() {
+	if len(c.buf) == 0 {
+		return
+	}
+	// Without an agent listening the send fails, the metrics are lost
+	c.conn.Write(c.buf)
+	c.buf = c.buf[:0]
+}
+
+// runStatsd pushes the gauges and the buffered metrics every --statsd-interval
+// until stop is closed, then pushes them a last time
+func runStatsd(stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+
+	ticker := time.NewTicker(cfg.statsd.interval)
+	defer ticker.Stop()
+
+	push := func() {
+		for _, g := range gauges {
+			stats.gauge(g.name, g.value())
+		}
+		stats.flush()
+	}
+
+	for {
+		select {
+		case <-ticker.C:
+			push()
+		case <-stop:
+			push()
+			return
+		}
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
+)
+
+// tenantQuota holds the per-tenant limits
+type tenantQuota struct {
+	MaxConcurrentJobs int   `json:"max_concurrent_jobs"`
+	MaxBytes          int64 `json:"max_bytes"`
+
+	// Split jobs and source megapixels per UTC day and month of every API
+	// key of the tenant
+	DailyRequests     int64   `json:"daily_requests"`
+	MonthlyRequests   int64   `json:"monthly_requests"`
+	DailyMegapixels   float64 `json:"daily_megapixels"`
+	MonthlyMegapixels float64 `json:"monthly_megapixels"`
+}
+
+// tenant is an isolated namespace of the shared deployment with its own
+// source host, output root and quotas
+type tenant struct {
+	ID        string      `json:"id"`
+	APIKeys   []string    `json:"api_keys"`
+	URLHost   string      `json:"url_host"`
+	OutputDir string      `json:"output_dir"`
+	Quota     tenantQuota `json:"quota"`
+
+	// outputPath is the absolute output root derived from file-path and OutputDir
+	outputPath string
+	// slots limits the number of jobs running at once, nil means unlimited
+	slots chan struct{}
+}
+
+// tenantRegistry resolves API keys to tenants. Keys are stored as SHA-256
+// digests so the lookup does not compare secrets byte by byte.
+type tenantRegistry struct {
+	tenants []*tenant
+	byKey   map[[32]byte]*tenant
+
+	// path is the tenants file the registry was loaded from
+	path string
+}
+
+// defaultTenant serves every request when no tenants file is configured
+var defaultTenant *tenant
+
+// tenants is nil unless a tenants file is configured, and swapped atomically
+// when the file is reloaded
+var tenants atomic.Pointer[tenantRegistry]
+
+// newDefaultTenant builds the single tenant backed by the global flags
+func newDefaultTenant() *tenant {
+	return &tenant{
+		ID:         "default",
+		URLHost:    cfg.urlHost,
+		outputPath: cfg.filePath,
+	}
+}
+
+// loadTenants reads and validates a tenants file of the form
+// {"tenants": [{"id": "...", "api_keys": ["..."], "url_host": "...", "output_dir": "...", "quota": {...}}]}.
+// url_host defaults to --url-host and output_dir to the tenant id.
+func loadTenants(path string) (*tenantRegistry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tenants file: %v", err)
+	}
+
+	var file struct {
+		Tenants []*tenant `json:"tenants"`
+	}
+
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse tenants file: %v", err)
+	}
+
+	if len(file.Tenants) == 0 {
+		return nil, errors.New("tenants file does not define any tenant")
+	}
+
+	registry := &tenantRegistry{
+		byKey: make(map[[32]byte]*tenant),
+		path:  path,
+	}
+
+	ids := make(map[string]bool)
+
+	for _, t := range file.Tenants {
+		if t.ID == "" || !containsOnlyAllowedChars(t.ID, allowedPrefixChars+"-") {
+			return nil, fmt.Errorf("tenant id %q must be non-empty and contain only alphanumeric characters, underscores and hyphens", t.ID)
+		}
+
+		if ids[t.ID] {
+			return nil, fmt.Errorf("duplicate tenant id %q", t.ID)
+		}
+		ids[t.ID] = true
+
+		if len(t.APIKeys) == 0 {
+			return nil, fmt.Errorf("tenant %q has no api keys", t.ID)
+		}
+
+		for _, key := range t.APIKeys {
+			if key == "" {
+				return nil, fmt.Errorf("tenant %q has an empty api key", t.ID)
+			}
+
+			digest := sha256.Sum256([]byte(key))
+			if _, exists := registry.byKey[digest]; exists {
+				return nil, fmt.Errorf("api key of tenant %q is already assigned", t.ID)
+			}
+			registry.byKey[digest] = t
+		}
+
+		if t.URLHost == "" {
+			t.URLHost = cfg.urlHost
+		}
+
+		if err := validateURLHost(t.URLHost); err != nil {
+			return nil, fmt.Errorf("tenant %q: %v", t.ID, err)
+		}
+
+		if t.OutputDir == "" {
+			t.OutputDir = t.ID
+		}
+
+		// Keep every tenant below the global file path
+		cleaned := filepath.Clean(t.OutputDir)
+		if filepath.IsAbs(cleaned) || cleaned == "." || strings.HasPrefix(cleaned, "..") {
+			return nil, fmt.Errorf("tenant %q: output_dir must be a relative subdirectory of file-path", t.ID)
+		}
+
+		// and apart from the others, the usage, the expiry and the job
+		// lookups of a tenant walk its whole directory
+		for _, other := range registry.tenants {
+			if nestedDirs(cleaned, filepath.Clean(other.OutputDir)) {
+				return nil, fmt.Errorf("tenant %q: output_dir %q overlaps the output_dir %q of tenant %q", t.ID, t.OutputDir, other.OutputDir, other.ID)
+			}
+		}
+		t.outputPath = filepath.Join(cfg.filePath, cleaned) + "/"
+
+		if err := os.MkdirAll(t.outputPath, 0755); err != nil {
+			return nil, fmt.Errorf("tenant %q: failed to create output directory: %v", t.ID, err)
+		}
+
+		if t.Quota.MaxConcurrentJobs < 0 {
+			return nil, fmt.Errorf("tenant %q: max_concurrent_jobs must be a positive integer", t.ID)
+		}
+
+		if t.Quota.MaxBytes < 0 {
+			return nil, fmt.Errorf("tenant %q: max_bytes must be a positive integer", t.ID)
+		}
+
+		if t.Quota.DailyRequests < 0 || t.Quota.MonthlyRequests < 0 || t.Quota.DailyMegapixels < 0 || t.Quota.MonthlyMegapixels < 0 {
+			return nil, fmt.Errorf("tenant %q: request and megapixel quotas must be positive", t.ID)
+		}
+
+		if t.Quota.MaxConcurrentJobs > 0 {
+			t.slots = make(chan struct{}, t.Quota.MaxConcurrentJobs)
+		}
+
+		registry.tenants = append(registry.tenants, t)
+	}
+
+	return registry, nil
+}
+
+// nestedDirs reports whether the cleaned relative paths a and b are the same
+// directory or one contains the other
+func nestedDirs(a string, b string) bool {
+	sep := string(filepath.Separator)
+	return a == b || strings.HasPrefix(a, b+sep) || strings.HasPrefix(b, a+sep)
+}
+
+// adopt carries the state of the tenants of previous over to the tenants of
+// reg with the same id: the job slots when the concurrency quota did not
+// change, so the running jobs still count against it. The stored bytes of the
+// new tenants and of the moved output directories are counted from the disk.
+func (reg *tenantRegistry) adopt(previous *tenantRegistry) {
+	for _, t := range reg.tenants {
+		i := slices.IndexFunc(previous.tenants, func(p *tenant) bool { return p.ID == t.ID })
+		if i >= 0 && previous.tenants[i].Quota.MaxConcurrentJobs == t.Quota.MaxConcurrentJobs {
+			t.slots = previous.tenants[i].slots
+		}
+		if i >= 0 && previous.tenants[i].outputPath == t.outputPath {
+			continue
+		}
+
+		size, err := dirSize(t.outputPath)
+		if err != nil {
+			logger.PrintError(err, nil)
+			continue
+		}
+		usage.set(t.ID, size)
+	}
+}
+
+// lookup returns the tenant owning key, or nil
+func (reg *tenantRegistry) lookup(key string) *tenant {
+	return reg.byKey[sha256.Sum256([]byte(key))]
+}
+
+// acquireJob reserves a job slot and reports whether one was available.
+// Every successful call must be followed by releaseJob.
+func (t *tenant) acquireJob() bool {
+	if t.slots == nil {
+		return true
+	}
+
+	select {
+	case t.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// releaseJob frees a slot reserved by acquireJob
+func (t *tenant) releaseJob() {
+	if t.slots != nil {
+		<-t.slots
+	}
+}
+
+// apiKeyFromRequest extracts the API key from the X-API-Key header or from a
+// bearer Authorization header
+func apiKeyFromRequest(r *http.Request) string {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+
+	authorization := r.Header.Get("Authorization")
+	if scheme, token, found := strings.Cut(authorization, " "); found && strings.EqualFold(scheme, "Bearer") {
+		return strings.TrimSpace(token)
+	}
+
+	return ""
+}
+
+// apiKeyAuth is a middleware that resolves the tenant from the request API key
+func apiKeyAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		t := tenants.Load().lookup(apiKeyFromRequest(r))
+		if t == nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="Restricted"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		next(w, contextSetTenant(r, t))
+	}
+}
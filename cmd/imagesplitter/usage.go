@@ -0,0 +1,285 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// usagePeriod is the consumption of an API key during a day or a month
+type usagePeriod struct {
+	Requests   int64   `json:"requests"`
+	Megapixels float64 `json:"megapixels"`
+}
+
+// add returns the sum of the two periods
+func (p usagePeriod) add(other usagePeriod) usagePeriod {
+	return usagePeriod{
+		Requests:   p.Requests + other.Requests,
+		Megapixels: p.Megapixels + other.Megapixels,
+	}
+}
+
+// keyUsage is the consumption of an API key in the current UTC day and month
+type keyUsage struct {
+	Day     string      `json:"day"`
+	Month   string      `json:"month"`
+	Daily   usagePeriod `json:"daily"`
+	Monthly usagePeriod `json:"monthly"`
+}
+
+// roll starts new periods when the day or the month of now differs
+func (u *keyUsage) roll(now time.Time) {
+	now = now.UTC()
+
+	if day := now.Format(time.DateOnly); u.Day != day {
+		u.Day = day
+		u.Daily = usagePeriod{}
+	}
+	if month := now.Format("2006-01"); u.Month != month {
+		u.Month = month
+		u.Monthly = usagePeriod{}
+	}
+}
+
+// usageTracker counts the split requests and the processed megapixels of
+// every API key, grouped by tenant
+type usageTracker struct {
+	mu       sync.Mutex
+	byTenant map[string]map[string]*keyUsage
+
+	// path persists the counters across restarts, when not empty
+	path string
+	// dirty is set when the counters changed since they were saved
+	dirty bool
+}
+
+// usageSaveInterval is how often runUsageSaver saves the changed counters
+const usageSaveInterval = 10 * time.Second
+
+var keyUsages = &usageTracker{byTenant: make(map[string]map[string]*keyUsage)}
+
+// apiKeyID identifies the API key of r in the usage without revealing it,
+// empty when the request has no API key
+func apiKeyID(r *http.Request) string {
+	key := apiKeyFromRequest(r)
+	if key == "" {
+		return ""
+	}
+
+	digest := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(digest[:6])
+}
+
+// key returns the usage of a key, rolled to now. The caller holds u.mu.
+func (u *usageTracker) key(tenantID, keyID string, now time.Time) *keyUsage {
+	keys, ok := u.byTenant[tenantID]
+	if !ok {
+		keys = make(map[string]*keyUsage)
+		u.byTenant[tenantID] = keys
+	}
+
+	usage, ok := keys[keyID]
+	if !ok {
+		usage = &keyUsage{}
+		keys[keyID] = usage
+	}
+
+	usage.roll(now)
+	return usage
+}
+
+// add records the consumption of a key, saved by the next flush
+func (u *usageTracker) add(tenantID, keyID string, consumed usagePeriod) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	usage := u.key(tenantID, keyID, time.Now())
+	usage.Daily = usage.Daily.add(consumed)
+	usage.Monthly = usage.Monthly.add(consumed)
+	u.dirty = true
+}
+
+// get returns the usage of a key of a tenant, rolled to now
+func (u *usageTracker) get(tenantID, keyID string) keyUsage {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return *u.key(tenantID, keyID, time.Now())
+}
+
+// tenant returns the usage of every key of a tenant and their sum
+func (u *usageTracker) tenant(tenantID string) (keyUsage, map[string]keyUsage) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	now := time.Now()
+
+	var total keyUsage
+	total.roll(now)
+
+	keys := make(map[string]keyUsage)
+	for keyID := range u.byTenant[tenantID] {
+		usage := u.key(tenantID, keyID, now)
+		total.Daily = total.Daily.add(usage.Daily)
+		total.Monthly = total.Monthly.add(usage.Monthly)
+
+		if keyID != "" {
+			keys[keyID] = *usage
+		}
+	}
+
+	return total, keys
+}
+
+// load reads the counters saved at path, a missing file means no usage yet
+func (u *usageTracker) load(path string) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.path = path
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read usage file: %v", err)
+	}
+
+	if err := json.Unmarshal(data, &u.byTenant); err != nil {
+		return fmt.Errorf("failed to parse usage file: %v", err)
+	}
+	return nil
+}
+
+// flush writes the counters to u.path through a temporary file when they
+// changed since the last flush. The file is written outside of u.mu, so the
+// requests counting their usage do not wait for the disk.
+func (u *usageTracker) flush() error {
+	u.mu.Lock()
+	if u.path == "" || !u.dirty {
+		u.mu.Unlock()
+		return nil
+	}
+	data, err := json.Marshal(u.byTenant)
+	u.dirty = false
+	path := u.path
+	u.mu.Unlock()
+
+	if err == nil {
+		err = os.WriteFile(path+".tmp", data, 0644)
+	}
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err != nil {
+		// Saved again by the next flush
+		u.mu.Lock()
+		u.dirty = true
+		u.mu.Unlock()
+		return fmt.Errorf("failed to save usage file: %v", err)
+	}
+	return nil
+}
+
+// runUsageSaver flushes keyUsages every usageSaveInterval and once more when
+// stop is closed, then closes done
+func runUsageSaver(stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+
+	ticker := time.NewTicker(usageSaveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			if err := keyUsages.flush(); err != nil {
+				logger.PrintError(err, nil)
+			}
+			return
+		}
+
+		if err := keyUsages.flush(); err != nil {
+			logger.PrintError(err, nil)
+		}
+	}
+}
+
+// checkUsageQuota returns an error describing the request or megapixel quota
+// of t that the API key keyID exhausted, and how long until its period ends.
+// Every key of the tenant gets the quotas.
+func checkUsageQuota(t *tenant, keyID string) (time.Duration, error) {
+	usage := keyUsages.get(t.ID, keyID)
+
+	now := time.Now().UTC()
+	tomorrow := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+	nextMonth := time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+
+	quota := t.Quota
+
+	if quota.DailyRequests > 0 && usage.Daily.Requests >= quota.DailyRequests {
+		return tomorrow.Sub(now), fmt.Errorf("daily request quota of %d exceeded", quota.DailyRequests)
+	}
+	if quota.DailyMegapixels > 0 && usage.Daily.Megapixels >= quota.DailyMegapixels {
+		return tomorrow.Sub(now), fmt.Errorf("daily quota of %g megapixels exceeded", quota.DailyMegapixels)
+	}
+	if quota.MonthlyRequests > 0 && usage.Monthly.Requests >= quota.MonthlyRequests {
+		return nextMonth.Sub(now), fmt.Errorf("monthly request quota of %d exceeded", quota.MonthlyRequests)
+	}
+	if quota.MonthlyMegapixels > 0 && usage.Monthly.Megapixels >= quota.MonthlyMegapixels {
+		return nextMonth.Sub(now), fmt.Errorf("monthly quota of %g megapixels exceeded", quota.MonthlyMegapixels)
+	}
+
+	return 0, nil
+}
+
+// usageQuotaResponse refuses a request of the API key keyID of t when a usage
+// quota is exhausted, and reports whether it did
+func usageQuotaResponse(w http.ResponseWriter, t *tenant, keyID string) bool {
+	retryAfter, err := checkUsageQuota(t, keyID)
+	if err == nil {
+		return false
+	}
+
+	w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())+1))
+	errMessage := map[string]string{
+		"error": err.Error(),
+	}
+	apiResponse(w, http.StatusTooManyRequests, errMessage)
+	return true
+}
+
+// handleUsage returns the consumption and the quotas of the tenant of the request
+func handleUsage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		errMessage := map[string]string{
+			"error": "Method not allowed",
+		}
+		apiResponse(w, http.StatusMethodNotAllowed, errMessage)
+		return
+	}
+
+	t := contextGetTenant(r)
+	total, keys := keyUsages.tenant(t.ID)
+	_, bytesStored := usage.get(t.ID)
+
+	apiResponse(w, http.StatusOK, map[string]any{
+		"tenant":       t.ID,
+		"day":          total.Day,
+		"month":        total.Month,
+		"daily":        total.Daily,
+		"monthly":      total.Monthly,
+		"bytes_stored": bytesStored,
+		"quota":        t.Quota,
+		"keys":         keys,
+	})
+}
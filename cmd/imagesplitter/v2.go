@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/jempe/imagesplitter/imageprocessor"
+)
+
+// Split modes of the v2 requests
+const (
+	splitModeV2Fixed = "fixed"
+	// splitModeV2Smart cuts at the gutters between panels
+	splitModeV2Smart = "smart"
+)
+
+// directionVertical stacks the chunks top to bottom, the only direction
+// supported so far
+const directionVertical = "vertical"
+
+// ImageRequestV2 is the request of /v2/split-image, the options of
+// ImageRequest grouped by the stage they apply to
+type ImageRequestV2 struct {
+	Source struct {
+		URL            string            `json:"url"`
+		FallbackURLs   []string          `json:"fallback_urls"`
+		Headers        map[string]string `json:"headers"`
+		ExpectedSHA256 string            `json:"expected_sha256"`
+		SVGWidth       int               `json:"svg_width"`
+		SVGDPI         int               `json:"svg_dpi"`
+	} `json:"source"`
+
+	Transform struct {
+		Rotate      int         `json:"rotate"`
+		Crop        *cropRegion `json:"crop"`
+		ColorSpace  string      `json:"colorspace"`
+		Sharpen     float64     `json:"sharpen"`
+		ConvertSRGB bool        `json:"convert_srgb"`
+	} `json:"transform"`
+
+	Split struct {
+		Mode        string `json:"mode"`
+		Direction   string `json:"direction"`
+		Width       int    `json:"width"`
+		MaxImages   int    `json:"max_images"`
+		Anchor      string `json:"anchor"`
+		Fit         string `json:"fit"`
+		ChunkAspect string `json:"chunk_aspect"`
+		MaxPixels   int    `json:"max_pixels"`
+		Preset      string `json:"preset"`
+		PadColor    string `json:"pad_color"`
+		SkipBlank   bool   `json:"skip_blank"`
+		Dedupe      bool   `json:"dedupe"`
+		Widths      []int  `json:"widths"`
+	} `json:"split"`
+
+	Output struct {
+		Prefix           string `json:"prefix"`
+		Name             string `json:"name"`
+		Layout           string `json:"layout"`
+		Format           string `json:"format"`
+		Background       string `json:"background"`
+		Quality          int    `json:"quality"`
+		PNGOptimize      int    `json:"png_optimize"`
+		TargetChunkBytes int    `json:"target_chunk_bytes"`
+		Subsampling      string `json:"subsampling"`
+		BitDepth         int    `json:"bit_depth"`
+		DPI              int    `json:"dpi"`
+		Verify           bool   `json:"verify"`
+		Inline           bool   `json:"inline"`
+	} `json:"output"`
+
+	Archive struct {
+		Zip bool `json:"zip"`
+	} `json:"archive"`
+
+	Previews struct {
+		ContactSheet bool `json:"contact_sheet"`
+		HTML         bool `json:"html"`
+		StripWidth   int  `json:"strip_width"`
+	} `json:"previews"`
+
+	Metadata       json.RawMessage `json:"metadata"`
+	DryRun         bool            `json:"dry_run"`
+	TimeoutSeconds int             `json:"timeout_seconds"`
+}
+
+// v2Fields maps the ImageRequest field names to their v2 paths, the keys of
+// the validation failures
+var v2Fields = map[string]string{
+	"url":                "source.url",
+	"fallback_urls":      "source.fallback_urls",
+	"headers":            "source.headers",
+	"expected_sha256":    "source.expected_sha256",
+	"svg_width":          "source.svg_width",
+	"svg_dpi":            "source.svg_dpi",
+	"rotate":             "transform.rotate",
+	"crop":               "transform.crop",
+	"colorspace":         "transform.colorspace",
+	"sharpen":            "transform.sharpen",
+	"convert_srgb":       "transform.convert_srgb",
+	"split_mode":         "split.mode",
+	"width":              "split.width",
+	"max_images":         "split.max_images",
+	"anchor":             "split.anchor",
+	"fit":                "split.fit",
+	"chunk_aspect":       "split.chunk_aspect",
+	"max_pixels":         "split.max_pixels",
+	"preset":             "split.preset",
+	"pad_color":          "split.pad_color",
+	"widths":             "split.widths",
+	"images_prefix":      "output.prefix",
+	"output_name":        "output.name",
+	"layout":             "output.layout",
+	"format":             "output.format",
+	"background":         "output.background",
+	"quality":            "output.quality",
+	"png_optimize":       "output.png_optimize",
+	"target_chunk_bytes": "output.target_chunk_bytes",
+	"subsampling":        "output.subsampling",
+	"bit_depth":          "output.bit_depth",
+	"dpi":                "output.dpi",
+	"verify":             "output.verify",
+	"strip_width":        "previews.strip_width",
+	"return_inline":      "output.inline",
+}
+
+// imageRequest returns the ImageRequest of req, recording in v the v2 only
+// options that cannot be mapped
+func (req *ImageRequestV2) imageRequest(v *validator) ImageRequest {
+	splitMode := ""
+	switch req.Split.Mode {
+	case "", splitModeV2Fixed:
+		splitMode = imageprocessor.SplitModeFixed
+	case splitModeV2Smart:
+		splitMode = imageprocessor.SplitModePanels
+	default:
+		v.AddError("split.mode", "mode must be fixed or smart")
+	}
+
+	v.Check(req.Split.Direction == "" || req.Split.Direction == directionVertical,
+		"split.direction", "direction must be vertical")
+
+	return ImageRequest{
+		URL:              req.Source.URL,
+		FallbackURLs:     req.Source.FallbackURLs,
+		Headers:          req.Source.Headers,
+		ExpectedSHA256:   req.Source.ExpectedSHA256,
+		SVGWidth:         req.Source.SVGWidth,
+		SVGDPI:           req.Source.SVGDPI,
+		Rotate:           req.Transform.Rotate,
+		Crop:             req.Transform.Crop,
+		ColorSpace:       req.Transform.ColorSpace,
+		Sharpen:          req.Transform.Sharpen,
+		ConvertSRGB:      req.Transform.ConvertSRGB,
+		SplitMode:        splitMode,
+		Width:            req.Split.Width,
+		MaxImages:        req.Split.MaxImages,
+		Anchor:           req.Split.Anchor,
+		Fit:              req.Split.Fit,
+		ChunkAspect:      req.Split.ChunkAspect,
+		MaxPixels:        req.Split.MaxPixels,
+		Preset:           req.Split.Preset,
+		PadColor:         req.Split.PadColor,
+		SkipBlank:        req.Split.SkipBlank,
+		Dedupe:           req.Split.Dedupe,
+		Widths:           req.Split.Widths,
+		ImagesPrefix:     req.Output.Prefix,
+		OutputName:       req.Output.Name,
+		Layout:           req.Output.Layout,
+		Format:           req.Output.Format,
+		Background:       req.Output.Background,
+		Quality:          req.Output.Quality,
+		PNGOptimize:      req.Output.PNGOptimize,
+		TargetChunkBytes: req.Output.TargetChunkBytes,
+		Subsampling:      req.Output.Subsampling,
+		BitDepth:         req.Output.BitDepth,
+		DPI:              req.Output.DPI,
+		Verify:           req.Output.Verify,
+		ReturnInline:     req.Output.Inline,
+		CreateZip:        req.Archive.Zip,
+		ContactSheet:     req.Previews.ContactSheet,
+		HTMLPreview:      req.Previews.HTML,
+		StripWidth:       req.Previews.StripWidth,
+		Metadata:         req.Metadata,
+		DryRun:           req.DryRun,
+		TimeoutSeconds:   req.TimeoutSeconds,
+	}
+}
+
+// handleSplitImageV2 runs the split job of an ImageRequestV2 JSON body. The
+// response is the one of /v1/split-image.
+func handleSplitImageV2(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		errMessage := map[string]string{
+			"error": "Method not allowed",
+		}
+		apiResponse(w, http.StatusMethodNotAllowed, errMessage)
+		return
+	}
+
+	reqV2 := defaultImageRequestV2()
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&reqV2); err != nil {
+		errMessage := map[string]string{
+			"error": "Invalid JSON: " + err.Error(),
+		}
+		apiResponse(w, http.StatusBadRequest, errMessage)
+		return
+	}
+
+	v := newValidator()
+	v.fields = v2Fields
+
+	req := reqV2.imageRequest(v)
+	splitImage(w, r, &req, v)
+}
@@ -0,0 +1,47 @@
+package main
+
+import "net/http"
+
+// validator collects the validation failures of a request by field name, so
+// all of them are reported in a single response
+type validator struct {
+	Errors map[string]string
+
+	// fields renames the keys of the failures, for request schemas whose
+	// field names differ from ImageRequest
+	fields map[string]string
+}
+
+func newValidator() *validator {
+	return &validator{Errors: make(map[string]string)}
+}
+
+// Valid reports whether no failure was recorded
+func (v *validator) Valid() bool {
+	return len(v.Errors) == 0
+}
+
+// AddError records message for key unless key already failed, the first
+// failure of a field being the most relevant
+func (v *validator) AddError(key, message string) {
+	if field, ok := v.fields[key]; ok {
+		key = field
+	}
+	if _, exists := v.Errors[key]; !exists {
+		v.Errors[key] = message
+	}
+}
+
+// Check records message for key when ok is false
+func (v *validator) Check(ok bool, key, message string) {
+	if !ok {
+		v.AddError(key, message)
+	}
+}
+
+// failedValidationResponse sends the failures of v as {"errors": {field: message}}
+func failedValidationResponse(w http.ResponseWriter, v *validator) {
+	apiResponse(w, http.StatusBadRequest, map[string]map[string]string{
+		"errors": v.Errors,
+	})
+}
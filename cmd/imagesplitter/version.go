@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// commit and buildDate are set at link time, e.g.
+//
+//	go build -ldflags "-X main.commit=$(git rev-parse HEAD) -X main.buildDate=$(date -u +%FT%TZ)"
+//
+// and read from the VCS stamp of the binary otherwise, the build date is then
+// the commit time
+var (
+	commit    string
+	buildDate string
+)
+
+// startTime is when the process started, the uptime of /version
+var startTime = time.Now()
+
+// buildInfo describes the binary of the server
+type buildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"build_date"`
+	// Modified is set for a binary built from a checkout with local changes
+	Modified  bool   `json:"modified"`
+	GoVersion string `json:"go_version"`
+}
+
+// readBuildInfo returns the build of the binary, the link time values taking
+// precedence over the VCS stamp
+var readBuildInfo = sync.OnceValue(func() buildInfo {
+	info := buildInfo{
+		Version:   version,
+		Commit:    commit,
+		BuildDate: buildDate,
+		GoVersion: runtime.Version(),
+	}
+
+	stamp, ok := debug.ReadBuildInfo()
+	if !ok {
+		return info
+	}
+	for _, setting := range stamp.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			if info.Commit == "" {
+				info.Commit = setting.Value
+			}
+		case "vcs.time":
+			if info.BuildDate == "" {
+				info.BuildDate = setting.Value
+			}
+		case "vcs.modified":
+			info.Modified = setting.Value == "true"
+		}
+	}
+	return info
+})
+
+// versionResponse is the body of /version
+type versionResponse struct {
+	buildInfo
+	Backend       string    `json:"backend"`
+	StartedAt     time.Time `json:"started_at"`
+	Uptime        string    `json:"uptime"`
+	UptimeSeconds int64     `json:"uptime_seconds"`
+}
+
+// handleVersion reports the build, the backend and the uptime of the server,
+// so a fleet can check which build every node runs
+func handleVersion(w http.ResponseWriter, r *http.Request) {
+	uptime := time.Since(startTime)
+
+	apiResponse(w, http.StatusOK, versionResponse{
+		buildInfo:     readBuildInfo(),
+		Backend:       cfg.backend,
+		StartedAt:     startTime.UTC().Truncate(time.Second),
+		Uptime:        uptime.Round(time.Second).String(),
+		UptimeSeconds: int64(uptime.Seconds()),
+	})
+}
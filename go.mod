@@ -1,3 +1,9 @@
 module github.com/jempe/imagesplitter
 
 go 1.21
+
+require (
+	golang.org/x/crypto v0.31.0
+	golang.org/x/image v0.23.0
+	golang.org/x/time v0.5.0
+)
@@ -0,0 +1,159 @@
+package imageprocessor
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"io"
+	"time"
+)
+
+// Supported archive formats for SplitToArchive
+const (
+	ArchiveZip = "zip"
+	ArchiveTar = "tar"
+)
+
+// SplitToArchive decodes an image from r, splits it with the Go
+// implementation and streams the chunks to w as a zip or tar archive.
+// Nothing is written to the filesystem. It returns the number of chunks.
+func (p *Processor) SplitToArchive(r io.Reader, w io.Writer, format string, imagesPrefix string, width int, maxImages int) (int, error) {
+	return p.splitToArchive(context.Background(), r, w, format, imagesPrefix, width, maxImages)
+}
+
+// splitToArchive is like SplitToArchive but stops between chunks when ctx is done
+func (p *Processor) splitToArchive(ctx context.Context, r io.Reader, w io.Writer, format string, imagesPrefix string, width int, maxImages int) (int, error) {
+	if format != ArchiveZip && format != ArchiveTar {
+		return 0, fmt.Errorf("unsupported archive format: %s", format)
+	}
+	p = p.withFit(width)
+
+	source := bufio.NewReaderSize(r, densityScanBytes)
+
+	if err := checkStillImage(source); err != nil {
+		return 0, err
+	}
+
+	// Chunks carry over the density of the source unless DPI overrides it
+	encoder := *p
+	encoder.DPI = p.chunkDPI(source)
+
+	// Decode the image
+	img, imageFormat, err := p.decodeSource(ctx, source)
+	if err != nil {
+		return 0, fmt.Errorf("failed to decode image: %w", err)
+	}
+
+	img, err = p.prepareImage(img)
+	if err != nil {
+		return 0, err
+	}
+
+	usePNG := p.pngChunks(imageFormat == "png")
+	modified := time.Now()
+
+	var zipWriter *zip.Writer
+	var tarWriter *tar.Writer
+
+	if format == ArchiveZip {
+		zipWriter = zip.NewWriter(w)
+	} else {
+		tarWriter = tar.NewWriter(w)
+	}
+
+	var names []string
+
+	splitCount, err := p.splitGoImage(img, usePNG, width, maxImages, func(index int, subImg image.Image) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		name := chunkFileName(imagesPrefix, index)
+		names = append(names, name)
+
+		if zipWriter != nil {
+			writer, err := zipWriter.CreateHeader(&zip.FileHeader{
+				Name:     name,
+				Method:   zip.Deflate,
+				Modified: modified,
+			})
+			if err != nil {
+				return fmt.Errorf("failed to add file to zip: %v", err)
+			}
+			return encoder.encode(ctx, writer, subImg, usePNG)
+		}
+
+		// tar needs the entry size up front, so encode the chunk in memory first
+		var buf bytes.Buffer
+		if err := encoder.encode(ctx, &buf, subImg, usePNG); err != nil {
+			return err
+		}
+
+		header := &tar.Header{
+			Name:    name,
+			Mode:    0644,
+			Size:    int64(buf.Len()),
+			ModTime: modified,
+		}
+		if err := tarWriter.WriteHeader(header); err != nil {
+			return fmt.Errorf("failed to add file to tar: %v", err)
+		}
+		if _, err := buf.WriteTo(tarWriter); err != nil {
+			return fmt.Errorf("failed to add file to tar: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if p.HTMLPreview {
+		var preview bytes.Buffer
+		if err := writeHTMLPreview(&preview, imagesPrefix, names); err != nil {
+			return 0, err
+		}
+
+		if zipWriter != nil {
+			writer, err := zipWriter.CreateHeader(&zip.FileHeader{
+				Name:     htmlPreviewFileName,
+				Method:   zip.Deflate,
+				Modified: modified,
+			})
+			if err != nil {
+				return 0, fmt.Errorf("failed to add file to zip: %v", err)
+			}
+			if _, err := preview.WriteTo(writer); err != nil {
+				return 0, fmt.Errorf("failed to add file to zip: %v", err)
+			}
+		} else {
+			header := &tar.Header{
+				Name:    htmlPreviewFileName,
+				Mode:    0644,
+				Size:    int64(preview.Len()),
+				ModTime: modified,
+			}
+			if err := tarWriter.WriteHeader(header); err != nil {
+				return 0, fmt.Errorf("failed to add file to tar: %v", err)
+			}
+			if _, err := preview.WriteTo(tarWriter); err != nil {
+				return 0, fmt.Errorf("failed to add file to tar: %v", err)
+			}
+		}
+	}
+
+	if zipWriter != nil {
+		if err := zipWriter.Close(); err != nil {
+			return 0, fmt.Errorf("failed to close zip writer: %v", err)
+		}
+	} else {
+		if err := tarWriter.Close(); err != nil {
+			return 0, fmt.Errorf("failed to close tar writer: %v", err)
+		}
+	}
+
+	return splitCount, nil
+}
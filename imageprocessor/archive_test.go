@@ -0,0 +1,143 @@
+package imageprocessor
+
+import (
+	"archive/zip"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Signatures of the end of central directory records
+const (
+	sigEndOfDirectory      = 0x06054b50
+	sigZip64EndOfDirectory = 0x06064b50
+	sigZip64Locator        = 0x07064b50
+)
+
+func TestZip64Archive(t *testing.T) {
+	if testing.Short() {
+		t.Skip("zips a 4 GB sparse chunk")
+	}
+
+	dir := t.TempDir()
+
+	// A sparse chunk past the 32-bit sizes, which deflates to a few MB
+	const chunkSize = 1<<32 + 1<<20
+	bigChunk := filepath.Join(dir, "page_01.jpg")
+	if err := os.WriteFile(bigChunk, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(bigChunk, chunkSize); err != nil {
+		t.Fatal(err)
+	}
+
+	smallChunk := filepath.Join(dir, "page_02.jpg")
+	if err := os.WriteFile(smallChunk, []byte("last chunk"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The archive starts past 4 GB of a sparse file, so the offsets of its
+	// entries and of its directory outgrow the 32-bit fields too
+	const zipOffset = 1<<32 + 1<<10
+	zipPath := filepath.Join(dir, "page.zip")
+	out, err := os.Create(zipPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	if _, err := out.Seek(zipOffset, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+
+	zipWriter := zip.NewWriter(out)
+	zipWriter.SetOffset(zipOffset)
+	for _, path := range []string{bigChunk, smallChunk} {
+		if err := addFileToZip(zipWriter, path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zipWriter.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := out.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := info.Size()
+
+	// The end of central directory points to the Zip64 one
+	tail := make([]byte, 22+20)
+	if _, err := out.ReadAt(tail, size-int64(len(tail))); err != nil {
+		t.Fatal(err)
+	}
+	locator, end := tail[:20], tail[20:]
+	if sig := binary.LittleEndian.Uint32(end); sig != sigEndOfDirectory {
+		t.Fatalf("got end of central directory signature %#x", sig)
+	}
+	if offset := binary.LittleEndian.Uint32(end[16:]); offset != 0xffffffff {
+		t.Errorf("got a 32-bit directory offset %#x, want 0xffffffff", offset)
+	}
+	if sig := binary.LittleEndian.Uint32(locator); sig != sigZip64Locator {
+		t.Fatalf("got Zip64 locator signature %#x", sig)
+	}
+
+	record := make([]byte, 56)
+	if _, err := out.ReadAt(record, int64(binary.LittleEndian.Uint64(locator[8:]))); err != nil {
+		t.Fatal(err)
+	}
+	if sig := binary.LittleEndian.Uint32(record); sig != sigZip64EndOfDirectory {
+		t.Fatalf("got Zip64 end of central directory signature %#x", sig)
+	}
+	if entries := binary.LittleEndian.Uint64(record[32:]); entries != 2 {
+		t.Errorf("got %d entries in the Zip64 record, want 2", entries)
+	}
+	if offset := binary.LittleEndian.Uint64(record[48:]); offset < 1<<32 {
+		t.Errorf("got directory offset %#x, want one past 4 GB", offset)
+	}
+
+	archive, err := zip.NewReader(out, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(archive.File) != 2 {
+		t.Fatalf("got %d entries, want 2", len(archive.File))
+	}
+
+	entry := archive.File[0]
+	if entry.Name != "page_01.jpg" || entry.UncompressedSize64 != chunkSize {
+		t.Fatalf("got entry %s of %d bytes, want page_01.jpg of %d", entry.Name, entry.UncompressedSize64, int64(chunkSize))
+	}
+	if entry.UncompressedSize != 0xffffffff {
+		t.Errorf("got a 32-bit entry size %#x, want 0xffffffff", entry.UncompressedSize)
+	}
+
+	// The reader checks the CRC-32 once the entry is read to its end
+	reader, err := entry.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := io.Copy(io.Discard, reader)
+	reader.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != chunkSize {
+		t.Errorf("read %d bytes of page_01.jpg, want %d", n, int64(chunkSize))
+	}
+
+	last, err := archive.File[1].Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(last)
+	last.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "last chunk" {
+		t.Errorf("got page_02.jpg %q, want %q", data, "last chunk")
+	}
+}
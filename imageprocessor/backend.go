@@ -0,0 +1,259 @@
+package imageprocessor
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+)
+
+// Names of the built-in backends
+const (
+	BackendGo  = "go"
+	BackendCLI = "cli"
+	// BackendVips is another name of BackendCLI
+	BackendVips        = "vips"
+	BackendImageMagick = "imagemagick"
+)
+
+// Backend decodes and cuts the sources of a Processor. The core flow
+// downloads the source, rasterizes SVG files, runs the OutputWidths sets,
+// uploads the chunks and adds the previews and the totals around Split.
+// Backends are registered by name with RegisterBackend and selected by
+// Processor.Backend.
+type Backend interface {
+	// Probe returns the width and height the image at imagePath is split at,
+	// once the transformations of p are applied, without decoding its pixels
+	Probe(ctx context.Context, p *Processor, imagePath string) (int, int, error)
+	// Split writes the chunks of the image at imagePath to outputDir, and
+	// their zip when createZip, and returns their paths in Images
+	Split(ctx context.Context, p *Processor, imagePath string, outputDir string, imagesPrefix string, width int, maxImages int, createZip bool) (ImageResponse, error)
+	// Encode writes a chunk decoded in Go to w with the encoding options of
+	// p, as a PNG when usePNG and a JPEG otherwise
+	Encode(ctx context.Context, p *Processor, w io.Writer, img image.Image, usePNG bool) error
+}
+
+var (
+	backendsMu sync.RWMutex
+	backends   = make(map[string]Backend)
+)
+
+func init() {
+	RegisterBackend(BackendGo, GoBackend{})
+	RegisterBackend(BackendCLI, CLIBackend{})
+	RegisterBackend(BackendVips, CLIBackend{})
+	RegisterBackend(BackendImageMagick, ImageMagickBackend{})
+}
+
+// RegisterBackend makes backend available as name. It panics when name is
+// already registered, like database/sql.Register.
+func RegisterBackend(name string, backend Backend) {
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+
+	if backend == nil {
+		panic("imageprocessor: RegisterBackend backend is nil")
+	}
+	if _, exists := backends[name]; exists {
+		panic("imageprocessor: RegisterBackend called twice for backend " + name)
+	}
+	backends[name] = backend
+}
+
+// Backends returns the sorted names of the registered backends
+func Backends() []string {
+	backendsMu.RLock()
+	defer backendsMu.RUnlock()
+
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// BackendName returns the name of the backend of p, Backend or the one
+// selected by UseCLI when empty. BackendVips is returned as BackendCLI.
+func (p *Processor) BackendName() string {
+	switch {
+	case p.Backend == BackendVips:
+		return BackendCLI
+	case p.Backend != "":
+		return p.Backend
+	case p.UseCLI:
+		return BackendCLI
+	default:
+		return BackendGo
+	}
+}
+
+// backend returns the registered backend of p
+func (p *Processor) backend() (Backend, error) {
+	backendsMu.RLock()
+	defer backendsMu.RUnlock()
+
+	backend, ok := backends[p.BackendName()]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown backend %q", ErrInvalidOptions, p.BackendName())
+	}
+	return backend, nil
+}
+
+// encode writes a chunk decoded in Go with the Encode of the backend of p
+func (p *Processor) encode(ctx context.Context, w io.Writer, img image.Image, usePNG bool) error {
+	backend, err := p.backend()
+	if err != nil {
+		return err
+	}
+	return backend.Encode(ctx, p, w, img, usePNG)
+}
+
+// GoBackend decodes, cuts and encodes the sources in Go. Backends replacing
+// some of its methods can embed it.
+type GoBackend struct{}
+
+func (GoBackend) Probe(ctx context.Context, p *Processor, imagePath string) (int, int, error) {
+	config, err := decodeFileConfig(imagePath)
+	if err != nil {
+		return 0, 0, fmt.Errorf("%w: %v", ErrInvalidSource, err)
+	}
+	return p.outputSize(config.Width, config.Height)
+}
+
+func (GoBackend) Split(ctx context.Context, p *Processor, imagePath string, outputDir string, imagesPrefix string, width int, maxImages int, createZip bool) (ImageResponse, error) {
+	return p.processImageWithGo(ctx, imagePath, outputDir, imagesPrefix, width, maxImages, createZip)
+}
+
+func (GoBackend) Encode(ctx context.Context, p *Processor, w io.Writer, img image.Image, usePNG bool) error {
+	return p.encodeChunk(w, img, usePNG)
+}
+
+// CLIBackend runs vips and zip on the sources. Backends replacing some of
+// its methods can embed it.
+type CLIBackend struct{}
+
+func (CLIBackend) Probe(ctx context.Context, p *Processor, imagePath string) (int, int, error) {
+	width, height, err := vipsDimensions(ctx, imagePath)
+	if err != nil {
+		return 0, 0, err
+	}
+	return p.outputSize(width, height)
+}
+
+func (CLIBackend) Split(ctx context.Context, p *Processor, imagePath string, outputDir string, imagesPrefix string, width int, maxImages int, createZip bool) (ImageResponse, error) {
+	return p.processImageWithCLI(ctx, vipsTools{}, imagePath, outputDir, imagesPrefix, width, maxImages, createZip)
+}
+
+// Encode has vips encode the JPEG chunks like the ones it cuts, from a
+// lossless copy of img. PNG chunks are encoded like in GoBackend.
+func (CLIBackend) Encode(ctx context.Context, p *Processor, w io.Writer, img image.Image, usePNG bool) error {
+	return p.encodeWithCLI(ctx, vipsTools{}, w, img, usePNG)
+}
+
+// cliTools are the image programs run by the CLI backends, vipsTools and
+// magickTools. The intermediate images they write stay lossless.
+type cliTools interface {
+	// dimensions returns the width and height of the image at imagePath
+	dimensions(ctx context.Context, imagePath string) (int, int, error)
+	// prepare applies the transformations of p to the source and returns the
+	// path of the image to split, imagePath when there is nothing to do
+	prepare(ctx context.Context, p *Processor, imagePath string, workDir string) (string, error)
+	// decode returns the path of the image the chunks are cropped from,
+	// imagePath or a copy decoded once when the program reads the source
+	// again for every chunk
+	decode(ctx context.Context, imagePath string, workDir string) (string, error)
+	// removeIntermediates deletes the intermediate images of workDir
+	removeIntermediates(workDir string)
+	// crop writes the rect region of imagePath to the JPEG outputPath, at
+	// quality or the default one of the program when zero
+	crop(ctx context.Context, p *Processor, imagePath string, outputPath string, rect image.Rectangle, quality int) error
+	// instagramTile writes the rect tile of imagePath, padded and scaled
+	// like instagramTile, to workDir and returns its path
+	instagramTile(ctx context.Context, p *Processor, imagePath string, workDir string, rect image.Rectangle, side int) (string, error)
+	// strip writes the strip of the width x height image at imagePath
+	strip(ctx context.Context, p *Processor, imagePath string, width int, height int, outputPath string) error
+}
+
+// encodeWithCLI writes a chunk decoded in Go to w, the JPEG chunks cropped
+// by tools from a lossless copy of img
+func (p *Processor) encodeWithCLI(ctx context.Context, tools cliTools, w io.Writer, img image.Image, usePNG bool) error {
+	if usePNG {
+		return p.encodeChunk(w, img, usePNG)
+	}
+
+	dir, err := os.MkdirTemp(p.TempDir, "encode-")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	sourcePath := filepath.Join(dir, "chunk.png")
+	sourceFile, err := os.Create(sourcePath)
+	if err != nil {
+		return fmt.Errorf("failed to save split image: %v", err)
+	}
+	if err := png.Encode(sourceFile, img); err != nil {
+		sourceFile.Close()
+		return fmt.Errorf("failed to save split image: %v", err)
+	}
+	if err := sourceFile.Close(); err != nil {
+		return fmt.Errorf("failed to save split image: %v", err)
+	}
+
+	outputPath := filepath.Join(dir, "chunk.jpg")
+	bounds := image.Rect(0, 0, img.Bounds().Dx(), img.Bounds().Dy())
+	if err := p.cropChunkWithCLI(ctx, tools, sourcePath, outputPath, bounds); err != nil {
+		return err
+	}
+
+	outputFile, err := os.Open(outputPath)
+	if err != nil {
+		return fmt.Errorf("failed to save split image: %v", err)
+	}
+	defer outputFile.Close()
+
+	if _, err := io.Copy(w, outputFile); err != nil {
+		return fmt.Errorf("failed to save split image: %v", err)
+	}
+	return nil
+}
+
+// vipsTools run vips and vipsheader
+type vipsTools struct{}
+
+func (vipsTools) dimensions(ctx context.Context, imagePath string) (int, int, error) {
+	return vipsDimensions(ctx, imagePath)
+}
+
+func (vipsTools) prepare(ctx context.Context, p *Processor, imagePath string, workDir string) (string, error) {
+	return p.prepareWithCLI(ctx, imagePath, workDir)
+}
+
+// decode keeps the source: vips decodes it lazily, a crop only up to the
+// bottom of its chunk, so an uncompressed copy of the whole image would cost
+// width x height x bands bytes of disk without saving a process
+func (vipsTools) decode(ctx context.Context, imagePath string, workDir string) (string, error) {
+	return imagePath, nil
+}
+
+func (vipsTools) removeIntermediates(workDir string) {
+	removeVipsFiles(workDir)
+}
+
+func (vipsTools) crop(ctx context.Context, p *Processor, imagePath string, outputPath string, rect image.Rectangle, quality int) error {
+	return p.vipsCrop(ctx, imagePath, outputPath, rect, quality)
+}
+
+func (vipsTools) instagramTile(ctx context.Context, p *Processor, imagePath string, workDir string, rect image.Rectangle, side int) (string, error) {
+	return p.instagramTileWithCLI(ctx, imagePath, workDir, rect, side)
+}
+
+func (vipsTools) strip(ctx context.Context, p *Processor, imagePath string, width int, height int, outputPath string) error {
+	return p.writeStripWithCLI(ctx, imagePath, width, height, outputPath)
+}
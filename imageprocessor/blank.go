@@ -0,0 +1,57 @@
+package imageprocessor
+
+import (
+	"fmt"
+	"image"
+)
+
+// blankMaxOther is the largest share of pixels differing from the first one
+// that a blank chunk can have, so scanner noise and specks don't count
+const blankMaxOther = 0.001
+
+// isBlank reports whether img is almost entirely a uniform color, comparing
+// every pixel with the top-left one within gutterTolerance
+func isBlank(img image.Image) bool {
+	bounds := img.Bounds()
+	if bounds.Empty() {
+		return true
+	}
+
+	first := img.At(bounds.Min.X, bounds.Min.Y)
+	maxOther := int(float64(bounds.Dx()*bounds.Dy()) * blankMaxOther)
+
+	other := 0
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			for _, diff := range channelDiffs(first, img.At(x, y)) {
+				if diff > gutterTolerance {
+					other++
+					break
+				}
+			}
+			if other > maxOther {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// isBlankFile reports whether the image at path is blank, see isBlank
+func isBlankFile(path string) (bool, error) {
+	img, _, err := decodeFile(path)
+	if err != nil {
+		return false, fmt.Errorf("failed to read split image: %v", err)
+	}
+	return isBlank(img), nil
+}
+
+// skippedNames returns the file names of the chunks at the zero based indexes
+func skippedNames(imagesPrefix string, indexes []int) []string {
+	var names []string
+	for _, index := range indexes {
+		names = append(names, chunkFileName(imagesPrefix, index))
+	}
+	return names
+}
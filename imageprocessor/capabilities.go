@@ -0,0 +1,279 @@
+package imageprocessor
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Programs looked up by DetectCapabilities
+const (
+	ProgramVips        = "vips"
+	ProgramVipsHeader  = "vipsheader"
+	ProgramZip         = "zip"
+	ProgramCurl        = "curl"
+	ProgramCJPEG       = "cjpeg"
+	ProgramRSVGConvert = "rsvg-convert"
+	ProgramConvert     = "convert"
+	ProgramIdentify    = "identify"
+)
+
+// vipsFormats are the formats probed in vips, with the extension vips picks
+// their loader and saver from
+var vipsFormats = []struct {
+	name      string
+	extension string
+}{
+	{"jpeg", ".jpg"},
+	{"png", ".png"},
+	{"webp", ".webp"},
+	{"gif", ".gif"},
+	{"tiff", ".tif"},
+	{"svg", ".svg"},
+	{"heif", ".heic"},
+	{"avif", ".avif"},
+	{"jxl", ".jxl"},
+}
+
+// Capabilities are the programs installed on the host and the formats vips
+// reads and writes, see DetectCapabilities. A Processor with Capabilities
+// routes its sources to the programs that can handle them, and refuses the
+// others with ErrUnsupportedInput, instead of failing on a missing program.
+type Capabilities struct {
+	// VipsVersion is the version of libvips, empty without vips
+	VipsVersion string `json:"vips_version,omitempty"`
+	// Programs maps the Program constants to whether they were found
+	Programs map[string]bool `json:"programs"`
+	// Loaders and Savers are the formats vips can read and write
+	Loaders []string `json:"loaders"`
+	Savers  []string `json:"savers"`
+}
+
+// DetectCapabilities looks up the programs of the backends in the PATH, the
+// cjpeg and rsvg-convert binaries at their configured paths, and asks vips
+// for its version and formats. Every saver is tried on a blank image, e.g.
+// an AVIF saver of a libheif without an AV1 encoder is not reported.
+func DetectCapabilities(ctx context.Context, cjpegPath string, rsvgConvertPath string) *Capabilities {
+	c := &Capabilities{
+		Programs: make(map[string]bool),
+		Loaders:  []string{},
+		Savers:   []string{},
+	}
+
+	paths := map[string]string{
+		ProgramVips:        "vips",
+		ProgramVipsHeader:  "vipsheader",
+		ProgramZip:         "zip",
+		ProgramCurl:        "curl",
+		ProgramCJPEG:       cjpegPath,
+		ProgramRSVGConvert: rsvgConvertPath,
+		ProgramConvert:     "convert",
+		ProgramIdentify:    "identify",
+	}
+	for program, path := range paths {
+		if path == "" {
+			path = program
+		}
+		_, err := exec.LookPath(path)
+		c.Programs[program] = err == nil
+	}
+
+	if !c.Programs[ProgramVips] {
+		return c
+	}
+
+	if output, err := exec.CommandContext(ctx, "vips", "--version").Output(); err == nil {
+		c.VipsVersion = strings.TrimPrefix(strings.TrimSpace(string(output)), "vips-")
+	}
+
+	output, err := exec.CommandContext(ctx, "vips", "-l", "foreign").Output()
+	if err != nil {
+		return c
+	}
+	loaders, savers := vipsForeignExtensions(output)
+
+	dir, err := os.MkdirTemp("", "capabilities-")
+	if err != nil {
+		return c
+	}
+	defer os.RemoveAll(dir)
+
+	for _, format := range vipsFormats {
+		if loaders[format.extension] {
+			c.Loaders = append(c.Loaders, format.name)
+		}
+		if !savers[format.extension] {
+			continue
+		}
+
+		probe := filepath.Join(dir, "probe"+format.extension)
+		if err := exec.CommandContext(ctx, "vips", "black", probe, "8", "8").Run(); err == nil {
+			c.Savers = append(c.Savers, format.name)
+		}
+	}
+
+	return c
+}
+
+// vipsForeignExtensions returns the file extensions of the loaders and of
+// the savers listed by "vips -l foreign", from lines like
+// "VipsForeignLoadHeifFile (heifload), load a HEIF image (.heic, .heif, .avif), ..."
+func vipsForeignExtensions(output []byte) (map[string]bool, map[string]bool) {
+	loaders := make(map[string]bool)
+	savers := make(map[string]bool)
+
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		start := strings.Index(line, "(")
+		end := strings.Index(line, ")")
+		if start < 0 || end < start {
+			continue
+		}
+		operation := line[start+1 : end]
+
+		var extensions map[string]bool
+		switch {
+		case strings.HasSuffix(operation, "load"):
+			extensions = loaders
+		case strings.HasSuffix(operation, "save"):
+			extensions = savers
+		default:
+			continue
+		}
+
+		// The extensions are the second parenthesized list
+		rest := line[end+1:]
+		start = strings.Index(rest, "(.")
+		end = strings.Index(rest, ")")
+		if start < 0 || end < start {
+			continue
+		}
+		for _, extension := range strings.Split(rest[start+1:end], ",") {
+			extensions[strings.ToLower(strings.TrimSpace(extension))] = true
+		}
+	}
+
+	return loaders, savers
+}
+
+// Has reports whether program, one of the Program constants, is installed
+func (c *Capabilities) Has(program string) bool {
+	return c.Programs[program]
+}
+
+// Loads reports whether vips reads the format
+func (c *Capabilities) Loads(format string) bool {
+	return c.Programs[ProgramVips] && slices.Contains(c.Loaders, format)
+}
+
+// Missing returns the programs the built-in backend name needs that are not
+// installed. The Go backend needs none.
+func (c *Capabilities) Missing(name string) []string {
+	var needed []string
+	switch name {
+	case BackendCLI, BackendVips:
+		needed = []string{ProgramVips, ProgramVipsHeader, ProgramZip, ProgramCurl}
+	case BackendImageMagick:
+		needed = []string{ProgramConvert, ProgramIdentify, ProgramZip}
+	}
+
+	var missing []string
+	for _, program := range needed {
+		if !c.Has(program) {
+			missing = append(missing, program)
+		}
+	}
+	return missing
+}
+
+// vipsOnlyFormat returns the format of the source starting with header when
+// only vips decodes it, heif, avif, jxl or tiff, and an empty string for
+// the formats the Go backend decodes
+func vipsOnlyFormat(header []byte) string {
+	switch {
+	case len(header) >= 12 && bytes.Equal(header[4:8], []byte("ftyp")):
+		// The compatible brands follow the major brand in the ftyp box
+		box := header[8:min(len(header), 64)]
+		switch {
+		case bytes.Contains(box, []byte("avif")), bytes.Contains(box, []byte("avis")):
+			return "avif"
+		case bytes.Contains(box, []byte("heic")), bytes.Contains(box, []byte("heix")),
+			bytes.Contains(box, []byte("mif1")), bytes.Contains(box, []byte("msf1")):
+			return "heif"
+		}
+	case bytes.HasPrefix(header, []byte{0xFF, 0x0A}),
+		bytes.HasPrefix(header, []byte("\x00\x00\x00\x0cJXL \r\n\x87\n")):
+		return "jxl"
+	case bytes.HasPrefix(header, []byte("II*\x00")), bytes.HasPrefix(header, []byte("MM\x00*")):
+		return "tiff"
+	}
+	return ""
+}
+
+// vipsOnlyFormatFile is like vipsOnlyFormat for the image at path
+func vipsOnlyFormatFile(path string) string {
+	file, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer file.Close()
+
+	header := make([]byte, 64)
+	n, _ := file.Read(header)
+	return vipsOnlyFormat(header[:n])
+}
+
+// routeSource returns p, or a copy of p splitting with BackendCLI when the Go
+// backend cannot decode the source at imagePath and vips can. Sources no
+// installed program decodes fail with ErrUnsupportedInput.
+func (p *Processor) routeSource(imagePath string, createZip bool) (*Processor, error) {
+	if p.Capabilities == nil || p.BackendName() != BackendGo {
+		return p, nil
+	}
+
+	format := vipsOnlyFormatFile(imagePath)
+	if format == "" {
+		return p, nil
+	}
+
+	var missing []string
+	if !p.Capabilities.Loads(format) {
+		missing = append(missing, "vips with a "+format+" loader")
+	}
+	if !p.Capabilities.Has(ProgramVipsHeader) {
+		missing = append(missing, ProgramVipsHeader)
+	}
+	if createZip && !p.Capabilities.Has(ProgramZip) {
+		missing = append(missing, ProgramZip)
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("%w: %s sources need %s", ErrUnsupportedInput, format, strings.Join(missing, " and "))
+	}
+
+	job := *p
+	job.Backend = BackendCLI
+	return &job, nil
+}
+
+// svgWithVips reports whether SVG sources are rasterized with vips, always
+// with BackendCLI and when rsvg-convert is missing otherwise
+func (p *Processor) svgWithVips() (bool, error) {
+	if p.BackendName() == BackendCLI {
+		return true, nil
+	}
+	if p.Capabilities == nil || p.Capabilities.Has(ProgramRSVGConvert) {
+		return false, nil
+	}
+	if p.Capabilities.Loads("svg") {
+		return true, nil
+	}
+	return false, fmt.Errorf("%w: SVG sources need rsvg-convert or vips with an svg loader", ErrUnsupportedInput)
+}
@@ -0,0 +1,27 @@
+package imageprocessor
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+// ErrChecksumMismatch is wrapped by the error of a download whose digest
+// differs from ExpectedSHA256
+var ErrChecksumMismatch = errors.New("source checksum mismatch")
+
+// sourceDigest returns the hex SHA-256 digest of the source downloaded in
+// memory, or at path when source is nil
+func sourceDigest(source []byte, path string) (string, error) {
+	if source != nil {
+		sum := sha256.Sum256(source)
+		return hex.EncodeToString(sum[:]), nil
+	}
+
+	sum, err := fileSHA256(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to hash image: %v", err)
+	}
+	return hex.EncodeToString(sum[:]), nil
+}
@@ -0,0 +1,80 @@
+package imageprocessor
+
+import (
+	"bytes"
+	"errors"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// serveSource serves the PNG sampleImage at every path
+func serveSource(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	var source bytes.Buffer
+	if err := png.Encode(&source, sampleImage()); err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(source.Bytes())
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestChecksumMismatch(t *testing.T) {
+	server := serveSource(t)
+	wrongSHA256 := strings.Repeat("0", 64)
+
+	t.Run("new output", func(t *testing.T) {
+		dir := t.TempDir()
+		p := Processor{OutputBaseDir: dir, OutputName: "page", MaxHeight: 10, ExpectedSHA256: wrongSHA256}
+
+		_, err := p.ProcessImage(server.URL+"/page.png", "page", 0, 0, false)
+		if !errors.Is(err, ErrChecksumMismatch) {
+			t.Fatalf("got %v, want ErrChecksumMismatch", err)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "page")); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("the output directory of the job was kept: %v", err)
+		}
+	})
+
+	t.Run("resumed output", func(t *testing.T) {
+		dir := t.TempDir()
+		outputDir := filepath.Join(dir, "page")
+		if err := os.Mkdir(outputDir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		earlier := []string{chunkFileName("page", 0), progressFileName}
+		for _, name := range earlier {
+			if err := os.WriteFile(filepath.Join(outputDir, name), []byte("earlier job"), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		p := Processor{
+			OutputBaseDir:   dir,
+			OutputName:      "page",
+			OutputCollision: OutputCollisionResume,
+			MaxHeight:       10,
+			ExpectedSHA256:  wrongSHA256,
+		}
+
+		_, err := p.ProcessImage(server.URL+"/page.png", "page", 0, 0, false)
+		if !errors.Is(err, ErrChecksumMismatch) {
+			t.Fatalf("got %v, want ErrChecksumMismatch", err)
+		}
+		for _, name := range earlier {
+			if _, err := os.Stat(filepath.Join(outputDir, name)); err != nil {
+				t.Errorf("%s of the earlier job was removed: %v", name, err)
+			}
+		}
+	})
+}
@@ -0,0 +1,50 @@
+package imageprocessor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ErrTooManyChunks is returned before anything is encoded when a job would
+// write more than MaxChunks chunks
+var ErrTooManyChunks = errors.New("too many chunks")
+
+// checkChunkCount returns ErrTooManyChunks when count chunks, on top of the
+// chunks of the previous sets, exceed MaxChunks
+func (p *Processor) checkChunkCount(count int) error {
+	if p.MaxChunks > 0 && p.previousChunks+count > p.MaxChunks {
+		return fmt.Errorf("%w: the job would write %d chunks, the limit is %d", ErrTooManyChunks, p.previousChunks+count, p.MaxChunks)
+	}
+	return nil
+}
+
+// checkSetsChunkCount checks the chunks of all the OutputWidths sets against
+// MaxChunks from the header of the image at imagePath, before the first set
+// is split, probed by the backend. The gutters of SplitModePanels are only
+// found by each set.
+func (p *Processor) checkSetsChunkCount(ctx context.Context, imagePath string, requestedWidth int, maxImages int) error {
+	if p.MaxChunks <= 0 || p.SplitMode == SplitModePanels {
+		return nil
+	}
+
+	backend, err := p.backend()
+	if err != nil {
+		return err
+	}
+
+	count := 0
+	for _, setWidth := range p.OutputWidths {
+		set := *p
+		set.ScaleWidth = setWidth
+
+		// Sources the backend cannot probe are checked by each set
+		width, height, err := backend.Probe(ctx, &set, imagePath)
+		if err != nil {
+			return nil
+		}
+		count += len(set.chunkRects(width, height, requestedWidth, maxImages))
+	}
+
+	return p.checkChunkCount(count)
+}
@@ -0,0 +1,210 @@
+package imageprocessor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned without a download for the sources of a host
+// whose last downloads all failed, until its cooldown ends
+var ErrCircuitOpen = errors.New("source host unavailable")
+
+// CircuitOpenError is the ErrCircuitOpen of a host, RetryAfter is the rest
+// of its cooldown
+type CircuitOpenError struct {
+	Host       string
+	RetryAfter time.Duration
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("%v: the last downloads from %s failed, retry in %s", ErrCircuitOpen, e.Host, e.RetryAfter.Round(time.Second))
+}
+
+func (e *CircuitOpenError) Unwrap() error {
+	return ErrCircuitOpen
+}
+
+// hostFailure is a download the source host failed, without a response or
+// with a server error status. The other failures, e.g. a 404 or a full disk,
+// say nothing about the host.
+type hostFailure struct {
+	error
+}
+
+// curlExitPattern and curlStatusPattern match the exit code and the HTTP
+// status in the error message of curl
+var (
+	curlExitPattern   = regexp.MustCompile(`curl: \((\d+)\)`)
+	curlStatusPattern = regexp.MustCompile(`returned error: (\d{3})`)
+)
+
+// curlHostFailure reports whether the curl output is a failure of the host:
+// it could not be resolved or reached, timed out, broke the transfer or
+// returned a server error
+func curlHostFailure(output string) bool {
+	match := curlExitPattern.FindStringSubmatch(output)
+	if match == nil {
+		return false
+	}
+
+	switch match[1] {
+	case "6", "7", "28", "35", "52", "56":
+		return true
+	case "22":
+		status := curlStatusPattern.FindStringSubmatch(output)
+		if status == nil {
+			return false
+		}
+		code, _ := strconv.Atoi(status[1])
+		return code >= 500
+	}
+	return false
+}
+
+// CircuitBreaker fails the downloads from a host fast for a cooldown once a
+// threshold of them failed in a row. A single download then probes the host
+// and closes the circuit when it succeeds. A nil CircuitBreaker allows every
+// download.
+type CircuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu    sync.Mutex
+	hosts map[string]*hostCircuit
+}
+
+// hostCircuit is the state of the downloads from a host
+type hostCircuit struct {
+	failures  int
+	openUntil time.Time
+	// probing is set while the download after the cooldown runs
+	probing bool
+}
+
+// NewCircuitBreaker returns a breaker opening after threshold consecutive
+// failures of a host, or nil (disabled) when threshold is not positive
+func NewCircuitBreaker(threshold int, cooldown time.Duration) *CircuitBreaker {
+	if threshold <= 0 {
+		return nil
+	}
+	return &CircuitBreaker{threshold: threshold, cooldown: cooldown, hosts: make(map[string]*hostCircuit)}
+}
+
+// sourceHost returns the host the circuit of the source at rawURL is kept for
+func sourceHost(rawURL string) string {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(parsed.Host)
+}
+
+// do runs download, the download of the source at rawURL, unless the circuit
+// of its host is open, and records its outcome. A download stopped by ctx is
+// not counted.
+func (b *CircuitBreaker) do(ctx context.Context, rawURL string, download func() error) error {
+	if b == nil {
+		return download()
+	}
+
+	host := sourceHost(rawURL)
+	if err := b.allow(host); err != nil {
+		return err
+	}
+
+	err := download()
+
+	var failure hostFailure
+	switch {
+	case ctx.Err() != nil:
+		b.cancelled(host)
+	case errors.As(err, &failure):
+		b.failed(host)
+	default:
+		b.succeeded(host)
+	}
+	return err
+}
+
+// allow returns a *CircuitOpenError while the circuit of host is open or
+// another download probes it
+func (b *CircuitBreaker) allow(host string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	circuit, ok := b.hosts[host]
+	if !ok || circuit.failures < b.threshold {
+		return nil
+	}
+
+	remaining := time.Until(circuit.openUntil)
+	if remaining > 0 || circuit.probing {
+		return &CircuitOpenError{Host: host, RetryAfter: max(remaining, 0)}
+	}
+	circuit.probing = true
+	return nil
+}
+
+// failed counts a failure of host, the circuit opens at the threshold and
+// again after a failed probe
+func (b *CircuitBreaker) failed(host string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	circuit, ok := b.hosts[host]
+	if !ok {
+		circuit = &hostCircuit{}
+		b.hosts[host] = circuit
+	}
+
+	circuit.failures++
+	circuit.probing = false
+	if circuit.failures >= b.threshold {
+		circuit.openUntil = time.Now().Add(b.cooldown)
+	}
+}
+
+// succeeded closes the circuit of host
+func (b *CircuitBreaker) succeeded(host string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.hosts, host)
+}
+
+// cancelled lets the next download probe host when a probe was stopped
+func (b *CircuitBreaker) cancelled(host string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if circuit, ok := b.hosts[host]; ok {
+		circuit.probing = false
+	}
+}
+
+// OpenHosts returns the hosts whose circuit is open, sorted
+func (b *CircuitBreaker) OpenHosts() []string {
+	if b == nil {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	hosts := []string{}
+	for host, circuit := range b.hosts {
+		if circuit.failures >= b.threshold {
+			hosts = append(hosts, host)
+		}
+	}
+	sort.Strings(hosts)
+	return hosts
+}
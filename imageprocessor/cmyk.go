@@ -0,0 +1,146 @@
+package imageprocessor
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+)
+
+// adobeAPP14 is an Adobe segment with the "unknown" (plain CMYK) transform
+var adobeAPP14 = []byte{
+	0xFF, 0xEE, 0x00, 0x0E,
+	'A', 'd', 'o', 'b', 'e',
+	0x00, 0x64, // version 100
+	0x00, 0x00, // flags0
+	0x00, 0x00, // flags1
+	0x00, // transform
+}
+
+// decodeImage decodes an image like image.Decode, converting CMYK JPEGs to RGB
+// so they are split and encoded with the right colors. A decoder panic on a
+// malformed image is returned as an error wrapping ErrInvalidSource.
+func decodeImage(r io.Reader) (img image.Image, format string, err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			img, format, err = nil, "", fmt.Errorf("%w: decoder panic: %v", ErrInvalidSource, recovered)
+		}
+	}()
+
+	r, inverted, err := withAdobeMarker(r)
+	if err != nil {
+		return nil, "", err
+	}
+
+	img, format, err = image.Decode(r)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if cmyk, ok := img.(*image.CMYK); ok {
+		return cmykToRGBA(cmyk, inverted), format, nil
+	}
+
+	return img, format, nil
+}
+
+// withAdobeMarker returns a reader of the same image as r. The Go decoder
+// rejects 4-component JPEGs without an Adobe APP14 segment and assumes the
+// Adobe convention of inverted CMYK values, so a segment is inserted for such
+// files and inverted reports that the decoded values must be inverted back.
+func withAdobeMarker(r io.Reader) (io.Reader, bool, error) {
+	br := bufio.NewReader(r)
+
+	soi, err := br.Peek(2)
+	if err != nil || soi[0] != 0xFF || soi[1] != 0xD8 {
+		return br, false, nil
+	}
+
+	var head bytes.Buffer
+	head.Write(soi)
+	br.Discard(2)
+
+	components, hasAdobe := 0, false
+
+	for components == 0 {
+		marker := make([]byte, 2)
+		if _, err := io.ReadFull(br, marker); err != nil || marker[0] != 0xFF {
+			break
+		}
+		head.Write(marker)
+
+		// Markers without a length, and the start of the scan data
+		if marker[1] == 0xD8 || marker[1] == 0x01 || (marker[1] >= 0xD0 && marker[1] <= 0xDA) {
+			break
+		}
+
+		var length uint16
+		if err := binary.Read(br, binary.BigEndian, &length); err != nil || length < 2 {
+			break
+		}
+		binary.Write(&head, binary.BigEndian, length)
+
+		segment := make([]byte, length-2)
+		if _, err := io.ReadFull(br, segment); err != nil {
+			return nil, false, fmt.Errorf("failed to read JPEG header: %v", err)
+		}
+		head.Write(segment)
+
+		switch {
+		case marker[1] == 0xEE && bytes.HasPrefix(segment, []byte("Adobe")):
+			hasAdobe = true
+		case isSOFMarker(marker[1]) && len(segment) >= 6:
+			components = int(segment[5])
+		}
+	}
+
+	if components != 4 || hasAdobe {
+		return io.MultiReader(&head, br), false, nil
+	}
+
+	header := head.Bytes()
+	fixed := make([]byte, 0, len(header)+len(adobeAPP14))
+	fixed = append(fixed, header[:2]...)
+	fixed = append(fixed, adobeAPP14...)
+	fixed = append(fixed, header[2:]...)
+
+	return io.MultiReader(bytes.NewReader(fixed), br), true, nil
+}
+
+// isSOFMarker reports whether a JPEG marker starts a frame
+func isSOFMarker(marker byte) bool {
+	return marker >= 0xC0 && marker <= 0xCF && marker != 0xC4 && marker != 0xC8 && marker != 0xCC
+}
+
+// cmykToRGBA converts img to RGB, inverting the values first when they were
+// decoded with the Adobe convention from a plain CMYK file
+func cmykToRGBA(img *image.CMYK, inverted bool) *image.RGBA {
+	bounds := img.Bounds()
+	rgba := image.NewRGBA(bounds)
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		src := img.Pix[img.PixOffset(bounds.Min.X, y):]
+		dst := rgba.Pix[rgba.PixOffset(bounds.Min.X, y):]
+
+		for x := 0; x < bounds.Dx(); x++ {
+			c, m, yy, k := src[4*x], src[4*x+1], src[4*x+2], src[4*x+3]
+			if inverted {
+				c, m, yy, k = 255-c, 255-m, 255-yy, 255-k
+			}
+
+			r, g, b := color.CMYKToRGB(c, m, yy, k)
+			dst[4*x], dst[4*x+1], dst[4*x+2], dst[4*x+3] = r, g, b, 255
+		}
+	}
+
+	return rgba
+}
+
+// isCMYKFile reports whether the image at path is a CMYK JPEG
+func isCMYKFile(path string) bool {
+	config, err := decodeFileConfig(path)
+	return err == nil && config.ColorModel == color.CMYKModel
+}
@@ -0,0 +1,84 @@
+package imageprocessor
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+)
+
+// CompressionReport compares the size of the chunks with the source, to
+// tell whether the encoding options inflate the storage
+type CompressionReport struct {
+	SourceBytes int64 `json:"source_bytes"`
+	ChunkBytes  int64 `json:"chunk_bytes"`
+	// Ratio is ChunkBytes over SourceBytes, above 1 when the chunks take
+	// more space than the source
+	Ratio  float64            `json:"ratio"`
+	Chunks []ChunkCompression `json:"chunks"`
+}
+
+// ChunkCompression compares a chunk with the part of the source it covers
+type ChunkCompression struct {
+	Name string `json:"name"`
+	// SourceBytes is the share of the source of the chunk by pixel area,
+	// among the chunks of its set. Left out when a chunk cannot be decoded.
+	SourceBytes int64   `json:"source_bytes,omitempty"`
+	Bytes       int64   `json:"bytes"`
+	Ratio       float64 `json:"ratio,omitempty"`
+}
+
+// compressionRatio returns after over before rounded to 3 decimals
+func compressionRatio(after int64, before int64) float64 {
+	if before <= 0 {
+		return 0
+	}
+	return math.Round(float64(after)/float64(before)*1000) / 1000
+}
+
+// addCompression sets the compression report of the chunks of a finished
+// job from a source of sourceBytes. Every chunk set covers the whole source.
+func (r *ImageResponse) addCompression(sourceBytes int64) {
+	if sourceBytes <= 0 || len(r.Images) == 0 {
+		return
+	}
+
+	sets := [][]string{r.Images}
+	if len(r.Sets) > 0 {
+		sets = sets[:0]
+		for _, set := range r.Sets {
+			sets = append(sets, set.Images)
+		}
+	}
+
+	report := &CompressionReport{SourceBytes: sourceBytes}
+	for _, images := range sets {
+		chunks := make([]ChunkCompression, len(images))
+		areas := make([]int64, len(images))
+		var totalArea int64
+		for i, image := range images {
+			path := filepath.Join(r.OutputDir, filepath.Base(image))
+			chunks[i].Name = filepath.Base(image)
+			if info, err := os.Stat(path); err == nil {
+				chunks[i].Bytes = info.Size()
+			}
+			report.ChunkBytes += chunks[i].Bytes
+
+			if config, err := decodeFileConfig(path); err == nil {
+				areas[i] = int64(config.Width) * int64(config.Height)
+			}
+			totalArea += areas[i]
+		}
+
+		for i := range chunks {
+			if areas[i] == 0 || totalArea == 0 {
+				continue
+			}
+			chunks[i].SourceBytes = sourceBytes * areas[i] / totalArea
+			chunks[i].Ratio = compressionRatio(chunks[i].Bytes, chunks[i].SourceBytes)
+		}
+		report.Chunks = append(report.Chunks, chunks...)
+	}
+
+	report.Ratio = compressionRatio(report.ChunkBytes, sourceBytes)
+	r.Compression = report
+}
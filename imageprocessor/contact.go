@@ -0,0 +1,143 @@
+package imageprocessor
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/jempe/imagesplitter/internal/jpegenc"
+	"golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+// Layout of the contact sheet
+const (
+	// contactThumbHeight is the height the tallest chunk is scaled down to
+	contactThumbHeight = 600
+	// contactColumns is the number of chunks on every row
+	contactColumns = 10
+	// contactLabelHeight is the space above every thumbnail for its name
+	contactLabelHeight = 18
+	// contactMargin separates the thumbnails
+	contactMargin = 12
+)
+
+var contactBackground = color.Gray{Y: 0xEE}
+
+// contactSheetFileName returns the name of the contact sheet of a job
+func contactSheetFileName(imagesPrefix string) string {
+	return imagesPrefix + "_contact.jpg"
+}
+
+// writeContactSheet lays out the chunks at chunkPaths in order, scaled down
+// to the same factor and labeled with their file name, and saves the
+// montage as a JPEG at outputPath
+func writeContactSheet(ctx context.Context, chunkPaths []string, outputPath string) error {
+	if len(chunkPaths) == 0 {
+		return nil
+	}
+
+	// Read the chunk sizes first to lay out the sheet
+	sizes := make([]image.Point, len(chunkPaths))
+	tallest := 0
+	for i, chunkPath := range chunkPaths {
+		config, err := decodeFileConfig(chunkPath)
+		if err != nil {
+			return fmt.Errorf("failed to read chunk for contact sheet: %v", err)
+		}
+		sizes[i] = image.Pt(config.Width, config.Height)
+		tallest = max(tallest, config.Height)
+	}
+
+	scale := 1.0
+	if tallest > contactThumbHeight {
+		scale = float64(contactThumbHeight) / float64(tallest)
+	}
+
+	thumbs := make([]image.Rectangle, len(sizes))
+	sheetWidth, sheetHeight := 0, 0
+	x, y, rowHeight := contactMargin, contactMargin, 0
+	for i, size := range sizes {
+		if i > 0 && i%contactColumns == 0 {
+			x = contactMargin
+			y += rowHeight + contactMargin
+			rowHeight = 0
+		}
+
+		width := max(1, int(float64(size.X)*scale))
+		height := max(1, int(float64(size.Y)*scale))
+
+		thumbs[i] = image.Rect(x, y+contactLabelHeight, x+width, y+contactLabelHeight+height)
+
+		x += width + contactMargin
+		rowHeight = max(rowHeight, contactLabelHeight+height)
+		sheetWidth = max(sheetWidth, x)
+		sheetHeight = max(sheetHeight, y+rowHeight+contactMargin)
+	}
+
+	sheet := image.NewRGBA(image.Rect(0, 0, sheetWidth, sheetHeight))
+	draw.Draw(sheet, sheet.Bounds(), image.NewUniform(contactBackground), image.Point{}, draw.Src)
+
+	labels := &font.Drawer{
+		Dst:  sheet,
+		Src:  image.Black,
+		Face: basicfont.Face7x13,
+	}
+
+	for i, chunkPath := range chunkPaths {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		chunk, _, err := decodeFile(chunkPath)
+		if err != nil {
+			return fmt.Errorf("failed to read chunk for contact sheet: %v", err)
+		}
+
+		draw.ApproxBiLinear.Scale(sheet, thumbs[i], chunk, chunk.Bounds(), draw.Src, nil)
+
+		labels.Dot = fixed.P(thumbs[i].Min.X, thumbs[i].Min.Y-5)
+		labels.DrawString(strings.TrimSuffix(filepath.Base(chunkPath), filepath.Ext(chunkPath)))
+	}
+
+	outFile, err := os.Create(outputPath)
+	if err != nil {
+		return fmt.Errorf("failed to create contact sheet: %v", err)
+	}
+	defer outFile.Close()
+
+	if err := jpegenc.Encode(outFile, sheet, &jpegenc.Options{Quality: jpegQuality}); err != nil {
+		return fmt.Errorf("failed to save contact sheet: %v", err)
+	}
+
+	return outFile.Close()
+}
+
+// decodeFile decodes the image at path and returns it with its format name
+func decodeFile(path string) (image.Image, string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, "", err
+	}
+	defer file.Close()
+
+	return decodeImage(file)
+}
+
+// decodeFileConfig decodes the header of the image at path
+func decodeFileConfig(path string) (image.Config, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return image.Config{}, err
+	}
+	defer file.Close()
+
+	config, _, err := image.DecodeConfig(file)
+	return config, err
+}
@@ -0,0 +1,147 @@
+package imageprocessor
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// resultFileName is the result of a ContentAddressed job, saved in its output
+// directory once it succeeds and returned to the identical jobs after it
+const resultFileName = "result.json"
+
+// pendingDirPrefix starts the names of the directories ContentAddressed jobs
+// download their source to, before the digest names their output directory
+const pendingDirPrefix = "pending-"
+
+// contentDirLength is the length of the names of the ContentAddressed output
+// directories, 128 bits of the content key in hex
+const contentDirLength = 32
+
+// contentDirs are the ContentAddressed output directories being written
+var contentDirs sync.Map
+
+// IsContentDirName reports whether name can be the output directory of a
+// ContentAddressed job
+func IsContentDirName(name string) bool {
+	return len(name) == contentDirLength && strings.Trim(name, "0123456789abcdef") == ""
+}
+
+// contentAddressed reports whether the output directory of the job is named
+// by its content key, OutputName takes precedence
+func (p *Processor) contentAddressed() bool {
+	return p.ContentAddressed && p.OutputName == ""
+}
+
+// contentKey returns the key of a job splitting the source with the digest
+// sourceSHA256, from the resume key and the options adding files next to
+// the chunks
+func (p *Processor) contentKey(sourceSHA256 string, imagesPrefix string, width int, maxImages int, createZip bool) (string, error) {
+	resumeKey, err := p.resumeKey(sourceSHA256, imagesPrefix, width, maxImages)
+	if err != nil {
+		return "", err
+	}
+
+	options := struct {
+		ResumeKey    string
+		CreateZip    bool
+		HTMLPreview  bool
+		ContactSheet bool
+		StripWidth   int
+		Dedupe       bool
+		Verify       bool
+		InMemory     bool
+	}{
+		resumeKey, createZip, p.HTMLPreview, p.ContactSheet, p.StripWidth, p.Dedupe, p.Verify, p.InMemory,
+	}
+
+	data, err := json.Marshal(options)
+	if err != nil {
+		return "", fmt.Errorf("failed to compute the content key: %v", err)
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// claimContentDir moves the pending directory of a job to the output
+// directory named by key and returns its name. The result of an earlier
+// job of the key is returned instead when it succeeded, and the pending
+// directory is removed. The directory is released by the returned function.
+func (p *Processor) claimContentDir(pendingDir string, key string) (string, *ImageResponse, func(), error) {
+	name := key[:contentDirLength]
+	outputDir := filepath.Join(p.OutputBaseDir, name)
+
+	if _, busy := contentDirs.LoadOrStore(outputDir, struct{}{}); busy {
+		os.RemoveAll(pendingDir)
+		return "", nil, nil, fmt.Errorf("%w: an identical job is writing %s", ErrOutputExists, name)
+	}
+	release := func() { contentDirs.Delete(outputDir) }
+
+	stored, err := readStoredResult(outputDir)
+	if err == nil {
+		os.RemoveAll(pendingDir)
+		// A reused output expires after its last use
+		now := time.Now()
+		os.Chtimes(outputDir, now, now)
+		return name, stored, release, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		release()
+		os.RemoveAll(pendingDir)
+		return "", nil, nil, err
+	}
+
+	// A directory without a result is the partial output of a failed job
+	if err := os.RemoveAll(outputDir); err != nil {
+		release()
+		os.RemoveAll(pendingDir)
+		return "", nil, nil, fmt.Errorf("failed to remove a partial output: %v", err)
+	}
+	if err := os.Rename(pendingDir, outputDir); err != nil {
+		release()
+		os.RemoveAll(pendingDir)
+		return "", nil, nil, fmt.Errorf("failed to create output directory: %v", err)
+	}
+	return name, nil, release, nil
+}
+
+// readStoredResult returns the result saved in outputDir by storeResult
+func readStoredResult(outputDir string) (*ImageResponse, error) {
+	data, err := os.ReadFile(filepath.Join(outputDir, resultFileName))
+	if err != nil {
+		return nil, err
+	}
+
+	var result ImageResponse
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, fmt.Errorf("failed to read the stored result: %v", err)
+	}
+	result.OutputDir = outputDir
+	return &result, nil
+}
+
+// storeResult saves the result of a ContentAddressed job in its output
+// directory, through a temporary file so a partial result is never reused
+func storeResult(result *ImageResponse) error {
+	data, err := json.Marshal(result)
+	if err != nil {
+		return fmt.Errorf("failed to store the result: %v", err)
+	}
+
+	path := filepath.Join(result.OutputDir, resultFileName)
+	if err := os.WriteFile(path+".tmp", data, 0644); err != nil {
+		return fmt.Errorf("failed to store the result: %v", err)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return fmt.Errorf("failed to store the result: %v", err)
+	}
+	return nil
+}
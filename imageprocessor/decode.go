@@ -0,0 +1,129 @@
+package imageprocessor
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"os"
+	"time"
+)
+
+// DefaultMaxSourcePixels bounds the sources decoded in Go when
+// MaxSourcePixels is zero. 250 megapixels take 1 GB once decoded as RGBA.
+const DefaultMaxSourcePixels = 250_000_000
+
+// ErrInvalidSource is wrapped by the errors of sources the decoder rejects,
+// crashes on or that exceed the decode limits
+var ErrInvalidSource = errors.New("invalid source image")
+
+// maxSourcePixels returns the pixel limit of the decoded sources
+func (p *Processor) maxSourcePixels() int64 {
+	if p.MaxSourcePixels > 0 {
+		return p.MaxSourcePixels
+	}
+	return DefaultMaxSourcePixels
+}
+
+// checkSourceSize returns an error when a source of the given dimensions
+// exceeds the pixel limit
+func (p *Processor) checkSourceSize(width int, height int) error {
+	if width <= 0 || height <= 0 {
+		return fmt.Errorf("%w: invalid image dimensions: %dx%d", ErrInvalidSource, width, height)
+	}
+
+	if limit := p.maxSourcePixels(); int64(width)*int64(height) > limit {
+		return fmt.Errorf("%w: %dx%d image exceeds the limit of %d pixels", ErrInvalidSource, width, height, limit)
+	}
+
+	return nil
+}
+
+// decodeSource decodes a source image within the limits of p. Its header is
+// checked against the pixel limit before the pixels are decoded, and the
+// decode is abandoned when ctx is done or DecodeTimeout elapses; the decoder
+// then finishes in the background, holding the encode slot of the job so
+// abandoned decodes still count against Encodes, and its result is dropped.
+// ConvertSRGB converts the decoded pixels from the embedded profile.
+func (p *Processor) decodeSource(ctx context.Context, r io.Reader) (image.Image, string, error) {
+	var header bytes.Buffer
+	config, _, err := image.DecodeConfig(io.TeeReader(r, &header))
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: %v", ErrInvalidSource, err)
+	}
+	if err := p.checkSourceSize(config.Width, config.Height); err != nil {
+		return nil, "", err
+	}
+
+	type decoded struct {
+		img    image.Image
+		format string
+		err    error
+	}
+
+	done := make(chan decoded, 1)
+	releaseSlot := p.encodeSlot.hold()
+	go func() {
+		defer releaseSlot()
+
+		source := io.MultiReader(&header, r)
+
+		// The profile precedes the pixels
+		var head *headWriter
+		if p.ConvertSRGB {
+			head = &headWriter{limit: iccScanBytes}
+			source = io.TeeReader(source, head)
+		}
+
+		img, format, err := decodeImage(source)
+		if err == nil && head != nil {
+			img, err = convertToSRGB(img, sourceICCProfile(head.data))
+		}
+		done <- decoded{img, format, err}
+	}()
+
+	var timeout <-chan time.Time
+	if p.DecodeTimeout > 0 {
+		timer := time.NewTimer(p.DecodeTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case result := <-done:
+		if result.err != nil && !errors.Is(result.err, ErrInvalidSource) {
+			result.err = fmt.Errorf("%w: %v", ErrInvalidSource, result.err)
+		}
+		return result.img, result.format, result.err
+	case <-ctx.Done():
+		return nil, "", ctx.Err()
+	case <-timeout:
+		return nil, "", fmt.Errorf("%w: decoding took longer than %s", ErrInvalidSource, p.DecodeTimeout)
+	}
+}
+
+// headWriter keeps the first limit bytes written to it
+type headWriter struct {
+	data  []byte
+	limit int
+}
+
+func (h *headWriter) Write(p []byte) (int, error) {
+	if room := h.limit - len(h.data); room > 0 {
+		h.data = append(h.data, p[:min(room, len(p))]...)
+	}
+	return len(p), nil
+}
+
+// decodeSourceFile is like decodeSource for the image at path
+func (p *Processor) decodeSourceFile(ctx context.Context, path string) (image.Image, string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, "", err
+	}
+	defer file.Close()
+
+	return p.decodeSource(ctx, file)
+}
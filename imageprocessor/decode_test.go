@@ -0,0 +1,111 @@
+package imageprocessor
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"testing"
+	"time"
+)
+
+// sampleImage returns a small image with enough detail to compress poorly
+func sampleImage() *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, 32, 32))
+	for y := 0; y < 32; y++ {
+		for x := 0; x < 32; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{R: uint8(x * 8), G: uint8(y * 8), B: uint8(x * y), A: 0xff})
+		}
+	}
+	return img
+}
+
+// encodedSamples returns sampleImage encoded as PNG, JPEG and GIF
+func encodedSamples(tb testing.TB) [][]byte {
+	tb.Helper()
+
+	img := sampleImage()
+	encoders := []func(io.Writer) error{
+		func(w io.Writer) error { return png.Encode(w, img) },
+		func(w io.Writer) error { return jpeg.Encode(w, img, nil) },
+		func(w io.Writer) error { return gif.Encode(w, img, nil) },
+	}
+
+	var samples [][]byte
+	for _, encode := range encoders {
+		var buf bytes.Buffer
+		if err := encode(&buf); err != nil {
+			tb.Fatal(err)
+		}
+		samples = append(samples, buf.Bytes())
+	}
+	return samples
+}
+
+func FuzzDecodeSource(f *testing.F) {
+	for _, sample := range encodedSamples(f) {
+		f.Add(sample)
+		// Truncated in the header, in the pixels and before the trailer
+		for _, n := range []int{8, 30, len(sample) / 2, len(sample) - 1} {
+			f.Add(sample[:n])
+		}
+	}
+
+	p := Processor{MaxSourcePixels: 1 << 20, DecodeTimeout: 10 * time.Second}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		img, _, err := p.decodeSource(context.Background(), bytes.NewReader(data))
+		if err != nil {
+			if !errors.Is(err, ErrInvalidSource) {
+				t.Fatalf("got an error not wrapping ErrInvalidSource: %v", err)
+			}
+			return
+		}
+
+		bounds := img.Bounds()
+		if pixels := int64(bounds.Dx()) * int64(bounds.Dy()); pixels <= 0 || pixels > p.MaxSourcePixels {
+			t.Fatalf("decoded a %dx%d image past the limits", bounds.Dx(), bounds.Dy())
+		}
+	})
+}
+
+func TestAbandonedDecodeKeepsEncodeSlot(t *testing.T) {
+	var source bytes.Buffer
+	if err := png.Encode(&source, sampleImage()); err != nil {
+		t.Fatal(err)
+	}
+
+	// The header is read, then the pixels never arrive
+	reader, writer := io.Pipe()
+	go writer.Write(source.Bytes()[:64])
+
+	p := &Processor{Encodes: NewSemaphore(1), DecodeTimeout: 50 * time.Millisecond}
+	job, releaseSlot, err := p.withEncodeSlot(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err = job.decodeSource(context.Background(), reader)
+	if !errors.Is(err, ErrInvalidSource) {
+		t.Fatalf("got %v, want a decode timeout", err)
+	}
+	releaseSlot()
+
+	if inUse := p.Encodes.InUse(); inUse != 1 {
+		t.Fatalf("got %d encode slots in use while the decoder runs, want 1", inUse)
+	}
+
+	// The decoder returns once its source fails
+	writer.CloseWithError(io.ErrUnexpectedEOF)
+	deadline := time.Now().Add(5 * time.Second)
+	for p.Encodes.InUse() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the encode slot was not freed once the decoder returned")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,74 @@
+package imageprocessor
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// dedupeChunks removes the chunk files whose content is identical to an
+// earlier one. It returns the remaining paths and maps the name of every
+// removed chunk to the name of the chunk it duplicates.
+func dedupeChunks(chunkPaths []string) ([]string, map[string]string, error) {
+	kept := make([]string, 0, len(chunkPaths))
+	duplicates := make(map[string]string)
+	seen := make(map[[sha256.Size]byte]string)
+
+	for _, chunkPath := range chunkPaths {
+		sum, err := fileSHA256(chunkPath)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to hash split image: %v", err)
+		}
+
+		if first, found := seen[sum]; found {
+			if err := os.Remove(chunkPath); err != nil {
+				return nil, nil, fmt.Errorf("failed to remove duplicate split image: %v", err)
+			}
+			duplicates[filepath.Base(chunkPath)] = filepath.Base(first)
+			continue
+		}
+
+		seen[sum] = chunkPath
+		kept = append(kept, chunkPath)
+	}
+
+	if len(duplicates) == 0 {
+		duplicates = nil
+	}
+
+	return kept, duplicates, nil
+}
+
+// fileSHA256 returns the SHA-256 digest of the file at path
+func fileSHA256(path string) ([sha256.Size]byte, error) {
+	var sum [sha256.Size]byte
+
+	file, err := os.Open(path)
+	if err != nil {
+		return sum, err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return sum, err
+	}
+
+	copy(sum[:], hash.Sum(nil))
+	return sum, nil
+}
+
+// resolveDuplicates replaces the names of removed chunks with the names of
+// the chunks they duplicate
+func resolveDuplicates(names []string, duplicates map[string]string) []string {
+	resolved := make([]string, len(names))
+	for i, name := range names {
+		if first, found := duplicates[name]; found {
+			name = first
+		}
+		resolved[i] = name
+	}
+	return resolved
+}
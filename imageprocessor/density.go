@@ -0,0 +1,139 @@
+package imageprocessor
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+)
+
+// MaxDPI is the highest pixel density the JPEG JFIF header can hold
+const MaxDPI = 65535
+
+// densityScanBytes bounds how far into a source we look for its density
+const densityScanBytes = 64 << 10
+
+// chunkDPI returns the density of the chunks of a source whose header is read
+// from r: DPI when it is set, otherwise the density of the source
+func (p *Processor) chunkDPI(r *bufio.Reader) int {
+	if p.DPI != 0 {
+		return p.DPI
+	}
+
+	header, _ := r.Peek(densityScanBytes)
+	return sourceDPI(header)
+}
+
+// setFileDPI rewrites the JPEG file at path to declare dpi
+func setFileDPI(path string, dpi int) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to set split image density: %v", err)
+	}
+
+	if err := os.WriteFile(path, withJFIFDensity(data, dpi), 0644); err != nil {
+		return fmt.Errorf("failed to set split image density: %v", err)
+	}
+	return nil
+}
+
+// sourceDPI returns the pixel density declared in the header of an encoded
+// image, or 0 when it has none
+func sourceDPI(header []byte) int {
+	if bytes.HasPrefix(header, []byte("\x89PNG\r\n\x1a\n")) {
+		return pngDensity(bytes.NewReader(header))
+	}
+	return jpegDensity(header)
+}
+
+// jpegDensity returns the density of the JFIF segment in data in dots per
+// inch, or 0 when there is none or it only gives an aspect ratio
+func jpegDensity(data []byte) int {
+	segment := jpegSegment(data, 0xE0, []byte("JFIF\x00"))
+	if len(segment) < 12 {
+		return 0
+	}
+
+	density := float64(binary.BigEndian.Uint16(segment[8:10]))
+	switch segment[7] {
+	case 1: // dots per inch
+		return int(density)
+	case 2: // dots per centimeter
+		return int(math.Round(density * 2.54))
+	}
+	return 0
+}
+
+// pngDensity returns the density of the pHYs chunk in r in dots per inch, or 0
+// when there is none or it only gives an aspect ratio
+func pngDensity(r io.Reader) int {
+	data := pngChunk(r, "pHYs")
+	if len(data) < 9 || data[8] != 1 {
+		return 0
+	}
+
+	pixelsPerMeter := float64(binary.BigEndian.Uint32(data[:4]))
+	return int(math.Round(pixelsPerMeter * 0.0254))
+}
+
+// withJFIFDensity returns the JPEG data with its JFIF segment declaring dpi,
+// adding the segment when there is none
+func withJFIFDensity(data []byte, dpi int) []byte {
+	if len(data) < 2 || data[0] != 0xFF || data[1] != 0xD8 {
+		return data
+	}
+
+	// Density fields of a JFIF segment right after the SOI marker
+	if len(data) >= 18 && data[2] == 0xFF && data[3] == 0xE0 && bytes.Equal(data[6:11], []byte("JFIF\x00")) {
+		data[13] = 1
+		binary.BigEndian.PutUint16(data[14:16], uint16(dpi))
+		binary.BigEndian.PutUint16(data[16:18], uint16(dpi))
+		return data
+	}
+
+	segment := []byte{
+		0xFF, 0xE0, 0x00, 0x10,
+		'J', 'F', 'I', 'F', 0x00,
+		0x01, 0x01, // version 1.1
+		0x01,       // dots per inch
+		0x00, 0x00, // X density
+		0x00, 0x00, // Y density
+		0x00, 0x00, // no thumbnail
+	}
+	binary.BigEndian.PutUint16(segment[12:14], uint16(dpi))
+	binary.BigEndian.PutUint16(segment[14:16], uint16(dpi))
+
+	result := make([]byte, 0, len(data)+len(segment))
+	result = append(result, data[:2]...)
+	result = append(result, segment...)
+	return append(result, data[2:]...)
+}
+
+// withPNGDensity returns the PNG data with a pHYs chunk declaring dpi right
+// after the IHDR chunk, which image/png always writes first
+func withPNGDensity(data []byte, dpi int) []byte {
+	// Signature and IHDR chunk
+	const headerEnd = 8 + 4 + 4 + 13 + 4
+	if len(data) < headerEnd {
+		return data
+	}
+
+	pixelsPerMeter := uint32(math.Round(float64(dpi) / 0.0254))
+
+	chunk := make([]byte, 4+4+9+4)
+	binary.BigEndian.PutUint32(chunk[0:4], 9)
+	copy(chunk[4:8], "pHYs")
+	binary.BigEndian.PutUint32(chunk[8:12], pixelsPerMeter)
+	binary.BigEndian.PutUint32(chunk[12:16], pixelsPerMeter)
+	chunk[16] = 1 // meter
+	binary.BigEndian.PutUint32(chunk[17:21], crc32.ChecksumIEEE(chunk[4:17]))
+
+	result := make([]byte, 0, len(data)+len(chunk))
+	result = append(result, data[:headerEnd]...)
+	result = append(result, chunk...)
+	return append(result, data[headerEnd:]...)
+}
@@ -0,0 +1,214 @@
+package imageprocessor
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// FetchOptions tune the HTTP client the sources are downloaded with. Zero
+// values use the defaults of DefaultFetchOptions.
+type FetchOptions struct {
+	// ConnectTimeout bounds the TCP connection and the TLS handshake
+	ConnectTimeout time.Duration
+	// ResponseHeaderTimeout bounds the wait for the response headers, the
+	// body is only bounded by the job deadline
+	ResponseHeaderTimeout time.Duration
+	// MaxIdleConns and MaxIdleConnsPerHost bound the pooled connections
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+	// IdleConnTimeout closes the pooled connections unused for that long
+	IdleConnTimeout time.Duration
+	// DisableKeepAlives closes every connection after its request
+	DisableKeepAlives bool
+	// NoKeepAliveHosts are closed after every request, for hosts that are
+	// only fetched once in a while
+	NoKeepAliveHosts []string
+
+	// UserAgent is sent with every download
+	UserAgent string
+	// MaxRedirects bounds the redirects followed, DisableRedirects follows none
+	MaxRedirects     int
+	DisableRedirects bool
+	// SameHostRedirects only follows redirects to the host of the source
+	SameHostRedirects bool
+
+	// DNSCacheTTL caches the addresses of the source hosts, zero disables it
+	DNSCacheTTL time.Duration
+	// PreferIP connects to the addresses of a family first, PreferIPv4 or
+	// PreferIPv6, in the order of the resolver when empty
+	PreferIP string
+	// DNSServers are queried in turn instead of the system resolvers, as
+	// host:port or host of port 53
+	DNSServers []string
+}
+
+// DefaultFetchOptions are used for the zero fields of FetchOptions
+var DefaultFetchOptions = FetchOptions{
+	ConnectTimeout:        10 * time.Second,
+	ResponseHeaderTimeout: 30 * time.Second,
+	MaxIdleConns:          100,
+	MaxIdleConnsPerHost:   10,
+	IdleConnTimeout:       90 * time.Second,
+	UserAgent:             "imagesplitter",
+	MaxRedirects:          10,
+}
+
+// defaultHTTPClient downloads the sources of processors without HTTPClient
+var defaultHTTPClient = NewHTTPClient(FetchOptions{})
+
+// NewHTTPClient returns a client that pools its connections and negotiates
+// HTTP/2, meant to be shared by all the processors
+func NewHTTPClient(opts FetchOptions) *http.Client {
+	opts = opts.withDefaults()
+
+	dialer := &net.Dialer{
+		Timeout:   opts.ConnectTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     true,
+		TLSHandshakeTimeout:   opts.ConnectTimeout,
+		ResponseHeaderTimeout: opts.ResponseHeaderTimeout,
+		ExpectContinueTimeout: time.Second,
+		MaxIdleConns:          opts.MaxIdleConns,
+		MaxIdleConnsPerHost:   opts.MaxIdleConnsPerHost,
+		IdleConnTimeout:       opts.IdleConnTimeout,
+		DisableKeepAlives:     opts.DisableKeepAlives,
+	}
+
+	resolver := newHostResolver(opts)
+	if resolver != nil {
+		transport.DialContext = resolver.dialContext(dialer)
+	}
+
+	return &http.Client{
+		Transport: &fetchTransport{
+			RoundTripper: transport,
+			userAgent:    opts.UserAgent,
+			closingHosts: opts.NoKeepAliveHosts,
+			resolver:     resolver,
+		},
+		CheckRedirect: opts.checkRedirect,
+	}
+}
+
+// withDefaults returns opts with the zero fields set from DefaultFetchOptions
+func (opts FetchOptions) withDefaults() FetchOptions {
+	if opts.ConnectTimeout <= 0 {
+		opts.ConnectTimeout = DefaultFetchOptions.ConnectTimeout
+	}
+	if opts.ResponseHeaderTimeout <= 0 {
+		opts.ResponseHeaderTimeout = DefaultFetchOptions.ResponseHeaderTimeout
+	}
+	if opts.MaxIdleConns <= 0 {
+		opts.MaxIdleConns = DefaultFetchOptions.MaxIdleConns
+	}
+	if opts.MaxIdleConnsPerHost <= 0 {
+		opts.MaxIdleConnsPerHost = DefaultFetchOptions.MaxIdleConnsPerHost
+	}
+	if opts.IdleConnTimeout <= 0 {
+		opts.IdleConnTimeout = DefaultFetchOptions.IdleConnTimeout
+	}
+	if opts.UserAgent == "" {
+		opts.UserAgent = DefaultFetchOptions.UserAgent
+	}
+	if opts.MaxRedirects <= 0 {
+		opts.MaxRedirects = DefaultFetchOptions.MaxRedirects
+	}
+	return opts
+}
+
+// checkRedirect applies the redirect policy of opts, via holds the requests
+// made so far, the source first
+func (opts FetchOptions) checkRedirect(req *http.Request, via []*http.Request) error {
+	if opts.DisableRedirects {
+		return fmt.Errorf("redirect to %s not followed", req.URL.Redacted())
+	}
+	if len(via) > opts.MaxRedirects {
+		return fmt.Errorf("stopped after %d redirects", opts.MaxRedirects)
+	}
+	if opts.SameHostRedirects && !strings.EqualFold(req.URL.Host, via[0].URL.Host) {
+		return fmt.Errorf("redirect to another host %s not followed", req.URL.Host)
+	}
+	return nil
+}
+
+// curlArgs returns the curl options matching opts. curl cannot restrict
+// redirects to a host, so it follows none with SameHostRedirects.
+func (opts FetchOptions) curlArgs() []string {
+	opts = opts.withDefaults()
+
+	args := []string{"--user-agent", opts.UserAgent}
+	if !opts.DisableRedirects && !opts.SameHostRedirects {
+		args = append(args, "--location", "--max-redirs", fmt.Sprintf("%d", opts.MaxRedirects))
+	}
+	return args
+}
+
+// fetchTransport sets the User-Agent of every request and closes the
+// connections to closingHosts after their requests. resolver is shared with
+// the curl downloads.
+type fetchTransport struct {
+	http.RoundTripper
+	userAgent    string
+	closingHosts []string
+	resolver     *hostResolver
+}
+
+func (t *fetchTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// RoundTrip must not modify the request
+	req = req.Clone(req.Context())
+	if req.Header.Get("User-Agent") == "" {
+		req.Header.Set("User-Agent", t.userAgent)
+	}
+	if slices.ContainsFunc(t.closingHosts, func(host string) bool {
+		return strings.EqualFold(host, req.URL.Hostname())
+	}) {
+		req.Close = true
+	}
+	return t.RoundTripper.RoundTrip(req)
+}
+
+// httpClient returns the client the sources of p are downloaded with
+func (p *Processor) httpClient() *http.Client {
+	if p.HTTPClient != nil {
+		return p.HTTPClient
+	}
+	return defaultHTTPClient
+}
+
+// hostResolver returns the resolver of the client of p, nil when it resolves
+// like the system does
+func (p *Processor) hostResolver() *hostResolver {
+	if transport, ok := p.httpClient().Transport.(*fetchTransport); ok {
+		return transport.resolver
+	}
+	return nil
+}
+
+// setHeaders adds the extra headers of a source download to req. The client
+// drops Authorization and Cookie on redirects to other hosts.
+func setHeaders(req *http.Request, headers http.Header) {
+	for name, values := range headers {
+		for _, value := range values {
+			req.Header.Add(name, value)
+		}
+	}
+}
+
+// statusError is the error of a download answered with an unexpected status,
+// a failure of the host for the server errors
+func statusError(resp *http.Response) error {
+	err := fmt.Errorf("failed to download image: unexpected status %s", resp.Status)
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return hostFailure{err}
+	}
+	return err
+}
@@ -0,0 +1,92 @@
+package imageprocessor
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+)
+
+// background is the color the alpha of the JPEG chunks is flattened onto,
+// Background or white
+func (p *Processor) background() color.Color {
+	if p.Background == nil {
+		return color.White
+	}
+	return p.Background
+}
+
+// flattenAlpha returns img composited over the background, img itself when
+// it is opaque. JPEG has no alpha channel, a transparent pixel would be
+// written with whatever color it stores, black in premultiplied images.
+func (p *Processor) flattenAlpha(img image.Image) image.Image {
+	if opaque, ok := img.(interface{ Opaque() bool }); ok && opaque.Opaque() {
+		return img
+	}
+
+	r, g, b, _ := p.background().RGBA()
+	return &flattenedImage{Image: img, background: color.RGBA64{uint16(r), uint16(g), uint16(b), 0xffff}}
+}
+
+// flattenedImage composites an image over an opaque color without copying it
+type flattenedImage struct {
+	image.Image
+	background color.RGBA64
+}
+
+func (f *flattenedImage) At(x, y int) color.Color {
+	c := f.Image.At(x, y)
+	r, g, b, a := c.RGBA()
+	if a == 0xffff {
+		return c
+	}
+
+	// The channels are premultiplied
+	transparency := 0xffff - a
+	return color.RGBA64{
+		R: uint16(r + uint32(f.background.R)*transparency/0xffff),
+		G: uint16(g + uint32(f.background.G)*transparency/0xffff),
+		B: uint16(b + uint32(f.background.B)*transparency/0xffff),
+		A: 0xffff,
+	}
+}
+
+// vipsBandsPattern matches the band count in the output of vipsheader
+var vipsBandsPattern = regexp.MustCompile(`, (\d+) bands?,`)
+
+// flattenWithCLI has vips flatten the alpha of the image at imagePath onto
+// the background, all the CLI chunks are JPEG. It returns imagePath when the
+// image has no alpha.
+func (p *Processor) flattenWithCLI(ctx context.Context, imagePath string, outputDir string) (string, error) {
+	output, err := exec.CommandContext(ctx, "vipsheader", imagePath).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("failed to get image dimensions: %v - %s", err, string(output))
+	}
+
+	// CMYK sources are converted to sRGB before, so 2 and 4 bands have alpha
+	match := vipsBandsPattern.FindSubmatch(output)
+	if match == nil {
+		return imagePath, nil
+	}
+	bands, _ := strconv.Atoi(string(match[1]))
+	if bands != 2 && bands != 4 {
+		return imagePath, nil
+	}
+
+	flattenedPath := filepath.Join(outputDir, "flattened.v")
+
+	vipsCmd := exec.CommandContext(ctx,
+		"vips", "flatten",
+		imagePath,
+		flattenedPath,
+		"--background", vipsColor(p.background(), bands == 2),
+	)
+	if output, err := vipsCmd.CombinedOutput(); err != nil {
+		return "", fmt.Errorf("failed to flatten image: %v - %s", err, string(output))
+	}
+	return flattenedPath, nil
+}
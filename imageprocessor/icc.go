@@ -0,0 +1,486 @@
+package imageprocessor
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"math"
+	"os"
+
+	"golang.org/x/image/draw"
+)
+
+// iccScanBytes bounds how far into a source its ICC profile is looked for
+const iccScanBytes = maxMetadataScanBytes
+
+// srgbColumns are the D50 XYZ colorants of sRGB, the columns of the matrix
+// of the sRGB ICC profile
+var srgbColumns = [3][3]float64{
+	{0.4360747, 0.2225045, 0.0139322},
+	{0.3850649, 0.7168786, 0.0971045},
+	{0.1430804, 0.0606169, 0.7141733},
+}
+
+// srgbTolerance is the largest difference of a colorant of a profile taken
+// for the sRGB one
+const srgbTolerance = 0.003
+
+// matrixProfile is an RGB ICC profile made of tone curves and a matrix to
+// the D50 XYZ connection space, the kind of the displays and of Adobe RGB,
+// Display P3 and ProPhoto RGB
+type matrixProfile struct {
+	// columns are the XYZ colorants of red, green and blue
+	columns [3][3]float64
+	// curves turn the encoded channels from 0 to 1 to linear light
+	curves [3]func(float64) float64
+}
+
+// errNotMatrixProfile is returned for the RGB profiles without a matrix,
+// made of lookup tables
+var errNotMatrixProfile = errors.New("the ICC profile has no matrix and tone curves")
+
+// sourceICCProfile returns the ICC profile embedded in the head of a JPEG,
+// PNG or WebP source, nil when there is none
+func sourceICCProfile(head []byte) []byte {
+	switch {
+	case bytes.HasPrefix(head, []byte{0xFF, 0xD8}):
+		return jpegICCProfile(head)
+	case bytes.HasPrefix(head, []byte("\x89PNG\r\n\x1a\n")):
+		return pngICCProfile(pngChunk(bytes.NewReader(head), "iCCP"))
+	case len(head) >= 12 && bytes.Equal(head[0:4], []byte("RIFF")) && bytes.Equal(head[8:12], []byte("WEBP")):
+		return webpChunk(head, "ICCP")
+	}
+	return nil
+}
+
+// readICCProfile returns the ICC profile embedded in the image at path
+func readICCProfile(path string) []byte {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+
+	head, _ := io.ReadAll(io.LimitReader(file, iccScanBytes))
+	return sourceICCProfile(head)
+}
+
+// jpegICCProfile joins the APP2 segments of the ICC profile of a JPEG, in
+// the order of their sequence numbers
+func jpegICCProfile(data []byte) []byte {
+	prefix := []byte("ICC_PROFILE\x00")
+	segments := jpegSegments(data, 0xE2, prefix)
+	if len(segments) == 0 {
+		return nil
+	}
+
+	parts := make([][]byte, len(segments))
+	for _, segment := range segments {
+		if len(segment) < len(prefix)+2 {
+			return nil
+		}
+		sequence, count := int(segment[len(prefix)]), int(segment[len(prefix)+1])
+		if count != len(segments) || sequence < 1 || sequence > count {
+			return nil
+		}
+		parts[sequence-1] = segment[len(prefix)+2:]
+	}
+	return bytes.Join(parts, nil)
+}
+
+// pngICCProfile returns the profile of the data of an iCCP chunk, a name
+// and the zlib compressed profile
+func pngICCProfile(data []byte) []byte {
+	_, compressed, found := bytes.Cut(data, []byte{0})
+	if !found || len(compressed) < 1 || compressed[0] != 0 {
+		return nil
+	}
+
+	r, err := zlib.NewReader(bytes.NewReader(compressed[1:]))
+	if err != nil {
+		return nil
+	}
+	defer r.Close()
+
+	profile, err := io.ReadAll(io.LimitReader(r, iccScanBytes))
+	if err != nil {
+		return nil
+	}
+	return profile
+}
+
+// webpChunk returns the data of the first chunk of the given type of a WebP
+func webpChunk(data []byte, wanted string) []byte {
+	pos := 12
+	for pos+8 <= len(data) {
+		chunkType := string(data[pos : pos+4])
+		length := int(binary.LittleEndian.Uint32(data[pos+4 : pos+8]))
+		end := pos + 8 + length
+		if end > len(data) || length < 0 {
+			return nil
+		}
+		if chunkType == wanted {
+			return data[pos+8 : end]
+		}
+		// Chunks are padded to an even length
+		pos = end + length%2
+	}
+	return nil
+}
+
+// iccColorSpace returns the color space signature of a profile, e.g.
+// "RGB " or "CMYK"
+func iccColorSpace(profile []byte) string {
+	if len(profile) < 128 {
+		return ""
+	}
+	return string(profile[16:20])
+}
+
+// iccTag returns the data of the tag with the given signature
+func iccTag(profile []byte, signature string) []byte {
+	if len(profile) < 132 {
+		return nil
+	}
+
+	count := int(binary.BigEndian.Uint32(profile[128:132]))
+	for i := 0; i < count; i++ {
+		entry := 132 + 12*i
+		if entry+12 > len(profile) {
+			return nil
+		}
+		if string(profile[entry:entry+4]) != signature {
+			continue
+		}
+
+		offset := int(binary.BigEndian.Uint32(profile[entry+4 : entry+8]))
+		size := int(binary.BigEndian.Uint32(profile[entry+8 : entry+12]))
+		if offset < 0 || size < 0 || offset+size > len(profile) {
+			return nil
+		}
+		return profile[offset : offset+size]
+	}
+	return nil
+}
+
+// s15Fixed16 decodes an ICC signed 15.16 fixed point number
+func s15Fixed16(data []byte) float64 {
+	return float64(int32(binary.BigEndian.Uint32(data))) / 65536
+}
+
+// parseMatrixProfile reads the colorants and the tone curves of an RGB
+// profile
+func parseMatrixProfile(profile []byte) (*matrixProfile, error) {
+	var parsed matrixProfile
+
+	for i, signature := range []string{"rXYZ", "gXYZ", "bXYZ"} {
+		tag := iccTag(profile, signature)
+		if len(tag) < 20 || string(tag[0:4]) != "XYZ " {
+			return nil, errNotMatrixProfile
+		}
+		for j := range parsed.columns[i] {
+			parsed.columns[i][j] = s15Fixed16(tag[8+4*j:])
+		}
+	}
+
+	for i, signature := range []string{"rTRC", "gTRC", "bTRC"} {
+		curve, err := parseToneCurve(iccTag(profile, signature))
+		if err != nil {
+			return nil, err
+		}
+		parsed.curves[i] = curve
+	}
+
+	return &parsed, nil
+}
+
+// parseToneCurve reads a curv or para tag
+func parseToneCurve(tag []byte) (func(float64) float64, error) {
+	if len(tag) < 12 {
+		return nil, errNotMatrixProfile
+	}
+
+	switch string(tag[0:4]) {
+	case "curv":
+		count := int(binary.BigEndian.Uint32(tag[8:12]))
+		if len(tag) < 12+2*count {
+			return nil, errNotMatrixProfile
+		}
+		switch count {
+		case 0:
+			return func(x float64) float64 { return x }, nil
+		case 1:
+			gamma := float64(binary.BigEndian.Uint16(tag[12:14])) / 256
+			return func(x float64) float64 { return math.Pow(x, gamma) }, nil
+		}
+
+		table := make([]float64, count)
+		for i := range table {
+			table[i] = float64(binary.BigEndian.Uint16(tag[12+2*i:])) / 65535
+		}
+		return func(x float64) float64 {
+			pos := x * float64(count-1)
+			i := min(int(pos), count-2)
+			return table[i] + (table[i+1]-table[i])*(pos-float64(i))
+		}, nil
+
+	case "para":
+		function := binary.BigEndian.Uint16(tag[8:10])
+		counts := map[uint16]int{0: 1, 1: 3, 2: 4, 3: 5, 4: 7}
+		count, ok := counts[function]
+		if !ok || len(tag) < 12+4*count {
+			return nil, errNotMatrixProfile
+		}
+
+		// g, a, b, c, d, e, f, the missing ones zero
+		var params [7]float64
+		for i := 0; i < count; i++ {
+			params[i] = s15Fixed16(tag[12+4*i:])
+		}
+		g, a, b, c, d, e, f := params[0], params[1], params[2], params[3], params[4], params[5], params[6]
+
+		switch function {
+		case 0:
+			return func(x float64) float64 { return math.Pow(x, g) }, nil
+		case 1:
+			return func(x float64) float64 {
+				if x >= -b/a {
+					return math.Pow(a*x+b, g)
+				}
+				return 0
+			}, nil
+		case 2:
+			return func(x float64) float64 {
+				if x >= -b/a {
+					return math.Pow(a*x+b, g) + c
+				}
+				return c
+			}, nil
+		case 3:
+			return func(x float64) float64 {
+				if x >= d {
+					return math.Pow(a*x+b, g)
+				}
+				return c * x
+			}, nil
+		default:
+			return func(x float64) float64 {
+				if x >= d {
+					return math.Pow(a*x+b, g) + e
+				}
+				return c*x + f
+			}, nil
+		}
+	}
+
+	return nil, errNotMatrixProfile
+}
+
+// isSRGB reports whether the colorants of the profile are the sRGB ones
+func (m *matrixProfile) isSRGB() bool {
+	for i := range m.columns {
+		for j := range m.columns[i] {
+			if math.Abs(m.columns[i][j]-srgbColumns[i][j]) > srgbTolerance {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// needsSRGBConversion reports whether a source embedding profile is not in
+// sRGB already: a profile of other colorants, or of another color space
+func needsSRGBConversion(profile []byte) bool {
+	if profile == nil {
+		return false
+	}
+	if iccColorSpace(profile) != "RGB " {
+		return true
+	}
+
+	parsed, err := parseMatrixProfile(profile)
+	return err != nil || !parsed.isSRGB()
+}
+
+// convertToSRGB converts img from the RGB profile embedded in its source to
+// sRGB, for ConvertSRGB. Sources without a profile are taken for sRGB. Gray
+// and CMYK profiles are ignored, CMYK sources are converted to RGB like
+// without ConvertSRGB.
+func convertToSRGB(img image.Image, profile []byte) (image.Image, error) {
+	if profile == nil || iccColorSpace(profile) != "RGB " {
+		return img, nil
+	}
+
+	parsed, err := parseMatrixProfile(profile)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v, only the vips and ImageMagick backends can convert it", ErrInvalidSource, err)
+	}
+	if parsed.isSRGB() {
+		return img, nil
+	}
+
+	// The source colorants in the sRGB ones
+	transform := multiply3(invert3(transpose3(srgbColumns)), transpose3(parsed.columns))
+
+	// Every 16-bit channel value in linear light
+	var linear [3][]float64
+	for c := range linear {
+		linear[c] = make([]float64, 1<<16)
+		for v := range linear[c] {
+			linear[c][v] = parsed.curves[c](float64(v) / 65535)
+		}
+	}
+
+	bounds := img.Bounds()
+	sixteenBit := bitDepth(img.ColorModel()) == 16
+	var converted draw.Image
+	if sixteenBit {
+		converted = image.NewNRGBA64(bounds)
+	} else {
+		converted = image.NewNRGBA(bounds)
+	}
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := color.NRGBA64Model.Convert(img.At(x, y)).(color.NRGBA64)
+			in := [3]float64{linear[0][c.R], linear[1][c.G], linear[2][c.B]}
+
+			var out [3]uint16
+			for i, row := range transform {
+				out[i] = srgbEncode(row[0]*in[0] + row[1]*in[1] + row[2]*in[2])
+			}
+			converted.Set(x, y, color.NRGBA64{R: out[0], G: out[1], B: out[2], A: c.A})
+		}
+	}
+
+	return converted, nil
+}
+
+// srgbEncode applies the sRGB tone curve to a linear value, clipped to the
+// sRGB gamut
+func srgbEncode(v float64) uint16 {
+	v = min(max(v, 0), 1)
+	if v <= 0.0031308 {
+		v *= 12.92
+	} else {
+		v = 1.055*math.Pow(v, 1/2.4) - 0.055
+	}
+	return uint16(math.Round(v * 65535))
+}
+
+func transpose3(m [3][3]float64) [3][3]float64 {
+	var t [3][3]float64
+	for i := range m {
+		for j := range m[i] {
+			t[j][i] = m[i][j]
+		}
+	}
+	return t
+}
+
+func multiply3(a [3][3]float64, b [3][3]float64) [3][3]float64 {
+	var m [3][3]float64
+	for i := range a {
+		for j := range b[0] {
+			for k := range b {
+				m[i][j] += a[i][k] * b[k][j]
+			}
+		}
+	}
+	return m
+}
+
+func invert3(m [3][3]float64) [3][3]float64 {
+	det := m[0][0]*(m[1][1]*m[2][2]-m[1][2]*m[2][1]) -
+		m[0][1]*(m[1][0]*m[2][2]-m[1][2]*m[2][0]) +
+		m[0][2]*(m[1][0]*m[2][1]-m[1][1]*m[2][0])
+
+	return [3][3]float64{
+		{(m[1][1]*m[2][2] - m[1][2]*m[2][1]) / det, (m[0][2]*m[2][1] - m[0][1]*m[2][2]) / det, (m[0][1]*m[1][2] - m[0][2]*m[1][1]) / det},
+		{(m[1][2]*m[2][0] - m[1][0]*m[2][2]) / det, (m[0][0]*m[2][2] - m[0][2]*m[2][0]) / det, (m[0][2]*m[1][0] - m[0][0]*m[1][2]) / det},
+		{(m[1][0]*m[2][1] - m[1][1]*m[2][0]) / det, (m[0][1]*m[2][0] - m[0][0]*m[2][1]) / det, (m[0][0]*m[1][1] - m[0][1]*m[1][0]) / det},
+	}
+}
+
+// srgbProfile builds a version 2 sRGB ICC profile, the target of the
+// ImageMagick conversion, which needs a profile file
+func srgbProfile() []byte {
+	xyz := func(x, y, z float64) []byte {
+		data := []byte("XYZ \x00\x00\x00\x00")
+		for _, v := range []float64{x, y, z} {
+			data = binary.BigEndian.AppendUint32(data, uint32(int32(math.Round(v*65536))))
+		}
+		return data
+	}
+
+	const curvePoints = 1024
+	curve := []byte("curv\x00\x00\x00\x00")
+	curve = binary.BigEndian.AppendUint32(curve, curvePoints)
+	for i := 0; i < curvePoints; i++ {
+		v := float64(i) / (curvePoints - 1)
+		if v <= 0.04045 {
+			v /= 12.92
+		} else {
+			v = math.Pow((v+0.055)/1.055, 2.4)
+		}
+		curve = binary.BigEndian.AppendUint16(curve, uint16(math.Round(v*65535)))
+	}
+
+	name := "sRGB\x00"
+	desc := []byte("desc\x00\x00\x00\x00")
+	desc = binary.BigEndian.AppendUint32(desc, uint32(len(name)))
+	desc = append(desc, name...)
+	// No Unicode nor ScriptCode description
+	desc = append(desc, make([]byte, 4+4+2+1+67)...)
+
+	tags := []struct {
+		signature string
+		data      []byte
+	}{
+		{"desc", desc},
+		{"cprt", []byte("text\x00\x00\x00\x00No copyright\x00")},
+		{"wtpt", xyz(0.9642, 1, 0.8249)},
+		{"rXYZ", xyz(srgbColumns[0][0], srgbColumns[0][1], srgbColumns[0][2])},
+		{"gXYZ", xyz(srgbColumns[1][0], srgbColumns[1][1], srgbColumns[1][2])},
+		{"bXYZ", xyz(srgbColumns[2][0], srgbColumns[2][1], srgbColumns[2][2])},
+		{"rTRC", curve},
+		{"gTRC", curve},
+		{"bTRC", curve},
+	}
+
+	table := binary.BigEndian.AppendUint32(nil, uint32(len(tags)))
+	var data []byte
+	offsets := make(map[string]int)
+	offset := 128 + 4 + 12*len(tags)
+	for _, tag := range tags {
+		// The tone curves share their data
+		key := string(tag.data)
+		if _, ok := offsets[key]; !ok {
+			offsets[key] = offset + len(data)
+			data = append(data, tag.data...)
+			for len(data)%4 != 0 {
+				data = append(data, 0)
+			}
+		}
+		table = append(table, tag.signature...)
+		table = binary.BigEndian.AppendUint32(table, uint32(offsets[key]))
+		table = binary.BigEndian.AppendUint32(table, uint32(len(tag.data)))
+	}
+
+	header := make([]byte, 128)
+	binary.BigEndian.PutUint32(header[0:], uint32(128+len(table)+len(data)))
+	binary.BigEndian.PutUint32(header[8:], 0x02100000)
+	copy(header[12:], "mntr")
+	copy(header[16:], "RGB ")
+	copy(header[20:], "XYZ ")
+	copy(header[36:], "acsp")
+	copy(header[68:], xyz(0.9642, 1, 0.8249)[8:])
+
+	profile := append(header, table...)
+	return append(profile, data...)
+}
@@ -0,0 +1,280 @@
+package imageprocessor
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// magickFileExt is the extension of the intermediate images in the ImageMagick
+// persistent cache format, memory mapped when read. Every .mpc file comes
+// with a .cache file holding its pixels.
+const magickFileExt = ".mpc"
+
+// ImageMagickBackend runs ImageMagick convert and identify, and zip, on the
+// sources, for the hosts without vips. The sources are downloaded in Go.
+// Backends replacing some of its methods can embed it.
+type ImageMagickBackend struct{}
+
+func (ImageMagickBackend) Probe(ctx context.Context, p *Processor, imagePath string) (int, int, error) {
+	width, height, err := magickDimensions(ctx, imagePath)
+	if err != nil {
+		return 0, 0, err
+	}
+	return p.outputSize(width, height)
+}
+
+func (ImageMagickBackend) Split(ctx context.Context, p *Processor, imagePath string, outputDir string, imagesPrefix string, width int, maxImages int, createZip bool) (ImageResponse, error) {
+	return p.processImageWithCLI(ctx, magickTools{}, imagePath, outputDir, imagesPrefix, width, maxImages, createZip)
+}
+
+// Encode has convert encode the JPEG chunks like the ones it cuts, from a
+// lossless copy of img. PNG chunks are encoded like in GoBackend.
+func (ImageMagickBackend) Encode(ctx context.Context, p *Processor, w io.Writer, img image.Image, usePNG bool) error {
+	return p.encodeWithCLI(ctx, magickTools{}, w, img, usePNG)
+}
+
+// magickTools run ImageMagick convert and identify
+type magickTools struct{}
+
+func (magickTools) dimensions(ctx context.Context, imagePath string) (int, int, error) {
+	return magickDimensions(ctx, imagePath)
+}
+
+// prepare applies the transformations in a single convert run, in the order
+// of prepareWithCLI
+func (magickTools) prepare(ctx context.Context, p *Processor, imagePath string, workDir string) (string, error) {
+	var args []string
+
+	// convert needs a file of the profile it converts to
+	if p.ConvertSRGB && needsSRGBConversion(readICCProfile(imagePath)) {
+		profilePath := filepath.Join(workDir, "srgb.icc")
+		if err := os.WriteFile(profilePath, srgbProfile(), 0644); err != nil {
+			return "", fmt.Errorf("failed to convert image to sRGB: %v", err)
+		}
+		defer os.Remove(profilePath)
+		args = append(args, "-profile", profilePath)
+	}
+
+	if p.Rotate != 0 {
+		args = append(args, "-rotate", fmt.Sprintf("%d", p.Rotate))
+	}
+
+	// Like vips, convert keeps CMYK JPEGs in CMYK
+	switch {
+	case p.ColorSpace == ColorSpaceGrayscale:
+		args = append(args, "-colorspace", "Gray")
+	case p.ColorSpace == ColorSpaceSRGB || isCMYKFile(imagePath):
+		args = append(args, "-colorspace", "sRGB")
+	}
+
+	if !p.Crop.Empty() {
+		args = append(args, "-crop", magickGeometry(p.Crop), "+repage")
+	}
+
+	if p.ScaleWidth > 0 || p.fitWidth > 0 {
+		width, height, err := magickDimensions(ctx, imagePath)
+		if err != nil {
+			return "", err
+		}
+		scaledWidth, scaledHeight, err := p.transformedSize(width, height)
+		if err != nil {
+			return "", err
+		}
+		if p.ScaleWidth > 0 {
+			args = append(args, "-resize", fmt.Sprintf("%dx%d!", scaledWidth, scaledHeight))
+			if croppedWidth, _ := p.croppedSize(width, height); scaledWidth < croppedWidth {
+				args = append(args, p.magickSharpenOptions()...)
+			}
+		}
+
+		if fitWidth, fitHeight := p.fitSize(scaledWidth, scaledHeight); fitWidth != scaledWidth {
+			switch p.Fit {
+			case FitPad:
+				args = append(args,
+					"-background", p.magickBackground(),
+					"-gravity", "NorthWest",
+					"-extent", fmt.Sprintf("%dx%d-%d+0", fitWidth, fitHeight, p.layout().CropOffset(fitWidth, scaledWidth)),
+				)
+			case FitScale:
+				args = append(args, "-resize", fmt.Sprintf("%dx%d!", fitWidth, fitHeight))
+				args = append(args, p.magickSharpenOptions()...)
+			}
+		}
+	}
+
+	if len(args) == 0 {
+		return imagePath, nil
+	}
+
+	preparedPath := filepath.Join(workDir, "prepared"+magickFileExt)
+	if err := runConvert(ctx, "failed to transform image", magickSource(imagePath), args, preparedPath); err != nil {
+		return "", err
+	}
+	return preparedPath, nil
+}
+
+func (magickTools) decode(ctx context.Context, imagePath string, workDir string) (string, error) {
+	if filepath.Ext(imagePath) == magickFileExt {
+		return imagePath, nil
+	}
+
+	decodedPath := filepath.Join(workDir, "decoded"+magickFileExt)
+	if err := runConvert(ctx, "failed to decode image", magickSource(imagePath), nil, decodedPath); err != nil {
+		return "", err
+	}
+	return decodedPath, nil
+}
+
+func (magickTools) removeIntermediates(workDir string) {
+	for _, pattern := range []string{"*" + magickFileExt, "*.cache"} {
+		paths, _ := filepath.Glob(filepath.Join(workDir, pattern))
+		for _, path := range paths {
+			os.Remove(path)
+		}
+	}
+}
+
+func (magickTools) crop(ctx context.Context, p *Processor, imagePath string, outputPath string, rect image.Rectangle, quality int) error {
+	args := []string{"-crop", magickGeometry(rect), "+repage"}
+	args = append(args, p.magickSaveOptions(quality)...)
+
+	return runConvert(ctx, "failed to split image", imagePath, args, outputPath)
+}
+
+func (magickTools) instagramTile(ctx context.Context, p *Processor, imagePath string, workDir string, rect image.Rectangle, side int) (string, error) {
+	args := []string{"-crop", magickGeometry(rect), "+repage"}
+
+	if p.PadColor != nil && rect.Dx() != rect.Dy() {
+		args = append(args,
+			"-background", p.magickBackground(),
+			"-gravity", "NorthWest",
+			"-extent", fmt.Sprintf("%dx%d", side, side),
+		)
+	}
+
+	args = append(args, "-resize", fmt.Sprintf("%g%%", 100*float64(instagramTileSize)/float64(side)))
+
+	tilePath := filepath.Join(workDir, "tile"+magickFileExt)
+	if err := runConvert(ctx, "failed to split image", imagePath, args, tilePath); err != nil {
+		return "", err
+	}
+	return tilePath, nil
+}
+
+func (magickTools) strip(ctx context.Context, p *Processor, imagePath string, width int, height int, outputPath string) error {
+	stripWidth, stripHeight := p.stripSize(width, height)
+
+	args := append(p.magickFlattenOptions(),
+		"-resize", fmt.Sprintf("%dx%d!", stripWidth, stripHeight),
+		"-quality", fmt.Sprintf("%d", jpegQuality),
+		"-strip",
+	)
+	return runConvert(ctx, "failed to save strip", imagePath, args, outputPath)
+}
+
+// runConvert runs convert on source with args and writes outputPath, errors
+// start with message
+func runConvert(ctx context.Context, message string, source string, args []string, outputPath string) error {
+	convertArgs := append([]string{source}, args...)
+	convertArgs = append(convertArgs, outputPath)
+
+	convertCmd := exec.CommandContext(ctx, "convert", convertArgs...)
+	if output, err := convertCmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %v - %s", message, err, string(output))
+	}
+	return nil
+}
+
+// magickDimensions returns the size of an image as reported by identify
+func magickDimensions(ctx context.Context, imagePath string) (int, int, error) {
+	identifyCmd := exec.CommandContext(ctx, "identify", "-format", "%w %h", magickSource(imagePath))
+	output, err := identifyCmd.CombinedOutput()
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to get image dimensions: %v - %s", err, string(output))
+	}
+
+	outputStr := strings.TrimSpace(string(output))
+	dimensions := strings.Fields(outputStr)
+	if len(dimensions) != 2 {
+		return 0, 0, fmt.Errorf("unexpected output format from identify: %s", outputStr)
+	}
+
+	width, err := strconv.Atoi(dimensions[0])
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to parse image width: %v", err)
+	}
+
+	height, err := strconv.Atoi(dimensions[1])
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to parse image height: %v", err)
+	}
+
+	return width, height, nil
+}
+
+// magickSource selects the first frame of imagePath, e.g. of a GIF
+func magickSource(imagePath string) string {
+	return imagePath + "[0]"
+}
+
+// magickGeometry formats rect as an ImageMagick geometry
+func magickGeometry(rect image.Rectangle) string {
+	return fmt.Sprintf("%dx%d+%d+%d", rect.Dx(), rect.Dy(), rect.Min.X, rect.Min.Y)
+}
+
+// magickSaveOptions returns the convert options of the chunks written by
+// ImageMagick, like vipsSaveOptions. A zero quality keeps the ImageMagick
+// default.
+func (p *Processor) magickSaveOptions(quality int) []string {
+	options := p.magickFlattenOptions()
+	if quality > 0 {
+		options = append(options, "-quality", fmt.Sprintf("%d", quality))
+	}
+	switch p.Subsampling {
+	case Subsampling420:
+		options = append(options, "-sampling-factor", "4:2:0")
+	case Subsampling444:
+		options = append(options, "-sampling-factor", "4:4:4")
+	}
+	// ImageMagick has no trellis quantization, only the optimized Huffman tables
+	if p.JPEGEncoder == JPEGEncoderMozJPEG {
+		if quality == 0 {
+			options = append(options, "-quality", fmt.Sprintf("%d", jpegQuality))
+		}
+		options = append(options, "-define", "jpeg:optimize-coding=true")
+	}
+	return options
+}
+
+// magickFlattenOptions returns the convert options flattening the alpha of
+// a JPEG onto Background
+func (p *Processor) magickFlattenOptions() []string {
+	return []string{
+		"-background", magickColor(p.background(), p.ColorSpace == ColorSpaceGrayscale),
+		"-alpha", "remove", "-alpha", "off",
+	}
+}
+
+// magickBackground formats the pad color as an ImageMagick color, gray for
+// grayscale chunks
+func (p *Processor) magickBackground() string {
+	return magickColor(p.padColor(), p.ColorSpace == ColorSpaceGrayscale)
+}
+
+// magickColor formats c as an ImageMagick color, gray(n) when gray
+func magickColor(c color.Color, gray bool) string {
+	if gray {
+		return fmt.Sprintf("gray(%d)", color.GrayModel.Convert(c).(color.Gray).Y)
+	}
+
+	r, g, b, _ := c.RGBA()
+	return fmt.Sprintf("rgb(%d,%d,%d)", r>>8, g>>8, b>>8)
+}
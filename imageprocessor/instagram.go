@@ -0,0 +1,114 @@
+package imageprocessor
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"golang.org/x/image/draw"
+)
+
+// PresetInstagram splits the image into 1:1 tiles for an Instagram carousel,
+// side by side for wide images and stacked for tall ones
+const PresetInstagram = "instagram"
+
+// instagramTileSize is the side of the square posts recommended by Instagram,
+// a carousel holds splitcore.MaxSquareTiles of them
+const instagramTileSize = 1080
+
+// instagramTile pads a short tile to a square with PadColor, when it is set,
+// and scales the tile to instagramTileSize. side is the side of a full tile.
+func (p *Processor) instagramTile(tile image.Image, side int, usePNG bool) image.Image {
+	bounds := tile.Bounds()
+
+	if p.PadColor != nil && bounds.Dx() != bounds.Dy() {
+		padded := p.newChunkImage(tile.ColorModel(), side, side, usePNG)
+		draw.Draw(padded, padded.Bounds(), image.NewUniform(p.PadColor), image.Point{}, draw.Src)
+		draw.Draw(padded, bounds.Sub(bounds.Min), tile, bounds.Min, draw.Src)
+		tile = padded
+		bounds = padded.Bounds()
+	}
+
+	scale := float64(instagramTileSize) / float64(side)
+	width := max(1, int(float64(bounds.Dx())*scale+0.5))
+	height := max(1, int(float64(bounds.Dy())*scale+0.5))
+
+	scaled := p.newChunkImage(tile.ColorModel(), width, height, usePNG)
+	draw.CatmullRom.Scale(scaled, scaled.Bounds(), tile, bounds, draw.Src, nil)
+
+	return scaled
+}
+
+// instagramTileWithCLI writes the rect tile of imagePath, padded and scaled
+// like instagramTile, to a vips file in outputDir and returns its path. The
+// caller removes the file.
+func (p *Processor) instagramTileWithCLI(ctx context.Context, imagePath string, outputDir string, rect image.Rectangle, side int) (string, error) {
+	tilePath := filepath.Join(outputDir, "tile.v")
+
+	vipsCmd := exec.CommandContext(ctx,
+		"vips", "crop",
+		imagePath,
+		tilePath,
+		fmt.Sprintf("%d", rect.Min.X), fmt.Sprintf("%d", rect.Min.Y),
+		fmt.Sprintf("%d", rect.Dx()), fmt.Sprintf("%d", rect.Dy()),
+	)
+	if output, err := vipsCmd.CombinedOutput(); err != nil {
+		return "", fmt.Errorf("failed to split image: %v - %s", err, string(output))
+	}
+
+	if p.PadColor != nil && rect.Dx() != rect.Dy() {
+		paddedPath := filepath.Join(outputDir, "padded.v")
+
+		vipsCmd := exec.CommandContext(ctx,
+			"vips", "gravity",
+			tilePath,
+			paddedPath,
+			"north-west",
+			fmt.Sprintf("%d", side), fmt.Sprintf("%d", side),
+			"--extend", "background",
+			"--background", p.vipsBackground(),
+		)
+		if output, err := vipsCmd.CombinedOutput(); err != nil {
+			return "", fmt.Errorf("failed to pad image: %v - %s", err, string(output))
+		}
+
+		os.Remove(tilePath)
+		tilePath = paddedPath
+	}
+
+	scaledPath := filepath.Join(outputDir, "scaled.v")
+
+	vipsCmd = exec.CommandContext(ctx,
+		"vips", "resize",
+		tilePath,
+		scaledPath,
+		fmt.Sprintf("%g", float64(instagramTileSize)/float64(side)),
+	)
+	if output, err := vipsCmd.CombinedOutput(); err != nil {
+		return "", fmt.Errorf("failed to scale image: %v - %s", err, string(output))
+	}
+
+	os.Remove(tilePath)
+	return scaledPath, nil
+}
+
+// vipsBackground formats the pad color as a vips background argument, a
+// single value for grayscale chunks
+func (p *Processor) vipsBackground() string {
+	return vipsColor(p.padColor(), p.ColorSpace == ColorSpaceGrayscale)
+}
+
+// vipsColor formats c as a vips background argument, a single value when
+// gray
+func vipsColor(c color.Color, gray bool) string {
+	if gray {
+		return fmt.Sprintf("%d", color.GrayModel.Convert(c).(color.Gray).Y)
+	}
+
+	r, g, b, _ := c.RGBA()
+	return fmt.Sprintf("%d %d %d", r>>8, g>>8, b>>8)
+}
@@ -0,0 +1,169 @@
+package imageprocessor
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// DefaultMemoryBudget bounds the bytes held in memory by an InMemory job
+// when MemoryBudget is zero
+const DefaultMemoryBudget = 256 << 20
+
+// memoryBudget returns the bytes an InMemory job may hold
+func (p *Processor) memoryBudget() int64 {
+	if p.MemoryBudget > 0 {
+		return p.MemoryBudget
+	}
+	return DefaultMemoryBudget
+}
+
+// inMemory reports whether a job is processed in memory. Only jobs writing
+// a zip in Go qualify, without the options that need the chunk files.
+func (p *Processor) inMemory(url string, createZip bool) bool {
+	return p.InMemory && createZip && p.BackendName() == BackendGo && !isSVGFile(url) &&
+		!p.SkipBlank && !p.Dedupe && !p.Verify && !p.ContactSheet && p.StripWidth == 0 && len(p.OutputWidths) == 0 &&
+		p.SourceHook == nil && p.ChunkHook == nil && p.OutputCollision != OutputCollisionResume
+}
+
+// downloadToMemory downloads url with client and returns its body. A
+// source larger than budget is written to spillPath instead, and nil is
+// returned.
+func downloadToMemory(ctx context.Context, client *http.Client, url string, headers http.Header, budget int64, spillPath string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %v", err)
+	}
+	setHeaders(req, headers)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, hostFailure{fmt.Errorf("failed to download image: %v", err)}
+	}
+	defer resp.Body.Close()
+
+	// A rejected download, e.g. missing credentials, is not an image
+	if resp.StatusCode != http.StatusOK {
+		return nil, statusError(resp)
+	}
+
+	var buf bytes.Buffer
+	if resp.ContentLength <= budget {
+		if resp.ContentLength > 0 {
+			buf.Grow(int(resp.ContentLength))
+		}
+		if _, err := io.CopyN(&buf, resp.Body, budget+1); err != nil && err != io.EOF {
+			return nil, fmt.Errorf("failed to save image: %v", err)
+		}
+		if int64(buf.Len()) <= budget {
+			return buf.Bytes(), nil
+		}
+	}
+
+	// What was read so far goes first
+	outFile, err := os.Create(spillPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create output file: %v", err)
+	}
+	defer outFile.Close()
+
+	if _, err := io.Copy(outFile, io.MultiReader(&buf, resp.Body)); err != nil {
+		return nil, fmt.Errorf("failed to save image: %v", err)
+	}
+	return nil, nil
+}
+
+// budgetWriter is a bytes.Buffer refusing to grow past limit
+type budgetWriter struct {
+	bytes.Buffer
+	limit int64
+	// exceeded is set once a write was refused, the archive errors wrap
+	// the write error as text
+	exceeded bool
+}
+
+func (w *budgetWriter) Write(data []byte) (int, error) {
+	if int64(w.Len()+len(data)) > w.limit {
+		w.exceeded = true
+		return 0, errors.New("memory budget exceeded")
+	}
+	return w.Buffer.Write(data)
+}
+
+// processInMemory splits the downloaded source and assembles the zip in
+// memory, then writes the zip to outputDir, the only file of the job, or
+// uploads it with ZipUploader. It
+// reports false, writing the source to sourcePath, when the zip outgrows
+// the memory budget or the source is only decoded by vips, so the caller
+// processes the job from disk.
+func (p *Processor) processInMemory(ctx context.Context, source []byte, sourcePath string, outputDir string, imagesPrefix string, width int, maxImages int) (ImageResponse, bool, error) {
+	job, releaseSlot, err := p.withEncodeSlot(ctx)
+	if err != nil {
+		return ImageResponse{}, false, fmt.Errorf("failed to wait for an encode slot: %v", err)
+	}
+	defer releaseSlot()
+	p = job
+
+	// Only vips decodes these, from the disk
+	if vipsOnlyFormat(source) != "" {
+		if err := os.WriteFile(sourcePath, source, 0644); err != nil {
+			return ImageResponse{}, false, fmt.Errorf("failed to save image: %v", err)
+		}
+		return ImageResponse{}, false, nil
+	}
+
+	archive := &budgetWriter{limit: p.memoryBudget() - int64(len(source))}
+	splitCount, err := p.splitToArchive(ctx, bytes.NewReader(source), archive, ArchiveZip, imagesPrefix, width, maxImages)
+	if archive.exceeded {
+		if err := os.WriteFile(sourcePath, source, 0644); err != nil {
+			return ImageResponse{}, false, fmt.Errorf("failed to save image: %v", err)
+		}
+		return ImageResponse{}, false, nil
+	}
+	if err != nil {
+		return ImageResponse{}, false, err
+	}
+
+	zipFileName := filepath.Join(outputDir, fmt.Sprintf("%s.zip", imagesPrefix))
+	zipOut, err := p.createZipOutput(ctx, zipFileName)
+	if err != nil {
+		return ImageResponse{}, false, err
+	}
+	defer zipOut.abort()
+
+	if _, err := zipOut.Write(archive.Bytes()); err != nil {
+		return ImageResponse{}, false, fmt.Errorf("failed to create zip file: %v", err)
+	}
+	if err := zipOut.close(); err != nil {
+		return ImageResponse{}, false, err
+	}
+
+	absZipPath, _ := filepath.Abs(zipFileName)
+	relativeZipPath, _ := filepath.Rel(p.OutputBaseDir, absZipPath)
+
+	result := ImageResponse{
+		Status:      "success",
+		Message:     fmt.Sprintf("Successfully split image into %d parts in memory and created zip file", splitCount),
+		ZipURL:      relativeZipPath,
+		Images:      []string{},
+		ChunkCount:  splitCount,
+		ZipBytes:    int64(archive.Len()),
+		OutputBytes: int64(archive.Len()),
+		OutputDir:   outputDir,
+		SourceBytes: int64(len(source)),
+	}
+	zipOut.setZip(&result)
+
+	if config, _, err := image.DecodeConfig(bytes.NewReader(source)); err == nil {
+		result.OriginalWidth = config.Width
+		result.OriginalHeight = config.Height
+	}
+
+	return result, true, nil
+}
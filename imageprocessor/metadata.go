@@ -0,0 +1,282 @@
+package imageprocessor
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+)
+
+// maxMetadataScanBytes bounds how far into a PNG stream we look for an eXIf chunk
+const maxMetadataScanBytes = 1 << 20
+
+// ImageInfo describes a source image without splitting it
+type ImageInfo struct {
+	Status              string `json:"status"`
+	Format              string `json:"format"`
+	Width               int    `json:"width"`
+	Height              int    `json:"height"`
+	ColorSpace          string `json:"color_space"`
+	BitDepth            int    `json:"bit_depth"`
+	Animated            bool   `json:"animated,omitempty"`
+	Orientation         int    `json:"exif_orientation,omitempty"`
+	DPI                 int    `json:"dpi,omitempty"`
+	SourceBytes         int64  `json:"source_bytes,omitempty"`
+	MaxHeight           int    `json:"max_height"`
+	EstimatedSplitCount int    `json:"estimated_split_count"`
+}
+
+// InfoImage fetches the header of the image at url and returns its metadata
+// together with the number of chunks the current settings would produce
+func (p *Processor) InfoImage(url string, width int, maxImages int) (ImageInfo, error) {
+	var body io.ReadCloser
+	var sourceBytes int64
+	err := p.Circuits.do(context.Background(), url, func() error {
+		var err error
+		body, sourceBytes, err = openRemoteImage(p.httpClient(), url, p.SourceHeaders)
+		return err
+	})
+	if err != nil {
+		return ImageInfo{}, err
+	}
+	defer body.Close()
+
+	return p.InfoReader(body, sourceBytes, width, maxImages)
+}
+
+// InfoReader reads the image header from r and returns its metadata.
+// sourceBytes is the total size of the encoded source, or -1 if unknown.
+func (p *Processor) InfoReader(r io.Reader, sourceBytes int64, width int, maxImages int) (ImageInfo, error) {
+	p = p.withFit(width)
+
+	// Keep a copy of what the decoder consumed, the EXIF block precedes the
+	// JPEG frame header so it is always part of it
+	var header bytes.Buffer
+	config, format, err := image.DecodeConfig(io.TeeReader(r, &header))
+	if err != nil {
+		return ImageInfo{}, fmt.Errorf("failed to decode image header: %v", err)
+	}
+
+	if sourceBytes < 0 {
+		sourceBytes = 0
+	}
+
+	outputWidth, outputHeight, err := p.outputSize(config.Width, config.Height)
+	if err != nil {
+		return ImageInfo{}, err
+	}
+
+	info := ImageInfo{
+		Status:              "success",
+		Format:              format,
+		Width:               config.Width,
+		Height:              config.Height,
+		ColorSpace:          colorSpaceName(config.ColorModel),
+		BitDepth:            bitDepth(config.ColorModel),
+		Animated:            isAnimatedWebP(header.Bytes()),
+		SourceBytes:         sourceBytes,
+		MaxHeight:           p.MaxHeight,
+		EstimatedSplitCount: len(p.chunkRects(outputWidth, outputHeight, width, maxImages)),
+	}
+
+	switch format {
+	case "jpeg":
+		info.Orientation = jpegOrientation(header.Bytes())
+		info.DPI = jpegDensity(header.Bytes())
+	case "png":
+		rest, _ := io.ReadAll(io.LimitReader(r, maxMetadataScanBytes))
+		data := append(header.Bytes(), rest...)
+		info.Orientation = pngOrientation(bytes.NewReader(data))
+		info.DPI = pngDensity(bytes.NewReader(data))
+	}
+
+	return info, nil
+}
+
+// colorSpaceName returns a short name for the color model reported by a decoder
+func colorSpaceName(model color.Model) string {
+	switch model {
+	case color.GrayModel:
+		return "gray"
+	case color.Gray16Model:
+		return "gray16"
+	case color.YCbCrModel:
+		return "ycbcr"
+	case color.CMYKModel:
+		return "cmyk"
+	case color.RGBAModel, color.NRGBAModel:
+		return "rgba"
+	case color.RGBA64Model, color.NRGBA64Model:
+		return "rgba64"
+	}
+
+	if _, ok := model.(color.Palette); ok {
+		return "paletted"
+	}
+
+	return "unknown"
+}
+
+// jpegOrientation scans the JPEG markers in data for an APP1 Exif segment and
+// returns its orientation tag, or 0 when there is none
+func jpegOrientation(data []byte) int {
+	segment := jpegSegment(data, 0xE1, []byte("Exif\x00\x00"))
+	if segment == nil {
+		return 0
+	}
+	return exifOrientation(segment[6:])
+}
+
+// jpegSegment returns the payload of the first JPEG segment in data with the
+// given marker whose payload starts with prefix, or nil when there is none
+func jpegSegment(data []byte, wanted byte, prefix []byte) []byte {
+	var found []byte
+	walkJPEGSegments(data, wanted, prefix, func(segment []byte) bool {
+		found = segment
+		return false
+	})
+	return found
+}
+
+// jpegSegments is like jpegSegment but returns every matching segment
+func jpegSegments(data []byte, wanted byte, prefix []byte) [][]byte {
+	var found [][]byte
+	walkJPEGSegments(data, wanted, prefix, func(segment []byte) bool {
+		found = append(found, segment)
+		return true
+	})
+	return found
+}
+
+// walkJPEGSegments calls fn with the payloads of the JPEG segments in data
+// with the given marker starting with prefix, before the image data, while
+// fn returns true
+func walkJPEGSegments(data []byte, wanted byte, prefix []byte, fn func(segment []byte) bool) {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return
+	}
+
+	pos := 2
+	for pos+4 <= len(data) {
+		if data[pos] != 0xFF {
+			return
+		}
+
+		marker := data[pos+1]
+		// Start of scan or end of image, no more metadata segments follow
+		if marker == 0xDA || marker == 0xD9 {
+			return
+		}
+
+		length := int(binary.BigEndian.Uint16(data[pos+2 : pos+4]))
+		end := pos + 2 + length
+		if length < 2 || end > len(data) {
+			return
+		}
+
+		segment := data[pos+4 : end]
+		if marker == wanted && bytes.HasPrefix(segment, prefix) && !fn(segment) {
+			return
+		}
+
+		pos = end
+	}
+}
+
+// pngOrientation walks the PNG chunks in r up to the first IDAT looking for an
+// eXIf chunk and returns its orientation tag, or 0 when there is none
+func pngOrientation(r io.Reader) int {
+	data := pngChunk(r, "eXIf")
+	if data == nil {
+		return 0
+	}
+	return exifOrientation(data)
+}
+
+// pngChunk walks the PNG chunks in r up to the first IDAT and returns the data
+// of the first chunk of the given type, or nil when there is none
+func pngChunk(r io.Reader, wanted string) []byte {
+	signature := make([]byte, 8)
+	if _, err := io.ReadFull(r, signature); err != nil {
+		return nil
+	}
+
+	chunkHeader := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(r, chunkHeader); err != nil {
+			return nil
+		}
+
+		length := binary.BigEndian.Uint32(chunkHeader[:4])
+		chunkType := string(chunkHeader[4:])
+
+		if chunkType == "IDAT" || chunkType == "IEND" || length > maxMetadataScanBytes {
+			return nil
+		}
+
+		if chunkType == wanted {
+			data := make([]byte, length)
+			if _, err := io.ReadFull(r, data); err != nil {
+				return nil
+			}
+			return data
+		}
+
+		// Skip the chunk data and its CRC
+		if _, err := io.CopyN(io.Discard, r, int64(length)+4); err != nil {
+			return nil
+		}
+	}
+}
+
+// exifOrientation reads the orientation tag (0x0112) from the first IFD of a
+// TIFF structured EXIF block
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 0
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0
+	}
+
+	if order.Uint16(tiff[2:4]) != 42 {
+		return 0
+	}
+
+	ifdOffset := int(order.Uint32(tiff[4:8]))
+	if ifdOffset < 8 || ifdOffset+2 > len(tiff) {
+		return 0
+	}
+
+	entries := int(order.Uint16(tiff[ifdOffset : ifdOffset+2]))
+	for i := 0; i < entries; i++ {
+		entry := ifdOffset + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 0
+		}
+
+		tag := order.Uint16(tiff[entry : entry+2])
+		if tag != 0x0112 {
+			continue
+		}
+
+		// The value is a SHORT stored in the first two bytes of the value field
+		orientation := int(order.Uint16(tiff[entry+8 : entry+10]))
+		if orientation < 1 || orientation > 8 {
+			return 0
+		}
+		return orientation
+	}
+
+	return 0
+}
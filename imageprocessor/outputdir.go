@@ -0,0 +1,179 @@
+package imageprocessor
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Policies of an OutputName whose directory already exists
+const (
+	// OutputCollisionReject fails the job with ErrOutputExists
+	OutputCollisionReject = "reject"
+	// OutputCollisionSuffix appends _2, _3 and so on to the name until it is free
+	OutputCollisionSuffix = "suffix"
+	// OutputCollisionOverwrite replaces the previous output once the job
+	// succeeds, a failed job leaves it in place. Jobs overwriting the same
+	// directory must not run at once.
+	OutputCollisionOverwrite = "overwrite"
+	// OutputCollisionResume writes to the existing directory, keeping the
+	// chunks an earlier job of the same source and options completed, so a
+	// retried job only encodes the others and the zip. The output of a
+	// cancelled job is kept for the retry. Jobs resuming the same directory
+	// must not run at once.
+	OutputCollisionResume = "resume"
+)
+
+// ErrOutputExists is returned when the directory of OutputName exists and
+// OutputCollision rejects the job
+var ErrOutputExists = errors.New("output directory exists")
+
+// originalImageName names the downloaded source in the output directory,
+// with the extension of its URL
+const originalImageName = "original_image"
+
+// ReservedNames are the files a job writes next to its chunks, without their
+// extension, which an images prefix must not take
+var ReservedNames = []string{
+	originalImageName,
+	strings.TrimSuffix(progressFileName, filepath.Ext(progressFileName)),
+	strings.TrimSuffix(resultFileName, filepath.Ext(resultFileName)),
+	strings.TrimSuffix(htmlPreviewFileName, filepath.Ext(htmlPreviewFileName)),
+}
+
+// OverwriteDirPrefix starts the names of the staging directories of
+// OutputBaseDir that the jobs replacing an output write to
+const OverwriteDirPrefix = ".overwrite-"
+
+// maxOutputSuffix bounds the suffixes tried with OutputCollisionSuffix
+const maxOutputSuffix = 1000
+
+// createOutputDir creates the output directory of a job in OutputBaseDir and
+// returns its name, OutputName or the Unix time of the job by default, and
+// whether it created it rather than resuming an existing one. A timestamp
+// taken by another job moves to the next second, so no two jobs share one. The source of
+// a ContentAddressed job is downloaded to a pending directory.
+func (p *Processor) createOutputDir() (string, bool, error) {
+	if err := os.MkdirAll(p.OutputBaseDir, 0755); err != nil {
+		return "", false, fmt.Errorf("failed to create output directory: %v", err)
+	}
+
+	if p.contentAddressed() {
+		dir, err := os.MkdirTemp(p.OutputBaseDir, pendingDirPrefix)
+		if err != nil {
+			return "", false, fmt.Errorf("failed to create output directory: %v", err)
+		}
+		// Published like the other output directories
+		if err := os.Chmod(dir, 0755); err != nil {
+			os.RemoveAll(dir)
+			return "", false, fmt.Errorf("failed to create output directory: %v", err)
+		}
+		return filepath.Base(dir), true, nil
+	}
+
+	if p.OutputName == "" {
+		// Every job owns its directory, the jobs started in the same second
+		// take the next free seconds
+		for start := time.Now().Unix(); ; start++ {
+			name := strconv.FormatInt(start, 10)
+			err := os.Mkdir(filepath.Join(p.OutputBaseDir, name), 0755)
+			if err == nil {
+				return name, true, nil
+			}
+			if !errors.Is(err, fs.ErrExist) {
+				return "", false, fmt.Errorf("failed to create output directory: %v", err)
+			}
+		}
+	}
+
+	name := p.OutputName
+
+	// Mkdir fails on an existing directory, so two jobs never get the same name
+	for suffix := 2; ; suffix++ {
+		err := os.Mkdir(filepath.Join(p.OutputBaseDir, name), 0755)
+		if err == nil {
+			return name, true, nil
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return "", false, fmt.Errorf("failed to create output directory: %v", err)
+		}
+		// The existing output is replaced by withOverwriteDir
+		if p.OutputCollision == OutputCollisionResume || p.OutputCollision == OutputCollisionOverwrite {
+			return name, false, nil
+		}
+
+		if p.OutputCollision != OutputCollisionSuffix {
+			return "", false, fmt.Errorf("%w: %s", ErrOutputExists, name)
+		}
+		if suffix > maxOutputSuffix {
+			return "", false, fmt.Errorf("%w: %s and its first %d suffixes", ErrOutputExists, p.OutputName, maxOutputSuffix-1)
+		}
+		name = fmt.Sprintf("%s_%d", p.OutputName, suffix)
+	}
+}
+
+// withOverwriteDir returns a copy of p writing the output that replaces the
+// one of name to a staging directory of OutputBaseDir, and the function
+// removing that directory. replaceOutput moves the output over the previous
+// one once the job succeeds, so the chunks are never mixed with the previous
+// ones and a failed job leaves them in place.
+func (p *Processor) withOverwriteDir(name string) (*Processor, func(), error) {
+	dir, err := os.MkdirTemp(p.OutputBaseDir, OverwriteDirPrefix)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create output directory: %v", err)
+	}
+	remove := func() { os.RemoveAll(dir) }
+
+	// The URLs are relative to the staging output, like they will be to
+	// OutputBaseDir once it is moved
+	baseDir := filepath.Join(dir, "output")
+	if err := os.MkdirAll(filepath.Join(baseDir, name), 0755); err != nil {
+		remove()
+		return nil, nil, fmt.Errorf("failed to create output directory: %v", err)
+	}
+
+	job := *p
+	job.OutputBaseDir = baseDir
+	job.replaces = filepath.Join(p.OutputBaseDir, name)
+	return &job, remove, nil
+}
+
+// replaceOutput moves the output of a job of withOverwriteDir over the one it
+// replaces, which is left in the staging directory to be removed with it
+func (p *Processor) replaceOutput(result *ImageResponse) error {
+	if p.replaces == "" {
+		return nil
+	}
+
+	previous := filepath.Join(filepath.Dir(p.OutputBaseDir), "previous")
+	if err := os.Rename(p.replaces, previous); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to replace the previous output: %v", err)
+	}
+	if err := os.Rename(result.OutputDir, p.replaces); err != nil {
+		os.Rename(previous, p.replaces)
+		return fmt.Errorf("failed to replace the previous output: %v", err)
+	}
+
+	// The chunks are listed by their absolute path
+	staged, _ := filepath.Abs(result.OutputDir)
+	replaced, _ := filepath.Abs(p.replaces)
+	rebase := func(paths []string) {
+		for i, path := range paths {
+			if rel, err := filepath.Rel(staged, path); err == nil && filepath.IsAbs(path) && !strings.HasPrefix(rel, "..") {
+				paths[i] = filepath.Join(replaced, rel)
+			}
+		}
+	}
+	rebase(result.Images)
+	for i := range result.Sets {
+		rebase(result.Sets[i].Images)
+	}
+
+	result.OutputDir = p.replaces
+	return nil
+}
@@ -0,0 +1,85 @@
+package imageprocessor
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestOverwriteOutput(t *testing.T) {
+	server := serveSource(t)
+
+	dir := t.TempDir()
+	outputDir := filepath.Join(dir, "page")
+	if err := os.Mkdir(outputDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	previous := filepath.Join(outputDir, "previous.jpg")
+	if err := os.WriteFile(previous, []byte("previous job"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	p := Processor{OutputBaseDir: dir, OutputName: "page", OutputCollision: OutputCollisionOverwrite, MaxHeight: 10}
+
+	// A failed job leaves the previous output in place
+	failing := p
+	failing.ExpectedSHA256 = strings.Repeat("0", 64)
+	if _, err := failing.ProcessImage(server.URL+"/page.png", "page", 0, 0, false); !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("got %v, want ErrChecksumMismatch", err)
+	}
+	if _, err := os.Stat(previous); err != nil {
+		t.Fatalf("the failed job removed the previous output: %v", err)
+	}
+
+	result, err := p.ProcessImage(server.URL+"/page.png", "page", 0, 0, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.OutputDir != outputDir {
+		t.Errorf("got output directory %s, want %s", result.OutputDir, outputDir)
+	}
+	if result.ZipURL != "page/page.zip" {
+		t.Errorf("got zip URL %s, want page/page.zip", result.ZipURL)
+	}
+	if _, err := os.Stat(previous); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("the previous output was kept: %v", err)
+	}
+	for _, image := range result.Images {
+		if filepath.Dir(image) != outputDir {
+			t.Errorf("got chunk %s outside of %s", image, outputDir)
+		}
+		if _, err := os.Stat(image); err != nil {
+			t.Error(err)
+		}
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("got %d entries in the base directory, want only the output", len(entries))
+	}
+}
+
+func TestTimestampOutputDirs(t *testing.T) {
+	p := Processor{OutputBaseDir: t.TempDir()}
+
+	// The jobs of the same second never share a directory
+	names := make(map[string]bool)
+	for i := 0; i < 3; i++ {
+		name, created, err := p.createOutputDir()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !created {
+			t.Errorf("%s was not created by its job", name)
+		}
+		if names[name] {
+			t.Fatalf("got output directory %s twice", name)
+		}
+		names[name] = true
+	}
+}
@@ -0,0 +1,102 @@
+package imageprocessor
+
+import (
+	"image"
+)
+
+// Split modes
+const (
+	// SplitModeFixed cuts chunks of MaxHeight pixels, the default
+	SplitModeFixed = "fixed"
+	// SplitModePanels cuts in the gutters between comic panels, grouping
+	// panels into chunks of up to MaxHeight pixels
+	SplitModePanels = "panels"
+)
+
+// Gutter detection of SplitModePanels
+const (
+	// gutterMinHeight is the number of uniform rows that make a gutter
+	gutterMinHeight = 8
+	// gutterTolerance is the largest difference of a channel to the first
+	// pixel of a row that still counts as uniform, in 8-bit values
+	gutterTolerance = 12
+)
+
+// splitRects returns the chunk rectangles of img, which is only read in
+// SplitModePanels
+func (p *Processor) splitRects(img image.Image, requestedWidth int, maxImages int) []image.Rectangle {
+	bounds := img.Bounds()
+	if p.SplitMode != SplitModePanels {
+		return p.chunkRects(bounds.Dx(), bounds.Dy(), requestedWidth, maxImages)
+	}
+	return p.panelRects(img, requestedWidth, maxImages)
+}
+
+// panelRects cuts img in the middle of its gutters, the runs of at least
+// gutterMinHeight uniform rows. Every chunk holds as many panels as fit in
+// the chunk height; a panel taller than that is cut at the chunk height.
+func (p *Processor) panelRects(img image.Image, requestedWidth int, maxImages int) []image.Rectangle {
+	bounds := img.Bounds()
+
+	width, xOffset := bounds.Dx(), 0
+	if requestedWidth > 0 && width > requestedWidth {
+		width = requestedWidth
+		xOffset = p.layout().CropOffset(bounds.Dx(), width)
+	}
+	totalHeight := bounds.Dy()
+	maxHeight := p.chunkHeight(width)
+
+	// Candidate cuts in the middle of every gutter
+	var cuts []int
+	runStart := -1
+	for y := 0; y <= totalHeight; y++ {
+		if y < totalHeight && uniformRow(img, bounds.Min.Y+y, bounds.Min.X+xOffset, width) {
+			if runStart < 0 {
+				runStart = y
+			}
+			continue
+		}
+
+		if runStart >= 0 && y-runStart >= gutterMinHeight && runStart > 0 && y < totalHeight {
+			cuts = append(cuts, (runStart+y)/2)
+		}
+		runStart = -1
+	}
+
+	var rects []image.Rectangle
+	start := 0
+	for start < totalHeight {
+		if maxImages > 0 && len(rects) == maxImages {
+			break
+		}
+
+		end := min(start+maxHeight, totalHeight)
+		if end < totalHeight {
+			// The last gutter that fits, or a hard cut when none does
+			for _, cut := range cuts {
+				if cut > start && cut <= start+maxHeight {
+					end = cut
+				}
+			}
+		}
+
+		rects = append(rects, image.Rect(xOffset, start, xOffset+width, end))
+		start = end
+	}
+
+	return rects
+}
+
+// uniformRow reports whether the width pixels of row y starting at x are all
+// within gutterTolerance of the first one
+func uniformRow(img image.Image, y int, x int, width int) bool {
+	first := img.At(x, y)
+	for i := 1; i < width; i++ {
+		for _, diff := range channelDiffs(first, img.At(x+i, y)) {
+			if diff > gutterTolerance {
+				return false
+			}
+		}
+	}
+	return true
+}
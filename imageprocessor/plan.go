@@ -0,0 +1,190 @@
+package imageprocessor
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"io"
+	"net/http"
+	"os"
+)
+
+// Fallback bytes per pixel used to estimate chunk sizes when the size of the
+// source is unknown (e.g. chunked HTTP responses or stdin)
+const (
+	estimatedJPEGBytesPerPixel = 0.35
+	estimatedPNGBytesPerPixel  = 1.5
+)
+
+// SplitPlan describes the chunks a split would produce without producing them
+type SplitPlan struct {
+	Status              string         `json:"status"`
+	Message             string         `json:"message"`
+	Format              string         `json:"format"`
+	OriginalWidth       int            `json:"original_width"`
+	OriginalHeight      int            `json:"original_height"`
+	SourceBytes         int64          `json:"source_bytes,omitempty"`
+	ChunkCount          int            `json:"chunk_count"`
+	EstimatedTotalBytes int64          `json:"estimated_total_bytes"`
+	Chunks              []PlannedChunk `json:"chunks"`
+}
+
+// PlannedChunk is a single entry of a SplitPlan
+type PlannedChunk struct {
+	Name           string `json:"name"`
+	X              int    `json:"x"`
+	Y              int    `json:"y"`
+	Width          int    `json:"width"`
+	Height         int    `json:"height"`
+	EstimatedBytes int64  `json:"estimated_bytes"`
+}
+
+// PlanImage fetches only as much of the image at url as is needed to read its
+// header and returns the split plan. The Go HTTP client is used for both
+// implementations since curl cannot stop after the header.
+func (p *Processor) PlanImage(url string, imagesPrefix string, width int, maxImages int) (SplitPlan, error) {
+	// The fallback URLs are tried in order like in ProcessImage
+	var body io.ReadCloser
+	var sourceBytes int64
+	var err error
+	for _, candidate := range append([]string{url}, p.FallbackURLs...) {
+		err = p.Circuits.do(context.Background(), candidate, func() error {
+			var err error
+			body, sourceBytes, err = openRemoteImage(p.httpClient(), candidate, p.SourceHeaders)
+			return err
+		})
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return SplitPlan{}, err
+	}
+	// Closing the body early drops the rest of the transfer
+	defer body.Close()
+
+	return p.PlanReader(body, sourceBytes, imagesPrefix, width, maxImages)
+}
+
+// openRemoteImage starts downloading url and returns the response body and
+// its announced length (-1 if unknown) so callers can read only what they need
+func openRemoteImage(client *http.Client, url string, headers http.Header) (io.ReadCloser, int64, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to create request: %v", err)
+	}
+	setHeaders(req, headers)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, 0, hostFailure{fmt.Errorf("failed to download image: %v", err)}
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, 0, statusError(resp)
+	}
+
+	return resp.Body, resp.ContentLength, nil
+}
+
+// PlanFile returns the split plan for an image on the local filesystem
+func (p *Processor) PlanFile(imagePath string, imagesPrefix string, width int, maxImages int) (SplitPlan, error) {
+	file, err := os.Open(imagePath)
+	if err != nil {
+		return SplitPlan{}, fmt.Errorf("failed to open image file: %v", err)
+	}
+	defer file.Close()
+
+	var sourceBytes int64 = -1
+	if info, err := file.Stat(); err == nil {
+		sourceBytes = info.Size()
+	}
+
+	return p.PlanReader(file, sourceBytes, imagesPrefix, width, maxImages)
+}
+
+// PlanReader reads the image header from r and returns the split plan.
+// sourceBytes is the total size of the encoded source, or -1 if unknown.
+func (p *Processor) PlanReader(r io.Reader, sourceBytes int64, imagesPrefix string, width int, maxImages int) (SplitPlan, error) {
+	p = p.withFit(width)
+
+	// The gutters of SplitModePanels need the whole image
+	var header bytes.Buffer
+	config, format, err := image.DecodeConfig(io.TeeReader(r, &header))
+	if err != nil {
+		return SplitPlan{}, fmt.Errorf("failed to decode image header: %v", err)
+	}
+
+	if isAnimatedWebP(header.Bytes()) {
+		return SplitPlan{}, errAnimatedWebP
+	}
+
+	if err := p.checkSourceSize(config.Width, config.Height); err != nil {
+		return SplitPlan{}, err
+	}
+
+	// Chunks re-encoded in the source format keep its compression ratio,
+	// the best available predictor of the output size
+	pngSource := format == "png"
+	bytesPerPixel := estimatedJPEGBytesPerPixel
+	if p.pngChunks(pngSource) {
+		bytesPerPixel = estimatedPNGBytesPerPixel
+	}
+	if sourceBytes > 0 && p.pngChunks(pngSource) == pngSource {
+		bytesPerPixel = float64(sourceBytes) / float64(config.Width*config.Height)
+	}
+	if sourceBytes < 0 {
+		sourceBytes = 0
+	}
+
+	outputWidth, outputHeight, err := p.outputSize(config.Width, config.Height)
+	if err != nil {
+		return SplitPlan{}, err
+	}
+
+	rects := p.chunkRects(outputWidth, outputHeight, width, maxImages)
+
+	if p.SplitMode == SplitModePanels {
+		img, _, err := p.decodeSource(context.Background(), io.MultiReader(&header, r))
+		if err != nil {
+			return SplitPlan{}, fmt.Errorf("failed to decode image: %w", err)
+		}
+		if img, err = p.prepareImage(img); err != nil {
+			return SplitPlan{}, err
+		}
+		rects = p.splitRects(img, width, maxImages)
+	}
+
+	if err := p.checkChunkCount(len(rects)); err != nil {
+		return SplitPlan{}, err
+	}
+
+	plan := SplitPlan{
+		Status:         "success",
+		Message:        fmt.Sprintf("Image would be split into %d parts", len(rects)),
+		Format:         format,
+		OriginalWidth:  config.Width,
+		OriginalHeight: config.Height,
+		SourceBytes:    sourceBytes,
+		ChunkCount:     len(rects),
+		Chunks:         make([]PlannedChunk, 0, len(rects)),
+	}
+
+	for i, rect := range rects {
+		estimated := int64(float64(rect.Dx()*rect.Dy()) * bytesPerPixel)
+
+		plan.Chunks = append(plan.Chunks, PlannedChunk{
+			Name:           chunkFileName(imagesPrefix, i),
+			X:              rect.Min.X,
+			Y:              rect.Min.Y,
+			Width:          rect.Dx(),
+			Height:         rect.Dy(),
+			EstimatedBytes: estimated,
+		})
+		plan.EstimatedTotalBytes += estimated
+	}
+
+	return plan, nil
+}
@@ -0,0 +1,47 @@
+package imageprocessor
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io"
+)
+
+// htmlPreviewFileName is the name of the HTML preview inside the archives
+const htmlPreviewFileName = "index.html"
+
+// htmlPreview stacks the chunks without gaps, as they were in the source
+var htmlPreview = template.Must(template.New("preview").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { margin: 0; background: #eee; }
+img { display: block; margin: 0 auto; max-width: 100%; }
+</style>
+</head>
+<body>
+{{range .Images}}<img src="{{.}}" alt="{{.}}">
+{{end}}</body>
+</html>
+`))
+
+// writeHTMLPreview writes a page displaying the chunk files named images in order
+func writeHTMLPreview(w io.Writer, title string, images []string) error {
+	var buf bytes.Buffer
+
+	data := struct {
+		Title  string
+		Images []string
+	}{title, images}
+
+	if err := htmlPreview.Execute(&buf, data); err != nil {
+		return fmt.Errorf("failed to render HTML preview: %v", err)
+	}
+
+	if _, err := buf.WriteTo(w); err != nil {
+		return fmt.Errorf("failed to save HTML preview: %v", err)
+	}
+	return nil
+}
@@ -2,10 +2,13 @@ package imageprocessor
 
 import (
 	"archive/zip"
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
 	"image"
-	"image/jpeg"
-	"image/png"
+	"image/color"
 	"io"
 	"net/http"
 	"os"
@@ -14,12 +17,242 @@ import (
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/jempe/imagesplitter/imageprocessor/splitcore"
 )
 
 type Processor struct {
 	OutputBaseDir string
 	MaxHeight     int
 	UseCLI        bool
+	// Backend names the registered backend splitting the sources, BackendCLI
+	// with UseCLI and BackendGo otherwise when empty
+	Backend string
+	// Capabilities route the sources to the installed programs, every
+	// program is assumed to be installed when nil
+	Capabilities *Capabilities
+
+	// OutputName names the output directory of the job in OutputBaseDir, the
+	// Unix time the job started at when empty. OutputCollision is one of the
+	// OutputCollision policies applied when it exists, OutputCollisionReject
+	// when empty. OutputCollisionResume keeps the chunks an interrupted job
+	// of the name completed.
+	OutputName      string
+	OutputCollision string
+	// ContentAddressed names the output directory of a job without
+	// OutputName by the digest of its source and options. A job identical to
+	// one that succeeded returns its result, see Reused in ImageResponse,
+	// once the source is downloaded and hashed, and splits nothing.
+	ContentAddressed bool
+
+	// TempDir holds the downloaded source and the intermediate files of every
+	// job in a directory of its own, removed when the job ends, so only the
+	// chunks, the zip and the previews are written to the output directory.
+	// Empty writes them to the output directory and keeps the source.
+	TempDir string
+	// scratchDir is the directory of the running job in TempDir
+	scratchDir string
+	// replaces is the output directory the job of withOverwriteDir replaces
+	replaces string
+
+	// InMemory downloads, splits and zips the jobs in memory and writes only
+	// the zip, for the jobs of the Go implementation creating a zip without
+	// SkipBlank, Dedupe, Verify, ContactSheet, StripWidth or OutputWidths. A
+	// job whose source and zip exceed MemoryBudget bytes, DefaultMemoryBudget
+	// when zero, falls back to the disk.
+	InMemory     bool
+	MemoryBudget int64
+
+	// ZipUploader streams the zips to a remote storage while they are
+	// written, ZipURL is then the URL of the uploaded zip. Nil writes them to
+	// the output directory.
+	ZipUploader ZipUploader
+	// ChunkUploader uploads every chunk as soon as it is written, at most
+	// MaxConcurrentUploads at once, DefaultConcurrentUploads when zero, and
+	// Images lists their URLs. The chunk files stay in the output directory.
+	ChunkUploader        ChunkUploader
+	MaxConcurrentUploads int
+	// uploads are the chunk uploads of the running job
+	uploads *chunkUploads
+	// progress records the chunks of a job with OutputCollisionResume
+	progress *jobProgress
+
+	// Downloads and Encodes bound the I/O and CPU bound stages separately,
+	// so slow downloads don't hold encode slots. Nil means unlimited.
+	Downloads Semaphore
+	Encodes   Semaphore
+	// encodeSlot is the Encodes slot of the running job
+	encodeSlot *sharedSlot
+
+	// Circuits fails the downloads from the hosts that keep failing fast,
+	// nil never does
+	Circuits *CircuitBreaker
+
+	// ChunkWritten is called after every chunk file is written with the
+	// time it took to encode and its size, when not nil
+	ChunkWritten func(encodeTime time.Duration, size int64)
+	// StageDone is called after the download, decode and zip stages of a
+	// job with the time they took, when not nil
+	StageDone func(stage string, elapsed time.Duration)
+	// OutputDirCreated is called with the output directory of a job once it
+	// is created, before the download, when not nil
+	OutputDirCreated func(outputDir string)
+	// SourceHook runs on the downloaded source before it is split and
+	// ChunkHook on every chunk once written, before it is zipped or uploaded,
+	// when not nil. They may rewrite the files in place, an error fails the
+	// job. Jobs with hooks are not processed in memory.
+	SourceHook func(ctx context.Context, path string) error
+	ChunkHook  func(ctx context.Context, path string) error
+
+	// JPEGEncoder is one of the JPEGEncoder constants, empty means JPEGEncoderStdlib
+	JPEGEncoder string
+	// CJPEGPath is the mozjpeg cjpeg binary used by the Go implementation
+	// with JPEGEncoderMozJPEG, "cjpeg" from the PATH when empty
+	CJPEGPath string
+	// SourceHeaders are sent with the source download, e.g. the credentials
+	// of a protected CDN
+	SourceHeaders http.Header
+
+	// HTTPClient downloads the sources in the Go implementation and the dry
+	// runs, a shared client with the DefaultFetchOptions when nil
+	HTTPClient *http.Client
+	// FetchOptions set the User-Agent and the redirects of the curl downloads,
+	// HTTPClient is expected to be built from the same options
+	FetchOptions FetchOptions
+
+	// FallbackURLs are mirrors of the source tried in order when its
+	// download fails
+	FallbackURLs []string
+
+	// ExpectedSHA256 is the hex SHA-256 digest the downloaded source must
+	// have, the job fails with ErrChecksumMismatch otherwise
+	ExpectedSHA256 string
+
+	// MaxSourcePixels bounds the sources decoded in Go, DefaultMaxSourcePixels
+	// when zero. DecodeTimeout bounds how long they take to decode, zero
+	// leaves it to the job context.
+	MaxSourcePixels int64
+	DecodeTimeout   time.Duration
+
+	// MaxChunks fails the jobs that would write more chunks, across all the
+	// OutputWidths sets, with ErrTooManyChunks. Zero is unlimited.
+	MaxChunks int
+	// previousChunks are the chunks of the sets split before this one
+	previousChunks int
+
+	// RSVGConvertPath is the librsvg rsvg-convert binary the Go
+	// implementation rasterizes SVG sources with, from the PATH when empty
+	RSVGConvertPath string
+
+	// SVGWidth and SVGDPI set the size SVG sources are rasterized at, the
+	// width taking precedence. Zero uses the size of the document.
+	SVGWidth int
+	SVGDPI   int
+
+	// Quality of the JPEG chunks from 1 to 100. Zero uses 90 in the Go
+	// implementation and the vips or ImageMagick default with the CLI ones.
+	Quality int
+
+	// OutputFormat is one of the OutputFormat constants, empty means
+	// OutputFormatSource
+	OutputFormat string
+
+	// ConvertSRGB converts the sources embedding an ICC profile other than
+	// sRGB, e.g. Display P3 or Adobe RGB, to sRGB before they are split. The
+	// sources without one are taken for sRGB. In Go only the RGB profiles of
+	// a matrix and tone curves are converted, the others fail the job.
+	ConvertSRGB bool
+
+	// Background is the color the transparent pixels of the JPEG chunks are
+	// flattened onto, white when nil
+	Background color.Color
+
+	// Subsampling is the chroma subsampling of the JPEG chunks, one of the
+	// Subsampling constants. Empty uses 4:2:0 in the Go implementation and
+	// the vips or ImageMagick default with the CLI ones.
+	Subsampling string
+
+	// BitDepth 8 converts 16-bit sources to 8-bit PNG chunks, zero keeps the
+	// source depth. JPEG chunks are always 8-bit.
+	BitDepth int
+
+	// DPI is the pixel density declared in the chunk headers. Zero carries
+	// over the density of the source, when it declares one.
+	DPI int
+
+	// TargetChunkBytes is the maximum size of every JPEG chunk, reached by
+	// lowering the quality. Zero keeps the default quality.
+	TargetChunkBytes int64
+
+	// PNGOptimize is one of the PNGOptimize levels of the PNG chunks
+	PNGOptimize int
+
+	// ColorSpace is one of the ColorSpace constants, empty means ColorSpaceKeep
+	ColorSpace string
+	// Rotate turns the source clockwise by 90, 180 or 270 degrees
+	Rotate int
+	// Crop is the region of the rotated source that is split, the whole image when empty
+	Crop image.Rectangle
+
+	// SkipBlank omits the chunks that are almost entirely a uniform color
+	SkipBlank bool
+
+	// Dedupe removes the chunks identical to an earlier one, see Duplicates
+	// in ImageResponse
+	Dedupe bool
+
+	// Verify decodes the chunks after the split and fails the job with
+	// ErrVerificationFailed when they don't reassemble into the source
+	Verify bool
+
+	// HTMLPreview adds an index.html displaying the chunks in order to the zip
+	HTMLPreview bool
+
+	// SplitMode is one of the SplitMode constants, empty means SplitModeFixed
+	SplitMode string
+
+	// ChunkAspect is the width:height ratio of the chunks, replacing
+	// MaxHeight when set
+	ChunkAspect image.Point
+
+	// Anchor places the requested width in a wider image, an Anchor
+	// constant or a pixel offset, AnchorLeft when empty. FitPad places a
+	// narrower image in the requested width at Anchor.
+	Anchor string
+
+	// Fit is one of the Fit constants, the handling of the sources narrower
+	// than the requested width once transformed, empty means FitNone
+	Fit string
+	// fitWidth is the requested width of a job with a Fit mode
+	fitWidth int
+
+	// MaxPixels is the largest pixel count of a chunk, lowering the chunk
+	// height and tiling wide images into columns when set
+	MaxPixels int
+
+	// Preset replaces the fixed height chunks, PresetInstagram is the only one
+	Preset string
+	// PadColor pads the last tile of a preset to a full tile, when set, and
+	// is the background of FitPad
+	PadColor color.Color
+
+	// ContactSheet also writes a montage of all the chunks, see ContactSheet
+	// in ImageResponse
+	ContactSheet bool
+	// StripWidth also writes the whole image scaled down to this width from
+	// the decoded source, see Strip in ImageResponse
+	StripWidth int
+
+	// ScaleWidth scales the source down to this width, keeping its aspect
+	// ratio, after the other transformations
+	ScaleWidth int
+	// Sharpen is the amount of the unsharp mask applied to the scaled
+	// sources, up to MaxSharpen, after ScaleWidth, OutputWidths and FitScale.
+	// Zero keeps them as scaled.
+	Sharpen float64
+	// OutputWidths splits the source once per width, scaled like ScaleWidth,
+	// see Sets in ImageResponse
+	OutputWidths []int
 }
 
 type ImageResponse struct {
@@ -28,80 +261,538 @@ type ImageResponse struct {
 	ZipURL        string   `json:"zip_url"`
 	Images        []string `json:"images"`
 	OriginalImage string   `json:"original_image"`
+	// SourceURL is the URL the source was downloaded from, one of the
+	// FallbackURLs when the first download failed
+	SourceURL string `json:"source_url,omitempty"`
+	// SourceSHA256 is the hex SHA-256 digest of the downloaded source
+	SourceSHA256 string `json:"source_sha256,omitempty"`
+	// Skipped are the names of the blank chunks that were not written
+	Skipped []string `json:"skipped,omitempty"`
+	// Duplicates maps the names of the chunks that were not stored because
+	// they are identical to an earlier one to the name of that chunk
+	Duplicates map[string]string `json:"duplicates,omitempty"`
+	// Verified is set when the chunks passed the verification
+	Verified bool `json:"verified,omitempty"`
+	// ContactSheet is the montage of all the chunks, when requested
+	ContactSheet string `json:"contact_sheet,omitempty"`
+	// Strip is the whole image scaled down to StripWidth, when requested
+	Strip string `json:"strip,omitempty"`
+	// Sets are the chunk sets of OutputWidths, whose chunks are also listed
+	// in Images
+	Sets []ImageSet `json:"sets,omitempty"`
+
+	// Totals of the job
+	ChunkCount     int   `json:"chunk_count"`
+	ZipBytes       int64 `json:"zip_bytes,omitempty"`
+	OutputBytes    int64 `json:"output_bytes"`
+	OriginalWidth  int   `json:"original_width,omitempty"`
+	OriginalHeight int   `json:"original_height,omitempty"`
+	DurationMS     int64 `json:"duration_ms"`
+	// Compression compares the chunks with the source, when they are on disk
+	Compression *CompressionReport `json:"compression,omitempty"`
+
+	// JobID identifies the job in the job listing, when jobs are recorded
+	JobID string `json:"job_id,omitempty"`
+	// ImagesPrefix is the images prefix of the request once normalized, when
+	// the server changed it
+	ImagesPrefix string `json:"images_prefix,omitempty"`
+	// Metadata is the metadata of the request, returned as is
+	Metadata json.RawMessage `json:"metadata,omitempty"`
+	// Reused is set when the result is the one of an earlier identical job,
+	// see ContentAddressed
+	Reused bool `json:"reused,omitempty"`
+	// InlineImages are the chunks of Images encoded in base64, in the same
+	// order, when returned inline
+	InlineImages []string `json:"inline_images,omitempty"`
+
+	// OutputDir is the local directory holding the generated files
+	OutputDir string `json:"-"`
+	// SourceBytes is the size of the downloaded source
+	SourceBytes int64 `json:"-"`
 }
 
 func (p *Processor) ProcessImage(url string, imagesPrefix string, width int, maxImages int, createZip bool) (ImageResponse, error) {
+	return p.ProcessImageContext(context.Background(), url, imagesPrefix, width, maxImages, createZip)
+}
+
+// ProcessImageContext is like ProcessImage but stops the download and the
+// split when ctx is done. The output directory of a cancelled job is removed.
+func (p *Processor) ProcessImageContext(ctx context.Context, url string, imagesPrefix string, width int, maxImages int, createZip bool) (ImageResponse, error) {
+	start := time.Now()
+
 	// Create output directory for image processing
-	outputBaseDir := p.OutputBaseDir
+	dirName, created, err := p.createOutputDir()
+	if err != nil {
+		return ImageResponse{}, err
+	}
+	outputDir := filepath.Join(p.OutputBaseDir, dirName)
+	if p.OutputDirCreated != nil {
+		p.OutputDirCreated(outputDir)
+	}
 
-	// Create a unique directory name based on timestamp
-	timestamp := fmt.Sprintf("%d", time.Now().Unix())
-	outputDir := filepath.Join(outputBaseDir, timestamp)
+	if p.OutputCollision == OutputCollisionOverwrite && !created {
+		job, removeStaging, err := p.withOverwriteDir(dirName)
+		if err != nil {
+			return ImageResponse{}, err
+		}
+		defer removeStaging()
+		p = job
+		outputDir = filepath.Join(p.OutputBaseDir, dirName)
+		created = true
+	}
 
-	// Create the directories
-	if err := os.MkdirAll(outputDir, 0755); err != nil {
-		return ImageResponse{}, fmt.Errorf("failed to create output directory: %v", err)
+	if p.TempDir != "" {
+		job, removeScratch, err := p.withScratchDir()
+		if err != nil {
+			return ImageResponse{}, err
+		}
+		defer removeScratch()
+		p = job
 	}
 
-	// Download the image to a temporary file
-	tempImagePath := filepath.Join(outputDir, "original_image")
-	// Determine file extension from URL
-	fileExt := ".jpg" // Default
-	if strings.HasSuffix(strings.ToLower(url), ".png") {
-		fileExt = ".png"
+	if err := p.Downloads.Acquire(ctx); err != nil {
+		p.removeIfCancelled(ctx, outputDir)
+		return ImageResponse{}, fmt.Errorf("failed to wait for a download slot: %v", err)
 	}
-	tempImagePath = tempImagePath + fileExt
 
-	// Download image using appropriate method based on config
+	// Download the image to a temporary file, trying the fallback URLs in
+	// order while the downloads fail
+	downloadStart := time.Now()
+	candidates := append([]string{url}, p.FallbackURLs...)
+
+	var tempImagePath, fileExt string
+	var source []byte
 	var downloadErr error
-	if p.UseCLI {
-		// Use curl for CLI mode
-		downloadErr = downloadImageWithCurl(url, tempImagePath)
-	} else {
-		// Use Go's HTTP client for Go mode
-		downloadErr = downloadImage(url, tempImagePath)
+	for _, candidate := range candidates {
+		fileExt = sourceFileExt(candidate)
+		tempImagePath = filepath.Join(p.workDir(outputDir), originalImageName+fileExt)
+
+		downloadErr = p.Circuits.do(ctx, candidate, func() error {
+			var err error
+			source, err = p.download(ctx, candidate, tempImagePath, createZip)
+			return err
+		})
+		if downloadErr == nil {
+			url = candidate
+			break
+		}
+
+		os.Remove(tempImagePath)
+		if ctx.Err() != nil {
+			break
+		}
 	}
 
+	p.Downloads.Release()
+
 	if downloadErr != nil {
+		p.removeIfCancelled(ctx, outputDir)
+		if len(candidates) > 1 && ctx.Err() == nil {
+			return ImageResponse{}, fmt.Errorf("all %d source URLs failed, the last one with: %w", len(candidates), downloadErr)
+		}
 		return ImageResponse{}, downloadErr
 	}
+	p.stageDone(StageDownload, downloadStart)
+
+	sourceSHA256, err := sourceDigest(source, tempImagePath)
+	if err != nil {
+		p.removeIfCancelled(ctx, outputDir)
+		return ImageResponse{}, err
+	}
+	// Nothing is split from a source that is not the expected one
+	if p.ExpectedSHA256 != "" && !strings.EqualFold(sourceSHA256, p.ExpectedSHA256) {
+		removeIfCreated(outputDir, created)
+		return ImageResponse{}, fmt.Errorf("%w: expected sha256 %s, downloaded %s", ErrChecksumMismatch, strings.ToLower(p.ExpectedSHA256), sourceSHA256)
+	}
+
+	if p.SourceHook != nil {
+		if err := p.SourceHook(ctx, tempImagePath); err != nil {
+			removeIfCreated(outputDir, created)
+			return ImageResponse{}, err
+		}
+	}
+
+	if p.contentAddressed() {
+		sourceBytes := int64(len(source))
+		if info, err := os.Stat(tempImagePath); err == nil {
+			sourceBytes = info.Size()
+		}
+
+		key, err := p.contentKey(sourceSHA256, imagesPrefix, width, maxImages, createZip)
+		if err != nil {
+			removeIfCreated(outputDir, created)
+			return ImageResponse{}, err
+		}
+		name, stored, release, err := p.claimContentDir(outputDir, key)
+		if err != nil {
+			return ImageResponse{}, err
+		}
+		defer release()
+
+		if stored != nil {
+			stored.SourceURL = url
+			stored.SourceBytes = sourceBytes
+			stored.DurationMS = time.Since(start).Milliseconds()
+			stored.Reused = true
+			return *stored, nil
+		}
+
+		dirName = name
+		outputDir = filepath.Join(p.OutputBaseDir, dirName)
+		tempImagePath = filepath.Join(p.workDir(outputDir), filepath.Base(tempImagePath))
+		if p.OutputDirCreated != nil {
+			p.OutputDirCreated(outputDir)
+		}
+	}
+
+	if p.OutputCollision == OutputCollisionResume {
+		key, err := p.resumeKey(sourceSHA256, imagesPrefix, width, maxImages)
+		if err != nil {
+			return ImageResponse{}, err
+		}
+		if p, err = p.withProgress(outputDir, key); err != nil {
+			return ImageResponse{}, err
+		}
+	}
+
+	if source != nil {
+		result, ok, err := p.processInMemory(ctx, source, tempImagePath, outputDir, imagesPrefix, width, maxImages)
+		if err != nil {
+			p.removeIfCancelled(ctx, outputDir)
+			return ImageResponse{}, err
+		}
+		if ok {
+			result.SourceSHA256 = sourceSHA256
+			result.SourceURL = url
+			result.DurationMS = time.Since(start).Milliseconds()
+			if p.contentAddressed() {
+				if err := storeResult(&result); err != nil {
+					return ImageResponse{}, err
+				}
+			}
+			if err := p.replaceOutput(&result); err != nil {
+				return ImageResponse{}, err
+			}
+			return result, nil
+		}
+	}
+
+	result, err := p.ProcessFileContext(ctx, tempImagePath, outputDir, imagesPrefix, width, maxImages, createZip)
+	if err != nil {
+		p.removeIfCancelled(ctx, outputDir)
+		return ImageResponse{}, err
+	}
+	p.progress.remove()
+
+	// The source in TempDir is not published
+	if p.scratchDir == "" {
+		result.OriginalImage = dirName + "/" + originalImageName + fileExt
+	}
+	if info, err := os.Stat(tempImagePath); err == nil {
+		result.SourceBytes = info.Size()
+	}
+	result.SourceSHA256 = sourceSHA256
+	result.SourceURL = url
+	result.DurationMS = time.Since(start).Milliseconds()
+
+	if p.contentAddressed() {
+		if err := storeResult(&result); err != nil {
+			return ImageResponse{}, err
+		}
+	}
+	if err := p.replaceOutput(&result); err != nil {
+		return ImageResponse{}, err
+	}
+
+	return result, nil
+}
+
+// ProcessFile splits an image that is already on the local filesystem and
+// writes the chunks (and optionally a zip) into outputDir, creating it if needed
+func (p *Processor) ProcessFile(imagePath string, outputDir string, imagesPrefix string, width int, maxImages int, createZip bool) (ImageResponse, error) {
+	return p.ProcessFileContext(context.Background(), imagePath, outputDir, imagesPrefix, width, maxImages, createZip)
+}
+
+// ProcessFileContext is like ProcessFile but stops splitting when ctx is done
+func (p *Processor) ProcessFileContext(ctx context.Context, imagePath string, outputDir string, imagesPrefix string, width int, maxImages int, createZip bool) (ImageResponse, error) {
+	start := time.Now()
+
+	// The chunks are compared with the source before an SVG is rasterized
+	var sourceBytes int64
+	if info, err := os.Stat(imagePath); err == nil {
+		sourceBytes = info.Size()
+	}
+
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		return ImageResponse{}, fmt.Errorf("failed to create output directory: %v", err)
+	}
+
+	if p.TempDir != "" && p.scratchDir == "" {
+		job, removeScratch, err := p.withScratchDir()
+		if err != nil {
+			return ImageResponse{}, err
+		}
+		defer removeScratch()
+		p = job
+	}
+	p = p.withFit(width)
+
+	job, releaseSlot, err := p.withEncodeSlot(ctx)
+	if err != nil {
+		return ImageResponse{}, fmt.Errorf("failed to wait for an encode slot: %v", err)
+	}
+	defer releaseSlot()
+	p = job
+
+	if isSVGFile(imagePath) {
+		rasterPath, err := p.rasterizeSVG(ctx, imagePath, p.workDir(outputDir))
+		if err != nil {
+			return ImageResponse{}, err
+		}
+		defer os.Remove(rasterPath)
+		imagePath = rasterPath
+	}
+
+	job, err = p.routeSource(imagePath, createZip)
+	if err != nil {
+		return ImageResponse{}, err
+	}
+	p = job
+
+	var uploads *chunkUploads
+	if p.ChunkUploader != nil && p.uploads == nil {
+		p, uploads = p.withChunkUploads(ctx)
+	}
 
 	var result ImageResponse
-	var err error
 
-	// Choose implementation based on config
-	if p.UseCLI {
-		// Use command line tools (convert and zip)
-		result, err = p.processImageWithCLI(tempImagePath, outputDir, imagesPrefix, width, maxImages, createZip)
+	if len(p.OutputWidths) > 0 {
+		result, err = p.processSets(ctx, imagePath, outputDir, imagesPrefix, width, maxImages, createZip)
 	} else {
-		// Use Go implementation
-		result, err = p.processImageWithGo(tempImagePath, outputDir, imagesPrefix, width, maxImages, createZip)
+		result, err = p.processFile(ctx, imagePath, outputDir, imagesPrefix, width, maxImages, createZip)
+	}
+	if uploads != nil {
+		// The uploads end before the job fails, the chunks are still read
+		if uploadErr := uploads.wait(&result); err == nil {
+			err = uploadErr
+		}
+	}
+	if err != nil {
+		return ImageResponse{}, err
 	}
 
+	result.OutputDir = outputDir
+	result.addTotals(imagePath, createZip)
+	result.addCompression(sourceBytes)
+	result.DurationMS = time.Since(start).Milliseconds()
+
+	return result, nil
+}
+
+// addTotals fills the chunk count, the sizes of the generated files and the
+// source dimensions of a finished job
+func (r *ImageResponse) addTotals(imagePath string, createZip bool) {
+	r.ChunkCount = len(r.Images)
+
+	fileSize := func(name string) int64 {
+		info, err := os.Stat(filepath.Join(r.OutputDir, filepath.Base(name)))
+		if err != nil {
+			return 0
+		}
+		return info.Size()
+	}
+
+	for _, image := range r.Images {
+		r.OutputBytes += fileSize(image)
+	}
+	if createZip {
+		// An uploaded zip was counted while it was written
+		if r.ZipBytes == 0 {
+			r.ZipBytes = fileSize(r.ZipURL)
+		}
+		r.OutputBytes += r.ZipBytes
+	}
+	r.OutputBytes += fileSize(r.ContactSheet)
+	r.OutputBytes += fileSize(r.Strip)
+	for _, set := range r.Sets {
+		r.OutputBytes += fileSize(set.ContactSheet)
+	}
+
+	// Formats Go cannot decode are left out
+	if config, err := decodeFileConfig(imagePath); err == nil {
+		r.OriginalWidth = config.Width
+		r.OriginalHeight = config.Height
+	}
+}
+
+// processFile splits the image with the backend of p and adds the contact
+// sheet
+func (p *Processor) processFile(ctx context.Context, imagePath string, outputDir string, imagesPrefix string, width int, maxImages int, createZip bool) (ImageResponse, error) {
+	backend, err := p.backend()
 	if err != nil {
 		return ImageResponse{}, err
 	}
 
-	result.OriginalImage = timestamp + "/original_image" + fileExt
+	result, err := backend.Split(ctx, p, imagePath, outputDir, imagesPrefix, width, maxImages, createZip)
+	if err != nil {
+		return ImageResponse{}, err
+	}
+
+	if p.ContactSheet {
+		chunkPaths := make([]string, len(result.Images))
+		for i, image := range result.Images {
+			chunkPaths[i] = filepath.Join(outputDir, filepath.Base(image))
+		}
+
+		sheetPath := filepath.Join(outputDir, contactSheetFileName(imagesPrefix))
+		if err := writeContactSheet(ctx, chunkPaths, sheetPath); err != nil {
+			return ImageResponse{}, err
+		}
+
+		absSheetPath, _ := filepath.Abs(sheetPath)
+		result.ContactSheet, _ = filepath.Rel(p.OutputBaseDir, absSheetPath)
+	}
+
+	// Written by the backends from the decoded source
+	if p.StripWidth > 0 {
+		absStripPath, _ := filepath.Abs(filepath.Join(outputDir, stripFileName(imagesPrefix)))
+		result.Strip, _ = filepath.Rel(p.OutputBaseDir, absStripPath)
+	}
 
 	return result, nil
 }
 
-// downloadImageWithCurl downloads an image from a URL to a local file using curl
-func downloadImageWithCurl(url string, outputPath string) error {
-	// Use curl to download the image
-	curlCmd := exec.Command(
-		"curl",
+// chunkWritten reports the chunk written at path since start to ChunkWritten
+func (p *Processor) chunkWritten(start time.Time, path string) {
+	if p.ChunkWritten == nil {
+		return
+	}
+
+	var size int64
+	if info, err := os.Stat(path); err == nil {
+		size = info.Size()
+	}
+	p.ChunkWritten(time.Since(start), size)
+}
+
+// Stages of a job reported to StageDone
+const (
+	StageDownload = "download"
+	StageDecode   = "decode"
+	StageZip      = "zip"
+)
+
+// stageDone reports the stage that started at start to StageDone
+func (p *Processor) stageDone(stage string, start time.Time) {
+	if p.StageDone != nil {
+		p.StageDone(stage, time.Since(start))
+	}
+}
+
+// sourceFileExt returns the extension of the downloaded source of url
+func sourceFileExt(url string) string {
+	switch {
+	case strings.HasSuffix(strings.ToLower(url), ".png"):
+		return ".png"
+	case strings.HasSuffix(strings.ToLower(url), ".svg"):
+		return ".svg"
+	default:
+		return ".jpg"
+	}
+}
+
+// download fetches the source at url with the backend of p, to path or in
+// memory for the InMemory jobs. It returns the source when it is in memory.
+func (p *Processor) download(ctx context.Context, url string, path string, createZip bool) ([]byte, error) {
+	switch {
+	case p.BackendName() == BackendCLI:
+		// Use curl for CLI mode
+		return nil, downloadImageWithCurl(ctx, p.FetchOptions, p.hostResolver(), url, p.SourceHeaders, path)
+	case p.inMemory(url, createZip):
+		return downloadToMemory(ctx, p.httpClient(), url, p.SourceHeaders, p.memoryBudget(), path)
+	default:
+		// Use Go's HTTP client for Go mode
+		return nil, downloadImage(ctx, p.httpClient(), url, p.SourceHeaders, path)
+	}
+}
+
+// withScratchDir returns a copy of p whose intermediate files go to a new
+// directory in TempDir, and the function removing that directory
+func (p *Processor) withScratchDir() (*Processor, func(), error) {
+	dir, err := os.MkdirTemp(p.TempDir, "job-")
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create temporary directory: %v", err)
+	}
+
+	job := *p
+	job.scratchDir = dir
+	return &job, func() { os.RemoveAll(dir) }, nil
+}
+
+// workDir returns the directory of the intermediate files of a job writing
+// its output to outputDir
+func (p *Processor) workDir(outputDir string) string {
+	if p.scratchDir != "" {
+		return p.scratchDir
+	}
+	return outputDir
+}
+
+// removeIfCancelled deletes the partial output of a job stopped by ctx,
+// unless it is resumed by the next job of its OutputName. The pending
+// directory of a ContentAddressed job is always deleted.
+func (p *Processor) removeIfCancelled(ctx context.Context, outputDir string) {
+	if p.contentAddressed() && strings.HasPrefix(filepath.Base(outputDir), pendingDirPrefix) {
+		os.RemoveAll(outputDir)
+		return
+	}
+	if ctx.Err() != nil && p.OutputCollision != OutputCollisionResume {
+		os.RemoveAll(outputDir)
+	}
+}
+
+// removeIfCreated deletes the output directory of a job refused before the
+// split when the job created it. An existing directory holds the output of an
+// earlier job of the OutputName, e.g. the chunks a resumed job keeps.
+func removeIfCreated(outputDir string, created bool) {
+	if created {
+		os.RemoveAll(outputDir)
+	}
+}
+
+// downloadImageWithCurl downloads an image from a URL to a local file using
+// curl, sending the extra headers. The host of url is resolved by resolver
+// when not nil.
+func downloadImageWithCurl(ctx context.Context, opts FetchOptions, resolver *hostResolver, url string, headers http.Header, outputPath string) error {
+	args := []string{
 		"--silent",             // Don't show progress meter or error messages
 		"--show-error",         // Show error messages
 		"--fail",               // Fail silently on server errors
 		"--output", outputPath, // Output to file
-		url,
-	)
+		"--header", "@-", // Extra headers from stdin, kept out of the process list
+	}
+	args = append(args, opts.curlArgs()...)
+
+	resolveArgs, err := resolver.curlResolveArgs(ctx, url)
+	if err != nil {
+		return err
+	}
+	args = append(args, resolveArgs...)
+
+	// Use curl to download the image
+	curlCmd := exec.CommandContext(ctx, "curl", append(args, url)...)
+
+	var stdin bytes.Buffer
+	headers.Write(&stdin)
+	curlCmd.Stdin = &stdin
 
 	output, err := curlCmd.CombinedOutput()
 	if err != nil {
-		return fmt.Errorf("failed to download image with curl: %v - %s", err, string(output))
+		err = fmt.Errorf("failed to download image with curl: %v - %s", err, string(output))
+		if curlHostFailure(string(output)) {
+			return hostFailure{err}
+		}
+		return err
 	}
 
 	// Check if file exists and has content
@@ -117,21 +808,27 @@ func downloadImageWithCurl(url string, outputPath string) error {
 	return nil
 }
 
-// downloadImage downloads an image from a URL to a local file
-func downloadImage(url string, outputPath string) error {
+// downloadImage downloads an image from a URL to a local file with client,
+// sending the extra headers
+func downloadImage(ctx context.Context, client *http.Client, url string, headers http.Header, outputPath string) error {
 	// Download image using streaming
-	client := &http.Client{}
-	req, err := http.NewRequest("GET", url, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		return fmt.Errorf("failed to create request: %v", err)
 	}
+	setHeaders(req, headers)
 
 	resp, err := client.Do(req)
 	if err != nil {
-		return fmt.Errorf("failed to download image: %v", err)
+		return hostFailure{fmt.Errorf("failed to download image: %v", err)}
 	}
 	defer resp.Body.Close()
 
+	// A rejected download, e.g. missing credentials, is not an image
+	if resp.StatusCode != http.StatusOK {
+		return statusError(resp)
+	}
+
 	// Create output file
 	outFile, err := os.Create(outputPath)
 	if err != nil {
@@ -149,123 +846,183 @@ func downloadImage(url string, outputPath string) error {
 }
 
 // processImageWithGo processes an image using Go's image processing libraries
-// processImageWithCLI processes an image using command line tools (vips and zip)
-func (p *Processor) processImageWithCLI(imagePath string, outputDir string, imagesPrefix string, requestedWidth int, maxImages int, createZip bool) (ImageResponse, error) {
+// processImageWithCLI processes an image using command line tools (vips or
+// ImageMagick, and zip)
+func (p *Processor) processImageWithCLI(ctx context.Context, tools cliTools, imagePath string, outputDir string, imagesPrefix string, requestedWidth int, maxImages int, createZip bool) (ImageResponse, error) {
 	// Store paths to split images
 	var chunkPaths []string
 
-	// Get image dimensions using vips
-	vipsInfoCmd := exec.Command("vipsheader", imagePath)
-	output, err := vipsInfoCmd.CombinedOutput()
-	if err != nil {
-		return ImageResponse{}, fmt.Errorf("failed to get image dimensions: %v - %s", err, string(output))
+	if err := checkStillImageFile(imagePath); err != nil {
+		return ImageResponse{}, err
 	}
 
-	// Parse dimensions from vipsheader output
-	// Format example: "cteam_01.jpg: 1170x5000 uchar, 3 bands, srgb, jpegload"
-	outputStr := strings.TrimSpace(string(output))
-
-	// Split by colon
-	parts := strings.Split(outputStr, ":")
-	if len(parts) < 2 {
-		return ImageResponse{}, fmt.Errorf("unexpected output format from vipsheader: %s", outputStr)
+	// Validate the transformations against the source before running tools
+	if p.Rotate != 0 || !p.Crop.Empty() || p.ColorSpace != "" || p.Fit != "" {
+		sourceWidth, sourceHeight, err := tools.dimensions(ctx, imagePath)
+		if err != nil {
+			return ImageResponse{}, err
+		}
+		if _, _, err := p.outputSize(sourceWidth, sourceHeight); err != nil {
+			return ImageResponse{}, err
+		}
 	}
 
-	// Get the part after the colon and trim spaces
-	dimensionPart := strings.TrimSpace(parts[1])
+	sourcePath := imagePath
 
-	// Split by space to get the dimensions (first token)
-	dimensionTokens := strings.Split(dimensionPart, " ")
-	if len(dimensionTokens) < 1 {
-		return ImageResponse{}, fmt.Errorf("unexpected dimension format from vipsheader: %s", dimensionPart)
-	}
+	// Intermediate images are only needed while splitting
+	workDir := p.workDir(outputDir)
+	defer tools.removeIntermediates(workDir)
 
-	// Split the dimensions by 'x'
-	dimensions := strings.Split(dimensionTokens[0], "x")
-	if len(dimensions) != 2 {
-		return ImageResponse{}, fmt.Errorf("unexpected dimension format from vipsheader: %s", dimensionTokens[0])
+	decodeStart := time.Now()
+	imagePath, err := tools.prepare(ctx, p, imagePath, workDir)
+	if err != nil {
+		return ImageResponse{}, err
 	}
 
-	width, err := strconv.Atoi(dimensions[0])
+	imagePath, err = tools.decode(ctx, imagePath, workDir)
 	if err != nil {
-		return ImageResponse{}, fmt.Errorf("failed to parse image width: %v", err)
+		return ImageResponse{}, err
 	}
+	p.stageDone(StageDecode, decodeStart)
 
-	totalHeight, err := strconv.Atoi(dimensions[1])
+	width, totalHeight, err := tools.dimensions(ctx, imagePath)
 	if err != nil {
-		return ImageResponse{}, fmt.Errorf("failed to parse image height: %v", err)
+		return ImageResponse{}, err
 	}
 
-	// Determine if we need to crop the width
-	originalWidth := width
-	cropWidth := false
-	if requestedWidth > 0 && originalWidth > requestedWidth {
-		width = requestedWidth
-		cropWidth = true
+	rects := p.chunkRects(width, totalHeight, requestedWidth, maxImages)
+
+	// Gutters are found in the source as decoded and transformed in Go
+	if p.SplitMode == SplitModePanels {
+		source, _, err := p.decodeSourceFile(ctx, sourcePath)
+		if err != nil {
+			return ImageResponse{}, fmt.Errorf("failed to decode image: %w", err)
+		}
+		if source, err = p.prepareImage(source); err != nil {
+			return ImageResponse{}, err
+		}
+		rects = p.splitRects(source, requestedWidth, maxImages)
 	}
 
-	// Calculate number of splits needed
-	maxHeight := p.MaxHeight
-	splitCount := (totalHeight + maxHeight - 1) / maxHeight // Ceiling division
+	if err := p.checkChunkCount(len(rects)); err != nil {
+		return ImageResponse{}, err
+	}
 
-	// Limit the number of images
-	if maxImages > 0 && splitCount > maxImages {
-		splitCount = maxImages
+	if p.StripWidth > 0 {
+		if err := tools.strip(ctx, p, imagePath, width, totalHeight, filepath.Join(outputDir, stripFileName(imagesPrefix))); err != nil {
+			return ImageResponse{}, err
+		}
 	}
 
-	// Split the image using vips
-	for i := 0; i < splitCount; i++ {
-		startY := i * maxHeight
-		endY := startY + maxHeight
-		if endY > totalHeight {
-			endY = totalHeight
+	splitCount := len(rects)
+
+	// Zero based indexes of the blank chunks that were not written
+	var skipped []int
+
+	// Split the image using the CLI tools
+	for i, rect := range rects {
+		// Output path for this split
+		outputPath := filepath.Join(outputDir, chunkFileName(imagesPrefix, i))
+
+		// Chunks completed by an earlier run of a resumed job are kept
+		if p.progress.done(outputPath) {
+			absPath, _ := filepath.Abs(outputPath)
+			chunkPaths = append(chunkPaths, absPath)
+			if !p.Dedupe {
+				p.uploadChunk(absPath)
+			}
+			continue
+		}
+
+		// Tiles are prepared in a file of their own, which is saved whole
+		chunkSource := imagePath
+		if p.Preset == PresetInstagram {
+			tilePath, err := tools.instagramTile(ctx, p, imagePath, workDir, rect, min(width, totalHeight))
+			if err != nil {
+				return ImageResponse{}, err
+			}
+			defer os.Remove(tilePath)
+
+			tileWidth, tileHeight, err := tools.dimensions(ctx, tilePath)
+			if err != nil {
+				return ImageResponse{}, err
+			}
+
+			chunkSource = tilePath
+			rect = image.Rect(0, 0, tileWidth, tileHeight)
 		}
 
-		// Add leading zero for numbers less than 10
-		fileNumber := i + 1
-		fileNumberStr := fmt.Sprintf("%d", fileNumber)
-		if fileNumber < 10 {
-			fileNumberStr = fmt.Sprintf("0%d", fileNumber)
+		// Extract a region of the image
+		encodeStart := time.Now()
+		if err := p.cropChunkWithCLI(ctx, tools, chunkSource, outputPath, rect); err != nil {
+			return ImageResponse{}, err
 		}
+		p.chunkWritten(encodeStart, outputPath)
 
-		// Output path for this split
-		outputPath := filepath.Join(outputDir, fmt.Sprintf("%s_%s.jpg", imagesPrefix, fileNumberStr))
-
-		// Use vips to extract a region of the image
-		cropHeight := endY - startY
-
-		// Command arguments
-		var vipsCmd *exec.Cmd
-
-		if cropWidth {
-			// If we need to crop width, use extract area with centered x-offset
-			xOffset := 0 //(width - requestedWidth) / 2
-			vipsCmd = exec.Command(
-				"vips", "crop",
-				imagePath,
-				outputPath,
-				fmt.Sprintf("%d", xOffset), fmt.Sprintf("%d", startY),
-				fmt.Sprintf("%d", requestedWidth), fmt.Sprintf("%d", cropHeight),
-			)
-		} else {
-			// Use original width
-			vipsCmd = exec.Command(
-				"vips", "crop",
-				imagePath,
-				outputPath,
-				"0", fmt.Sprintf("%d", startY),
-				fmt.Sprintf("%d", width), fmt.Sprintf("%d", cropHeight),
-			)
-		}
-
-		output, err := vipsCmd.CombinedOutput()
-		if err != nil {
-			return ImageResponse{}, fmt.Errorf("failed to split image: %v - %s", err, string(output))
+		if p.SkipBlank {
+			blank, err := isBlankFile(outputPath)
+			if err != nil {
+				return ImageResponse{}, err
+			}
+			if blank {
+				os.Remove(outputPath)
+				skipped = append(skipped, i)
+				continue
+			}
+		}
+
+		// vips and ImageMagick carry over the density of the source
+		if p.DPI > 0 {
+			if err := setFileDPI(outputPath, p.DPI); err != nil {
+				return ImageResponse{}, err
+			}
+		}
+
+		if p.ChunkHook != nil {
+			if err := p.ChunkHook(ctx, outputPath); err != nil {
+				return ImageResponse{}, err
+			}
+		}
+		if err := p.progress.record(outputPath); err != nil {
+			return ImageResponse{}, err
 		}
 
 		// Add absolute path to response
 		absPath, _ := filepath.Abs(outputPath)
 		chunkPaths = append(chunkPaths, absPath)
+
+		// The duplicates are only known once every chunk is written
+		if !p.Dedupe {
+			p.uploadChunk(absPath)
+		}
+	}
+
+	// The chunks are compared with the source as decoded and transformed in Go
+	if p.Verify {
+		source, _, err := p.decodeSourceFile(ctx, sourcePath)
+		if err != nil {
+			return ImageResponse{}, fmt.Errorf("failed to decode image: %w", err)
+		}
+		if source, err = p.prepareImage(source); err != nil {
+			return ImageResponse{}, err
+		}
+		if err := p.verifyChunks(ctx, source, chunkPaths, skipped, requestedWidth, maxImages); err != nil {
+			return ImageResponse{}, err
+		}
+	}
+
+	// The preview shows every chunk in order, duplicates included
+	previewNames := chunkNames(chunkPaths)
+
+	var duplicates map[string]string
+	if p.Dedupe {
+		if chunkPaths, duplicates, err = dedupeChunks(chunkPaths); err != nil {
+			return ImageResponse{}, err
+		}
+		previewNames = resolveDuplicates(previewNames, duplicates)
+		for _, chunkPath := range chunkPaths {
+			p.uploadChunk(chunkPath)
+		}
 	}
 
 	// Create a zip file using the zip command
@@ -289,13 +1046,55 @@ func (p *Processor) processImageWithCLI(imagePath string, outputDir string, imag
 		images = append(images, imageRelPath)
 	}
 
+	// The preview is only written to be zipped
+	if createZip && p.HTMLPreview {
+		previewPath := filepath.Join(workDir, htmlPreviewFileName)
+
+		previewFile, err := os.Create(previewPath)
+		if err != nil {
+			return ImageResponse{}, fmt.Errorf("failed to create HTML preview: %v", err)
+		}
+		err = writeHTMLPreview(previewFile, imagesPrefix, previewNames)
+		previewFile.Close()
+		if err != nil {
+			return ImageResponse{}, err
+		}
+		defer os.Remove(previewPath)
+
+		zipArgs = append(zipArgs, previewPath)
+	}
+
 	// Execute the zip command
+	var zipOut *zipOutput
 	if createZip {
-		zipCmd := exec.Command("zip", zipArgs...)
-		output, err := zipCmd.CombinedOutput()
-		if err != nil {
-			return ImageResponse{}, fmt.Errorf("failed to create zip file: %v - %s", err, string(output))
+		zipStart := time.Now()
+
+		// An uploaded zip is streamed from the standard output of zip
+		var output bytes.Buffer
+		var stdout io.Writer = &output
+		if p.ZipUploader != nil {
+			zipOut, err = p.createZipOutput(ctx, zipFileName)
+			if err != nil {
+				return ImageResponse{}, err
+			}
+			defer zipOut.abort()
+
+			zipArgs[1] = "-"
+			stdout = zipOut
+		}
+
+		zipCmd := exec.CommandContext(ctx, "zip", zipArgs...)
+		zipCmd.Stdout = stdout
+		zipCmd.Stderr = &output
+		if err := zipCmd.Run(); err != nil {
+			return ImageResponse{}, fmt.Errorf("failed to create zip file: %v - %s", err, output.String())
 		}
+		if zipOut != nil {
+			if err := zipOut.close(); err != nil {
+				return ImageResponse{}, err
+			}
+		}
+		p.stageDone(StageZip, zipStart)
 	}
 
 	// Get absolute path to zip file
@@ -303,15 +1102,142 @@ func (p *Processor) processImageWithCLI(imagePath string, outputDir string, imag
 
 	relativeZipPath, _ := filepath.Rel(p.OutputBaseDir, absZipPath)
 
-	return ImageResponse{
-		Status:  "success",
-		Message: fmt.Sprintf("Successfully split image into %d parts and created zip file using CLI tools", splitCount),
-		ZipURL:  relativeZipPath,
-		Images:  images,
-	}, nil
+	result := ImageResponse{
+		Status:     "success",
+		Message:    fmt.Sprintf("Successfully split image into %d parts and created zip file using CLI tools", splitCount-len(skipped)),
+		ZipURL:     relativeZipPath,
+		Images:     images,
+		Skipped:    skippedNames(imagesPrefix, skipped),
+		Duplicates: duplicates,
+		Verified:   p.Verify,
+	}
+	if zipOut != nil {
+		zipOut.setZip(&result)
+	}
+
+	return result, nil
+}
+
+// removeVipsFiles deletes the intermediate images written into outputDir
+func removeVipsFiles(outputDir string) {
+	paths, _ := filepath.Glob(filepath.Join(outputDir, "*"+vipsFileExt))
+	for _, path := range paths {
+		os.Remove(path)
+	}
+}
+
+// vipsCrop writes the rect region of imagePath to outputPath with vips, at
+// quality or the vips default when zero
+func (p *Processor) vipsCrop(ctx context.Context, imagePath string, outputPath string, rect image.Rectangle, quality int) error {
+	vipsCmd := exec.CommandContext(ctx,
+		"vips", "crop",
+		imagePath,
+		outputPath+p.vipsSaveOptions(quality),
+		fmt.Sprintf("%d", rect.Min.X), fmt.Sprintf("%d", rect.Min.Y),
+		fmt.Sprintf("%d", rect.Dx()), fmt.Sprintf("%d", rect.Dy()),
+	)
+
+	output, err := vipsCmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to split image: %v - %s", err, string(output))
+	}
+	return nil
+}
+
+// cropChunkWithCLI writes the rect region of imagePath to outputPath with
+// tools, searching for the quality that fits TargetChunkBytes when it is set
+func (p *Processor) cropChunkWithCLI(ctx context.Context, tools cliTools, imagePath string, outputPath string, rect image.Rectangle) error {
+	crop := func(outputPath string, quality int) error {
+		return tools.crop(ctx, p, imagePath, outputPath, rect, quality)
+	}
+
+	if p.TargetChunkBytes <= 0 {
+		return crop(outputPath, p.Quality)
+	}
+
+	// Every attempt gets its own file, the best one is renamed to outputPath
+	attemptPath := func(quality int) string {
+		ext := filepath.Ext(outputPath)
+		return fmt.Sprintf("%s.q%d%s", strings.TrimSuffix(outputPath, ext), quality, ext)
+	}
+
+	tried := []int{}
+	defer func() {
+		for _, quality := range tried {
+			os.Remove(attemptPath(quality))
+		}
+	}()
+
+	quality, err := p.searchQuality(func(quality int) (int64, error) {
+		tried = append(tried, quality)
+		if err := crop(attemptPath(quality), quality); err != nil {
+			return 0, err
+		}
+
+		info, err := os.Stat(attemptPath(quality))
+		if err != nil {
+			return 0, fmt.Errorf("failed to verify split image: %v", err)
+		}
+		return info.Size(), nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := os.Rename(attemptPath(quality), outputPath); err != nil {
+		return fmt.Errorf("failed to save split image: %v", err)
+	}
+	return nil
+}
+
+// vipsDimensions returns the size of an image as reported by vipsheader
+func vipsDimensions(ctx context.Context, imagePath string) (int, int, error) {
+	// Get image dimensions using vips
+	vipsInfoCmd := exec.CommandContext(ctx, "vipsheader", imagePath)
+	output, err := vipsInfoCmd.CombinedOutput()
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to get image dimensions: %v - %s", err, string(output))
+	}
+
+	// Parse dimensions from vipsheader output
+	// Format example: "cteam_01.jpg: 1170x5000 uchar, 3 bands, srgb, jpegload"
+	outputStr := strings.TrimSpace(string(output))
+
+	// Split by colon
+	parts := strings.Split(outputStr, ":")
+	if len(parts) < 2 {
+		return 0, 0, fmt.Errorf("unexpected output format from vipsheader: %s", outputStr)
+	}
+
+	// Get the part after the colon and trim spaces
+	dimensionPart := strings.TrimSpace(parts[1])
+
+	// Split by space to get the dimensions (first token)
+	dimensionTokens := strings.Split(dimensionPart, " ")
+	if len(dimensionTokens) < 1 {
+		return 0, 0, fmt.Errorf("unexpected dimension format from vipsheader: %s", dimensionPart)
+	}
+
+	// Split the dimensions by 'x'
+	dimensions := strings.Split(dimensionTokens[0], "x")
+	if len(dimensions) != 2 {
+		return 0, 0, fmt.Errorf("unexpected dimension format from vipsheader: %s", dimensionTokens[0])
+	}
+
+	width, err := strconv.Atoi(dimensions[0])
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to parse image width: %v", err)
+	}
+
+	totalHeight, err := strconv.Atoi(dimensions[1])
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to parse image height: %v", err)
+	}
+
+	return width, totalHeight, nil
 }
 
-func (p *Processor) processImageWithGo(imagePath string, outputDir string, imagesPrefix string, requestedWidth int, maxImages int, createZip bool) (ImageResponse, error) {
+func (p *Processor) processImageWithGo(ctx context.Context, imagePath string, outputDir string, imagesPrefix string, requestedWidth int, maxImages int, createZip bool) (ImageResponse, error) {
 	// Store paths to split images
 	var chunkPaths []string
 
@@ -322,106 +1248,145 @@ func (p *Processor) processImageWithGo(imagePath string, outputDir string, image
 	}
 	defer file.Close()
 
+	source := bufio.NewReaderSize(file, densityScanBytes)
+
+	if err := checkStillImage(source); err != nil {
+		return ImageResponse{}, err
+	}
+
+	// Chunks carry over the density of the source unless DPI overrides it
+	encoder := *p
+	encoder.DPI = p.chunkDPI(source)
+
 	// Decode the image
-	img, _, err := image.Decode(file)
+	decodeStart := time.Now()
+	img, _, err := p.decodeSource(ctx, source)
 	if err != nil {
-		return ImageResponse{}, fmt.Errorf("failed to decode image: %v", err)
+		return ImageResponse{}, fmt.Errorf("failed to decode image: %w", err)
 	}
 
-	// Get image dimensions
-	bounds := img.Bounds()
-	originalWidth := bounds.Max.X
-	totalHeight := bounds.Max.Y
-
-	// Determine if we need to crop the width
-	width := originalWidth
-	cropWidth := false
-	if requestedWidth > 0 && originalWidth > requestedWidth {
-		width = requestedWidth
-		cropWidth = true
+	img, err = p.prepareImage(img)
+	if err != nil {
+		return ImageResponse{}, err
 	}
+	p.stageDone(StageDecode, decodeStart)
 
-	// Calculate number of splits needed
-	maxHeight := p.MaxHeight
-	splitCount := (totalHeight + maxHeight - 1) / maxHeight // Ceiling division
+	usePNG := p.pngChunks(strings.HasSuffix(strings.ToLower(imagePath), ".png"))
 
-	// Limit the number of images
-	if maxImages > 0 && splitCount > maxImages {
-		splitCount = maxImages
-	}
+	// Zero based indexes of the blank chunks that were not written
+	var skipped []int
 
 	// Split the image
-	for i := 0; i < splitCount; i++ {
-		startY := i * maxHeight
-		endY := startY + maxHeight
-		if endY > totalHeight {
-			endY = totalHeight
+	splitCount, err := p.splitGoImage(img, usePNG, requestedWidth, maxImages, func(index int, subImg image.Image) error {
+		// Stop between chunks when the job is cancelled
+		if err := ctx.Err(); err != nil {
+			return err
 		}
 
-		// Create subimage
-		subImg := image.NewRGBA(image.Rect(0, 0, width, endY-startY))
-		for y := startY; y < endY; y++ {
-			for x := 0; x < width; x++ {
-				// If cropping width, center the image horizontally
-				srcX := x
-				if cropWidth {
-					// Calculate offset to center the cropped area
-					offset := 0 //(originalWidth - width) / 2
-					srcX = x + offset
-				}
-				subImg.Set(x, y-startY, img.At(srcX, y))
+		if p.SkipBlank && isBlank(subImg) {
+			skipped = append(skipped, index)
+			return nil
+		}
+
+		outputPath := filepath.Join(outputDir, chunkFileName(imagesPrefix, index))
+
+		// Chunks completed by an earlier run of a resumed job are kept
+		if p.progress.done(outputPath) {
+			absPath, _ := filepath.Abs(outputPath)
+			chunkPaths = append(chunkPaths, absPath)
+			if !p.Dedupe {
+				p.uploadChunk(absPath)
 			}
+			return nil
 		}
 
 		// Save the split image
-		// Add leading zero for numbers less than 10
-		fileNumber := i + 1
-		fileNumberStr := fmt.Sprintf("%d", fileNumber)
-		if fileNumber < 10 {
-			fileNumberStr = fmt.Sprintf("0%d", fileNumber)
-		}
-		outputPath := filepath.Join(outputDir, fmt.Sprintf("%s_%s.jpg", imagesPrefix, fileNumberStr))
+		encodeStart := time.Now()
 		outFile, err := os.Create(outputPath)
 		if err != nil {
-			return ImageResponse{}, fmt.Errorf("failed to create output file: %v", err)
+			return fmt.Errorf("failed to create output file: %v", err)
 		}
 
-		if strings.HasSuffix(strings.ToLower(imagePath), ".png") {
-			if err := png.Encode(outFile, subImg); err != nil {
-				outFile.Close()
-				return ImageResponse{}, fmt.Errorf("failed to save split image: %v", err)
-			}
-		} else {
-			// Default to JPEG
-			if err := jpeg.Encode(outFile, subImg, &jpeg.Options{Quality: 90}); err != nil {
-				outFile.Close()
-				return ImageResponse{}, fmt.Errorf("failed to save split image: %v", err)
-			}
+		if err := encoder.encode(ctx, outFile, subImg, usePNG); err != nil {
+			outFile.Close()
+			return err
 		}
 		outFile.Close()
+		p.chunkWritten(encodeStart, outputPath)
+
+		if p.ChunkHook != nil {
+			if err := p.ChunkHook(ctx, outputPath); err != nil {
+				return err
+			}
+		}
+		if err := p.progress.record(outputPath); err != nil {
+			return err
+		}
 
 		// Add absolute path to response
 		absPath, _ := filepath.Abs(outputPath)
 		chunkPaths = append(chunkPaths, absPath)
+
+		// The duplicates are only known once every chunk is written
+		if !p.Dedupe {
+			p.uploadChunk(absPath)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return ImageResponse{}, err
+	}
+
+	if p.StripWidth > 0 {
+		if err := p.writeStrip(img, filepath.Join(outputDir, stripFileName(imagesPrefix))); err != nil {
+			return ImageResponse{}, err
+		}
+	}
+
+	if p.Verify {
+		if err := p.verifyChunks(ctx, img, chunkPaths, skipped, requestedWidth, maxImages); err != nil {
+			return ImageResponse{}, err
+		}
+	}
+
+	// The preview shows every chunk in order, duplicates included
+	previewNames := chunkNames(chunkPaths)
+
+	var duplicates map[string]string
+	if p.Dedupe {
+		if chunkPaths, duplicates, err = dedupeChunks(chunkPaths); err != nil {
+			return ImageResponse{}, err
+		}
+		previewNames = resolveDuplicates(previewNames, duplicates)
+		for _, chunkPath := range chunkPaths {
+			p.uploadChunk(chunkPath)
+		}
 	}
 
 	// Create a zip file containing all the split images
 	zipFileName := filepath.Join(outputDir, fmt.Sprintf("%s.zip", imagesPrefix))
+	var zipOut *zipOutput
 	if createZip {
-		zipFile, err := os.Create(zipFileName)
+		zipStart := time.Now()
+		zipOut, err = p.createZipOutput(ctx, zipFileName)
 		if err != nil {
-			return ImageResponse{}, fmt.Errorf("failed to create zip file: %v", err)
+			return ImageResponse{}, err
 		}
-		defer zipFile.Close()
+		defer zipOut.abort()
 
 		// Create a new zip archive
-		zipWriter := zip.NewWriter(zipFile)
+		zipWriter := zip.NewWriter(zipOut)
 		defer zipWriter.Close()
 
 		images := []string{}
 
 		// Add each split image to the zip file
 		for _, imagePath := range chunkPaths {
+			if err := ctx.Err(); err != nil {
+				return ImageResponse{}, err
+			}
+
 			if err := addFileToZip(zipWriter, imagePath); err != nil {
 				return ImageResponse{}, fmt.Errorf("failed to add file to zip: %v", err)
 			}
@@ -430,10 +1395,28 @@ func (p *Processor) processImageWithGo(imagePath string, outputDir string, image
 			images = append(images, imageRelPath)
 		}
 
+		if p.HTMLPreview {
+			writer, err := zipWriter.CreateHeader(&zip.FileHeader{
+				Name:     htmlPreviewFileName,
+				Method:   zip.Deflate,
+				Modified: time.Now(),
+			})
+			if err != nil {
+				return ImageResponse{}, fmt.Errorf("failed to add file to zip: %v", err)
+			}
+			if err := writeHTMLPreview(writer, imagesPrefix, previewNames); err != nil {
+				return ImageResponse{}, err
+			}
+		}
+
 		// Close the zip writer before returning
 		if err := zipWriter.Close(); err != nil {
 			return ImageResponse{}, fmt.Errorf("failed to close zip writer: %v", err)
 		}
+		if err := zipOut.close(); err != nil {
+			return ImageResponse{}, err
+		}
+		p.stageDone(StageZip, zipStart)
 	}
 
 	// Get absolute path to zip file
@@ -441,15 +1424,113 @@ func (p *Processor) processImageWithGo(imagePath string, outputDir string, image
 
 	relativeZipPath, _ := filepath.Rel(p.OutputBaseDir, absZipPath)
 
-	return ImageResponse{
-		Status:  "success",
-		Message: fmt.Sprintf("Successfully split image into %d parts and created zip file", splitCount),
-		ZipURL:  relativeZipPath,
-		Images:  chunkPaths,
-	}, nil
+	result := ImageResponse{
+		Status:     "success",
+		Message:    fmt.Sprintf("Successfully split image into %d parts and created zip file", splitCount-len(skipped)),
+		ZipURL:     relativeZipPath,
+		Images:     chunkPaths,
+		Skipped:    skippedNames(imagesPrefix, skipped),
+		Duplicates: duplicates,
+		Verified:   p.Verify,
+	}
+	if zipOut != nil {
+		zipOut.setZip(&result)
+	}
+
+	return result, nil
+}
+
+// splitGoImage cuts img into horizontal strips of at most MaxHeight pixels,
+// optionally cropped to requestedWidth, and calls fn for each of them in order.
+// It returns the number of chunks produced.
+func (p *Processor) splitGoImage(img image.Image, usePNG bool, requestedWidth int, maxImages int, fn func(index int, chunk image.Image) error) (int, error) {
+	bounds := img.Bounds()
+	rects := p.splitRects(img, requestedWidth, maxImages)
+	if err := p.checkChunkCount(len(rects)); err != nil {
+		return 0, err
+	}
+
+	if !usePNG {
+		img = p.flattenAlpha(img)
+	}
+
+	for i, rect := range rects {
+		// Rectangles are relative to the origin of the prepared image
+		rect = rect.Add(bounds.Min)
+
+		// Create subimage
+		subImg := p.newChunkImage(img.ColorModel(), rect.Dx(), rect.Dy(), usePNG)
+		for y := rect.Min.Y; y < rect.Max.Y; y++ {
+			for x := rect.Min.X; x < rect.Max.X; x++ {
+				subImg.Set(x-rect.Min.X, y-rect.Min.Y, img.At(x, y))
+			}
+		}
+
+		var chunk image.Image = subImg
+		if p.Preset == PresetInstagram {
+			chunk = p.instagramTile(subImg, min(bounds.Dx(), bounds.Dy()), usePNG)
+		}
+
+		if err := fn(i, chunk); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(rects), nil
+}
+
+// chunkRects returns the source rectangle of every chunk for an image of the
+// given dimensions, see splitcore.Layout
+func (p *Processor) chunkRects(originalWidth int, totalHeight int, requestedWidth int, maxImages int) []image.Rectangle {
+	return p.layout().Rects(originalWidth, totalHeight, requestedWidth, maxImages)
+}
+
+// chunkHeight returns the height of the chunks of the given width
+func (p *Processor) chunkHeight(width int) int {
+	return p.layout().ChunkHeight(width)
+}
+
+// Anchors of the width crop, see Anchor
+const (
+	AnchorLeft   = splitcore.AnchorLeft
+	AnchorCenter = splitcore.AnchorCenter
+	AnchorRight  = splitcore.AnchorRight
+)
+
+// ValidAnchor reports whether anchor is an Anchor constant, a pixel offset
+// or empty
+func ValidAnchor(anchor string) bool {
+	return splitcore.ValidAnchor(anchor)
+}
+
+// layout returns the chunk layout of p
+func (p *Processor) layout() splitcore.Layout {
+	return splitcore.Layout{
+		MaxHeight:   p.MaxHeight,
+		ChunkAspect: p.ChunkAspect,
+		MaxPixels:   p.MaxPixels,
+		Squares:     p.Preset == PresetInstagram,
+		Anchor:      p.Anchor,
+	}
+}
+
+// chunkFileName returns the file name of the chunk at the zero based index
+func chunkFileName(imagesPrefix string, index int) string {
+	return splitcore.ChunkFileName(imagesPrefix, index)
+}
+
+// chunkNames returns the file names of the chunks at paths
+func chunkNames(paths []string) []string {
+	names := make([]string, len(paths))
+	for i, path := range paths {
+		names[i] = filepath.Base(path)
+	}
+	return names
 }
 
-// addFileToZip adds a file to a zip archive
+// addFileToZip adds a file to a zip archive. The entry is streamed with a
+// data descriptor, so archive/zip switches to Zip64 records on its own when
+// the file or the archive outgrows the 32-bit fields.
 func addFileToZip(zipWriter *zip.Writer, filePath string) error {
 	file, err := os.Open(filePath)
 	if err != nil {
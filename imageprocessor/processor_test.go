@@ -0,0 +1,63 @@
+package imageprocessor
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFailedSourceHook(t *testing.T) {
+	server := serveSource(t)
+	errHook := errors.New("hook failed")
+	failingHook := func(ctx context.Context, path string) error { return errHook }
+
+	tests := []struct {
+		name      string
+		collision string
+		existing  bool
+		kept      bool
+	}{
+		{"new output", OutputCollisionReject, false, false},
+		{"resumed output", OutputCollisionResume, true, true},
+		{"overwritten output", OutputCollisionOverwrite, true, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			outputDir := filepath.Join(dir, "page")
+			earlier := filepath.Join(outputDir, chunkFileName("page", 0))
+			if tt.existing {
+				if err := os.Mkdir(outputDir, 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(earlier, []byte("earlier job"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			p := Processor{
+				OutputBaseDir:   dir,
+				OutputName:      "page",
+				OutputCollision: tt.collision,
+				MaxHeight:       10,
+				SourceHook:      failingHook,
+			}
+			if _, err := p.ProcessImage(server.URL+"/page.png", "page", 0, 0, false); !errors.Is(err, errHook) {
+				t.Fatalf("got %v, want the hook error", err)
+			}
+
+			_, err := os.Stat(outputDir)
+			if kept := err == nil; kept != tt.kept {
+				t.Fatalf("got output directory kept %v, want %v", kept, tt.kept)
+			}
+			if tt.existing {
+				if _, err := os.Stat(earlier); err != nil {
+					t.Errorf("the chunk of the earlier job was removed: %v", err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,227 @@
+package imageprocessor
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Address families of FetchOptions.PreferIP
+const (
+	PreferIPv4 = "ipv4"
+	PreferIPv6 = "ipv6"
+)
+
+// maxDNSCacheEntries bounds the hosts cached, the expired ones are dropped
+// when it is reached
+const maxDNSCacheEntries = 1024
+
+// hostResolver resolves the source hosts with the resolvers and the address
+// family of FetchOptions, and caches the addresses for DNSCacheTTL
+type hostResolver struct {
+	resolver *net.Resolver
+	ttl      time.Duration
+	prefer   string
+	timeout  time.Duration
+
+	mu      sync.Mutex
+	entries map[string]dnsEntry
+}
+
+// dnsEntry are the cached addresses of a host
+type dnsEntry struct {
+	addrs   []string
+	expires time.Time
+}
+
+// newHostResolver returns the resolver of opts, nil when opts resolve like the
+// system does
+func newHostResolver(opts FetchOptions) *hostResolver {
+	if opts.DNSCacheTTL <= 0 && opts.PreferIP == "" && len(opts.DNSServers) == 0 {
+		return nil
+	}
+
+	resolver := net.DefaultResolver
+	if len(opts.DNSServers) > 0 {
+		resolver = pinnedResolver(opts.DNSServers, opts.ConnectTimeout)
+	}
+
+	return &hostResolver{
+		resolver: resolver,
+		ttl:      opts.DNSCacheTTL,
+		prefer:   opts.PreferIP,
+		timeout:  opts.ConnectTimeout,
+		entries:  make(map[string]dnsEntry),
+	}
+}
+
+// pinnedResolver returns a resolver querying servers, host:port or host of
+// port 53, in turn so a failed query is retried on the next one
+func pinnedResolver(servers []string, timeout time.Duration) *net.Resolver {
+	addrs := make([]string, len(servers))
+	for i, server := range servers {
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(strings.Trim(server, "[]"), "53")
+		}
+		addrs[i] = server
+	}
+
+	var next atomic.Uint32
+	dialer := &net.Dialer{Timeout: timeout}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network string, address string) (net.Conn, error) {
+			server := addrs[int(next.Add(1)-1)%len(addrs)]
+			return dialer.DialContext(ctx, network, server)
+		},
+	}
+}
+
+// lookup returns the addresses of host, from the cache while they are fresh.
+// The last addresses of a host are used again when the lookup fails.
+func (r *hostResolver) lookup(ctx context.Context, host string) ([]string, error) {
+	if net.ParseIP(host) != nil {
+		return []string{host}, nil
+	}
+	host = strings.ToLower(host)
+
+	r.mu.Lock()
+	entry, cached := r.entries[host]
+	r.mu.Unlock()
+	if cached && time.Now().Before(entry.expires) {
+		return entry.addrs, nil
+	}
+
+	if r.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.timeout)
+		defer cancel()
+	}
+
+	addrs, err := r.resolver.LookupHost(ctx, host)
+	if err != nil {
+		if cached {
+			return entry.addrs, nil
+		}
+		return nil, err
+	}
+	r.sortAddrs(addrs)
+
+	if r.ttl > 0 {
+		r.store(host, addrs)
+	}
+	return addrs, nil
+}
+
+// sortAddrs puts the addresses of the preferred family first, keeping the
+// order of the resolver otherwise
+func (r *hostResolver) sortAddrs(addrs []string) {
+	if r.prefer == "" {
+		return
+	}
+
+	sort.SliceStable(addrs, func(i, j int) bool {
+		return r.preferred(addrs[i]) && !r.preferred(addrs[j])
+	})
+}
+
+// preferred reports whether addr is of the preferred family
+func (r *hostResolver) preferred(addr string) bool {
+	isIPv4 := net.ParseIP(addr).To4() != nil
+	return isIPv4 == (r.prefer == PreferIPv4)
+}
+
+// store caches the addresses of host
+func (r *hostResolver) store(host string, addrs []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	if len(r.entries) >= maxDNSCacheEntries {
+		for cachedHost, entry := range r.entries {
+			if now.After(entry.expires) {
+				delete(r.entries, cachedHost)
+			}
+		}
+		if len(r.entries) >= maxDNSCacheEntries {
+			return
+		}
+	}
+	r.entries[host] = dnsEntry{addrs: addrs, expires: now.Add(r.ttl)}
+}
+
+// dialContext returns the DialContext of a transport connecting to the
+// addresses of r in order until one accepts the connection
+func (r *hostResolver) dialContext(dialer *net.Dialer) func(ctx context.Context, network string, address string) (net.Conn, error) {
+	return func(ctx context.Context, network string, address string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+
+		addrs, err := r.lookup(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+
+		var firstErr error
+		for _, addr := range addrs {
+			conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(addr, port))
+			if err == nil {
+				return conn, nil
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+			if ctx.Err() != nil {
+				break
+			}
+		}
+		if firstErr == nil {
+			firstErr = fmt.Errorf("no addresses found for %s", host)
+		}
+		return nil, firstErr
+	}
+}
+
+// curlResolveArgs returns the --resolve option making curl connect to the
+// addresses r resolves for the host of rawURL. Redirects to other hosts are
+// resolved by curl.
+func (r *hostResolver) curlResolveArgs(ctx context.Context, rawURL string) ([]string, error) {
+	if r == nil {
+		return nil, nil
+	}
+
+	parsed, err := url.Parse(rawURL)
+	if err != nil || parsed.Hostname() == "" || net.ParseIP(parsed.Hostname()) != nil {
+		return nil, nil
+	}
+
+	port := parsed.Port()
+	if port == "" {
+		port = "80"
+		if parsed.Scheme == "https" {
+			port = "443"
+		}
+	}
+
+	addrs, err := r.lookup(ctx, parsed.Hostname())
+	if err != nil {
+		return nil, hostFailure{fmt.Errorf("failed to download image: %v", err)}
+	}
+
+	bracketed := make([]string, len(addrs))
+	for i, addr := range addrs {
+		if strings.Contains(addr, ":") {
+			addr = "[" + addr + "]"
+		}
+		bracketed[i] = addr
+	}
+	return []string{"--resolve", parsed.Hostname() + ":" + port + ":" + strings.Join(bracketed, ",")}, nil
+}
@@ -0,0 +1,194 @@
+package imageprocessor
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// progressFileName is the file of a job with OutputCollisionResume recording
+// its completed chunks in the output directory. It is removed once the job
+// succeeds.
+const progressFileName = "progress.json"
+
+// jobProgress is the per-chunk state of a resumable job
+type jobProgress struct {
+	mu   sync.Mutex
+	path string
+
+	// Key identifies the source and the options of the job, the chunks of an
+	// earlier run with another key are not kept
+	Key string `json:"key"`
+	// Chunks maps the names of the completed chunks to their state
+	Chunks map[string]chunkState `json:"chunks"`
+}
+
+// chunkState is a completed chunk, kept by a resumed job while the file is intact
+type chunkState struct {
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// resumeKey returns the key of a job splitting the source with the digest
+// sourceSHA256, from every option that changes the chunks
+func (p *Processor) resumeKey(sourceSHA256 string, imagesPrefix string, width int, maxImages int) (string, error) {
+	var padColor, background string
+	if p.PadColor != nil {
+		r, g, b, a := p.PadColor.RGBA()
+		padColor = fmt.Sprintf("%04x%04x%04x%04x", r, g, b, a)
+	}
+	if p.Background != nil {
+		r, g, b, a := p.Background.RGBA()
+		background = fmt.Sprintf("%04x%04x%04x%04x", r, g, b, a)
+	}
+
+	options := struct {
+		SourceSHA256     string
+		ImagesPrefix     string
+		Width            int
+		MaxImages        int
+		MaxHeight        int
+		Backend          string
+		JPEGEncoder      string
+		SVGWidth         int
+		SVGDPI           int
+		Quality          int
+		OutputFormat     string
+		Subsampling      string
+		BitDepth         int
+		DPI              int
+		TargetChunkBytes int64
+		PNGOptimize      int
+		ColorSpace       string
+		Rotate           int
+		Crop             image.Rectangle
+		SkipBlank        bool
+		SplitMode        string
+		ChunkAspect      image.Point
+		MaxPixels        int
+		Preset           string
+		PadColor         string
+		ScaleWidth       int
+		OutputWidths     []int
+		Anchor           string
+		Fit              string
+		Background       string
+		Sharpen          float64
+		ConvertSRGB      bool
+	}{
+		sourceSHA256, imagesPrefix, width, maxImages, p.MaxHeight, p.BackendName(), p.JPEGEncoder,
+		p.SVGWidth, p.SVGDPI, p.Quality, p.OutputFormat, p.Subsampling, p.BitDepth, p.DPI,
+		p.TargetChunkBytes, p.PNGOptimize, p.ColorSpace, p.Rotate, p.Crop, p.SkipBlank, p.SplitMode,
+		p.ChunkAspect, p.MaxPixels, p.Preset, padColor, p.ScaleWidth, p.OutputWidths,
+		p.Anchor, p.Fit, background, p.Sharpen, p.ConvertSRGB,
+	}
+
+	data, err := json.Marshal(options)
+	if err != nil {
+		return "", fmt.Errorf("failed to compute the resume key: %v", err)
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// withProgress returns a copy of p recording its chunks in outputDir, which
+// keeps the chunks an earlier run of the same key completed. The chunks of
+// an earlier run with another key are removed.
+func (p *Processor) withProgress(outputDir string, key string) (*Processor, error) {
+	progress := &jobProgress{
+		path:   filepath.Join(outputDir, progressFileName),
+		Key:    key,
+		Chunks: make(map[string]chunkState),
+	}
+
+	data, err := os.ReadFile(progress.path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read the job progress: %v", err)
+	}
+
+	if err == nil {
+		var previous jobProgress
+		if err := json.Unmarshal(data, &previous); err == nil && previous.Key == key && previous.Chunks != nil {
+			progress.Chunks = previous.Chunks
+		} else {
+			for name := range previous.Chunks {
+				os.Remove(filepath.Join(outputDir, filepath.Base(name)))
+			}
+			os.Remove(progress.path)
+		}
+	}
+
+	job := *p
+	job.progress = progress
+	return &job, nil
+}
+
+// done reports whether the chunk at path was completed by an earlier run
+// and is intact
+func (j *jobProgress) done(path string) bool {
+	if j == nil {
+		return false
+	}
+
+	j.mu.Lock()
+	state, ok := j.Chunks[filepath.Base(path)]
+	j.mu.Unlock()
+	if !ok {
+		return false
+	}
+
+	info, err := os.Stat(path)
+	if err != nil || info.Size() != state.Size {
+		return false
+	}
+	sum, err := fileSHA256(path)
+	return err == nil && hex.EncodeToString(sum[:]) == state.SHA256
+}
+
+// record saves that the chunk at path is complete, through a temporary file
+// so a crash never leaves a partial state
+func (j *jobProgress) record(path string) error {
+	if j == nil {
+		return nil
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("failed to record the job progress: %v", err)
+	}
+	sum, err := fileSHA256(path)
+	if err != nil {
+		return fmt.Errorf("failed to record the job progress: %v", err)
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.Chunks[filepath.Base(path)] = chunkState{Size: info.Size(), SHA256: hex.EncodeToString(sum[:])}
+
+	data, err := json.Marshal(j)
+	if err != nil {
+		return fmt.Errorf("failed to record the job progress: %v", err)
+	}
+	if err := os.WriteFile(j.path+".tmp", data, 0644); err != nil {
+		return fmt.Errorf("failed to record the job progress: %v", err)
+	}
+	if err := os.Rename(j.path+".tmp", j.path); err != nil {
+		return fmt.Errorf("failed to record the job progress: %v", err)
+	}
+	return nil
+}
+
+// remove deletes the progress of a job that succeeded
+func (j *jobProgress) remove() {
+	if j != nil {
+		os.Remove(j.path)
+	}
+}
@@ -0,0 +1,98 @@
+package imageprocessor
+
+import (
+	"context"
+	"sync"
+)
+
+// Semaphore limits how many operations of a kind run at once. A nil
+// Semaphore never blocks.
+type Semaphore chan struct{}
+
+// NewSemaphore returns a semaphore admitting n operations at once, or nil
+// (unlimited) when n is not positive
+func NewSemaphore(n int) Semaphore {
+	if n <= 0 {
+		return nil
+	}
+	return make(Semaphore, n)
+}
+
+// Acquire waits for a free slot or until ctx is done
+func (s Semaphore) Acquire(ctx context.Context) error {
+	if s == nil {
+		return nil
+	}
+
+	select {
+	case s <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Release frees a slot taken by Acquire
+func (s Semaphore) Release() {
+	if s != nil {
+		<-s
+	}
+}
+
+// InUse returns the number of slots currently taken
+func (s Semaphore) InUse() int {
+	return len(s)
+}
+
+// sharedSlot is a slot of a Semaphore held by a job and by the decodes it
+// abandoned, freed once all of them released it
+type sharedSlot struct {
+	sem Semaphore
+
+	mu      sync.Mutex
+	holders int
+}
+
+// hold adds a holder of the slot and returns its release function, a no-op
+// for a nil slot
+func (s *sharedSlot) hold() func() {
+	if s == nil {
+		return func() {}
+	}
+
+	s.mu.Lock()
+	s.holders++
+	s.mu.Unlock()
+
+	var once sync.Once
+	return func() { once.Do(s.release) }
+}
+
+// release removes a holder and frees the slot after the last one
+func (s *sharedSlot) release() {
+	s.mu.Lock()
+	s.holders--
+	free := s.holders == 0
+	s.mu.Unlock()
+
+	if free {
+		s.sem.Release()
+	}
+}
+
+// withEncodeSlot waits for a slot of Encodes and returns the job holding it,
+// and the function releasing it once the job ends. The decodes abandoned by
+// the job keep the slot until they return, see decodeSource.
+func (p *Processor) withEncodeSlot(ctx context.Context) (*Processor, func(), error) {
+	if p.Encodes == nil {
+		return p, func() {}, nil
+	}
+	if err := p.Encodes.Acquire(ctx); err != nil {
+		return nil, nil, err
+	}
+
+	slot := &sharedSlot{sem: p.Encodes}
+	job := *p
+	job.encodeSlot = slot
+	return &job, slot.hold(), nil
+}
@@ -0,0 +1,140 @@
+package imageprocessor
+
+import (
+	"archive/zip"
+	"context"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// ImageSet is the chunk set of one of the OutputWidths
+type ImageSet struct {
+	Width        int               `json:"width"`
+	Images       []string          `json:"images"`
+	Skipped      []string          `json:"skipped,omitempty"`
+	Duplicates   map[string]string `json:"duplicates,omitempty"`
+	ContactSheet string            `json:"contact_sheet,omitempty"`
+}
+
+// setPrefix returns the images prefix of the chunk set of the given width
+func setPrefix(imagesPrefix string, width int) string {
+	return fmt.Sprintf("%s_%dw", imagesPrefix, width)
+}
+
+// processSets splits the image once per entry of OutputWidths, scaled down to
+// that width, into chunks prefixed by setPrefix, and zips all the sets together
+func (p *Processor) processSets(ctx context.Context, imagePath string, outputDir string, imagesPrefix string, width int, maxImages int, createZip bool) (ImageResponse, error) {
+	result := ImageResponse{
+		Status:   "success",
+		Verified: p.Verify,
+	}
+
+	var chunkPaths []string
+
+	if err := p.checkSetsChunkCount(ctx, imagePath, width, maxImages); err != nil {
+		return ImageResponse{}, err
+	}
+
+	// The strip is scaled from the widest set
+	stripSet := slices.Max(p.OutputWidths)
+
+	// Every set is checked against MaxChunks with the chunks of the previous ones
+	previousChunks := 0
+
+	for _, setWidth := range p.OutputWidths {
+		if err := ctx.Err(); err != nil {
+			return ImageResponse{}, err
+		}
+
+		set := *p
+		set.OutputWidths = nil
+		set.ScaleWidth = setWidth
+		set.previousChunks = previousChunks
+		if setWidth != stripSet {
+			set.StripWidth = 0
+		}
+
+		prefix := setPrefix(imagesPrefix, setWidth)
+
+		setResult, err := set.processFile(ctx, imagePath, outputDir, prefix, width, maxImages, false)
+		if err != nil {
+			return ImageResponse{}, err
+		}
+
+		previousChunks += len(setResult.Images) + len(setResult.Skipped) + len(setResult.Duplicates)
+		if setResult.Strip != "" {
+			result.Strip = setResult.Strip
+		}
+		result.Images = append(result.Images, setResult.Images...)
+		result.Skipped = append(result.Skipped, setResult.Skipped...)
+		for name, first := range setResult.Duplicates {
+			if result.Duplicates == nil {
+				result.Duplicates = make(map[string]string)
+			}
+			result.Duplicates[name] = first
+		}
+
+		result.Sets = append(result.Sets, ImageSet{
+			Width:        setWidth,
+			Images:       setResult.Images,
+			Skipped:      setResult.Skipped,
+			Duplicates:   setResult.Duplicates,
+			ContactSheet: setResult.ContactSheet,
+		})
+
+		for _, image := range setResult.Images {
+			chunkPaths = append(chunkPaths, filepath.Join(outputDir, filepath.Base(image)))
+		}
+	}
+
+	zipFileName := filepath.Join(outputDir, fmt.Sprintf("%s.zip", imagesPrefix))
+	absZipPath, _ := filepath.Abs(zipFileName)
+	result.ZipURL, _ = filepath.Rel(p.OutputBaseDir, absZipPath)
+
+	if createZip {
+		zipStart := time.Now()
+		if err := p.writeChunksZip(ctx, zipFileName, chunkPaths, &result); err != nil {
+			return ImageResponse{}, err
+		}
+		p.stageDone(StageZip, zipStart)
+	}
+
+	result.Message = fmt.Sprintf("Successfully split image into %d parts in %d sets and created zip file", len(chunkPaths), len(result.Sets))
+
+	return result, nil
+}
+
+// writeChunksZip saves the chunks at chunkPaths in a zip at zipFileName, or
+// uploads it with ZipUploader, setting the zip of result
+func (p *Processor) writeChunksZip(ctx context.Context, zipFileName string, chunkPaths []string, result *ImageResponse) error {
+	zipOut, err := p.createZipOutput(ctx, zipFileName)
+	if err != nil {
+		return err
+	}
+	defer zipOut.abort()
+
+	zipWriter := zip.NewWriter(zipOut)
+	defer zipWriter.Close()
+
+	for _, chunkPath := range chunkPaths {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if err := addFileToZip(zipWriter, chunkPath); err != nil {
+			return fmt.Errorf("failed to add file to zip: %v", err)
+		}
+	}
+
+	if err := zipWriter.Close(); err != nil {
+		return fmt.Errorf("failed to close zip writer: %v", err)
+	}
+	if err := zipOut.close(); err != nil {
+		return err
+	}
+
+	zipOut.setZip(result)
+	return nil
+}
@@ -0,0 +1,144 @@
+package imageprocessor
+
+import (
+	"context"
+	"fmt"
+	"image/color"
+	"math"
+	"os/exec"
+	"path/filepath"
+
+	"golang.org/x/image/draw"
+)
+
+// MaxSharpen is the largest Sharpen amount
+const MaxSharpen = 5
+
+// sharpenSigma is the radius of the blur the unsharp mask subtracts, in
+// pixels, the scale of the detail it restores in a resized image
+const sharpenSigma = 1.0
+
+// sharpenKernel is the normalized Gaussian kernel of sharpenSigma, 3 sigma
+// on each side
+var sharpenKernel = func() []float32 {
+	radius := int(math.Ceil(3 * sharpenSigma))
+	kernel := make([]float32, 2*radius+1)
+
+	var sum float32
+	for i := range kernel {
+		x := float64(i - radius)
+		kernel[i] = float32(math.Exp(-x * x / (2 * sharpenSigma * sharpenSigma)))
+		sum += kernel[i]
+	}
+	for i := range kernel {
+		kernel[i] /= sum
+	}
+	return kernel
+}()
+
+// sharpen applies the unsharp mask of Sharpen to a resized image in place:
+// every channel moves away from its blurred value by the amount. The alpha
+// is kept.
+func (p *Processor) sharpen(img draw.Image) {
+	if p.Sharpen <= 0 {
+		return
+	}
+
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+
+	// The premultiplied channels, alpha last
+	var channels [4][]float32
+	for c := range channels {
+		channels[c] = make([]float32, width*height)
+	}
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			r, g, b, a := img.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+			i := y*width + x
+			channels[0][i], channels[1][i], channels[2][i], channels[3][i] = float32(r), float32(g), float32(b), float32(a)
+		}
+	}
+
+	amount := float32(p.Sharpen)
+	alpha := channels[3]
+	for _, channel := range channels[:3] {
+		blurred := gaussianBlur(channel, width, height)
+		for i, value := range channel {
+			channel[i] = min(max(value+amount*(value-blurred[i]), 0), alpha[i])
+		}
+	}
+
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			i := y*width + x
+			img.Set(bounds.Min.X+x, bounds.Min.Y+y, color.RGBA64{
+				R: uint16(channels[0][i]),
+				G: uint16(channels[1][i]),
+				B: uint16(channels[2][i]),
+				A: uint16(alpha[i]),
+			})
+		}
+	}
+}
+
+// gaussianBlur returns the width x height plane blurred with sharpenKernel,
+// horizontally then vertically, the edges repeated
+func gaussianBlur(plane []float32, width int, height int) []float32 {
+	radius := len(sharpenKernel) / 2
+	horizontal := make([]float32, len(plane))
+	for y := 0; y < height; y++ {
+		row := plane[y*width : (y+1)*width]
+		for x := range row {
+			var sum float32
+			for k, weight := range sharpenKernel {
+				sum += weight * row[min(max(x+k-radius, 0), width-1)]
+			}
+			horizontal[y*width+x] = sum
+		}
+	}
+
+	blurred := make([]float32, len(plane))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			var sum float32
+			for k, weight := range sharpenKernel {
+				sum += weight * horizontal[min(max(y+k-radius, 0), height-1)*width+x]
+			}
+			blurred[y*width+x] = sum
+		}
+	}
+	return blurred
+}
+
+// sharpenWithCLI has vips sharpen the resized image at imagePath, see
+// sharpen, and returns the path of the result, imagePath without Sharpen.
+// The vips jaggy slope is 3 for an amount of 1.
+func (p *Processor) sharpenWithCLI(ctx context.Context, imagePath string, outputDir string) (string, error) {
+	if p.Sharpen <= 0 {
+		return imagePath, nil
+	}
+
+	sharpenedPath := filepath.Join(outputDir, "sharpened.v")
+
+	vipsCmd := exec.CommandContext(ctx,
+		"vips", "sharpen",
+		imagePath,
+		sharpenedPath,
+		"--sigma", fmt.Sprintf("%g", sharpenSigma),
+		"--m2", fmt.Sprintf("%g", 3*p.Sharpen),
+	)
+	if output, err := vipsCmd.CombinedOutput(); err != nil {
+		return "", fmt.Errorf("failed to sharpen image: %v - %s", err, string(output))
+	}
+	return sharpenedPath, nil
+}
+
+// magickSharpenOptions returns the convert options of the unsharp mask of a
+// resized image, nil without Sharpen
+func (p *Processor) magickSharpenOptions() []string {
+	if p.Sharpen <= 0 {
+		return nil
+	}
+	return []string{"-unsharp", fmt.Sprintf("0x%g+%g+0", sharpenSigma, p.Sharpen)}
+}
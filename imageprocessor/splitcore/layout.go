@@ -0,0 +1,190 @@
+// Package splitcore holds the chunk layout and the naming scheme of the
+// imageprocessor package, and a pure Go split built on them. It only depends
+// on the standard library and reaches the filesystem through FS, so it
+// compiles to WebAssembly and splits in the browser exactly like the server.
+package splitcore
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"strconv"
+)
+
+// MaxSquareTiles is the most tiles of a Squares layout, the number of posts
+// an Instagram carousel can hold
+const MaxSquareTiles = 20
+
+// Anchors of the width crop of an image wider than the requested width
+const (
+	AnchorLeft   = "left"
+	AnchorCenter = "center"
+	AnchorRight  = "right"
+)
+
+// Layout sizes the chunks of a split
+type Layout struct {
+	// MaxHeight is the height of the chunks
+	MaxHeight int
+	// ChunkAspect is the width:height ratio of the chunks, replacing
+	// MaxHeight when set
+	ChunkAspect image.Point
+	// MaxPixels is the largest pixel count of a chunk, lowering the chunk
+	// height and tiling wide images into columns when set
+	MaxPixels int
+	// Squares replaces the fixed height chunks with square tiles, side by
+	// side for wide images and stacked for tall ones
+	Squares bool
+	// Anchor places the requested width in a wider image: AnchorLeft when
+	// empty, AnchorCenter, AnchorRight, or the offset of the left edge of the
+	// crop in pixels, e.g. "120", kept inside the image
+	Anchor string
+}
+
+// ValidAnchor reports whether anchor is one of the Anchor constants, a pixel
+// offset or empty
+func ValidAnchor(anchor string) bool {
+	switch anchor {
+	case "", AnchorLeft, AnchorCenter, AnchorRight:
+		return true
+	}
+	offset, err := strconv.Atoi(anchor)
+	return err == nil && offset >= 0
+}
+
+// CropOffset returns the left edge of the width pixels of the image
+// originalWidth pixels wide that are kept, per Anchor
+func (l Layout) CropOffset(originalWidth int, width int) int {
+	switch l.Anchor {
+	case "", AnchorLeft:
+		return 0
+	case AnchorCenter:
+		return (originalWidth - width) / 2
+	case AnchorRight:
+		return originalWidth - width
+	}
+	offset, _ := strconv.Atoi(l.Anchor)
+	return max(0, min(offset, originalWidth-width))
+}
+
+// Rects returns the source rectangle of every chunk for an image of the
+// given dimensions. Chunks are at most MaxHeight pixels tall, or as tall as
+// ChunkAspect gives for their width, and, when
+// requestedWidth is smaller than the image, cropped to that width at Anchor.
+// MaxPixels lowers the height further and tiles images too wide for it.
+func (l Layout) Rects(originalWidth int, totalHeight int, requestedWidth int, maxImages int) []image.Rectangle {
+	// Determine if we need to crop the width
+	width := originalWidth
+	xOffset := 0
+	if requestedWidth > 0 && originalWidth > requestedWidth {
+		width = requestedWidth
+		xOffset = l.CropOffset(originalWidth, width)
+	}
+
+	if l.Squares {
+		rects := squareRects(width, totalHeight, maxImages)
+		for i := range rects {
+			rects[i] = rects[i].Add(image.Pt(xOffset, 0))
+		}
+		return rects
+	}
+
+	// Calculate number of splits needed
+	maxHeight := l.ChunkHeight(width)
+	columns, columnWidth := 1, width
+	if l.MaxPixels > 0 {
+		columns, columnWidth, maxHeight = l.budgetLayout(width, min(maxHeight, totalHeight))
+	}
+	rows := (totalHeight + maxHeight - 1) / maxHeight // Ceiling division
+	splitCount := rows * columns
+
+	// Limit the number of images
+	if maxImages > 0 && splitCount > maxImages {
+		splitCount = maxImages
+	}
+
+	// Tiles are ordered row by row, left to right
+	rects := make([]image.Rectangle, 0, splitCount)
+	for i := 0; i < splitCount; i++ {
+		startY := (i / columns) * maxHeight
+		endY := startY + maxHeight
+		if endY > totalHeight {
+			endY = totalHeight
+		}
+
+		startX := xOffset + (i%columns)*columnWidth
+		endX := min(startX+columnWidth, xOffset+width)
+
+		rects = append(rects, image.Rect(startX, startY, endX, endY))
+	}
+
+	return rects
+}
+
+// ChunkHeight returns the height of the chunks of the given width
+func (l Layout) ChunkHeight(width int) int {
+	if l.ChunkAspect.X > 0 && l.ChunkAspect.Y > 0 {
+		return max(1, (width*l.ChunkAspect.Y+l.ChunkAspect.X/2)/l.ChunkAspect.X)
+	}
+	return l.MaxHeight
+}
+
+// budgetLayout returns the number of columns, the column width and the chunk
+// height that keep the chunks of an image width pixels wide under MaxPixels,
+// with chunks at most maxHeight tall. Images too wide for a square chunk, or
+// a chunk of maxHeight, under the budget are tiled into columns of equal
+// width, save for rounding.
+func (l Layout) budgetLayout(width int, maxHeight int) (int, int, int) {
+	if l.MaxPixels/width >= min(width, maxHeight) {
+		return 1, width, min(maxHeight, l.MaxPixels/width)
+	}
+
+	side := int(math.Sqrt(float64(l.MaxPixels)))
+	for side*side > l.MaxPixels {
+		side--
+	}
+
+	columns := (width + side - 1) / side
+	columnWidth := (width + columns - 1) / columns
+
+	return columns, columnWidth, min(maxHeight, l.MaxPixels/columnWidth)
+}
+
+// squareRects returns the tiles of a width x height image. Every tile is
+// a square with the side of the shorter dimension, except the last one when
+// the longer dimension is not a multiple of it.
+func squareRects(width int, height int, maxImages int) []image.Rectangle {
+	side := min(width, height)
+	length := max(width, height)
+
+	count := (length + side - 1) / side
+	if maxImages <= 0 || maxImages > MaxSquareTiles {
+		maxImages = MaxSquareTiles
+	}
+	count = min(count, maxImages)
+
+	rects := make([]image.Rectangle, 0, count)
+	for i := 0; i < count; i++ {
+		start := i * side
+		end := min(start+side, length)
+
+		if width >= height {
+			rects = append(rects, image.Rect(start, 0, end, height))
+		} else {
+			rects = append(rects, image.Rect(0, start, width, end))
+		}
+	}
+
+	return rects
+}
+
+// ChunkFileName returns the file name of the chunk at the zero based index,
+// adding a leading zero for numbers less than 10
+func ChunkFileName(imagesPrefix string, index int) string {
+	fileNumber := index + 1
+	fileNumberStr := fmt.Sprintf("%d", fileNumber)
+	if fileNumber < 10 {
+		fileNumberStr = fmt.Sprintf("0%d", fileNumber)
+	}
+	return fmt.Sprintf("%s_%s.jpg", imagesPrefix, fileNumberStr)
+}
@@ -0,0 +1,207 @@
+package splitcore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/jempe/imagesplitter/internal/jpegenc"
+)
+
+// DefaultQuality is the quality of the JPEG chunks when Options.Quality is zero
+const DefaultQuality = 90
+
+// Formats of the chunks
+const (
+	FormatJPEG = "jpeg"
+	FormatPNG  = "png"
+)
+
+// FS receives the chunks of a split
+type FS interface {
+	// Create returns a writer of the file name, the chunk is complete once
+	// the writer is closed
+	Create(name string) (io.WriteCloser, error)
+}
+
+// DirFS writes the chunks to the local directory it names
+type DirFS string
+
+func (dir DirFS) Create(name string) (io.WriteCloser, error) {
+	return os.Create(filepath.Join(string(dir), name))
+}
+
+// MemFS holds the chunks in memory, e.g. to hand them to JavaScript
+type MemFS struct {
+	mu    sync.Mutex
+	files map[string][]byte
+}
+
+func (m *MemFS) Create(name string) (io.WriteCloser, error) {
+	return &memFile{fs: m, name: name}, nil
+}
+
+// Names returns the sorted names of the files of m
+func (m *MemFS) Names() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	names := make([]string, 0, len(m.files))
+	for name := range m.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// File returns the content of the file name and whether it exists
+func (m *MemFS) File(name string) ([]byte, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	data, ok := m.files[name]
+	return data, ok
+}
+
+// memFile is stored in its MemFS when it is closed
+type memFile struct {
+	bytes.Buffer
+	fs   *MemFS
+	name string
+}
+
+func (f *memFile) Close() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if f.fs.files == nil {
+		f.fs.files = make(map[string][]byte)
+	}
+	f.fs.files[f.name] = f.Bytes()
+	return nil
+}
+
+// Options are the parameters of a split
+type Options struct {
+	Layout
+	// ImagesPrefix starts the chunk file names, see ChunkFileName
+	ImagesPrefix string
+	// Width crops the chunks to this width from the left edge, zero keeps
+	// the width of the image
+	Width int
+	// MaxImages limits the number of chunks, zero is unlimited
+	MaxImages int
+	// Format is FormatJPEG or FormatPNG. Empty encodes PNG sources as PNG and
+	// the others as JPEG, like the server.
+	Format string
+	// Quality of the JPEG chunks, DefaultQuality when zero
+	Quality int
+}
+
+// Split cuts img into the chunks of opts.Layout and writes them to fsys in
+// order. It returns the names of the chunks. An empty Format is FormatJPEG.
+func Split(ctx context.Context, img image.Image, fsys FS, opts Options) ([]string, error) {
+	if opts.Format != "" && opts.Format != FormatJPEG && opts.Format != FormatPNG {
+		return nil, fmt.Errorf("unsupported format: %s", opts.Format)
+	}
+	if opts.MaxHeight <= 0 && (opts.ChunkAspect.X <= 0 || opts.ChunkAspect.Y <= 0) && !opts.Squares {
+		return nil, errors.New("max height must be a positive integer")
+	}
+
+	quality := opts.Quality
+	if quality == 0 {
+		quality = DefaultQuality
+	}
+
+	usePNG := opts.Format == FormatPNG
+	bounds := img.Bounds()
+	rects := opts.Layout.Rects(bounds.Dx(), bounds.Dy(), opts.Width, opts.MaxImages)
+
+	names := make([]string, 0, len(rects))
+	for i, rect := range rects {
+		// Stop between chunks when the split is cancelled
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		// Rectangles are relative to the origin of the image
+		rect = rect.Add(bounds.Min)
+		chunk := newChunkImage(img.ColorModel(), rect.Dx(), rect.Dy(), usePNG)
+		draw.Draw(chunk, chunk.Bounds(), img, rect.Min, draw.Src)
+
+		name := ChunkFileName(opts.ImagesPrefix, i)
+		if err := writeChunk(fsys, name, chunk, usePNG, quality); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+
+	return names, nil
+}
+
+// SplitReader decodes a JPEG, PNG or GIF image from r and splits it like Split
+func SplitReader(ctx context.Context, r io.Reader, fsys FS, opts Options) ([]string, error) {
+	img, format, err := image.Decode(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image: %v", err)
+	}
+
+	if opts.Format == "" && format == "png" {
+		opts.Format = FormatPNG
+	}
+	return Split(ctx, img, fsys, opts)
+}
+
+// newChunkImage returns the image a chunk of a source with the color model
+// is copied to, gray for gray sources and 16-bit for the 16-bit PNG chunks
+func newChunkImage(model color.Model, width int, height int, usePNG bool) draw.Image {
+	rect := image.Rect(0, 0, width, height)
+
+	gray := model == color.GrayModel || model == color.Gray16Model
+	sixteenBit := usePNG && (model == color.Gray16Model || model == color.RGBA64Model || model == color.NRGBA64Model)
+
+	switch {
+	case gray && sixteenBit:
+		return image.NewGray16(rect)
+	case gray:
+		return image.NewGray(rect)
+	case sixteenBit:
+		return image.NewNRGBA64(rect)
+	}
+	return image.NewRGBA(rect)
+}
+
+// writeChunk encodes chunk to the file name of fsys
+func writeChunk(fsys FS, name string, chunk image.Image, usePNG bool, quality int) error {
+	file, err := fsys.Create(name)
+	if err != nil {
+		return fmt.Errorf("failed to create output file: %v", err)
+	}
+
+	if usePNG {
+		err = png.Encode(file, chunk)
+	} else {
+		err = jpegenc.Encode(file, chunk, &jpegenc.Options{Quality: quality})
+	}
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to save split image: %v", err)
+	}
+
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to save split image: %v", err)
+	}
+	return nil
+}
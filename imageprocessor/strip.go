@@ -0,0 +1,73 @@
+package imageprocessor
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"os"
+	"os/exec"
+
+	"github.com/jempe/imagesplitter/internal/jpegenc"
+	"golang.org/x/image/draw"
+)
+
+// maxStripHeight is the tallest JPEG, taller strips are narrowed to fit
+const maxStripHeight = 65535
+
+// stripFileName returns the name of the strip of a job
+func stripFileName(imagesPrefix string) string {
+	return imagesPrefix + "_strip.jpg"
+}
+
+// stripSize returns the dimensions of the strip of a width x height image,
+// at most StripWidth wide, never scaled up
+func (p *Processor) stripSize(width int, height int) (int, int) {
+	stripWidth, stripHeight := scaledSize(width, height, min(p.StripWidth, width))
+	if stripHeight > maxStripHeight {
+		stripWidth, stripHeight = max(1, width*maxStripHeight/height), maxStripHeight
+	}
+	return stripWidth, stripHeight
+}
+
+// writeStrip saves the prepared image scaled down to the strip size as a
+// JPEG at outputPath
+func (p *Processor) writeStrip(img image.Image, outputPath string) error {
+	bounds := img.Bounds()
+	width, height := p.stripSize(bounds.Dx(), bounds.Dy())
+
+	strip := p.newChunkImage(img.ColorModel(), width, height, false)
+	draw.CatmullRom.Scale(strip, strip.Bounds(), p.flattenAlpha(img), bounds, draw.Src, nil)
+
+	outFile, err := os.Create(outputPath)
+	if err != nil {
+		return fmt.Errorf("failed to create strip: %v", err)
+	}
+	defer outFile.Close()
+
+	if err := jpegenc.Encode(outFile, strip, &jpegenc.Options{Quality: jpegQuality}); err != nil {
+		return fmt.Errorf("failed to save strip: %v", err)
+	}
+
+	return outFile.Close()
+}
+
+// writeStripWithCLI is writeStrip for the prepared image at imagePath, of
+// the given dimensions, scaled by vips
+func (p *Processor) writeStripWithCLI(ctx context.Context, imagePath string, width int, height int, outputPath string) error {
+	stripWidth, stripHeight := p.stripSize(width, height)
+
+	vipsCmd := exec.CommandContext(ctx,
+		"vips", "thumbnail_image",
+		imagePath,
+		fmt.Sprintf("%s[Q=%d,strip]", outputPath, jpegQuality),
+		fmt.Sprintf("%d", stripWidth),
+		"--height", fmt.Sprintf("%d", stripHeight),
+		"--size", "force",
+	)
+
+	if output, err := vipsCmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to save strip: %v - %s", err, string(output))
+	}
+
+	return nil
+}
@@ -0,0 +1,86 @@
+package imageprocessor
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// Limits of the SVG rasterization
+const (
+	// MaxSVGWidth bounds the width SVG sources are rasterized at
+	MaxSVGWidth = 16384
+	// MaxSVGDPI bounds the density SVG sources are rasterized at
+	MaxSVGDPI = 1200
+	// svgSniffBytes is how far into a file the svg element is looked for,
+	// enough for an XML declaration, a doctype and comments
+	svgSniffBytes = 4096
+)
+
+// isSVGFile reports whether the file at path is an SVG document
+func isSVGFile(path string) bool {
+	file, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	head := make([]byte, svgSniffBytes)
+	n, _ := io.ReadFull(file, head)
+	head = bytes.TrimPrefix(head[:n], []byte("\xEF\xBB\xBF"))
+	head = bytes.TrimLeft(head, " \t\r\n")
+
+	return bytes.HasPrefix(head, []byte("<")) && bytes.Contains(bytes.ToLower(head), []byte("<svg"))
+}
+
+// rasterizeSVG renders the SVG at imagePath to a PNG in outputDir, at
+// SVGWidth pixels wide, at SVGDPI or at its own size otherwise, and returns
+// its path. The Go implementation runs rsvg-convert, or vips when only vips
+// is installed, the CLI one vips.
+func (p *Processor) rasterizeSVG(ctx context.Context, imagePath string, outputDir string) (string, error) {
+	rasterPath := filepath.Join(outputDir, "rasterized.png")
+
+	useVips, err := p.svgWithVips()
+	if err != nil {
+		return "", err
+	}
+
+	var cmd *exec.Cmd
+	if useVips {
+		switch {
+		case p.SVGWidth > 0:
+			// The height is only a bound, the aspect ratio is kept
+			cmd = exec.CommandContext(ctx, "vips", "thumbnail", imagePath, rasterPath,
+				fmt.Sprintf("%d", p.SVGWidth), "--height", "10000000")
+		case p.SVGDPI > 0:
+			cmd = exec.CommandContext(ctx, "vips", "svgload", imagePath, rasterPath,
+				"--dpi", fmt.Sprintf("%d", p.SVGDPI))
+		default:
+			cmd = exec.CommandContext(ctx, "vips", "svgload", imagePath, rasterPath)
+		}
+	} else {
+		rsvgPath := p.RSVGConvertPath
+		if rsvgPath == "" {
+			rsvgPath = "rsvg-convert"
+		}
+
+		args := []string{"--format", "png", "--output", rasterPath}
+		switch {
+		case p.SVGWidth > 0:
+			args = append(args, "--width", fmt.Sprintf("%d", p.SVGWidth), "--keep-aspect-ratio")
+		case p.SVGDPI > 0:
+			args = append(args, "--dpi-x", fmt.Sprintf("%d", p.SVGDPI), "--dpi-y", fmt.Sprintf("%d", p.SVGDPI))
+		}
+		cmd = exec.CommandContext(ctx, rsvgPath, append(args, imagePath)...)
+	}
+
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return "", fmt.Errorf("failed to rasterize SVG: %v - %s", err, string(output))
+	}
+
+	return rasterPath, nil
+}
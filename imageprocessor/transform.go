@@ -0,0 +1,524 @@
+package imageprocessor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"os/exec"
+	"path/filepath"
+
+	"golang.org/x/image/draw"
+)
+
+// Color spaces of the chunks
+const (
+	// ColorSpaceKeep keeps grayscale sources in grayscale and writes every other source as RGB
+	ColorSpaceKeep = "keep"
+	// ColorSpaceGrayscale converts the chunks to a single gray channel
+	ColorSpaceGrayscale = "grayscale"
+	// ColorSpaceSRGB always writes RGB chunks, also for grayscale sources
+	ColorSpaceSRGB = "srgb"
+)
+
+// Fit modes of the sources narrower than the requested width
+const (
+	// FitNone splits narrower sources at their own width
+	FitNone = "none"
+	// FitPad pads narrower sources to the requested width with PadColor,
+	// white when unset, placing them at Anchor
+	FitPad = "pad"
+	// FitScale scales narrower sources up to the requested width, keeping
+	// their aspect ratio
+	FitScale = "scale"
+)
+
+// ErrInvalidOptions is wrapped by the errors of options that don't fit the source
+var ErrInvalidOptions = errors.New("invalid options")
+
+// subImager is implemented by the image types of the standard library
+type subImager interface {
+	SubImage(r image.Rectangle) image.Image
+}
+
+// withFit returns a copy of p fitting the sources narrower than
+// requestedWidth to it, p itself without a Fit mode or a requested width
+func (p *Processor) withFit(requestedWidth int) *Processor {
+	if p.Fit == "" || p.Fit == FitNone || requestedWidth <= 0 {
+		return p
+	}
+
+	job := *p
+	job.fitWidth = requestedWidth
+	return &job
+}
+
+// outputSize returns the dimensions of a source of the given size once the
+// transformations of p are applied, the fit last, or an error when they don't
+// fit the source
+func (p *Processor) outputSize(width int, height int) (int, int, error) {
+	width, height, err := p.transformedSize(width, height)
+	if err != nil {
+		return 0, 0, err
+	}
+	width, height = p.fitSize(width, height)
+	return width, height, nil
+}
+
+// fitSize returns the dimensions of a transformed image of the given size
+// once fitted to the requested width
+func (p *Processor) fitSize(width int, height int) (int, int) {
+	if p.fitWidth <= width {
+		return width, height
+	}
+
+	switch p.Fit {
+	case FitPad:
+		return p.fitWidth, height
+	case FitScale:
+		return scaledSize(width, height, p.fitWidth)
+	}
+	return width, height
+}
+
+// padColor is the color of the padding, PadColor or white
+func (p *Processor) padColor() color.Color {
+	if p.PadColor == nil {
+		return color.White
+	}
+	return p.PadColor
+}
+
+// transformedSize returns the dimensions of a source of the given size once
+// the transformations of p but the fit are applied, or an error when they
+// don't fit the source. The source is rotated first, so the crop region
+// refers to the upright image.
+func (p *Processor) transformedSize(width int, height int) (int, int, error) {
+	switch p.ColorSpace {
+	case "", ColorSpaceKeep, ColorSpaceGrayscale, ColorSpaceSRGB:
+	default:
+		return 0, 0, fmt.Errorf("%w: unsupported color space %q", ErrInvalidOptions, p.ColorSpace)
+	}
+
+	switch p.Subsampling {
+	case "", Subsampling420, Subsampling444:
+	default:
+		return 0, 0, fmt.Errorf("%w: unsupported chroma subsampling %q", ErrInvalidOptions, p.Subsampling)
+	}
+
+	switch p.SplitMode {
+	case "", SplitModeFixed:
+	case SplitModePanels:
+		if p.Preset != "" {
+			return 0, 0, fmt.Errorf("%w: panel splitting is not supported with the %s preset", ErrInvalidOptions, p.Preset)
+		}
+	default:
+		return 0, 0, fmt.Errorf("%w: unsupported split mode %q", ErrInvalidOptions, p.SplitMode)
+	}
+
+	if p.ChunkAspect.X < 0 || p.ChunkAspect.Y < 0 {
+		return 0, 0, fmt.Errorf("%w: chunk aspect ratio must be positive", ErrInvalidOptions)
+	}
+
+	if p.MaxPixels < 0 {
+		return 0, 0, fmt.Errorf("%w: max pixels cannot be negative", ErrInvalidOptions)
+	}
+	if p.MaxPixels > 0 && (p.SplitMode == SplitModePanels || p.Preset != "") {
+		return 0, 0, fmt.Errorf("%w: max pixels is only supported with fixed height chunks", ErrInvalidOptions)
+	}
+
+	switch p.Preset {
+	case "":
+	case PresetInstagram:
+		if p.Verify {
+			return 0, 0, fmt.Errorf("%w: verify is not supported with the %s preset", ErrInvalidOptions, p.Preset)
+		}
+		if p.ChunkAspect != (image.Point{}) {
+			return 0, 0, fmt.Errorf("%w: chunk aspect ratio is not supported with the %s preset", ErrInvalidOptions, p.Preset)
+		}
+	default:
+		return 0, 0, fmt.Errorf("%w: unsupported preset %q", ErrInvalidOptions, p.Preset)
+	}
+
+	if p.SVGWidth < 0 || p.SVGWidth > MaxSVGWidth {
+		return 0, 0, fmt.Errorf("%w: svg width must be between 0 and %d", ErrInvalidOptions, MaxSVGWidth)
+	}
+	if p.SVGDPI < 0 || p.SVGDPI > MaxSVGDPI {
+		return 0, 0, fmt.Errorf("%w: svg dpi must be between 0 and %d", ErrInvalidOptions, MaxSVGDPI)
+	}
+
+	if p.DPI < 0 || p.DPI > MaxDPI {
+		return 0, 0, fmt.Errorf("%w: dpi must be between 0 and %d", ErrInvalidOptions, MaxDPI)
+	}
+
+	if p.BitDepth != 0 && p.BitDepth != 8 {
+		return 0, 0, fmt.Errorf("%w: bit depth must be 8", ErrInvalidOptions)
+	}
+
+	if p.TargetChunkBytes < 0 {
+		return 0, 0, fmt.Errorf("%w: target chunk bytes cannot be negative", ErrInvalidOptions)
+	}
+
+	if p.PNGOptimize < PNGOptimizeNone || p.PNGOptimize > PNGOptimizePalette {
+		return 0, 0, fmt.Errorf("%w: png optimize level must be between %d and %d", ErrInvalidOptions, PNGOptimizeNone, PNGOptimizePalette)
+	}
+
+	if p.ScaleWidth < 0 {
+		return 0, 0, fmt.Errorf("%w: scale width cannot be negative", ErrInvalidOptions)
+	}
+	if p.Sharpen < 0 || p.Sharpen > MaxSharpen {
+		return 0, 0, fmt.Errorf("%w: sharpen must be between 0 and %d", ErrInvalidOptions, MaxSharpen)
+	}
+	if p.StripWidth < 0 {
+		return 0, 0, fmt.Errorf("%w: strip width cannot be negative", ErrInvalidOptions)
+	}
+	for _, width := range p.OutputWidths {
+		if width <= 0 {
+			return 0, 0, fmt.Errorf("%w: output widths must be positive", ErrInvalidOptions)
+		}
+	}
+	if len(p.OutputWidths) > 0 && p.Preset != "" {
+		return 0, 0, fmt.Errorf("%w: output widths are not supported with the %s preset", ErrInvalidOptions, p.Preset)
+	}
+	switch p.Fit {
+	case "", FitNone:
+	case FitPad, FitScale:
+		if len(p.OutputWidths) > 0 {
+			return 0, 0, fmt.Errorf("%w: fit is not supported with output widths", ErrInvalidOptions)
+		}
+		if p.Preset != "" {
+			return 0, 0, fmt.Errorf("%w: fit is not supported with the %s preset", ErrInvalidOptions, p.Preset)
+		}
+	default:
+		return 0, 0, fmt.Errorf("%w: unsupported fit %q", ErrInvalidOptions, p.Fit)
+	}
+	if len(p.OutputWidths) > 0 && p.HTMLPreview {
+		return 0, 0, fmt.Errorf("%w: HTML preview is not supported with output widths", ErrInvalidOptions)
+	}
+
+	switch p.Rotate {
+	case 0, 180:
+	case 90, 270:
+		width, height = height, width
+	default:
+		return 0, 0, fmt.Errorf("%w: rotate must be 90, 180 or 270 degrees", ErrInvalidOptions)
+	}
+
+	if !p.Crop.Empty() {
+		if !p.Crop.In(image.Rect(0, 0, width, height)) {
+			return 0, 0, fmt.Errorf("%w: crop region %dx%d+%d+%d exceeds the %dx%d image", ErrInvalidOptions,
+				p.Crop.Dx(), p.Crop.Dy(), p.Crop.Min.X, p.Crop.Min.Y, width, height)
+		}
+		width, height = p.Crop.Dx(), p.Crop.Dy()
+	}
+
+	if p.ScaleWidth > 0 && p.ScaleWidth < width {
+		width, height = scaledSize(width, height, p.ScaleWidth)
+	}
+
+	return width, height, nil
+}
+
+// croppedSize returns the dimensions of a source of the given size once
+// rotated and cropped, the options being valid
+func (p *Processor) croppedSize(width int, height int) (int, int) {
+	if p.Rotate == 90 || p.Rotate == 270 {
+		width, height = height, width
+	}
+	if !p.Crop.Empty() {
+		width, height = p.Crop.Dx(), p.Crop.Dy()
+	}
+	return width, height
+}
+
+// scaledSize returns the dimensions of a width x height image scaled to
+// scaleWidth, keeping its aspect ratio
+func scaledSize(width int, height int, scaleWidth int) (int, int) {
+	return scaleWidth, max(1, (height*scaleWidth+width/2)/width)
+}
+
+// prepareImage applies the transformations of p to a decoded source before it
+// is split. The result may not have its origin at (0, 0).
+func (p *Processor) prepareImage(img image.Image) (image.Image, error) {
+	bounds := img.Bounds()
+	if _, _, err := p.outputSize(bounds.Dx(), bounds.Dy()); err != nil {
+		return nil, err
+	}
+
+	if p.Rotate != 0 {
+		img = &rotatedImage{Image: img, degrees: p.Rotate}
+		bounds = img.Bounds()
+	}
+
+	if !p.Crop.Empty() {
+		crop := p.Crop.Add(bounds.Min)
+		if sub, ok := img.(subImager); ok {
+			img = sub.SubImage(crop)
+		} else {
+			img = &croppedImage{Image: img, rect: crop}
+		}
+		bounds = img.Bounds()
+	}
+
+	if p.ScaleWidth > 0 && p.ScaleWidth < bounds.Dx() {
+		width, height := scaledSize(bounds.Dx(), bounds.Dy(), p.ScaleWidth)
+		scaled := p.newChunkImage(img.ColorModel(), width, height, true)
+		draw.CatmullRom.Scale(scaled, scaled.Bounds(), img, bounds, draw.Src, nil)
+		p.sharpen(scaled)
+		img = scaled
+		bounds = img.Bounds()
+	}
+
+	if width, height := p.fitSize(bounds.Dx(), bounds.Dy()); width != bounds.Dx() {
+		fitted := p.newChunkImage(img.ColorModel(), width, height, true)
+		switch p.Fit {
+		case FitPad:
+			draw.Draw(fitted, fitted.Bounds(), image.NewUniform(p.padColor()), image.Point{}, draw.Src)
+			x := p.layout().CropOffset(width, bounds.Dx())
+			draw.Draw(fitted, image.Rect(x, 0, x+bounds.Dx(), height), img, bounds.Min, draw.Src)
+		case FitScale:
+			draw.CatmullRom.Scale(fitted, fitted.Bounds(), img, bounds, draw.Src, nil)
+			p.sharpen(fitted)
+		}
+		img = fitted
+	}
+
+	return img, nil
+}
+
+// newChunkImage returns the buffer a chunk of a source with the given color
+// model is copied into, in the color space requested by p. 16-bit sources keep
+// their depth in PNG chunks unless BitDepth is 8.
+func (p *Processor) newChunkImage(model color.Model, width int, height int, usePNG bool) draw.Image {
+	rect := image.Rect(0, 0, width, height)
+
+	gray := p.ColorSpace == ColorSpaceGrayscale
+	if p.ColorSpace != ColorSpaceSRGB && (model == color.GrayModel || model == color.Gray16Model) {
+		gray = true
+	}
+
+	sixteenBit := usePNG && p.BitDepth != 8 && bitDepth(model) == 16
+
+	switch {
+	case gray && sixteenBit:
+		return image.NewGray16(rect)
+	case gray:
+		return image.NewGray(rect)
+	case sixteenBit:
+		return image.NewNRGBA64(rect)
+	}
+	return image.NewRGBA(rect)
+}
+
+// bitDepth returns the bits per channel of a color model
+func bitDepth(model color.Model) int {
+	switch model {
+	case color.Gray16Model, color.RGBA64Model, color.NRGBA64Model, color.Alpha16Model:
+		return 16
+	}
+	return 8
+}
+
+// rotatedImage turns an image clockwise by 90, 180 or 270 degrees without
+// copying it. Its origin is always (0, 0).
+type rotatedImage struct {
+	image.Image
+	degrees int
+}
+
+func (r *rotatedImage) Bounds() image.Rectangle {
+	b := r.Image.Bounds()
+	if r.degrees == 180 {
+		return image.Rect(0, 0, b.Dx(), b.Dy())
+	}
+	return image.Rect(0, 0, b.Dy(), b.Dx())
+}
+
+func (r *rotatedImage) At(x, y int) color.Color {
+	b := r.Image.Bounds()
+
+	switch r.degrees {
+	case 90:
+		return r.Image.At(b.Min.X+y, b.Max.Y-1-x)
+	case 180:
+		return r.Image.At(b.Max.X-1-x, b.Max.Y-1-y)
+	default:
+		return r.Image.At(b.Max.X-1-y, b.Min.Y+x)
+	}
+}
+
+// croppedImage restricts an image that cannot produce a sub image itself
+type croppedImage struct {
+	image.Image
+	rect image.Rectangle
+}
+
+func (c *croppedImage) Bounds() image.Rectangle {
+	return c.rect
+}
+
+// vipsFileExt is the extension of the intermediate images in the vips native
+// format, uncompressed and memory mapped when read
+const vipsFileExt = ".v"
+
+// prepareWithCLI applies the transformations of p to the source with vips and
+// returns the path of the image to split, which is imagePath when there is
+// nothing to do. Intermediate images use the vips native format to avoid a
+// lossy encode.
+func (p *Processor) prepareWithCLI(ctx context.Context, imagePath string, outputDir string) (string, error) {
+	if p.ConvertSRGB && needsSRGBConversion(readICCProfile(imagePath)) {
+		convertedPath := filepath.Join(outputDir, "srgb.v")
+
+		vipsCmd := exec.CommandContext(ctx, "vips", "icc_transform", imagePath, convertedPath, "srgb", "--embedded")
+
+		output, err := vipsCmd.CombinedOutput()
+		if err != nil {
+			return "", fmt.Errorf("failed to convert image to sRGB: %v - %s", err, string(output))
+		}
+
+		imagePath = convertedPath
+	}
+
+	// vips keeps CMYK JPEGs in CMYK, which most viewers render wrongly
+	space := ""
+	switch {
+	case p.ColorSpace == ColorSpaceGrayscale:
+		space = "b-w"
+	case p.ColorSpace == ColorSpaceSRGB || isCMYKFile(imagePath):
+		space = "srgb"
+	}
+
+	if p.Rotate != 0 {
+		rotatedPath := filepath.Join(outputDir, "rotated.v")
+
+		vipsCmd := exec.CommandContext(ctx,
+			"vips", "rot",
+			imagePath,
+			rotatedPath,
+			fmt.Sprintf("d%d", p.Rotate),
+		)
+
+		output, err := vipsCmd.CombinedOutput()
+		if err != nil {
+			return "", fmt.Errorf("failed to rotate image: %v - %s", err, string(output))
+		}
+
+		imagePath = rotatedPath
+	}
+
+	if space != "" {
+		convertedPath := filepath.Join(outputDir, "converted.v")
+
+		vipsCmd := exec.CommandContext(ctx, "vips", "colourspace", imagePath, convertedPath, space)
+
+		output, err := vipsCmd.CombinedOutput()
+		if err != nil {
+			return "", fmt.Errorf("failed to convert image color space: %v - %s", err, string(output))
+		}
+
+		imagePath = convertedPath
+	}
+
+	if !p.Crop.Empty() {
+		croppedPath := filepath.Join(outputDir, "cropped.v")
+
+		vipsCmd := exec.CommandContext(ctx,
+			"vips", "crop",
+			imagePath,
+			croppedPath,
+			fmt.Sprintf("%d", p.Crop.Min.X), fmt.Sprintf("%d", p.Crop.Min.Y),
+			fmt.Sprintf("%d", p.Crop.Dx()), fmt.Sprintf("%d", p.Crop.Dy()),
+		)
+
+		output, err := vipsCmd.CombinedOutput()
+		if err != nil {
+			return "", fmt.Errorf("failed to crop image: %v - %s", err, string(output))
+		}
+
+		imagePath = croppedPath
+	}
+
+	imagePath, err := p.flattenWithCLI(ctx, imagePath, outputDir)
+	if err != nil {
+		return "", err
+	}
+
+	if p.ScaleWidth > 0 {
+		width, height, err := vipsDimensions(ctx, imagePath)
+		if err != nil {
+			return "", err
+		}
+
+		if p.ScaleWidth < width {
+			scaledWidth, scaledHeight := scaledSize(width, height, p.ScaleWidth)
+			resizedPath := filepath.Join(outputDir, "resized.v")
+
+			vipsCmd := exec.CommandContext(ctx,
+				"vips", "thumbnail_image",
+				imagePath,
+				resizedPath,
+				fmt.Sprintf("%d", scaledWidth),
+				"--height", fmt.Sprintf("%d", scaledHeight),
+				"--size", "force",
+			)
+
+			output, err := vipsCmd.CombinedOutput()
+			if err != nil {
+				return "", fmt.Errorf("failed to scale image: %v - %s", err, string(output))
+			}
+
+			if imagePath, err = p.sharpenWithCLI(ctx, resizedPath, outputDir); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	if p.fitWidth > 0 {
+		width, height, err := vipsDimensions(ctx, imagePath)
+		if err != nil {
+			return "", err
+		}
+
+		if fitWidth, fitHeight := p.fitSize(width, height); fitWidth != width {
+			fittedPath := filepath.Join(outputDir, "fitted.v")
+
+			var vipsCmd *exec.Cmd
+			switch p.Fit {
+			case FitPad:
+				vipsCmd = exec.CommandContext(ctx,
+					"vips", "embed",
+					imagePath,
+					fittedPath,
+					fmt.Sprintf("%d", p.layout().CropOffset(fitWidth, width)), "0",
+					fmt.Sprintf("%d", fitWidth), fmt.Sprintf("%d", fitHeight),
+					"--extend", "background",
+					"--background", p.vipsBackground(),
+				)
+			default:
+				vipsCmd = exec.CommandContext(ctx,
+					"vips", "thumbnail_image",
+					imagePath,
+					fittedPath,
+					fmt.Sprintf("%d", fitWidth),
+					"--height", fmt.Sprintf("%d", fitHeight),
+					"--size", "force",
+				)
+			}
+
+			output, err := vipsCmd.CombinedOutput()
+			if err != nil {
+				return "", fmt.Errorf("failed to fit image: %v - %s", err, string(output))
+			}
+
+			imagePath = fittedPath
+			if p.Fit == FitScale {
+				if imagePath, err = p.sharpenWithCLI(ctx, imagePath, outputDir); err != nil {
+					return "", err
+				}
+			}
+		}
+	}
+
+	return imagePath, nil
+}
@@ -0,0 +1,99 @@
+package imageprocessor
+
+import (
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writePNG encodes img to a PNG file of dir
+func writePNG(t *testing.T, dir string, name string, img image.Image) string {
+	t.Helper()
+
+	path := filepath.Join(dir, name)
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	if err := png.Encode(file, img); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestSixteenBitChunks(t *testing.T) {
+	// 0x1234 has no 8-bit equivalent, so a chunk keeps it only at 16 bits
+	const level = 0x1234
+
+	rgba := image.NewNRGBA64(image.Rect(0, 0, 20, 50))
+	gray := image.NewGray16(image.Rect(0, 0, 20, 50))
+	for y := 0; y < 50; y++ {
+		for x := 0; x < 20; x++ {
+			rgba.SetNRGBA64(x, y, color.NRGBA64{R: level, G: level + 1, B: level + 2, A: 0xffff})
+			gray.SetGray16(x, y, color.Gray16{Y: level})
+		}
+	}
+
+	tests := []struct {
+		name     string
+		source   image.Image
+		bitDepth int
+		want     int
+		gray     bool
+	}{
+		{"rgba", rgba, 0, 16, false},
+		{"gray", gray, 0, 16, true},
+		{"rgba 8-bit", rgba, 8, 8, false},
+		{"gray 8-bit", gray, 8, 8, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			source := writePNG(t, dir, "source.png", tt.source)
+
+			p := Processor{OutputBaseDir: dir, MaxHeight: 20, BitDepth: tt.bitDepth}
+			outputDir := filepath.Join(dir, "output")
+			result, err := p.ProcessFile(source, outputDir, "page", 0, 0, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.ChunkCount != 3 {
+				t.Fatalf("got %d chunks, want 3", result.ChunkCount)
+			}
+
+			for _, name := range result.Images {
+				file, err := os.Open(filepath.Join(outputDir, filepath.Base(name)))
+				if err != nil {
+					t.Fatal(err)
+				}
+				chunk, err := png.Decode(file)
+				file.Close()
+				if err != nil {
+					t.Fatalf("%s: %v", name, err)
+				}
+
+				model := chunk.ColorModel()
+				if depth := bitDepth(model); depth != tt.want {
+					t.Fatalf("%s: got a %d-bit chunk, want %d-bit", name, depth, tt.want)
+				}
+				if isGray := model == color.GrayModel || model == color.Gray16Model; isGray != tt.gray {
+					t.Fatalf("%s: got a gray chunk %v, want %v", name, isGray, tt.gray)
+				}
+				if tt.want == 8 {
+					continue
+				}
+
+				r, _, _, _ := chunk.At(0, 0).RGBA()
+				if r != level {
+					t.Errorf("%s: got level %#x, want %#x", name, r, level)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,221 @@
+package imageprocessor
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// DefaultConcurrentUploads bounds the chunk uploads of a job running at once
+// when MaxConcurrentUploads is zero
+const DefaultConcurrentUploads = 4
+
+// ZipUploader uploads the zips of the jobs to a remote storage, e.g. an S3
+// bucket, as they are written instead of saving them to the output directory
+type ZipUploader interface {
+	// UploadZip starts the upload of the zip at name, relative to
+	// OutputBaseDir with slashes
+	UploadZip(ctx context.Context, name string) (ZipUpload, error)
+}
+
+// ZipUpload is a zip upload in progress
+type ZipUpload interface {
+	io.Writer
+	// Complete finishes the upload and returns the URL of the zip
+	Complete() (string, error)
+	// Abort discards what was uploaded
+	Abort()
+}
+
+// zipOutput is where the zip of a job is written, the zip file or an upload
+// of ZipUploader, counting the bytes written
+type zipOutput struct {
+	file   *os.File
+	upload ZipUpload
+	size   int64
+	// url is the URL of the uploaded zip once closed
+	url  string
+	done bool
+}
+
+// createZipOutput opens the zip at zipFileName, or starts its upload when
+// ZipUploader is set
+func (p *Processor) createZipOutput(ctx context.Context, zipFileName string) (*zipOutput, error) {
+	if p.ZipUploader == nil {
+		zipFile, err := os.Create(zipFileName)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create zip file: %v", err)
+		}
+		return &zipOutput{file: zipFile}, nil
+	}
+
+	absZipPath, _ := filepath.Abs(zipFileName)
+	name, _ := filepath.Rel(p.OutputBaseDir, absZipPath)
+
+	upload, err := p.ZipUploader.UploadZip(ctx, filepath.ToSlash(name))
+	if err != nil {
+		return nil, fmt.Errorf("failed to upload zip file: %v", err)
+	}
+	return &zipOutput{upload: upload}, nil
+}
+
+func (z *zipOutput) Write(data []byte) (int, error) {
+	var n int
+	var err error
+	if z.upload != nil {
+		n, err = z.upload.Write(data)
+	} else {
+		n, err = z.file.Write(data)
+	}
+	z.size += int64(n)
+	return n, err
+}
+
+// close closes the zip file or completes the upload
+func (z *zipOutput) close() error {
+	z.done = true
+	if z.upload == nil {
+		return z.file.Close()
+	}
+
+	url, err := z.upload.Complete()
+	if err != nil {
+		z.upload.Abort()
+		return fmt.Errorf("failed to upload zip file: %v", err)
+	}
+	z.url = url
+	return nil
+}
+
+// abort closes the zip file or discards the upload when the zip was not
+// closed, deferred after createZipOutput
+func (z *zipOutput) abort() {
+	if z.done {
+		return
+	}
+	z.done = true
+	if z.upload != nil {
+		z.upload.Abort()
+	} else {
+		z.file.Close()
+	}
+}
+
+// setZip sets the zip URL and size of result from the uploaded zip, the
+// zip file is left to addTotals
+func (z *zipOutput) setZip(result *ImageResponse) {
+	if z.url == "" {
+		return
+	}
+	result.ZipURL = z.url
+	result.ZipBytes = z.size
+}
+
+// ChunkUploader uploads the chunks of the jobs to a remote storage as soon
+// as they are encoded, while the next ones are
+type ChunkUploader interface {
+	// UploadChunk uploads the chunk file at path as name, relative to
+	// OutputBaseDir with slashes, and returns its URL
+	UploadChunk(ctx context.Context, name string, path string) (string, error)
+}
+
+// chunkUploads are the chunk uploads of a job, at most MaxConcurrentUploads
+// at once. The first failure cancels the others.
+type chunkUploads struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	slots  chan struct{}
+	wg     sync.WaitGroup
+
+	mu sync.Mutex
+	// urls maps the chunk file names to their URL
+	urls map[string]string
+	err  error
+}
+
+// withChunkUploads returns a copy of p uploading the chunks of the job with
+// ChunkUploader, and the uploads to wait for
+func (p *Processor) withChunkUploads(ctx context.Context) (*Processor, *chunkUploads) {
+	concurrency := p.MaxConcurrentUploads
+	if concurrency <= 0 {
+		concurrency = DefaultConcurrentUploads
+	}
+
+	uploadCtx, cancel := context.WithCancel(ctx)
+	uploads := &chunkUploads{
+		ctx:    uploadCtx,
+		cancel: cancel,
+		slots:  make(chan struct{}, concurrency),
+		urls:   make(map[string]string),
+	}
+
+	job := *p
+	job.uploads = uploads
+	return &job, uploads
+}
+
+// uploadChunk starts the upload of the chunk at path, waiting for a slot
+// while MaxConcurrentUploads are running. Nothing is uploaded without
+// ChunkUploader.
+func (p *Processor) uploadChunk(path string) {
+	u := p.uploads
+	if u == nil {
+		return
+	}
+
+	select {
+	case u.slots <- struct{}{}:
+	case <-u.ctx.Done():
+		return
+	}
+
+	absPath, _ := filepath.Abs(path)
+	name, _ := filepath.Rel(p.OutputBaseDir, absPath)
+
+	u.wg.Add(1)
+	go func() {
+		defer u.wg.Done()
+		defer func() { <-u.slots }()
+
+		url, err := p.ChunkUploader.UploadChunk(u.ctx, filepath.ToSlash(name), path)
+
+		u.mu.Lock()
+		defer u.mu.Unlock()
+		if err != nil {
+			if u.err == nil {
+				u.err = fmt.Errorf("failed to upload chunk %s: %v", filepath.Base(path), err)
+				u.cancel()
+			}
+			return
+		}
+		u.urls[filepath.Base(path)] = url
+	}()
+}
+
+// wait waits for the running uploads and replaces the chunks of result with
+// their URLs
+func (u *chunkUploads) wait(result *ImageResponse) error {
+	u.wg.Wait()
+	u.cancel()
+
+	if u.err != nil {
+		return u.err
+	}
+
+	uploaded := func(images []string) {
+		for i, image := range images {
+			if url, ok := u.urls[filepath.Base(image)]; ok {
+				images[i] = url
+			}
+		}
+	}
+
+	uploaded(result.Images)
+	for _, set := range result.Sets {
+		uploaded(set.Images)
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package imageprocessor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"slices"
+)
+
+// ErrVerificationFailed is wrapped by the errors of chunks that don't
+// reassemble into the source
+var ErrVerificationFailed = errors.New("verification failed")
+
+// Tolerances of the verification, in 8-bit channel values
+const (
+	// verifyMaxDiffPNG is the largest difference of a channel of a PNG chunk,
+	// which only allows for rounding
+	verifyMaxDiffPNG = 1
+	// verifyMeanDiffJPEG is the largest mean difference of the channels of a
+	// JPEG chunk, high enough for the lowest target_chunk_bytes quality
+	verifyMeanDiffJPEG = 16
+)
+
+// verifyChunks decodes the chunks at chunkPaths and checks that they
+// reassemble into source, the image that was split, except for the skipped
+// chunk indexes: every chunk must have the size of its region and its pixels
+// must match within the tolerance of its format
+func (p *Processor) verifyChunks(ctx context.Context, source image.Image, chunkPaths []string, skipped []int, requestedWidth int, maxImages int) error {
+	bounds := source.Bounds()
+	rects := p.splitRects(source, requestedWidth, maxImages)
+
+	if len(rects) != len(chunkPaths)+len(skipped) {
+		return fmt.Errorf("%w: expected %d chunks, found %d", ErrVerificationFailed, len(rects), len(chunkPaths)+len(skipped))
+	}
+
+	chunkPaths = slices.Clone(chunkPaths)
+
+	// The JPEG chunks are compared with the flattened source
+	flattened := p.flattenAlpha(source)
+
+	for i, rect := range rects {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		// Blank chunks that were skipped have no file to compare
+		if slices.Contains(skipped, i) {
+			continue
+		}
+
+		chunkPath := chunkPaths[0]
+		chunkPaths = chunkPaths[1:]
+
+		chunk, format, err := decodeFile(chunkPath)
+		if err != nil {
+			return fmt.Errorf("%w: failed to decode chunk %d: %v", ErrVerificationFailed, i+1, err)
+		}
+
+		chunkBounds := chunk.Bounds()
+		if chunkBounds.Dx() != rect.Dx() || chunkBounds.Dy() != rect.Dy() {
+			return fmt.Errorf("%w: chunk %d is %dx%d, expected %dx%d", ErrVerificationFailed,
+				i+1, chunkBounds.Dx(), chunkBounds.Dy(), rect.Dx(), rect.Dy())
+		}
+
+		lossless := format == "png"
+		expected := source
+		if !lossless {
+			expected = flattened
+		}
+		maxDiff, meanDiff := chunkDiff(expected, rect.Add(bounds.Min), chunk)
+
+		if lossless && maxDiff > verifyMaxDiffPNG {
+			return fmt.Errorf("%w: chunk %d differs from the source by up to %d", ErrVerificationFailed, i+1, maxDiff)
+		}
+		if !lossless && meanDiff > verifyMeanDiffJPEG {
+			return fmt.Errorf("%w: chunk %d differs from the source by %.1f on average", ErrVerificationFailed, i+1, meanDiff)
+		}
+	}
+
+	return nil
+}
+
+// chunkDiff compares chunk with the rect region of source, converted to the
+// color model of the chunk, and returns the largest and the mean difference
+// of the channels
+func chunkDiff(source image.Image, rect image.Rectangle, chunk image.Image) (int, float64) {
+	model := chunk.ColorModel()
+	chunkMin := chunk.Bounds().Min
+
+	maxDiff := 0
+	var total int64
+
+	for y := 0; y < rect.Dy(); y++ {
+		for x := 0; x < rect.Dx(); x++ {
+			want := model.Convert(source.At(rect.Min.X+x, rect.Min.Y+y))
+			got := chunk.At(chunkMin.X+x, chunkMin.Y+y)
+
+			for _, diff := range channelDiffs(want, got) {
+				total += int64(diff)
+				maxDiff = max(maxDiff, diff)
+			}
+		}
+	}
+
+	pixels := rect.Dx() * rect.Dy()
+	if pixels == 0 {
+		return 0, 0
+	}
+
+	return maxDiff, float64(total) / float64(pixels*4)
+}
+
+// channelDiffs returns the differences of the 8-bit channels of two colors
+func channelDiffs(a, b color.Color) [4]int {
+	r1, g1, b1, a1 := a.RGBA()
+	r2, g2, b2, a2 := b.RGBA()
+
+	diff := func(x, y uint32) int {
+		d := int(x>>8) - int(y>>8)
+		if d < 0 {
+			return -d
+		}
+		return d
+	}
+
+	return [4]int{diff(r1, r2), diff(g1, g2), diff(b1, b2), diff(a1, a2)}
+}
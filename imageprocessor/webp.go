@@ -0,0 +1,58 @@
+package imageprocessor
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+
+	_ "golang.org/x/image/webp" // registers the WebP decoder for still images
+)
+
+// ErrUnsupportedInput is wrapped by the errors of sources that are decoded
+// fine but cannot be split faithfully
+var ErrUnsupportedInput = errors.New("unsupported input")
+
+// errAnimatedWebP is returned for animated WebP sources, of which the Go
+// decoder reads nothing and vips only the first frame
+var errAnimatedWebP = fmt.Errorf("%w: animated WebP sources are not supported", ErrUnsupportedInput)
+
+// webpHeaderBytes covers the RIFF header and the flags of the VP8X chunk
+const webpHeaderBytes = 21
+
+// isAnimatedWebP reports whether header, the start of a file, is the header
+// of an extended WebP with the animation flag set
+func isAnimatedWebP(header []byte) bool {
+	const animationFlag = 1 << 1
+
+	if len(header) < webpHeaderBytes {
+		return false
+	}
+
+	return bytes.Equal(header[0:4], []byte("RIFF")) &&
+		bytes.Equal(header[8:12], []byte("WEBP")) &&
+		bytes.Equal(header[12:16], []byte("VP8X")) &&
+		header[20]&animationFlag != 0
+}
+
+// checkStillImage returns errAnimatedWebP when the source read by r is an
+// animated WebP, without consuming it
+func checkStillImage(r *bufio.Reader) error {
+	header, _ := r.Peek(webpHeaderBytes)
+	if isAnimatedWebP(header) {
+		return errAnimatedWebP
+	}
+	return nil
+}
+
+// checkStillImageFile is like checkStillImage for the image at path
+func checkStillImageFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open image file: %v", err)
+	}
+	defer file.Close()
+
+	return checkStillImage(bufio.NewReaderSize(file, webpHeaderBytes))
+}
@@ -0,0 +1,124 @@
+// Copyright 2011 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package jpegenc
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"testing"
+)
+
+// gradient returns an image whose size is not a multiple of the 16x16 MCU, so
+// the padding of the last blocks is encoded too
+func gradient() *image.RGBA {
+	m := image.NewRGBA(image.Rect(0, 0, 37, 29))
+	for y := 0; y < 29; y++ {
+		for x := 0; x < 37; x++ {
+			m.Set(x, y, color.RGBA{uint8(x * 7), uint8(y * 8), uint8(255 - x*3 - y*2), 255})
+		}
+	}
+	return m
+}
+
+func delta(u0, u1 uint32) int64 {
+	d := int64(u0) - int64(u1)
+	if d < 0 {
+		return -d
+	}
+	return d
+}
+
+// averageDelta returns the average delta in RGB space. The two images must
+// have the same bounds.
+func averageDelta(m0, m1 image.Image) int64 {
+	b := m0.Bounds()
+	var sum, n int64
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c0 := m0.At(x, y)
+			c1 := m1.At(x, y)
+			r0, g0, b0, _ := c0.RGBA()
+			r1, g1, b1, _ := c1.RGBA()
+			sum += delta(r0, r1)
+			sum += delta(g0, g1)
+			sum += delta(b0, b1)
+			n += 3
+		}
+	}
+	return sum / n
+}
+
+func TestRoundTrip(t *testing.T) {
+	tests := []struct {
+		name        string
+		subsampling Subsampling
+		want        image.YCbCrSubsampleRatio
+		// tolerance is the average delta allowed, halving the chroma
+		// resolution costs more on the saturated gradient
+		tolerance int64
+	}{
+		{"4:2:0", Subsampling420, image.YCbCrSubsampleRatio420, 4 << 8},
+		{"4:4:4", Subsampling444, image.YCbCrSubsampleRatio444, 1 << 8},
+	}
+
+	m0 := gradient()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := Encode(&buf, m0, &Options{Quality: 90, Subsampling: tt.subsampling}); err != nil {
+				t.Fatal(err)
+			}
+
+			m1, err := jpeg.Decode(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if m1.Bounds() != m0.Bounds() {
+				t.Fatalf("got bounds %v, want %v", m1.Bounds(), m0.Bounds())
+			}
+			ycbcr, ok := m1.(*image.YCbCr)
+			if !ok {
+				t.Fatalf("got a %T, want an *image.YCbCr", m1)
+			}
+			if ycbcr.SubsampleRatio != tt.want {
+				t.Errorf("got subsample ratio %v, want %v", ycbcr.SubsampleRatio, tt.want)
+			}
+			if got := averageDelta(m0, m1); got > tt.tolerance {
+				t.Errorf("got average delta %d, want at most %d", got, tt.tolerance)
+			}
+		})
+	}
+}
+
+// TestRoundTripGray checks that gray images are written with a single
+// component whatever the subsampling
+func TestRoundTripGray(t *testing.T) {
+	m0 := image.NewGray(image.Rect(0, 0, 37, 29))
+	for y := 0; y < 29; y++ {
+		for x := 0; x < 37; x++ {
+			m0.SetGray(x, y, color.Gray{uint8(x*5 + y*2)})
+		}
+	}
+
+	for _, subsampling := range []Subsampling{Subsampling420, Subsampling444} {
+		var buf bytes.Buffer
+		if err := Encode(&buf, m0, &Options{Quality: 90, Subsampling: subsampling}); err != nil {
+			t.Fatal(err)
+		}
+
+		m1, err := jpeg.Decode(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := m1.(*image.Gray); !ok {
+			t.Fatalf("got a %T, want an *image.Gray", m1)
+		}
+		if got := averageDelta(m0, m1); got > 1<<8 {
+			t.Errorf("got average delta %d, want at most %d", got, 1<<8)
+		}
+	}
+}
@@ -2,10 +2,13 @@ package jsonlog
 
 import (
 	"encoding/json"
+	"fmt"
 	"io"
 	"os"
 	"runtime/debug"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -13,6 +16,7 @@ type Level int8
 
 const (
 	LevelInfo Level = iota
+	LevelWarning
 	LevelError
 	LevelFatal
 	LevelOff
@@ -22,32 +26,61 @@ func (l Level) String() string {
 	switch l {
 	case LevelInfo:
 		return "INFO"
+	case LevelWarning:
+		return "WARNING"
 	case LevelError:
 		return "ERROR"
 	case LevelFatal:
 		return "FATAL"
+	case LevelOff:
+		return "OFF"
 	default:
 		return ""
 	}
 }
 
+// ParseLevel returns the level named s (case insensitive)
+func ParseLevel(s string) (Level, error) {
+	for _, level := range []Level{LevelInfo, LevelWarning, LevelError, LevelFatal, LevelOff} {
+		if strings.EqualFold(s, level.String()) {
+			return level, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q", s)
+}
+
 type Logger struct {
 	out      io.Writer
-	minLevel Level
+	minLevel atomic.Int32
 	mu       sync.Mutex
 }
 
 func New(out io.Writer, minLevel Level) *Logger {
-	return &Logger{
-		out:      out,
-		minLevel: minLevel,
+	l := &Logger{
+		out: out,
 	}
+	l.minLevel.Store(int32(minLevel))
+	return l
+}
+
+// SetMinLevel changes the minimum level written, it is safe to call while logging
+func (l *Logger) SetMinLevel(level Level) {
+	l.minLevel.Store(int32(level))
+}
+
+// MinLevel returns the minimum level written
+func (l *Logger) MinLevel() Level {
+	return Level(l.minLevel.Load())
 }
 
 func (l *Logger) PrintInfo(message string, properties map[string]string) {
 	l.print(LevelInfo, message, properties)
 }
 
+func (l *Logger) PrintWarning(message string, properties map[string]string) {
+	l.print(LevelWarning, message, properties)
+}
+
 func (l *Logger) PrintError(err error, properties map[string]string) {
 	l.print(LevelError, err.Error(), properties)
 }
@@ -58,7 +91,7 @@ func (l *Logger) PrintFatal(err error, properties map[string]string) {
 }
 
 func (l *Logger) print(level Level, message string, properties map[string]string) (int, error) {
-	if level < l.minLevel {
+	if level < l.MinLevel() {
 		return 0, nil
 	}
 
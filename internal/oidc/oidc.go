@@ -0,0 +1,412 @@
+package oidc
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrInvalidToken = errors.New("invalid token")
+	ErrExpiredToken = errors.New("token has expired")
+	ErrUnknownKey   = errors.New("token signed with an unknown key")
+)
+
+const (
+	// clockSkew is the leeway applied to the exp and nbf claims
+	clockSkew = time.Minute
+	// minRefreshInterval limits how often a stale cache or an unknown kid
+	// triggers a JWKS fetch
+	minRefreshInterval = time.Minute
+)
+
+// Claims holds the registered claims of a verified access token
+type Claims struct {
+	Issuer    string
+	Subject   string
+	Audience  []string
+	ExpiresAt time.Time
+	// Raw contains every claim of the token payload
+	Raw map[string]any
+}
+
+// Verifier validates access tokens issued by a single OIDC provider. The
+// provider metadata and signing keys are fetched lazily and cached.
+type Verifier struct {
+	issuer   string
+	audience string
+	cacheTTL time.Duration
+	client   *http.Client
+
+	mu          sync.Mutex
+	jwksURI     string
+	keys        map[string]crypto.PublicKey
+	fetchedAt   time.Time
+	lastAttempt time.Time
+	// lastErr is the error of the last refresh, nil once one succeeded
+	lastErr error
+}
+
+// NewVerifier returns a verifier accepting tokens from issuer whose audience
+// contains audience. Signing keys are refetched after cacheTTL.
+func NewVerifier(issuer string, audience string, cacheTTL time.Duration) *Verifier {
+	return &Verifier{
+		issuer:   issuer,
+		audience: audience,
+		cacheTTL: cacheTTL,
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// SetCacheTTL changes how long the signing keys are cached
+func (v *Verifier) SetCacheTTL(cacheTTL time.Duration) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.cacheTTL = cacheTTL
+}
+
+// Refresh performs the issuer discovery if needed and fetches the signing keys
+func (v *Verifier) Refresh() error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	return v.refreshLocked()
+}
+
+func (v *Verifier) refreshLocked() error {
+	v.lastAttempt = time.Now()
+	v.lastErr = v.fetchLocked()
+	return v.lastErr
+}
+
+func (v *Verifier) fetchLocked() error {
+	if v.jwksURI == "" {
+		var metadata struct {
+			Issuer  string `json:"issuer"`
+			JWKSURI string `json:"jwks_uri"`
+		}
+
+		discoveryURL := strings.TrimSuffix(v.issuer, "/") + "/.well-known/openid-configuration"
+		if err := v.getJSON(discoveryURL, &metadata); err != nil {
+			return fmt.Errorf("oidc discovery failed: %v", err)
+		}
+
+		if metadata.Issuer != v.issuer {
+			return fmt.Errorf("oidc discovery returned issuer %q, expected %q", metadata.Issuer, v.issuer)
+		}
+
+		if metadata.JWKSURI == "" {
+			return errors.New("oidc discovery document has no jwks_uri")
+		}
+
+		v.jwksURI = metadata.JWKSURI
+	}
+
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+
+	if err := v.getJSON(v.jwksURI, &set); err != nil {
+		return fmt.Errorf("failed to fetch oidc signing keys: %v", err)
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+
+		key, err := jwk.publicKey()
+		if err != nil {
+			// Skip key types we don't support instead of failing the whole set
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+
+	if len(keys) == 0 {
+		return errors.New("oidc provider did not publish any usable signing key")
+	}
+
+	v.keys = keys
+	v.fetchedAt = time.Now()
+
+	return nil
+}
+
+func (v *Verifier) getJSON(url string, target any) error {
+	resp, err := v.client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s from %s", resp.Status, url)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(target)
+}
+
+// key returns the public key for kid, refreshing the cached key set when it
+// is stale or does not know kid. The refreshes are at least
+// minRefreshInterval apart, so the requests do not queue behind a fetch each
+// while the provider is down.
+func (v *Verifier) key(kid string) (crypto.PublicKey, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	stale := v.keys == nil || time.Since(v.fetchedAt) > v.cacheTTL
+	key, found := v.keys[kid]
+
+	if (stale || !found) && time.Since(v.lastAttempt) > minRefreshInterval {
+		v.refreshLocked()
+		key, found = v.keys[kid]
+	}
+
+	// Keep serving with the previous keys when the provider is unreachable
+	if v.keys == nil {
+		return nil, v.lastErr
+	}
+
+	if !found {
+		return nil, ErrUnknownKey
+	}
+
+	return key, nil
+}
+
+// Verify checks the signature, issuer, audience and validity period of a
+// compact serialized JWT access token
+func (v *Verifier) Verify(token string) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidToken
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	key, err := v.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := verifySignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), signature); err != nil {
+		return nil, err
+	}
+
+	var raw map[string]any
+	if err := decodeSegment(parts[1], &raw); err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	claims := &Claims{Raw: raw}
+	claims.Issuer, _ = raw["iss"].(string)
+	claims.Subject, _ = raw["sub"].(string)
+
+	switch aud := raw["aud"].(type) {
+	case string:
+		claims.Audience = []string{aud}
+	case []any:
+		for _, entry := range aud {
+			if s, ok := entry.(string); ok {
+				claims.Audience = append(claims.Audience, s)
+			}
+		}
+	}
+
+	if claims.Issuer != v.issuer {
+		return nil, fmt.Errorf("%w: unexpected issuer", ErrInvalidToken)
+	}
+
+	if v.audience != "" && !contains(claims.Audience, v.audience) {
+		return nil, fmt.Errorf("%w: unexpected audience", ErrInvalidToken)
+	}
+
+	now := time.Now()
+
+	exp, ok := numericDate(raw["exp"])
+	if !ok {
+		return nil, fmt.Errorf("%w: missing exp claim", ErrInvalidToken)
+	}
+	claims.ExpiresAt = exp
+
+	if now.After(exp.Add(clockSkew)) {
+		return nil, ErrExpiredToken
+	}
+
+	if nbf, ok := numericDate(raw["nbf"]); ok && now.Add(clockSkew).Before(nbf) {
+		return nil, fmt.Errorf("%w: token not valid yet", ErrInvalidToken)
+	}
+
+	return claims, nil
+}
+
+func decodeSegment(segment string, target any) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, target)
+}
+
+func numericDate(value any) (time.Time, bool) {
+	seconds, ok := value.(float64)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(seconds), 0), true
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// esCurves are the curves of the ES* algorithms
+var esCurves = map[string]string{
+	"ES256": "P-256",
+	"ES384": "P-384",
+	"ES512": "P-521",
+}
+
+// verifySignature checks a JWS signature for the RS*, PS* and ES* algorithms
+func verifySignature(alg string, key crypto.PublicKey, signed []byte, signature []byte) error {
+	if len(alg) != 5 {
+		return fmt.Errorf("%w: unsupported algorithm %q", ErrInvalidToken, alg)
+	}
+
+	var hash crypto.Hash
+	switch alg[2:] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("%w: unsupported algorithm %q", ErrInvalidToken, alg)
+	}
+
+	h := hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+
+	switch {
+	case strings.HasPrefix(alg, "RS"):
+		rsaKey, ok := key.(*rsa.PublicKey)
+		if !ok || rsa.VerifyPKCS1v15(rsaKey, hash, digest, signature) != nil {
+			return ErrInvalidToken
+		}
+	case strings.HasPrefix(alg, "PS"):
+		rsaKey, ok := key.(*rsa.PublicKey)
+		if !ok || rsa.VerifyPSS(rsaKey, hash, digest, signature, nil) != nil {
+			return ErrInvalidToken
+		}
+	case strings.HasPrefix(alg, "ES"):
+		// ES256 signs with P-256, ES384 with P-384 and ES512 with P-521, and
+		// the signature is r and s at the byte size of the curve
+		ecKey, ok := key.(*ecdsa.PublicKey)
+		if !ok || ecKey.Curve.Params().Name != esCurves[alg] {
+			return ErrInvalidToken
+		}
+		half := (ecKey.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*half {
+			return ErrInvalidToken
+		}
+		r := new(big.Int).SetBytes(signature[:half])
+		s := new(big.Int).SetBytes(signature[half:])
+		if !ecdsa.Verify(ecKey, digest, r, s) {
+			return ErrInvalidToken
+		}
+	default:
+		return fmt.Errorf("%w: unsupported algorithm %q", ErrInvalidToken, alg)
+	}
+
+	return nil
+}
+
+// jsonWebKey is the subset of RFC 7517 needed for RSA and EC public keys
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (jwk jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch jwk.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", jwk.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{
+			Curve: curve,
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", jwk.Kty)
+	}
+}
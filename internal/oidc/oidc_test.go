@@ -0,0 +1,315 @@
+package oidc
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testIssuer is an OIDC provider serving the discovery document and the
+// public keys of its signing keys
+type testIssuer struct {
+	*httptest.Server
+	keys     map[string]crypto.Signer
+	jwksHits atomic.Int32
+	down     atomic.Bool
+}
+
+func newTestIssuer(t *testing.T) *testIssuer {
+	t.Helper()
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ec256, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ec384, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	issuer := &testIssuer{keys: map[string]crypto.Signer{"rsa": rsaKey, "ec256": ec256, "ec384": ec384}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":   issuer.URL,
+			"jwks_uri": issuer.URL + "/keys",
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		issuer.jwksHits.Add(1)
+		if issuer.down.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		var set struct {
+			Keys []jsonWebKey `json:"keys"`
+		}
+		for kid, key := range issuer.keys {
+			switch key := key.Public().(type) {
+			case *rsa.PublicKey:
+				set.Keys = append(set.Keys, jsonWebKey{
+					Kty: "RSA",
+					Kid: kid,
+					Use: "sig",
+					N:   encodeSegment(key.N.Bytes()),
+					E:   encodeSegment(big.NewInt(int64(key.E)).Bytes()),
+				})
+			case *ecdsa.PublicKey:
+				set.Keys = append(set.Keys, jsonWebKey{
+					Kty: "EC",
+					Kid: kid,
+					Crv: key.Curve.Params().Name,
+					X:   encodeSegment(key.X.Bytes()),
+					Y:   encodeSegment(key.Y.Bytes()),
+				})
+			}
+		}
+		json.NewEncoder(w).Encode(set)
+	})
+
+	issuer.Server = httptest.NewServer(mux)
+	t.Cleanup(issuer.Close)
+
+	return issuer
+}
+
+func encodeSegment(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// token signs claims with the key kid, using alg to pick the hash and the
+// padding but not the key type, so mismatches can be tested
+func (issuer *testIssuer) token(t *testing.T, alg string, kid string, claims map[string]any) string {
+	t.Helper()
+
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := encodeSegment(header) + "." + encodeSegment(payload)
+
+	hash := crypto.SHA256
+	switch alg[len(alg)-3:] {
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	}
+	h := hash.New()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+
+	var signature []byte
+	var err error
+	switch key := issuer.keys[kid].(type) {
+	case *rsa.PrivateKey:
+		if alg[:2] == "PS" {
+			signature, err = rsa.SignPSS(rand.Reader, key, hash, digest, nil)
+		} else {
+			signature, err = rsa.SignPKCS1v15(rand.Reader, key, hash, digest)
+		}
+	case *ecdsa.PrivateKey:
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, key, digest)
+		size := (key.Curve.Params().BitSize + 7) / 8
+		signature = make([]byte, 2*size)
+		r.FillBytes(signature[:size])
+		s.FillBytes(signature[size:])
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signed + "." + encodeSegment(signature)
+}
+
+func TestVerify(t *testing.T) {
+	issuer := newTestIssuer(t)
+	v := NewVerifier(issuer.URL, "imagesplitter", time.Hour)
+
+	claims := func(changes map[string]any) map[string]any {
+		c := map[string]any{
+			"iss": issuer.URL,
+			"sub": "alice",
+			"aud": []string{"other", "imagesplitter"},
+			"exp": time.Now().Add(time.Hour).Unix(),
+		}
+		for name, value := range changes {
+			c[name] = value
+		}
+		return c
+	}
+
+	// resign replaces the signature of a token by the given bytes
+	resign := func(token string, signature []byte) string {
+		return token[:strings.LastIndex(token, ".")+1] + encodeSegment(signature)
+	}
+
+	valid := issuer.token(t, "ES256", "ec256", claims(nil))
+	signature := signatureOf(t, valid)
+
+	tests := []struct {
+		name  string
+		token string
+		want  error
+	}{
+		{"RS256", issuer.token(t, "RS256", "rsa", claims(nil)), nil},
+		{"RS512", issuer.token(t, "RS512", "rsa", claims(nil)), nil},
+		{"PS256", issuer.token(t, "PS256", "rsa", claims(nil)), nil},
+		{"ES256", valid, nil},
+		{"ES384", issuer.token(t, "ES384", "ec384", claims(nil)), nil},
+		{"string audience", issuer.token(t, "RS256", "rsa", claims(map[string]any{"aud": "imagesplitter"})), nil},
+		{"HS256", issuer.token(t, "HS256", "rsa", claims(nil)), ErrInvalidToken},
+		{"none", issuer.token(t, "none", "rsa", claims(nil)), ErrInvalidToken},
+		{"RS256 with an EC key", issuer.token(t, "RS256", "ec256", claims(nil)), ErrInvalidToken},
+		{"ES256 with an RSA key", issuer.token(t, "ES256", "rsa", claims(nil)), ErrInvalidToken},
+		{"ES256 with a P-384 key", issuer.token(t, "ES256", "ec384", claims(nil)), ErrInvalidToken},
+		{"PS256 signature as RS256", resign(issuer.token(t, "RS256", "rsa", claims(nil)), signatureOf(t, issuer.token(t, "PS256", "rsa", claims(nil)))), ErrInvalidToken},
+		{"short ES256 signature", resign(valid, signature[1:]), ErrInvalidToken},
+		{"padded ES256 signature", resign(valid, append([]byte{0}, signature...)), ErrInvalidToken},
+		{"tampered payload", resign(issuer.token(t, "ES256", "ec256", claims(map[string]any{"sub": "mallory"})), signature), ErrInvalidToken},
+		{"unknown key", issuer.token(t, "RS256", "missing", claims(nil)), ErrUnknownKey},
+		{"expired", issuer.token(t, "RS256", "rsa", claims(map[string]any{"exp": time.Now().Add(-2 * clockSkew).Unix()})), ErrExpiredToken},
+		{"within the clock skew", issuer.token(t, "RS256", "rsa", claims(map[string]any{"exp": time.Now().Add(-clockSkew / 2).Unix()})), nil},
+		{"not valid yet", issuer.token(t, "RS256", "rsa", claims(map[string]any{"nbf": time.Now().Add(2 * clockSkew).Unix()})), ErrInvalidToken},
+		{"missing exp", issuer.token(t, "RS256", "rsa", claims(map[string]any{"exp": nil})), ErrInvalidToken},
+		{"wrong audience", issuer.token(t, "RS256", "rsa", claims(map[string]any{"aud": "other"})), ErrInvalidToken},
+		{"wrong issuer", issuer.token(t, "RS256", "rsa", claims(map[string]any{"iss": "https://example.com"})), ErrInvalidToken},
+		{"two segments", "e30.e30", ErrInvalidToken},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			verified, err := v.Verify(tt.token)
+			if tt.want == nil {
+				if err != nil {
+					t.Fatalf("got %v, want a valid token", err)
+				}
+				if verified.Subject != "alice" {
+					t.Errorf("got subject %q, want alice", verified.Subject)
+				}
+				return
+			}
+			if !errors.Is(err, tt.want) {
+				t.Errorf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func signatureOf(t *testing.T, token string) []byte {
+	t.Helper()
+
+	signature, err := base64.RawURLEncoding.DecodeString(token[strings.LastIndex(token, ".")+1:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signature
+}
+
+// TestRFC7515Example checks the ES256 example of RFC 7515 appendix A.3, whose
+// signature is valid but whose exp claim is in 2011
+func TestRFC7515Example(t *testing.T) {
+	token := "eyJhbGciOiJFUzI1NiJ9" +
+		".eyJpc3MiOiJqb2UiLA0KICJleHAiOjEzMDA4MTkzODAsDQogImh0dHA6Ly9leGFtcGxlLmNvbS9pc19yb290Ijp0cnVlfQ" +
+		".DtEhU3ljbEg8L38VWAfUAqOyKAM6-Xx-F4GawxaepmXFCgfTjDxw5djxLa8ISlSApmWQxfKTUJqPP3-Kg6NU1Q"
+
+	key, err := jsonWebKey{
+		Kty: "EC",
+		Crv: "P-256",
+		X:   "f83OJ3D2xF1Bg8vub9tLe1gHMzV76e8Tus9uPHvRVEU",
+		Y:   "x_FEzRu9m36HLN_tue659LNpXW6pCyStikYjKIWI5a0",
+	}.publicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v := &Verifier{issuer: "joe", cacheTTL: time.Hour, keys: map[string]crypto.PublicKey{"": key}, fetchedAt: time.Now()}
+
+	if _, err := v.Verify(token); !errors.Is(err, ErrExpiredToken) {
+		t.Errorf("got %v, want ErrExpiredToken", err)
+	}
+
+	tampered := strings.Replace(token, ".DtEh", ".EtEh", 1)
+	if _, err := v.Verify(tampered); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("got %v for a tampered signature, want ErrInvalidToken", err)
+	}
+}
+
+func TestStaleKeys(t *testing.T) {
+	issuer := newTestIssuer(t)
+	v := NewVerifier(issuer.URL, "", time.Millisecond)
+
+	token := issuer.token(t, "RS256", "rsa", map[string]any{
+		"iss": issuer.URL,
+		"exp": time.Now().Add(time.Hour).Unix(),
+	})
+
+	if _, err := v.Verify(token); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	issuer.down.Store(true)
+
+	// The stale keys are served without a fetch until minRefreshInterval has
+	// passed since the last attempt
+	for i := 0; i < 3; i++ {
+		if _, err := v.Verify(token); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if hits := issuer.jwksHits.Load(); hits != 1 {
+		t.Errorf("got %d key set fetches, want 1", hits)
+	}
+
+	v.mu.Lock()
+	v.lastAttempt = time.Now().Add(-2 * minRefreshInterval)
+	v.mu.Unlock()
+
+	// A failed refresh keeps the previous keys and is not retried right away
+	for i := 0; i < 3; i++ {
+		if _, err := v.Verify(token); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if hits := issuer.jwksHits.Load(); hits != 2 {
+		t.Errorf("got %d key set fetches, want 2", hits)
+	}
+}
+
+func TestUnreachableProvider(t *testing.T) {
+	issuer := newTestIssuer(t)
+	issuer.down.Store(true)
+	v := NewVerifier(issuer.URL, "", time.Hour)
+
+	token := issuer.token(t, "RS256", "rsa", map[string]any{
+		"iss": issuer.URL,
+		"exp": time.Now().Add(time.Hour).Unix(),
+	})
+
+	for i := 0; i < 3; i++ {
+		if _, err := v.Verify(token); err == nil || errors.Is(err, ErrInvalidToken) {
+			t.Fatalf("got %v, want the fetch error", err)
+		}
+	}
+	if hits := issuer.jwksHits.Load(); hits != 1 {
+		t.Errorf("got %d key set fetches, want 1", hits)
+	}
+}
@@ -0,0 +1,359 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MinPartSize is the smallest part S3 accepts, save for the last one
+const MinPartSize = 5 << 20
+
+// Client uploads objects to a bucket of an S3 compatible storage. The
+// requests are signed with AWS Signature Version 4.
+type Client struct {
+	// Endpoint is the base URL of the storage, e.g.
+	// https://s3.eu-west-1.amazonaws.com
+	Endpoint string
+	Region   string
+	Bucket   string
+
+	AccessKeyID     string
+	SecretAccessKey string
+	// SessionToken is sent with temporary credentials
+	SessionToken string
+
+	// PathStyle addresses the bucket in the path instead of the host name,
+	// as most S3 compatible storages expect
+	PathStyle bool
+
+	// HTTPClient sends the requests, http.DefaultClient when nil
+	HTTPClient *http.Client
+}
+
+// ObjectURL returns the URL of the object key
+func (c *Client) ObjectURL(key string) string {
+	return c.objectURL(key, nil).String()
+}
+
+// objectURL returns the URL of the object key with the query of the request
+func (c *Client) objectURL(key string, query url.Values) *url.URL {
+	u, err := url.Parse(c.Endpoint)
+	if err != nil {
+		u = &url.URL{Scheme: "https", Host: c.Endpoint}
+	}
+
+	if c.PathStyle {
+		u.Path = "/" + c.Bucket + "/" + key
+	} else {
+		u.Host = c.Bucket + "." + u.Host
+		u.Path = "/" + key
+	}
+	u.RawPath = uriEncode(u.Path, false)
+	u.RawQuery = canonicalQuery(query)
+
+	return u
+}
+
+// do sends a signed request for the object key and returns the response
+// body, failing on statuses other than 2xx
+func (c *Client) do(ctx context.Context, method string, key string, query url.Values, body []byte, header http.Header) ([]byte, http.Header, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.objectURL(key, query).String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	c.sign(req, body, time.Now().UTC())
+
+	client := c.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var s3Err struct {
+			Code    string `xml:"Code"`
+			Message string `xml:"Message"`
+		}
+		if xml.Unmarshal(data, &s3Err) == nil && s3Err.Code != "" {
+			return nil, nil, fmt.Errorf("%s %s: %s: %s", method, key, s3Err.Code, s3Err.Message)
+		}
+		return nil, nil, fmt.Errorf("%s %s: unexpected status %s", method, key, resp.Status)
+	}
+
+	return data, resp.Header, nil
+}
+
+// PutObject uploads body as the object key in a single request
+func (c *Client) PutObject(ctx context.Context, key string, body []byte, contentType string) error {
+	_, _, err := c.do(ctx, http.MethodPut, key, nil, body, http.Header{"Content-Type": {contentType}})
+	return err
+}
+
+// Upload is a multipart upload in progress. Writes are buffered and sent as
+// parts of partSize bytes.
+type Upload struct {
+	client   *Client
+	ctx      context.Context
+	key      string
+	id       string
+	partSize int
+
+	buf       []byte
+	parts     []completedPart
+	err       error
+	completed bool
+}
+
+type completedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+// CreateMultipartUpload starts a multipart upload of the object key, with
+// parts of partSize bytes, at least MinPartSize. The upload stops when ctx
+// is done.
+func (c *Client) CreateMultipartUpload(ctx context.Context, key string, contentType string, partSize int) (*Upload, error) {
+	partSize = max(partSize, MinPartSize)
+
+	data, _, err := c.do(ctx, http.MethodPost, key, url.Values{"uploads": {""}}, nil, http.Header{"Content-Type": {contentType}})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create multipart upload: %v", err)
+	}
+
+	var created struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := xml.Unmarshal(data, &created); err != nil || created.UploadID == "" {
+		return nil, errors.New("failed to create multipart upload: no upload id in the response")
+	}
+
+	return &Upload{
+		client:   c,
+		ctx:      ctx,
+		key:      key,
+		id:       created.UploadID,
+		partSize: partSize,
+		buf:      make([]byte, 0, partSize),
+	}, nil
+}
+
+// Write buffers data, uploading every full part
+func (u *Upload) Write(data []byte) (int, error) {
+	if u.err != nil {
+		return 0, u.err
+	}
+
+	written := 0
+	for len(data) > 0 {
+		n := min(len(data), u.partSize-len(u.buf))
+		u.buf = append(u.buf, data[:n]...)
+		data = data[n:]
+		written += n
+
+		if len(u.buf) == u.partSize {
+			if err := u.uploadPart(); err != nil {
+				return written, err
+			}
+		}
+	}
+
+	return written, nil
+}
+
+// uploadPart sends the buffered bytes as the next part
+func (u *Upload) uploadPart() error {
+	number := len(u.parts) + 1
+	query := url.Values{
+		"partNumber": {strconv.Itoa(number)},
+		"uploadId":   {u.id},
+	}
+
+	_, header, err := u.client.do(u.ctx, http.MethodPut, u.key, query, u.buf, nil)
+	if err != nil {
+		u.err = fmt.Errorf("failed to upload part %d: %v", number, err)
+		return u.err
+	}
+
+	u.parts = append(u.parts, completedPart{PartNumber: number, ETag: header.Get("ETag")})
+	u.buf = u.buf[:0]
+	return nil
+}
+
+// Complete uploads the last part and assembles the object
+func (u *Upload) Complete() error {
+	if u.err != nil {
+		return u.err
+	}
+
+	// An empty object still needs a part
+	if len(u.buf) > 0 || len(u.parts) == 0 {
+		if err := u.uploadPart(); err != nil {
+			return err
+		}
+	}
+
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+		Parts   []completedPart `xml:"Part"`
+	}{Parts: u.parts})
+	if err != nil {
+		return err
+	}
+
+	// S3 may report a failure with a 200 status once it started answering
+	data, _, err := u.client.do(u.ctx, http.MethodPost, u.key, url.Values{"uploadId": {u.id}}, body, http.Header{"Content-Type": {"application/xml"}})
+	if err == nil && bytes.Contains(data, []byte("<Error>")) {
+		err = errors.New("storage reported an error")
+	}
+	if err != nil {
+		u.err = fmt.Errorf("failed to complete multipart upload: %v", err)
+		return u.err
+	}
+
+	u.completed = true
+	u.err = errors.New("upload already completed")
+	return nil
+}
+
+// Abort discards the uploaded parts, it does nothing after Complete
+func (u *Upload) Abort() error {
+	if u.completed {
+		return nil
+	}
+
+	// The job context may be done already
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	_, _, err := u.client.do(ctx, http.MethodDelete, u.key, url.Values{"uploadId": {u.id}}, nil, nil)
+	if err != nil {
+		return fmt.Errorf("failed to abort multipart upload: %v", err)
+	}
+	return nil
+}
+
+// sign adds the AWS Signature Version 4 Authorization header to req
+func (c *Client) sign(req *http.Request, body []byte, now time.Time) {
+	payloadHash := sha256.Sum256(body)
+	payload := hex.EncodeToString(payloadHash[:])
+
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payload)
+	if c.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", c.SessionToken)
+	}
+
+	// Every x-amz header, the host and the content type are signed
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		if strings.HasPrefix(name, "x-amz-") || name == "content-type" || name == "range" {
+			headers[name] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payload,
+	}, "\n")
+
+	scope := date + "/" + c.Region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+c.SecretAccessKey), date)
+	key = hmacSHA256(key, c.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.AccessKeyID, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// canonicalQuery encodes query sorted by name, as the signature expects
+func canonicalQuery(query url.Values) string {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var pairs []string
+	for _, name := range names {
+		for _, value := range query[name] {
+			pairs = append(pairs, uriEncode(name, true)+"="+uriEncode(value, true))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// uriEncode escapes every byte of s but the unreserved characters, and the
+// slashes unless encodeSlash is set
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}